@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+type user struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username,omitempty"`
+	Nickname  string    `json:"nickname"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newUser converts a user for the user viewerID. Other users only see the
+// nickname, never the username.
+func newUser(u *models.User, viewerID int64) user {
+	resp := user{ID: u.ID, Nickname: u.Nickname, CreatedAt: u.CreatedAt}
+	if u.ID == viewerID {
+		resp.Username = u.Username
+	}
+	return resp
+}
+
+type offer struct {
+	ID          int     `json:"id"`
+	UserID      int64   `json:"user_id"`
+	Username    string  `json:"username,omitempty"`
+	AmountBTC   float64 `json:"amount_btc"`
+	PriceUSD    float64 `json:"price_usd"`
+	Status      string  `json:"status"`
+	InvoiceLink string  `json:"invoice_link,omitempty"`
+	// How the invoice is paid: lightning, onchain or both
+	PaymentMethod string `json:"payment_method"`
+	// BOLT11 invoice and Bitcoin address of a pending offer
+	PaymentRequest string `json:"payment_request,omitempty"`
+	PaymentAddress string `json:"payment_address,omitempty"`
+	// Confirmations of the on-chain payment of a pending offer, once
+	// received, and the number required before it is paid
+	Confirmations         *int      `json:"confirmations,omitempty"`
+	ConfirmationsRequired int       `json:"confirmations_required,omitempty"`
+	MakerFeeSats          int64     `json:"maker_fee_sats"` // Included in the invoice
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+// newOffer converts an offer for the user viewerID. The username, invoice
+// link and payment details are only shown to the offer owner.
+func newOffer(o *models.Offer, viewerID int64) offer {
+	resp := offer{
+		ID:            o.ID,
+		UserID:        o.UserID,
+		AmountBTC:     o.AmountBTC,
+		PriceUSD:      o.PriceUSD,
+		Status:        string(o.Status),
+		PaymentMethod: string(o.PaymentMethod),
+		MakerFeeSats:  o.MakerFeeSats,
+		CreatedAt:     o.CreatedAt,
+		UpdatedAt:     o.UpdatedAt,
+	}
+	if o.UserID == viewerID {
+		resp.Username = o.Username
+		resp.InvoiceLink = o.InvoiceLink
+		resp.ConfirmationsRequired = o.ConfirmationsRequired
+		if o.Status == models.StatusPending {
+			resp.PaymentRequest = o.PaymentRequest
+			resp.PaymentAddress = o.PaymentAddress
+			if o.Confirmations >= 0 && o.PaymentMethod.OnChain() {
+				confirmations := o.Confirmations
+				resp.Confirmations = &confirmations
+			}
+		}
+	}
+	return resp
+}
+
+type trade struct {
+	ID           int       `json:"id"`
+	OfferID      int       `json:"offer_id"`
+	SellerID     int64     `json:"seller_id"`
+	BuyerID      int64     `json:"buyer_id"`
+	Status       string    `json:"status"`
+	MakerFeeSats int64     `json:"maker_fee_sats"` // Paid by the seller with the invoice
+	TakerFeeSats int64     `json:"taker_fee_sats"` // Deducted from the payout
+	DisputedBy   int64     `json:"disputed_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func newTrade(t *models.Trade) trade {
+	return trade{
+		ID:           t.ID,
+		OfferID:      t.OfferID,
+		SellerID:     t.SellerID,
+		BuyerID:      t.BuyerID,
+		Status:       string(t.Status),
+		MakerFeeSats: t.MakerFeeSats,
+		TakerFeeSats: t.TakerFeeSats,
+		DisputedBy:   t.DisputedBy,
+		CreatedAt:    t.CreatedAt,
+		UpdatedAt:    t.UpdatedAt,
+	}
+}
+
+type tradeMessage struct {
+	ID        int       `json:"id"`
+	TradeID   int       `json:"trade_id"`
+	SenderID  int64     `json:"sender_id"`
+	Text      string    `json:"text"`
+	PhotoID   string    `json:"photo_id,omitempty"`
+	Frontend  string    `json:"frontend"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newTradeMessage(m *models.TradeMessage) tradeMessage {
+	return tradeMessage{
+		ID:        m.ID,
+		TradeID:   m.TradeID,
+		SenderID:  m.SenderID,
+		Text:      m.Text,
+		PhotoID:   m.PhotoID,
+		Frontend:  m.Frontend,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+type payout struct {
+	ID          int       `json:"id"`
+	TradeID     int       `json:"trade_id"`
+	Destination string    `json:"destination"`
+	AmountSats  int64     `json:"amount_sats"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newPayout(p *models.Payout) payout {
+	return payout{
+		ID:          p.ID,
+		TradeID:     p.TradeID,
+		Destination: p.Destination,
+		AmountSats:  p.AmountSats,
+		Status:      string(p.Status),
+		CreatedAt:   p.CreatedAt,
+		UpdatedAt:   p.UpdatedAt,
+	}
+}
+
+type refund struct {
+	ID          int       `json:"id"`
+	OfferID     int       `json:"offer_id"`
+	TradeID     int       `json:"trade_id,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	AmountSats  int64     `json:"amount_sats"`
+	Status      string    `json:"status"`
+	Duplicate   bool      `json:"duplicate,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newRefund(r *models.Refund) refund {
+	return refund{
+		ID:          r.ID,
+		OfferID:     r.OfferID,
+		TradeID:     r.TradeID,
+		Destination: r.Destination,
+		AmountSats:  r.AmountSats,
+		Status:      string(r.Status),
+		Duplicate:   r.Duplicate,
+		CreatedAt:   r.CreatedAt,
+		UpdatedAt:   r.UpdatedAt,
+	}
+}
+
+type invoice struct {
+	ID               string    `json:"id"`
+	Status           string    `json:"status"`
+	AdditionalStatus string    `json:"additional_status"`
+	Paid             bool      `json:"paid"`
+	Amount           string    `json:"amount"`
+	Currency         string    `json:"currency"`
+	CheckoutLink     string    `json:"checkout_link"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// offerInvoice is one of the invoices created for an offer
+type offerInvoice struct {
+	ID          string    `json:"id"`
+	InvoiceLink string    `json:"invoice_link"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newOfferInvoice(inv models.OfferInvoice) offerInvoice {
+	return offerInvoice{ID: inv.InvoiceID, InvoiceLink: inv.InvoiceLink, Active: inv.Active, CreatedAt: inv.CreatedAt}
+}
+
+// errorBody is the envelope of every error response
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+// writeError writes an error envelope
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+// writeShopError maps a shop error to its HTTP status and error code
+func writeShopError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, shop.ErrNotRegistered):
+		writeError(w, http.StatusNotFound, "not_found", "user not found")
+	case errors.Is(err, shop.ErrOfferNotFound), errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrRefundNotFound):
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, shop.ErrInvalidDestination):
+		writeError(w, http.StatusBadRequest, "invalid_request", shop.ErrInvalidDestination.Error())
+	case errors.Is(err, shop.ErrUnresolvable):
+		writeError(w, http.StatusBadRequest, "invalid_request", shop.ErrUnresolvable.Error())
+	case errors.Is(err, shop.ErrPayoutAmount):
+		writeError(w, http.StatusBadRequest, "invalid_request", shop.ErrPayoutAmount.Error())
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		writeError(w, http.StatusBadRequest, "invalid_request", shop.ErrInvoiceNetwork.Error())
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		writeError(w, http.StatusBadRequest, "invalid_request", shop.ErrInvoiceAmount.Error())
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		writeError(w, http.StatusBadRequest, "invalid_request", shop.ErrInvoiceExpired.Error())
+	case errors.Is(err, shop.ErrPaymentMethod):
+		writeError(w, http.StatusBadRequest, "invalid_request", "payment_method must be lightning, onchain or both")
+	case errors.Is(err, shop.ErrNotOwner), errors.Is(err, shop.ErrNotParticipant), errors.Is(err, shop.ErrNotBuyer),
+		errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		writeError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, shop.ErrNotPending), errors.Is(err, shop.ErrNotPaid),
+		errors.Is(err, shop.ErrNotTaken), errors.Is(err, shop.ErrDisputed),
+		errors.Is(err, shop.ErrOwnOffer), errors.Is(err, shop.ErrNotAvailable),
+		errors.Is(err, shop.ErrTradeClosed), errors.Is(err, shop.ErrPayoutExists),
+		errors.Is(err, shop.ErrNotRefreshable), errors.Is(err, shop.ErrRefundExists):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, shop.ErrThrottled):
+		var throttled *shop.ThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.Wait.Seconds()))))
+		}
+		writeError(w, http.StatusTooManyRequests, "rate_limited", shop.ErrThrottled.Error())
+	case errors.Is(err, shop.ErrTooManyOffers), errors.Is(err, shop.ErrTooManyInvoices), errors.Is(err, shop.ErrCooldown):
+		writeError(w, http.StatusTooManyRequests, "rate_limited", err.Error())
+	case errors.Is(err, shop.ErrInvoice):
+		log.Printf("API invoice error: %v", err)
+		writeError(w, http.StatusBadGateway, "invoice_error", shop.ErrInvoice.Error())
+	case errors.Is(err, shop.ErrPayout):
+		log.Printf("API payout error: %v", err)
+		writeError(w, http.StatusBadGateway, "payout_error", shop.ErrPayout.Error())
+	case errors.Is(err, shop.ErrRefund):
+		log.Printf("API refund error: %v", err)
+		writeError(w, http.StatusBadGateway, "refund_error", shop.ErrRefund.Error())
+	default:
+		log.Printf("API error: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+}
@@ -0,0 +1,447 @@
+// Package api serves the shop over an authenticated REST/JSON API. Users
+// authenticate with the token issued by the bot's /apitoken command.
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// Offer list limits
+const (
+	defaultLimit = 50
+	maxLimit     = 100
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Server is an http.Handler serving the shop API under /api/v1
+type Server struct {
+	shop           *shop.Service
+	mux            *http.ServeMux
+	webhookSecret  string
+	webhookStoreID string
+}
+
+// NewServer creates an API server for the given shop
+func NewServer(svc *shop.Service) *Server {
+	s := &Server{shop: svc, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("GET /openapi.json", s.openAPI)
+	s.mux.HandleFunc("GET /api/v1/me", s.auth(s.me))
+	s.mux.HandleFunc("GET /api/v1/users/{id}", s.auth(s.getUser))
+	s.mux.HandleFunc("GET /api/v1/offers", s.auth(s.listOffers))
+	s.mux.HandleFunc("POST /api/v1/offers", s.auth(s.createOffer))
+	s.mux.HandleFunc("GET /api/v1/offers/{id}", s.auth(s.getOffer))
+	s.mux.HandleFunc("POST /api/v1/offers/{id}/cancel", s.auth(s.cancelOffer))
+	s.mux.HandleFunc("POST /api/v1/offers/{id}/take", s.auth(s.takeOffer))
+	s.mux.HandleFunc("GET /api/v1/offers/{id}/invoice", s.auth(s.getInvoice))
+	s.mux.HandleFunc("POST /api/v1/offers/{id}/refresh-invoice", s.auth(s.refreshInvoice))
+	s.mux.HandleFunc("GET /api/v1/offers/{id}/invoices", s.auth(s.listOfferInvoices))
+	s.mux.HandleFunc("POST /api/v1/offers/{id}/refund", s.auth(s.setRefundDestination))
+	s.mux.HandleFunc("GET /api/v1/trades", s.auth(s.listTrades))
+	s.mux.HandleFunc("GET /api/v1/trades/{id}", s.auth(s.getTrade))
+	s.mux.HandleFunc("GET /api/v1/trades/{id}/messages", s.auth(s.getTradeMessages))
+	s.mux.HandleFunc("POST /api/v1/trades/{id}/payout", s.auth(s.setPayoutDestination))
+	s.mux.HandleFunc("POST /api/v1/trades/{id}/dispute", s.auth(s.openDispute))
+	s.mux.HandleFunc("GET /api/v1/payouts", s.auth(s.listPayouts))
+	s.mux.HandleFunc("GET /api/v1/refunds", s.auth(s.listRefunds))
+	s.mux.HandleFunc("POST /webhooks/btcpay", s.btcpayWebhook)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handlerFunc is an API handler for an authenticated user
+type handlerFunc func(w http.ResponseWriter, r *http.Request, userID int64)
+
+// auth resolves the user behind the bearer token and spends a request from
+// their rate limit before calling h
+func (s *Server) auth(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing bearer token")
+			return
+		}
+		userID, err := s.shop.Authenticate(token)
+		if err != nil {
+			if !errors.Is(err, shop.ErrInvalidToken) {
+				log.Printf("Failed to authenticate API request: %v", err)
+			}
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid API token")
+			return
+		}
+		banned, err := s.shop.IsBanned(userID)
+		if err != nil {
+			writeShopError(w, err)
+			return
+		}
+		if banned {
+			writeError(w, http.StatusForbidden, "forbidden", "account suspended")
+			return
+		}
+		if err := s.shop.Throttle(userID); err != nil {
+			writeShopError(w, err)
+			return
+		}
+		h(w, r, userID)
+	}
+}
+
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (s *Server) me(w http.ResponseWriter, r *http.Request, userID int64) {
+	u, err := s.shop.User(userID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUser(u, userID))
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, userID int64) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid user ID")
+		return
+	}
+	u, err := s.shop.User(id)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUser(u, userID))
+}
+
+func (s *Server) listOffers(w http.ResponseWriter, r *http.Request, userID int64) {
+	q := r.URL.Query()
+	filter := db.OfferFilter{Status: models.OfferStatus(q.Get("status")), Limit: defaultLimit}
+
+	var err error
+	if v := q.Get("user_id"); v != "" {
+		if filter.UserID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "invalid user_id")
+			return
+		}
+	}
+	if v := q.Get("min_amount"); v != "" {
+		if filter.MinAmountBTC, err = strconv.ParseFloat(v, 64); err != nil || filter.MinAmountBTC < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_request", "invalid min_amount")
+			return
+		}
+	}
+	if v := q.Get("max_amount"); v != "" {
+		if filter.MaxAmountBTC, err = strconv.ParseFloat(v, 64); err != nil || filter.MaxAmountBTC < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_request", "invalid max_amount")
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			writeError(w, http.StatusBadRequest, "invalid_request", "limit must be between 1 and 100")
+			return
+		}
+	}
+	switch filter.Status {
+	case "", models.StatusPending, models.StatusPaid, models.StatusCompleted, models.StatusCancelled, models.StatusExpired:
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid status")
+		return
+	}
+
+	offers, err := s.shop.Offers(filter)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	resp := make([]offer, 0, len(offers))
+	for i := range offers {
+		resp = append(resp, newOffer(&offers[i], userID))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) createOffer(w http.ResponseWriter, r *http.Request, userID int64) {
+	var req struct {
+		AmountBTC     float64              `json:"amount_btc"`
+		PriceUSD      float64              `json:"price_usd"`
+		PaymentMethod models.PaymentMethod `json:"payment_method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = models.PaymentLightning
+	}
+	if req.AmountBTC <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "amount_btc must be positive")
+		return
+	}
+	if req.PriceUSD <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "price_usd must be positive")
+		return
+	}
+
+	o, err := s.shop.CreateOffer(userID, req.AmountBTC, req.PriceUSD, req.PaymentMethod)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newOffer(o, userID))
+}
+
+func (s *Server) getOffer(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	o, err := s.shop.Offer(offerID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newOffer(o, userID))
+}
+
+func (s *Server) cancelOffer(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	o, err := s.shop.CancelOffer(userID, offerID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newOffer(o, userID))
+}
+
+func (s *Server) takeOffer(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	t, err := s.shop.TakeOffer(userID, offerID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newTrade(t))
+}
+
+func (s *Server) getInvoice(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	inv, err := s.shop.Invoice(userID, offerID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, invoice{
+		ID:               inv.ID,
+		Status:           inv.Status,
+		AdditionalStatus: inv.AdditionalStatus,
+		Paid:             inv.IsPaid(),
+		Amount:           inv.Amount,
+		Currency:         inv.Currency,
+		CheckoutLink:     inv.CheckoutLink,
+		ExpiresAt:        inv.ExpirationTime.UTC(),
+	})
+}
+
+func (s *Server) refreshInvoice(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	o, err := s.shop.RefreshInvoice(userID, offerID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newOffer(o, userID))
+}
+
+func (s *Server) listOfferInvoices(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	invoices, err := s.shop.OfferInvoices(userID, offerID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	resp := make([]offerInvoice, 0, len(invoices))
+	for _, inv := range invoices {
+		resp = append(resp, newOfferInvoice(inv))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) listTrades(w http.ResponseWriter, r *http.Request, userID int64) {
+	trades, err := s.shop.Trades(userID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	resp := make([]trade, 0, len(trades))
+	for i := range trades {
+		resp = append(resp, newTrade(&trades[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getTrade(w http.ResponseWriter, r *http.Request, userID int64) {
+	tradeID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	t, err := s.shop.Trade(userID, tradeID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTrade(t))
+}
+
+func (s *Server) getTradeMessages(w http.ResponseWriter, r *http.Request, userID int64) {
+	tradeID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	messages, err := s.shop.TradeMessages(userID, tradeID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	resp := make([]tradeMessage, 0, len(messages))
+	for i := range messages {
+		resp = append(resp, newTradeMessage(&messages[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) openDispute(w http.ResponseWriter, r *http.Request, userID int64) {
+	tradeID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	t, err := s.shop.OpenDispute(userID, tradeID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTrade(t))
+}
+
+func (s *Server) setPayoutDestination(w http.ResponseWriter, r *http.Request, userID int64) {
+	tradeID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	p, err := s.shop.SetPayoutDestination(userID, tradeID, req.Destination)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	if p == nil {
+		// The trade is paid out once the seller confirms the payment
+		trade, err := s.shop.Trade(userID, tradeID)
+		if err != nil {
+			writeShopError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, newTrade(trade))
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPayout(p))
+}
+
+func (s *Server) listPayouts(w http.ResponseWriter, r *http.Request, userID int64) {
+	payouts, err := s.shop.Payouts(userID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	resp := make([]payout, 0, len(payouts))
+	for i := range payouts {
+		resp = append(resp, newPayout(&payouts[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pathID parses the {id} path parameter, replying with an error if invalid
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid ID")
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) setRefundDestination(w http.ResponseWriter, r *http.Request, userID int64) {
+	offerID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	refund, err := s.shop.SetRefundDestination(userID, offerID, req.Destination)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newRefund(refund))
+}
+
+func (s *Server) listRefunds(w http.ResponseWriter, r *http.Request, userID int64) {
+	refunds, err := s.shop.Refunds(userID)
+	if err != nil {
+		writeShopError(w, err)
+		return
+	}
+	resp := make([]refund, 0, len(refunds))
+	for i := range refunds {
+		resp = append(resp, newRefund(&refunds[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
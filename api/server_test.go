@@ -0,0 +1,409 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/api"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11/bolt11test"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay/btcpaytest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/ratelimit"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// client calls the API as one user
+type client struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+// do sends a request and decodes the JSON response into out, returning the
+// status code
+func (c *client) do(method, path string, body, out interface{}) int {
+	c.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		r = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, c.url+path, r)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		c.t.Errorf("%s %s: Content-Type = %q", method, path, ct)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// expectError checks that a request fails with status and code
+func (c *client) expectError(method, path string, body interface{}, status int, code string) {
+	c.t.Helper()
+	var e apiError
+	if got := c.do(method, path, body, &e); got != status || e.Error.Code != code {
+		c.t.Errorf("%s %s = %d %q, want %d %q", method, path, got, e.Error.Code, status, code)
+	}
+}
+
+type offer struct {
+	ID             int     `json:"id"`
+	UserID         int64   `json:"user_id"`
+	AmountBTC      float64 `json:"amount_btc"`
+	Status         string  `json:"status"`
+	InvoiceLink    string  `json:"invoice_link"`
+	PaymentRequest string  `json:"payment_request"`
+}
+
+type trade struct {
+	ID       int    `json:"id"`
+	OfferID  int    `json:"offer_id"`
+	SellerID int64  `json:"seller_id"`
+	BuyerID  int64  `json:"buyer_id"`
+	Status   string `json:"status"`
+}
+
+func newAPI(t *testing.T, setup ...func(*shop.Service)) (alice, bob *client, pay *btcpaytest.Server) {
+	t.Helper()
+	pay = btcpaytest.NewServer("key", "store")
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	svc := shop.NewService(database, pay.Client())
+	for _, f := range setup {
+		f(svc)
+	}
+	server := api.NewServer(svc)
+	server.SetWebhookSecret("whsec", "store")
+	srv := httptest.NewServer(server)
+	pay.AddWebhook(srv.URL+"/webhooks/btcpay", "whsec")
+	t.Cleanup(func() {
+		srv.Close()
+		database.Close()
+		pay.Close()
+	})
+
+	login := func(id, username string) *client {
+		userID, err := svc.Register(models.Identity{Frontend: shop.FrontendTelegram, ExternalID: id, ChatID: id, Username: username})
+		if err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+		token, err := svc.CreateAPIToken(userID)
+		if err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+		return &client{t: t, url: srv.URL, token: token}
+	}
+	return login("1001", "alice"), login("1002", "bob"), pay
+}
+
+func TestAuthentication(t *testing.T) {
+	alice, bob, _ := newAPI(t)
+
+	var me struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+	}
+	if status := alice.do("GET", "/api/v1/me", nil, &me); status != http.StatusOK || me.ID != 1001 || me.Username != "alice" || me.Nickname == "" {
+		t.Errorf("GET /me = %d %+v", status, me)
+	}
+
+	// Other users only see the nickname
+	var other map[string]interface{}
+	if status := bob.do("GET", "/api/v1/users/1001", nil, &other); status != http.StatusOK || other["nickname"] != me.Nickname {
+		t.Errorf("GET /users/1001 = %d %v", status, other)
+	}
+	if _, ok := other["username"]; ok {
+		t.Errorf("GET /users/1001 shows the username to another user: %v", other)
+	}
+	alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.01, "price_usd": 500}, nil)
+	var offers []map[string]interface{}
+	bob.do("GET", "/api/v1/offers", nil, &offers)
+	if len(offers) != 1 {
+		t.Fatalf("offers seen by bob = %v", offers)
+	}
+	if _, ok := offers[0]["username"]; ok {
+		t.Errorf("offer shows the seller's username to another user: %v", offers[0])
+	}
+	alice.do("GET", "/api/v1/offers", nil, &offers)
+	if len(offers) != 1 || offers[0]["username"] != "alice" {
+		t.Errorf("offers seen by alice = %v", offers)
+	}
+
+	anonymous := &client{t: t, url: alice.url}
+	anonymous.expectError("GET", "/api/v1/me", nil, http.StatusUnauthorized, "unauthorized")
+	forged := &client{t: t, url: alice.url, token: "p2ps_forged"}
+	forged.expectError("GET", "/api/v1/offers", nil, http.StatusUnauthorized, "unauthorized")
+
+	alice.expectError("GET", "/api/v1/users/42", nil, http.StatusNotFound, "not_found")
+	alice.expectError("GET", "/api/v1/nope", nil, http.StatusNotFound, "not_found")
+}
+
+func TestOffers(t *testing.T) {
+	alice, bob, _ := newAPI(t)
+
+	var created offer
+	if status := alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.01, "price_usd": 500}, &created); status != http.StatusCreated {
+		t.Fatalf("POST /offers = %d", status)
+	}
+	if created.ID != 1 || created.Status != "pending" || created.InvoiceLink == "" || !strings.HasPrefix(created.PaymentRequest, "lnbc") {
+		t.Errorf("created offer = %+v", created)
+	}
+	alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.5, "price_usd": 20000}, nil)
+	alice.expectError("POST", "/api/v1/offers", map[string]float64{"amount_btc": -1, "price_usd": 5}, http.StatusBadRequest, "invalid_request")
+
+	var offers []offer
+	bob.do("GET", "/api/v1/offers?max_amount=0.1", nil, &offers)
+	if len(offers) != 1 || offers[0].ID != 1 || offers[0].InvoiceLink != "" || offers[0].PaymentRequest != "" {
+		t.Errorf("filtered offers seen by bob = %+v", offers)
+	}
+	bob.do("GET", "/api/v1/offers?user_id=1001&limit=1", nil, &offers)
+	if len(offers) != 1 || offers[0].ID != 2 {
+		t.Errorf("limited offers = %+v", offers)
+	}
+	bob.expectError("GET", "/api/v1/offers?status=bogus", nil, http.StatusBadRequest, "invalid_request")
+
+	bob.expectError("POST", "/api/v1/offers/1/cancel", nil, http.StatusForbidden, "forbidden")
+	var cancelled offer
+	if status := alice.do("POST", "/api/v1/offers/2/cancel", nil, &cancelled); status != http.StatusOK || cancelled.Status != "cancelled" {
+		t.Errorf("cancel = %d %+v", status, cancelled)
+	}
+	alice.expectError("POST", "/api/v1/offers/2/cancel", nil, http.StatusConflict, "conflict")
+	bob.do("GET", "/api/v1/offers?status=pending", nil, &offers)
+	if len(offers) != 1 || offers[0].ID != 1 {
+		t.Errorf("pending offers = %+v", offers)
+	}
+	alice.expectError("GET", "/api/v1/offers/99", nil, http.StatusNotFound, "not_found")
+}
+
+func TestRateLimits(t *testing.T) {
+	alice, bob, pay := newAPI(t, func(svc *shop.Service) {
+		svc.SetRateLimits(shop.RateLimits{
+			User:    ratelimit.New(4, time.Hour),
+			Invoice: ratelimit.New(1, time.Hour),
+		})
+	})
+
+	body := map[string]float64{"amount_btc": 0.01, "price_usd": 500}
+	if status := alice.do("POST", "/api/v1/offers", body, nil); status != http.StatusCreated {
+		t.Fatalf("POST /offers = %d", status)
+	}
+	alice.expectError("POST", "/api/v1/offers", body, http.StatusTooManyRequests, "rate_limited")
+	alice.expectError("POST", "/api/v1/offers/1/refresh-invoice", nil, http.StatusTooManyRequests, "rate_limited")
+	if n := len(pay.Invoices()); n != 1 {
+		t.Errorf("throttled requests created invoices: %d invoices", n)
+	}
+	if status := bob.do("POST", "/api/v1/offers", body, nil); status != http.StatusCreated {
+		t.Errorf("POST /offers by another user = %d", status)
+	}
+
+	// Every request draws from the per-user bucket
+	alice.do("GET", "/api/v1/me", nil, nil)
+	req, _ := http.NewRequest("GET", alice.url+"/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+alice.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("GET /me = %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestInvoiceStatus(t *testing.T) {
+	alice, bob, pay := newAPI(t)
+
+	var created offer
+	alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.01, "price_usd": 500}, &created)
+
+	var inv struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Paid   bool   `json:"paid"`
+	}
+	alice.do("GET", "/api/v1/offers/1/invoice", nil, &inv)
+	if inv.Status != "New" || inv.Paid {
+		t.Errorf("new invoice = %+v", inv)
+	}
+	pay.MarkSettled(inv.ID)
+	alice.do("GET", "/api/v1/offers/1/invoice", nil, &inv)
+	if inv.Status != "Settled" || !inv.Paid {
+		t.Errorf("settled invoice = %+v", inv)
+	}
+
+	bob.expectError("GET", "/api/v1/offers/1/invoice", nil, http.StatusForbidden, "forbidden")
+}
+
+func TestBTCPayWebhook(t *testing.T) {
+	alice, _, pay := newAPI(t)
+	alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.01, "price_usd": 500}, nil)
+
+	// A settled invoice marks its offer paid without anyone polling BTCPay
+	if err := pay.MarkSettled(pay.Invoices()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range pay.Deliveries() {
+		if d.Err != nil || d.StatusCode != http.StatusNoContent {
+			t.Errorf("delivery of %s = %d, %v", d.Event.Type, d.StatusCode, d.Err)
+		}
+	}
+	var got offer
+	alice.do("GET", "/api/v1/offers/1", nil, &got)
+	if got.Status != "paid" {
+		t.Errorf("offer after webhook = %+v", got)
+	}
+
+	// Events of invoices the shop does not know are acknowledged
+	id, _, err := pay.Client().CreateInvoice(1000, "not an offer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay.MarkSettled(id)
+	deliveries := pay.Deliveries()
+	if d := deliveries[len(deliveries)-1]; d.Event.InvoiceID != id || d.StatusCode != http.StatusNoContent {
+		t.Errorf("unknown invoice delivery = %+v", d)
+	}
+
+	req, _ := http.NewRequest("POST", alice.url+"/webhooks/btcpay", bytes.NewReader([]byte(`{"type":"InvoiceSettled"}`)))
+	req.Header.Set("BTCPay-Sig", "sha256=forged")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged webhook = %d", resp.StatusCode)
+	}
+
+	// Events of another store are rejected, even when signed with the secret
+	body := []byte(`{"type":"InvoiceSettled","storeId":"other","invoiceId":"` + pay.Invoices()[0].ID + `"}`)
+	req, _ = http.NewRequest("POST", alice.url+"/webhooks/btcpay", bytes.NewReader(body))
+	req.Header.Set(btcpay.SignatureHeader, btcpay.SignWebhook(body, "whsec"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("webhook of another store = %d", resp.StatusCode)
+	}
+}
+
+func TestTrades(t *testing.T) {
+	alice, bob, _ := newAPI(t)
+	alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.01, "price_usd": 500}, nil)
+
+	alice.expectError("POST", "/api/v1/offers/1/take", nil, http.StatusConflict, "conflict")
+	var taken trade
+	if status := bob.do("POST", "/api/v1/offers/1/take", nil, &taken); status != http.StatusCreated {
+		t.Fatalf("take = %d", status)
+	}
+	if taken.OfferID != 1 || taken.SellerID != 1001 || taken.BuyerID != 1002 || taken.Status != "open" {
+		t.Errorf("trade = %+v", taken)
+	}
+	bob.expectError("POST", "/api/v1/offers/1/take", nil, http.StatusConflict, "conflict")
+
+	for _, c := range []*client{alice, bob} {
+		var trades []trade
+		c.do("GET", "/api/v1/trades", nil, &trades)
+		if len(trades) != 1 || trades[0].ID != taken.ID {
+			t.Errorf("trades = %+v", trades)
+		}
+	}
+
+	var messages []map[string]interface{}
+	if status := alice.do("GET", "/api/v1/trades/1/messages", nil, &messages); status != http.StatusOK || messages == nil || len(messages) != 0 {
+		t.Errorf("trade messages = %d %v", status, messages)
+	}
+	bob.expectError("GET", "/api/v1/trades/2/messages", nil, http.StatusNotFound, "not_found")
+
+	alice.do("POST", "/api/v1/offers/1/cancel", nil, nil)
+	var got trade
+	bob.do("GET", "/api/v1/trades/1", nil, &got)
+	if got.Status != "cancelled" {
+		t.Errorf("trade after cancel = %+v", got)
+	}
+	bob.expectError("GET", "/api/v1/trades/2", nil, http.StatusNotFound, "not_found")
+}
+
+func TestPayouts(t *testing.T) {
+	alice, bob, _ := newAPI(t)
+	alice.do("POST", "/api/v1/offers", map[string]float64{"amount_btc": 0.01, "price_usd": 500}, nil)
+	bob.do("POST", "/api/v1/offers/1/take", nil, nil)
+
+	bob.expectError("POST", "/api/v1/trades/1/payout", map[string]string{"destination": "nowhere"}, http.StatusBadRequest, "invalid_request")
+	alice.expectError("POST", "/api/v1/trades/1/payout", map[string]string{"destination": "alice@example.com"}, http.StatusForbidden, "forbidden")
+	bob.expectError("POST", "/api/v1/trades/2/payout", map[string]string{"destination": "bob@example.com"}, http.StatusNotFound, "not_found")
+	signer := bolt11test.NewSigner()
+	bob.expectError("POST", "/api/v1/trades/1/payout", map[string]string{"destination": signer.Sign(bolt11test.Invoice{AmountMsat: 1_000})}, http.StatusBadRequest, "invalid_request")
+	invoice := signer.Sign(bolt11test.Invoice{AmountMsat: 1_000_000_000})
+	if status := bob.do("POST", "/api/v1/trades/1/payout", map[string]string{"destination": invoice}, nil); status != http.StatusAccepted {
+		t.Errorf("payout of open trade = %d", status)
+	}
+
+	var payouts []map[string]interface{}
+	if status := bob.do("GET", "/api/v1/payouts", nil, &payouts); status != http.StatusOK || payouts == nil || len(payouts) != 0 {
+		t.Errorf("payouts = %d %v", status, payouts)
+	}
+
+	// Only offers cancelled after they were paid are refunded
+	alice.expectError("POST", "/api/v1/offers/1/refund", map[string]string{"destination": "alice@example.com"}, http.StatusNotFound, "not_found")
+	var refunds []map[string]interface{}
+	if status := alice.do("GET", "/api/v1/refunds", nil, &refunds); status != http.StatusOK || refunds == nil || len(refunds) != 0 {
+		t.Errorf("refunds = %d %v", status, refunds)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	alice, _, _ := newAPI(t)
+
+	resp, err := http.Get(alice.url + "/openapi.json")
+	if err != nil {
+		t.Fatalf("GET /openapi.json: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+	for _, path := range []string{"/me", "/offers", "/offers/{id}/take", "/trades/{id}", "/trades/{id}/messages", "/trades/{id}/payout", "/payouts", "/offers/{id}/refund", "/refunds"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("spec lacks %s", path)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+)
+
+// maxWebhookBody is the largest webhook body accepted
+const maxWebhookBody = 1 << 20
+
+// SetWebhookSecret enables the BTCPay webhook endpoint, which accepts events
+// of the store storeID signed with secret. The endpoint is disabled while the
+// secret is empty.
+func (s *Server) SetWebhookSecret(secret, storeID string) {
+	s.webhookSecret = secret
+	s.webhookStoreID = storeID
+}
+
+// btcpayWebhook applies invoice and payout events delivered by BTCPay Server
+func (s *Server) btcpayWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.webhookSecret == "" {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "failed to read body")
+		return
+	}
+	event, err := btcpay.ParseWebhook(body, r.Header.Get(btcpay.SignatureHeader), s.webhookSecret)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+	// Invoice and payout IDs are only meaningful within the shop's store
+	if event.StoreID != s.webhookStoreID {
+		log.Printf("Rejected webhook event %s of store %q", event.DeliveryID, event.StoreID)
+		writeError(w, http.StatusForbidden, "forbidden", "event of another store")
+		return
+	}
+	handle := s.shop.HandleInvoiceEvent
+	if event.IsPayout() {
+		handle = s.shop.HandlePayoutEvent
+	}
+	if err := handle(event); err != nil {
+		log.Printf("Failed to handle webhook event %s: %v", event.DeliveryID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
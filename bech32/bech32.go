@@ -0,0 +1,120 @@
+// Package bech32 encodes and decodes the bech32 strings used by LNURLs and
+// BOLT11 Lightning invoices (BIP-173). Unlike segwit addresses, these have
+// no length limit.
+package bech32
+
+import (
+	"fmt"
+	"strings"
+)
+
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// polymod computes the bech32 checksum of the expanded data
+func polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+// hrpExpand expands the human-readable part for checksum computation
+func hrpExpand(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// Decode splits a bech32 string into its lowercased human-readable part and
+// its data as 5-bit groups, verifying the checksum
+func Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, fmt.Errorf("mixed case in bech32 string")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, fmt.Errorf("invalid bech32 separator position")
+	}
+	hrp := s[:sep]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, fmt.Errorf("invalid character in bech32 prefix")
+		}
+	}
+
+	data := make([]byte, 0, len(s)-sep-1)
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(charset, s[i])
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", s[i])
+		}
+		data = append(data, byte(v))
+	}
+	if polymod(append(hrpExpand(hrp), data...)) != 1 {
+		return "", nil, fmt.Errorf("invalid bech32 checksum")
+	}
+	return hrp, data[:len(data)-6], nil
+}
+
+// Encode builds a bech32 string from a human-readable part and 5-bit groups
+func Encode(hrp string, data []byte) string {
+	hrp = strings.ToLower(hrp)
+	values := append(hrpExpand(hrp), data...)
+	mod := polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range data {
+		b.WriteByte(charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(charset[(mod>>(5*(5-i)))&31])
+	}
+	return b.String()
+}
+
+// ConvertBits regroups data from groups of fromBits to groups of toBits.
+// With pad, incomplete trailing groups are zero-padded; without it, they
+// must be zero padding and are dropped.
+func ConvertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	maxV := uint32(1)<<toBits - 1
+	out := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, v := range data {
+		if uint32(v)>>fromBits != 0 {
+			return nil, fmt.Errorf("invalid %d-bit group %d", fromBits, v)
+		}
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxV))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(toBits-bits)&maxV))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxV != 0 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return out, nil
+}
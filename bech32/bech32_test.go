@@ -0,0 +1,65 @@
+package bech32_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+)
+
+func TestDecode(t *testing.T) {
+	// BIP-173 test vectors
+	valid := []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	}
+	for _, s := range valid {
+		hrp, data, err := bech32.Decode(s)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", s, err)
+			continue
+		}
+		if got := bech32.Encode(hrp, data); got != strings.ToLower(s) {
+			t.Errorf("Encode(Decode(%q)) = %q", s, got)
+		}
+	}
+
+	invalid := map[string]string{
+		"mixed case":     "A12uEL5L",
+		"bad checksum":   "a12uel5m",
+		"empty prefix":   "1nwldj5",
+		"short checksum": "li1dgmt3",
+		"bad character":  "abcdef1bpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+	}
+	for name, s := range invalid {
+		if _, _, err := bech32.Decode(s); err == nil {
+			t.Errorf("%s: Decode(%q) succeeded", name, s)
+		}
+	}
+}
+
+func TestLNURL(t *testing.T) {
+	// LUD-01 example
+	const lnurl = "LNURL1DP68GURN8GHJ7UM9WFMXJCM99E3K7MF0V9CXJ0M385EKVCENXC6R2C35XVUKXEFCV5MKVV34X5EKZD3EV56NYD3HXQURZEPEXEJXXEPNXSCRVWFNV9NXZCN9XQ6XYEFHVGCXXCMYXYMNSERXFQ5FNS"
+	const url = "https://service.com/api?q=3fc3645b439ce8e7f2553a69e5267081d96dcd340693afabe04be7b0ccd178df"
+
+	hrp, data, err := bech32.Decode(lnurl)
+	if err != nil || hrp != "lnurl" {
+		t.Fatalf("Decode = %q, %v", hrp, err)
+	}
+	decoded, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil || string(decoded) != url {
+		t.Fatalf("ConvertBits = %q, %v", decoded, err)
+	}
+
+	groups, err := bech32.ConvertBits([]byte(url), 8, 5, true)
+	if err != nil {
+		t.Fatalf("ConvertBits: %v", err)
+	}
+	if got := bech32.Encode("lnurl", groups); got != strings.ToLower(lnurl) {
+		t.Errorf("Encode = %q", got)
+	}
+}
@@ -0,0 +1,331 @@
+// Package bolt11 decodes and validates BOLT11 Lightning invoices.
+package bolt11
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+)
+
+// Errors returned when checking an invoice
+var (
+	ErrWrongNetwork = errors.New("invoice is for another network")
+	ErrWrongAmount  = errors.New("invoice is for another amount")
+	ErrExpired      = errors.New("invoice has expired")
+)
+
+// Network is a Bitcoin network an invoice can be paid on
+type Network string
+
+// Networks and their invoice prefixes
+const (
+	Mainnet Network = "mainnet"
+	Testnet Network = "testnet"
+	Signet  Network = "signet"
+	Regtest Network = "regtest"
+)
+
+// prefixes maps currency prefixes to networks. Decode tries the longest
+// first, as "bcrt" and "tbs" extend "bc" and "tb".
+var prefixes = []struct {
+	prefix  string
+	network Network
+}{
+	{"bcrt", Regtest},
+	{"tbs", Signet},
+	{"bc", Mainnet},
+	{"tb", Testnet},
+}
+
+// ParseNetwork parses a network name such as "mainnet" or "regtest"
+func ParseNetwork(name string) (Network, error) {
+	for _, p := range prefixes {
+		if string(p.network) == strings.ToLower(name) {
+			return p.network, nil
+		}
+	}
+	return "", fmt.Errorf("unknown network %q", name)
+}
+
+// Defaults of optional fields
+const (
+	defaultExpiry             = time.Hour
+	defaultMinFinalCLTVExpiry = 18
+)
+
+// Lengths in 5-bit groups of the timestamp and signature
+const (
+	timestampGroups = 7
+	signatureGroups = 104
+)
+
+// Tagged field types
+const (
+	tagPaymentHash        = 1  // p
+	tagRouteHint          = 3  // r
+	tagExpiry             = 6  // x
+	tagDescription        = 13 // d
+	tagPaymentSecret      = 16 // s
+	tagPayee              = 19 // n
+	tagDescriptionHash    = 23 // h
+	tagMinFinalCLTVExpiry = 24 // c
+)
+
+// HopHint is a hop of a private route to the payee
+type HopHint struct {
+	PubKey                    [33]byte
+	ShortChannelID            uint64
+	FeeBaseMsat               uint32
+	FeeProportionalMillionths uint32
+	CLTVExpiryDelta           uint16
+}
+
+// hopHintLength is the encoded size of a hop hint in bytes
+const hopHintLength = 33 + 8 + 4 + 4 + 2
+
+// Invoice is a decoded BOLT11 invoice
+type Invoice struct {
+	Network            Network
+	AmountMsat         int64 // 0 when the payer chooses the amount
+	Timestamp          time.Time
+	Expiry             time.Duration
+	PaymentHash        [32]byte
+	PaymentSecret      []byte // nil when absent
+	Description        string
+	DescriptionHash    []byte // nil when absent
+	MinFinalCLTVExpiry int
+	RouteHints         [][]HopHint
+	Payee              [33]byte // Compressed public key of the payee
+}
+
+// ExpiresAt returns when the invoice expires
+func (inv *Invoice) ExpiresAt() time.Time {
+	return inv.Timestamp.Add(inv.Expiry)
+}
+
+// Check verifies that the invoice can be paid on network for exactly
+// amountMsat at time now
+func (inv *Invoice) Check(network Network, amountMsat int64, now time.Time) error {
+	if inv.Network != network {
+		return fmt.Errorf("%w: %s instead of %s", ErrWrongNetwork, inv.Network, network)
+	}
+	if inv.AmountMsat != amountMsat {
+		return fmt.Errorf("%w: %d msat instead of %d", ErrWrongAmount, inv.AmountMsat, amountMsat)
+	}
+	if !now.Before(inv.ExpiresAt()) {
+		return fmt.Errorf("%w: at %s", ErrExpired, inv.ExpiresAt().UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Decode parses a BOLT11 invoice, with or without a "lightning:" prefix,
+// and verifies its signature
+func Decode(s string) (*Invoice, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 10 && strings.EqualFold(s[:10], "lightning:") {
+		s = s[10:]
+	}
+	hrp, data, err := bech32.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(hrp, "ln") {
+		return nil, fmt.Errorf("not a Lightning invoice")
+	}
+	if len(data) < timestampGroups+signatureGroups {
+		return nil, fmt.Errorf("invoice too short")
+	}
+
+	inv := &Invoice{Expiry: defaultExpiry, MinFinalCLTVExpiry: defaultMinFinalCLTVExpiry}
+	amount := ""
+	for _, p := range prefixes {
+		if strings.HasPrefix(hrp[2:], p.prefix) {
+			inv.Network, amount = p.network, hrp[2+len(p.prefix):]
+			break
+		}
+	}
+	if inv.Network == "" {
+		return nil, fmt.Errorf("unknown currency prefix %q", hrp)
+	}
+	if amount != "" {
+		if inv.AmountMsat, err = parseAmount(amount); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := data[:len(data)-signatureGroups]
+	inv.Timestamp = time.Unix(int64(readInt(fields[:timestampGroups])), 0)
+	payee, err := decodeFields(inv, fields[timestampGroups:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the prefix and the fields regrouped into bytes
+	message, err := bech32.ConvertBits(fields, 5, 8, true)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(append([]byte(hrp), message...))
+	signature, err := bech32.ConvertBits(data[len(data)-signatureGroups:], 5, 8, false)
+	if err != nil || len(signature) != 65 || signature[64] > 3 {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+	compact := append([]byte{27 + 4 + signature[64]}, signature[:64]...)
+	key, _, err := ecdsa.RecoverCompact(compact, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	recovered := key.SerializeCompressed()
+	if payee != nil && !bytes.Equal(payee, recovered) {
+		return nil, fmt.Errorf("signature does not match the payee")
+	}
+	copy(inv.Payee[:], recovered)
+	return inv, nil
+}
+
+// decodeFields reads the tagged fields into inv and returns the payee key
+// of the n field, if any. Fields of unknown type or of a length the
+// specification does not allow are skipped.
+func decodeFields(inv *Invoice, fields []byte) ([]byte, error) {
+	var payee []byte
+	hasPaymentHash, hasDescription := false, false
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("truncated tagged field")
+		}
+		tag, length := fields[0], int(fields[1])<<5|int(fields[2])
+		if len(fields) < 3+length {
+			return nil, fmt.Errorf("truncated tagged field")
+		}
+		value := fields[3 : 3+length]
+		fields = fields[3+length:]
+
+		switch tag {
+		case tagPaymentHash:
+			if length != 52 || hasPaymentHash {
+				continue
+			}
+			b, err := bech32.ConvertBits(value, 5, 8, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid payment hash: %v", err)
+			}
+			copy(inv.PaymentHash[:], b)
+			hasPaymentHash = true
+		case tagPaymentSecret:
+			if length != 52 {
+				continue
+			}
+			b, err := bech32.ConvertBits(value, 5, 8, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid payment secret: %v", err)
+			}
+			inv.PaymentSecret = b
+		case tagDescription:
+			b, err := bech32.ConvertBits(value, 5, 8, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid description: %v", err)
+			}
+			inv.Description = string(b)
+			hasDescription = true
+		case tagDescriptionHash:
+			if length != 52 {
+				continue
+			}
+			b, err := bech32.ConvertBits(value, 5, 8, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid description hash: %v", err)
+			}
+			inv.DescriptionHash = b
+			hasDescription = true
+		case tagPayee:
+			if length != 53 {
+				continue
+			}
+			b, err := bech32.ConvertBits(value, 5, 8, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid payee: %v", err)
+			}
+			payee = b
+		case tagExpiry:
+			inv.Expiry = time.Duration(readInt(value)) * time.Second
+		case tagMinFinalCLTVExpiry:
+			inv.MinFinalCLTVExpiry = int(readInt(value))
+		case tagRouteHint:
+			route, err := decodeRoute(value)
+			if err != nil {
+				return nil, err
+			}
+			inv.RouteHints = append(inv.RouteHints, route)
+		}
+	}
+	if !hasPaymentHash {
+		return nil, fmt.Errorf("invoice has no payment hash")
+	}
+	if !hasDescription {
+		return nil, fmt.Errorf("invoice has no description or description hash")
+	}
+	return payee, nil
+}
+
+// decodeRoute decodes the hops of an r field
+func decodeRoute(value []byte) ([]HopHint, error) {
+	b, err := bech32.ConvertBits(value, 5, 8, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route hint: %v", err)
+	}
+	if len(b) == 0 || len(b)%hopHintLength != 0 {
+		return nil, fmt.Errorf("invalid route hint length %d", len(b))
+	}
+	var route []HopHint
+	for ; len(b) > 0; b = b[hopHintLength:] {
+		var hop HopHint
+		copy(hop.PubKey[:], b[:33])
+		hop.ShortChannelID = binary.BigEndian.Uint64(b[33:41])
+		hop.FeeBaseMsat = binary.BigEndian.Uint32(b[41:45])
+		hop.FeeProportionalMillionths = binary.BigEndian.Uint32(b[45:49])
+		hop.CLTVExpiryDelta = binary.BigEndian.Uint16(b[49:51])
+		route = append(route, hop)
+	}
+	return route, nil
+}
+
+// readInt reads a big-endian integer of 5-bit groups
+func readInt(groups []byte) uint64 {
+	var n uint64
+	for _, g := range groups {
+		n = n<<5 | uint64(g)
+	}
+	return n
+}
+
+// parseAmount converts a BOLT11 amount such as "2500u" to millisatoshis
+func parseAmount(s string) (int64, error) {
+	// Millisatoshis per unit of each multiplier; pico-bitcoin is 1/10 msat
+	multipliers := map[byte]int64{'m': 100_000_000, 'u': 100_000, 'n': 100, 'p': 1}
+	digits, unit := s, int64(100_000_000_000) // whole bitcoin without multiplier
+	if m, ok := multipliers[s[len(s)-1]]; ok {
+		digits, unit = s[:len(s)-1], m
+	}
+	if digits == "" || digits[0] == '0' {
+		return 0, fmt.Errorf("invalid invoice amount %q", s)
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n > (1<<63-1)/unit {
+		return 0, fmt.Errorf("invalid invoice amount %q", s)
+	}
+	if unit == 1 {
+		if n%10 != 0 {
+			return 0, fmt.Errorf("invoice amount %q is not a whole millisatoshi", s)
+		}
+		return n / 10, nil
+	}
+	return n * unit, nil
+}
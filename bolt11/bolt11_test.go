@@ -0,0 +1,184 @@
+package bolt11_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11/bolt11test"
+)
+
+// Test vectors from the BOLT11 specification, all signed by the same key
+const (
+	payee       = "03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad"
+	paymentHash = "0001020304050607080900010203040506070809000102030405060708090102"
+	timestamp   = 1496314658
+
+	donation    = "lnbc1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq8rkx3yf5tcsyz3d73gafnh3cax9rn449d9p5uxz9ezhhypd0elx87sjle52x86fux2ypatgddc6k63n7erqz25le42c4u4ecky03ylcqca784w"
+	coffee      = "lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpuaztrnwngzn3kdzw5hydlzf03qdgm2hdq27cqv3agm2awhz5se903vruatfhq77w3ls4evs3ch9zw97j25emudupq63nyw24cg27h2rspfj9srp"
+	nonsense    = "lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpquwpc4curk03c9wlrswe78q4eyqc7d8d0xqzpuyk0sg5g70me25alkluzd2x62aysf2pyy8edtjeevuv4p2d5p76r4zkmneet7uvyakky2zr4cusd45tftc9c5fh0nnqpnl2jfll544esqchsrny"
+	testnetCake = "lntb20m1pvjluezhp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqfpp3x9et2e20v6pu37c5d9vax37wxq72un98kmzzhznpurw9sgl2v0nklu2g4d0keph5t7tj9tcqd8rexnd07ux4uv2cjvcqwaxgj7v4uwn5wmypjd5n69z2xm3xgksg28nwht7f6zspwp3f9t"
+	mainnetCake = "lnbc20m1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqhp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqscc6gd6ql3jrc5yzme8v4ntcewwz5cnw92tz0pc8qcuufvq7khhr8wpald05e92xw006sq94mg8v2ndf4sefvf9sygkshp5zfem29trqq2yxxz7"
+	routed      = "lnbc20m1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqhp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqsfpp3qjmp7lwpagxun9pygexvgpjdc4jdj85fr9yq20q82gphp2nflc7jtzrcazrra7wwgzxqc8u7754cdlpfrmccae92qgzqvzq2ps8pqqqqqqpqqqqq9qqqvpeuqafqxu92d8lr6fvg0r5gv0heeeqgcrqlnm6jhphu9y00rrhy4grqszsvpcgpy9qqqqqqgqqqqq7qqzqj9n4evl6mr5aj9f58zp6fyjzup6ywn3x6sk8akg5v4tgn2q8g4fhx05wf6juaxu9760yp46454gpg5mtzgerlzezqcqvjnhjh8z3g2qqdhhwkj"
+)
+
+var cakeHash = sha256.Sum256([]byte("One piece of chocolate cake, one icecream cone, one pickle, one slice of swiss cheese, one slice of salami, one lollypop, one piece of cherry pie, one sausage, one cupcake, and one slice of watermelon"))
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name            string
+		invoice         string
+		network         bolt11.Network
+		amountMsat      int64
+		expiry          time.Duration
+		description     string
+		descriptionHash []byte
+	}{
+		{"donation", donation, bolt11.Mainnet, 0, time.Hour, "Please consider supporting this project", nil},
+		{"coffee", coffee, bolt11.Mainnet, 250_000_000, time.Minute, "1 cup coffee", nil},
+		{"utf-8 description", "LIGHTNING:" + strings.ToUpper(nonsense), bolt11.Mainnet, 250_000_000, time.Minute, "ナンセンス 1杯", nil},
+		{"testnet", testnetCake, bolt11.Testnet, 2_000_000_000, time.Hour, "", cakeHash[:]},
+		{"description hash", mainnetCake, bolt11.Mainnet, 2_000_000_000, time.Hour, "", cakeHash[:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := bolt11.Decode(tt.invoice)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if inv.Network != tt.network || inv.AmountMsat != tt.amountMsat || inv.Expiry != tt.expiry {
+				t.Errorf("network, amount, expiry = %s, %d, %s", inv.Network, inv.AmountMsat, inv.Expiry)
+			}
+			if inv.Description != tt.description || hex.EncodeToString(inv.DescriptionHash) != hex.EncodeToString(tt.descriptionHash) {
+				t.Errorf("description = %q, hash %x", inv.Description, inv.DescriptionHash)
+			}
+			if inv.Timestamp.Unix() != timestamp || hex.EncodeToString(inv.PaymentHash[:]) != paymentHash {
+				t.Errorf("timestamp = %d, payment hash %x", inv.Timestamp.Unix(), inv.PaymentHash)
+			}
+			if hex.EncodeToString(inv.Payee[:]) != payee {
+				t.Errorf("payee = %x", inv.Payee)
+			}
+			if inv.MinFinalCLTVExpiry != 18 || inv.RouteHints != nil {
+				t.Errorf("min final CLTV expiry = %d, route hints %+v", inv.MinFinalCLTVExpiry, inv.RouteHints)
+			}
+		})
+	}
+}
+
+func TestRouteHints(t *testing.T) {
+	inv, err := bolt11.Decode(routed)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(inv.RouteHints) != 1 || len(inv.RouteHints[0]) != 2 {
+		t.Fatalf("route hints = %+v", inv.RouteHints)
+	}
+	want := []struct {
+		pubKey    string
+		channel   uint64
+		feeBase   uint32
+		feeRate   uint32
+		cltvDelta uint16
+	}{
+		{"029e03a901b85534ff1e92c43c74431f7ce72046060fcf7a95c37e148f78c77255", 0x0102030405060708, 1, 20, 3},
+		{"039e03a901b85534ff1e92c43c74431f7ce72046060fcf7a95c37e148f78c77255", 0x030405060708090a, 2, 30, 4},
+	}
+	for i, hop := range inv.RouteHints[0] {
+		w := want[i]
+		if hex.EncodeToString(hop.PubKey[:]) != w.pubKey || hop.ShortChannelID != w.channel ||
+			hop.FeeBaseMsat != w.feeBase || hop.FeeProportionalMillionths != w.feeRate || hop.CLTVExpiryDelta != w.cltvDelta {
+			t.Errorf("hop %d = %+v", i, hop)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := map[string]string{
+		"bad checksum":     coffee[:len(coffee)-1] + "q",
+		"not an invoice":   "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"unknown currency": "lnxy1qqqqqq",
+		"mixed case":       "LNBC" + coffee[4:],
+		"leading zero":     "lnbc02500u" + coffee[9:],
+		"empty":            "",
+	}
+	for name, s := range tests {
+		if _, err := bolt11.Decode(s); err == nil {
+			t.Errorf("%s: Decode succeeded", name)
+		}
+	}
+
+	// Changing the amount keeps a valid checksum once re-encoded, but the
+	// signature then recovers another payee
+	_, data, _ := bech32.Decode(coffee)
+	inv, err := bolt11.Decode(bech32.Encode("lnbc2400u", data))
+	if err == nil && hex.EncodeToString(inv.Payee[:]) == payee {
+		t.Errorf("tampered invoice verified for the original payee")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	inv, err := bolt11.Decode(coffee)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	issued := time.Unix(timestamp, 0)
+
+	tests := []struct {
+		name       string
+		network    bolt11.Network
+		amountMsat int64
+		now        time.Time
+		want       error
+	}{
+		{"valid", bolt11.Mainnet, 250_000_000, issued.Add(59 * time.Second), nil},
+		{"wrong network", bolt11.Regtest, 250_000_000, issued, bolt11.ErrWrongNetwork},
+		{"wrong amount", bolt11.Mainnet, 250_001_000, issued, bolt11.ErrWrongAmount},
+		{"expired", bolt11.Mainnet, 250_000_000, issued.Add(time.Minute), bolt11.ErrExpired},
+	}
+	for _, tt := range tests {
+		if err := inv.Check(tt.network, tt.amountMsat, tt.now); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Check = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if donation, _ := bolt11.Decode(donation); donation.Check(bolt11.Mainnet, 1000, issued) == nil {
+		t.Error("invoice without amount accepted for a fixed amount")
+	}
+}
+
+func TestSigner(t *testing.T) {
+	signer := bolt11test.NewSigner()
+	hash := sha256.Sum256([]byte("metadata"))
+	issued := time.Unix(timestamp, 0)
+	for _, network := range []bolt11.Network{bolt11.Mainnet, bolt11.Testnet, bolt11.Signet, bolt11.Regtest} {
+		for _, amount := range []int64{0, 1, 150, 1_000_000, 2_500_000_000} {
+			pr := signer.Sign(bolt11test.Invoice{Network: network, AmountMsat: amount, Timestamp: issued, Expiry: 90 * time.Second, DescriptionHash: &hash})
+			inv, err := bolt11.Decode(pr)
+			if err != nil {
+				t.Fatalf("Decode(%s): %v", pr, err)
+			}
+			if inv.Network != network || inv.AmountMsat != amount || !inv.Timestamp.Equal(issued) || inv.Expiry != 90*time.Second {
+				t.Errorf("Decode(%s) = %+v", pr, inv)
+			}
+			if !bytes.Equal(inv.DescriptionHash, hash[:]) || inv.Payee != signer.PubKey() {
+				t.Errorf("Decode(%s): wrong description hash or payee", pr)
+			}
+		}
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	for _, name := range []string{"mainnet", "testnet", "signet", "Regtest"} {
+		if n, err := bolt11.ParseNetwork(name); err != nil || !strings.EqualFold(string(n), name) {
+			t.Errorf("ParseNetwork(%q) = %q, %v", name, n, err)
+		}
+	}
+	if _, err := bolt11.ParseNetwork("liquid"); err == nil {
+		t.Error("ParseNetwork(liquid) succeeded")
+	}
+}
@@ -0,0 +1,125 @@
+// Package bolt11test signs BOLT11 invoices for tests, as the Lightning node of
+// a payee would.
+package bolt11test
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+)
+
+// Invoice describes an invoice to sign
+type Invoice struct {
+	Network         bolt11.Network // defaults to mainnet
+	AmountMsat      int64          // 0 leaves the amount to the payer
+	Timestamp       time.Time      // defaults to now
+	Expiry          time.Duration  // defaults to one hour
+	Description     string
+	DescriptionHash *[32]byte // replaces the description when set
+}
+
+// currencies maps networks to their invoice prefixes
+var currencies = map[bolt11.Network]string{
+	bolt11.Mainnet: "bc",
+	bolt11.Testnet: "tb",
+	bolt11.Signet:  "tbs",
+	bolt11.Regtest: "bcrt",
+}
+
+// Signer signs invoices with a random node key
+type Signer struct {
+	key *btcec.PrivateKey
+}
+
+// NewSigner creates a signer with a fresh key
+func NewSigner() *Signer {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		panic(fmt.Sprintf("bolt11test: generating key: %v", err))
+	}
+	return &Signer{key: key}
+}
+
+// PubKey returns the compressed public key invoices are signed with
+func (s *Signer) PubKey() [33]byte {
+	var pub [33]byte
+	copy(pub[:], s.key.PubKey().SerializeCompressed())
+	return pub
+}
+
+// Sign encodes and signs an invoice with a random payment hash
+func (s *Signer) Sign(inv Invoice) string {
+	if inv.Network == "" {
+		inv.Network = bolt11.Mainnet
+	}
+	if inv.Timestamp.IsZero() {
+		inv.Timestamp = time.Now()
+	}
+	if inv.Expiry == 0 {
+		inv.Expiry = time.Hour
+	}
+	hrp := "ln" + currencies[inv.Network]
+	if inv.AmountMsat > 0 {
+		hrp += encodeAmount(inv.AmountMsat)
+	}
+
+	data := intToGroups(uint64(inv.Timestamp.Unix()), 7)
+	var paymentHash [32]byte
+	rand.Read(paymentHash[:])
+	data = appendTag(data, 1, bytesToGroups(paymentHash[:])) // p: payment hash
+	if inv.DescriptionHash != nil {
+		data = appendTag(data, 23, bytesToGroups(inv.DescriptionHash[:])) // h: description hash
+	} else {
+		data = appendTag(data, 13, bytesToGroups([]byte(inv.Description))) // d: description
+	}
+	data = appendTag(data, 6, intToGroups(uint64(inv.Expiry/time.Second), 0)) // x: expiry
+
+	// The signature covers the prefix and the data regrouped into bytes
+	message, _ := bech32.ConvertBits(data, 5, 8, true)
+	digest := sha256.Sum256(append([]byte(hrp), message...))
+	compact := ecdsa.SignCompact(s.key, digest[:], true)
+	signature := append(compact[1:], compact[0]-27-4) // r || s || recovery ID
+	return bech32.Encode(hrp, append(data, bytesToGroups(signature)...))
+}
+
+// appendTag appends a tagged field holding 5-bit groups
+func appendTag(data []byte, tag byte, groups []byte) []byte {
+	data = append(data, tag, byte(len(groups)>>5), byte(len(groups)&31))
+	return append(data, groups...)
+}
+
+// bytesToGroups regroups bytes into zero-padded 5-bit groups
+func bytesToGroups(b []byte) []byte {
+	groups, _ := bech32.ConvertBits(b, 8, 5, true)
+	return groups
+}
+
+// intToGroups writes n as big-endian 5-bit groups, using at least min groups
+func intToGroups(n uint64, min int) []byte {
+	var groups []byte
+	for ; n > 0 || len(groups) < min; n >>= 5 {
+		groups = append([]byte{byte(n & 31)}, groups...)
+	}
+	return groups
+}
+
+// encodeAmount writes an amount with the largest exact BOLT11 multiplier
+func encodeAmount(msat int64) string {
+	switch {
+	case msat%100_000_000 == 0:
+		return strconv.FormatInt(msat/100_000_000, 10) + "m"
+	case msat%100_000 == 0:
+		return strconv.FormatInt(msat/100_000, 10) + "u"
+	case msat%100 == 0:
+		return strconv.FormatInt(msat/100, 10) + "n"
+	default:
+		return strconv.FormatInt(msat*10, 10) + "p"
+	}
+}
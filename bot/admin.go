@@ -0,0 +1,246 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/markup"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// auditLogSize is the number of entries shown by /audit
+const auditLogSize = 15
+
+// admin resolves the shop user sending an admin command, replying to users
+// who are not admins
+func (b *Bot) admin(m *telebot.Message) (int64, bool) {
+	userID := b.userID(m.Sender)
+	if !b.shop.IsAdmin(userID) {
+		b.replyText(m.Sender, b.locale(m.Sender).T("admin.only"))
+		return 0, false
+	}
+	return userID, true
+}
+
+// commandText returns everything after the command, keeping line breaks
+func commandText(m *telebot.Message) string {
+	i := strings.IndexAny(m.Text, " \n")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(m.Text[i:])
+}
+
+// showStats shows the shop statistics
+func (b *Bot) showStats(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	stats, err := b.shop.Stats(adminID)
+	if err != nil {
+		b.replyText(m.Sender, l.T("admin.stats_failed"))
+		return fmt.Errorf("failed to compute stats: %v", err)
+	}
+	msg := shop.StatsMessage(l, stats)
+	b.reply(m.Sender, msg)
+	return nil
+}
+
+// banUser handles /ban <@user|id> [reason]
+func (b *Bot) banUser(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	args := strings.SplitN(commandText(m), " ", 2)
+	if args[0] == "" {
+		b.replyText(m.Sender, l.T("admin.ban_usage"))
+		return nil
+	}
+	userID, err := b.shop.FindUser(args[0])
+	if err != nil {
+		b.replyText(m.Sender, l.T("admin.user_not_found", markup.Escape(args[0])))
+		return nil
+	}
+	var reason string
+	if len(args) == 2 {
+		reason = strings.TrimSpace(args[1])
+	}
+
+	switch err := b.shop.Ban(adminID, userID, reason); {
+	case errors.Is(err, shop.ErrBanAdmin):
+		b.replyText(m.Sender, l.T("admin.ban_admin"))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("admin.ban_failed"))
+		return fmt.Errorf("failed to ban user %d: %v", userID, err)
+	}
+	b.replyText(m.Sender, l.T("admin.banned", markup.Escape(args[0])))
+	return nil
+}
+
+// unbanUser handles /unban <@user|id>
+func (b *Bot) unbanUser(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	ref := commandText(m)
+	if ref == "" {
+		b.replyText(m.Sender, l.T("admin.unban_usage"))
+		return nil
+	}
+	userID, err := b.shop.FindUser(ref)
+	if err != nil {
+		b.replyText(m.Sender, l.T("admin.user_not_found", markup.Escape(ref)))
+		return nil
+	}
+
+	switch err := b.shop.Unban(adminID, userID); {
+	case errors.Is(err, shop.ErrNotBanned):
+		b.replyText(m.Sender, l.T("admin.not_banned", markup.Escape(ref)))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("admin.unban_failed"))
+		return fmt.Errorf("failed to unban user %d: %v", userID, err)
+	}
+	b.replyText(m.Sender, l.T("admin.unbanned", markup.Escape(ref)))
+	return nil
+}
+
+// forceCancel handles /forcecancel <offer_id>
+func (b *Bot) forceCancel(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	offerID, err := strconv.Atoi(strings.TrimPrefix(commandText(m), "#"))
+	if err != nil {
+		b.replyText(m.Sender, l.T("admin.forcecancel_usage"))
+		return nil
+	}
+
+	_, err = b.shop.ForceCancel(adminID, offerID)
+	switch {
+	case errors.Is(err, shop.ErrOfferNotFound):
+		b.replyText(m.Sender, l.T("offer.not_found"))
+		return nil
+	case errors.Is(err, shop.ErrOfferClosed):
+		b.replyText(m.Sender, l.T("admin.offer_closed"))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("cancel.failed"))
+		return fmt.Errorf("failed to force cancel offer %d: %v", offerID, err)
+	}
+	b.replyText(m.Sender, l.T("admin.forcecancelled", offerID))
+	return nil
+}
+
+// resolveDispute handles /resolve <trade_id> <buyer|seller>
+func (b *Bot) resolveDispute(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	args := strings.Fields(commandText(m))
+	if len(args) != 2 {
+		b.replyText(m.Sender, l.T("admin.resolve_usage"))
+		return nil
+	}
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	winner := shop.DisputeWinner(strings.ToLower(args[1]))
+	if err != nil || (winner != shop.DisputeBuyer && winner != shop.DisputeSeller) {
+		b.replyText(m.Sender, l.T("admin.resolve_usage"))
+		return nil
+	}
+
+	trade, err := b.shop.ResolveDispute(adminID, tradeID, winner)
+	switch {
+	case errors.Is(err, shop.ErrTradeNotFound):
+		b.replyText(m.Sender, l.T("admin.trade_not_found", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrTradeClosed):
+		b.replyText(m.Sender, l.T("admin.trade_closed", tradeID))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("admin.resolve_failed"))
+		return fmt.Errorf("failed to resolve dispute over trade %d: %v", tradeID, err)
+	}
+	b.reply(m.Sender, shop.DisputeResolvedMessage(l, trade, winner))
+	return nil
+}
+
+// broadcast handles /broadcast <text>
+func (b *Bot) broadcast(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	text := commandText(m)
+	if text == "" {
+		b.replyText(m.Sender, l.T("admin.broadcast_usage"))
+		return nil
+	}
+
+	sent, err := b.shop.Broadcast(adminID, text)
+	if err != nil {
+		b.replyText(m.Sender, l.T("admin.broadcast_failed"))
+		return fmt.Errorf("failed to broadcast: %v", err)
+	}
+	b.replyText(m.Sender, l.N("admin.broadcast_sent", sent))
+	return nil
+}
+
+// lookupInvoice handles /lookup <invoice_id>
+func (b *Bot) lookupInvoice(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	invoiceID := commandText(m)
+	if invoiceID == "" {
+		b.replyText(m.Sender, l.T("admin.lookup_usage"))
+		return nil
+	}
+
+	offer, invoice, err := b.shop.Lookup(adminID, invoiceID)
+	switch {
+	case errors.Is(err, shop.ErrOfferNotFound):
+		b.replyText(m.Sender, l.T("admin.lookup_none"))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("admin.lookup_failed"))
+		return fmt.Errorf("failed to look up invoice %s: %v", invoiceID, err)
+	}
+	msg := shop.LookupMessage(l, offer, invoice)
+	b.reply(m.Sender, msg)
+	return nil
+}
+
+// showAuditLog shows the latest admin actions
+func (b *Bot) showAuditLog(m *telebot.Message) error {
+	adminID, ok := b.admin(m)
+	if !ok {
+		return nil
+	}
+	l := b.locale(m.Sender)
+	entries, err := b.shop.AuditLog(adminID, auditLogSize)
+	if err != nil {
+		b.replyText(m.Sender, l.T("admin.audit_failed"))
+		return fmt.Errorf("failed to fetch audit log: %v", err)
+	}
+	msg := shop.AuditLogMessage(l, entries)
+	b.reply(m.Sender, msg)
+	return nil
+}
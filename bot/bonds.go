@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// bond shows the sender's seller bond. "/bond post" posts a new bond,
+// "/bond release" releases the active one and "/bond <bond> <destination>"
+// says where to send a bond released to or won by the sender.
+func (b *Bot) bond(u *telebot.User, payload string) error {
+	l := b.locale(u)
+	userID := b.userID(u)
+	args := strings.Fields(payload)
+	if len(args) == 0 {
+		bond, err := b.shop.Bond(userID)
+		if err != nil && !errors.Is(err, shop.ErrNoBond) {
+			b.replyText(u, l.T("bond.failed"))
+			return err
+		}
+		if b.shop.Bonds().AmountSats <= 0 && bond == nil {
+			b.replyText(u, l.T("bond.disabled"))
+			return nil
+		}
+		b.reply(u, shop.BondMessage(l, bond, b.shop.Bonds()))
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "post":
+		bond, err := b.shop.PostBond(userID)
+		switch {
+		case errors.Is(err, shop.ErrNotRegistered):
+			b.replyText(u, l.T("register.first"))
+			return nil
+		case errors.Is(err, shop.ErrBondsDisabled):
+			b.replyText(u, l.T("bond.disabled"))
+			return nil
+		case errors.Is(err, shop.ErrBondExists):
+			b.replyText(u, l.T("bond.exists"))
+			return nil
+		case err != nil:
+			b.replyText(u, l.T("bond.failed"))
+			return fmt.Errorf("failed to post bond: %v", err)
+		}
+		b.reply(u, shop.BondMessage(l, bond, b.shop.Bonds()))
+		return nil
+	case "release":
+		bond, err := b.shop.ReleaseBond(userID)
+		switch {
+		case errors.Is(err, shop.ErrNoBond):
+			b.replyText(u, l.T("bond.no_bond"))
+			return nil
+		case errors.Is(err, shop.ErrOpenTrades):
+			b.replyText(u, l.T("bond.open_trades"))
+			return nil
+		case err != nil:
+			b.replyText(u, l.T("bond.failed"))
+			return fmt.Errorf("failed to release bond: %v", err)
+		}
+		b.reply(u, shop.BondMessage(l, bond, b.shop.Bonds()))
+		return nil
+	}
+
+	bondID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		b.replyText(u, l.T("bond.command_usage", "/bond"))
+		return nil
+	}
+	if len(args) != 2 {
+		b.replyText(u, l.T("bond.usage", "/bond", bondID))
+		return nil
+	}
+
+	bond, err := b.shop.ClaimBond(userID, bondID, args[1])
+	switch {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		b.replyText(u, l.T("payout.invalid"))
+		return nil
+	case errors.Is(err, shop.ErrUnresolvable):
+		b.replyText(u, l.T("payout.unresolvable"))
+		return nil
+	case errors.Is(err, shop.ErrPayoutAmount):
+		b.replyText(u, l.T("bond.amount_rejected", bondID))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		b.replyText(u, l.T("payout.wrong_network", b.shop.Network()))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		b.replyText(u, l.T("bond.wrong_amount", bondID))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		b.replyText(u, l.T("payout.expired"))
+		return nil
+	case errors.Is(err, shop.ErrBondNotFound):
+		b.replyText(u, l.T("bond.not_found", bondID))
+		return nil
+	case errors.Is(err, shop.ErrBondPayoutExist):
+		b.replyText(u, l.T("bond.payout_exists", bondID))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("bond.failed"))
+		return fmt.Errorf("failed to send bond %d: %v", bondID, err)
+	}
+	b.reply(u, shop.BondPayoutMessage(l, bond))
+	return nil
+}
@@ -1,16 +1,18 @@
 package bot
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
 	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/config"
-	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/markup"
 	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
 	"gopkg.in/tucnak/telebot.v2"
 )
 
@@ -20,33 +22,37 @@ const (
 	btnListOffers  = "list_offers"
 	btnMarketplace = "marketplace"
 	btnHelp        = "help"
-	
-	// Callback prefixes
-	cbConfirmPayment = "confirm_payment:"
-	cbCancelOffer    = "cancel_offer:"
+
+	// Callback uniques, the offer ID is carried in the button data
+	cbConfirmPayment = shop.ActionConfirmPayment
+	cbCancelOffer    = shop.ActionCancelOffer
+	cbRefreshInvoice = shop.ActionRefreshInvoice
+	cbTakeOffer      = shop.ActionTakeOffer
+	cbTradeChat      = shop.ActionTradeChat
+	cbContact        = shop.ActionContact
+	cbPayout         = shop.ActionPayout
+	cbRefund         = shop.ActionRefund
+	cbReferralPayout = shop.ActionReferralPayout
+	cbPostBond       = shop.ActionPostBond
+	cbReleaseBond    = shop.ActionReleaseBond
+	cbClaimBond      = shop.ActionClaimBond
+	cbSetLanguage    = "set_language"
 )
 
+// maxMessageLength is the longest text Telegram accepts in a single message
+const maxMessageLength = 4096
+
 // Bot represents the Telegram bot with its dependencies
 type Bot struct {
-	teleBot   *telebot.Bot
-	database  *db.Database
-	btcpay    *btcpay.Client
-	config    *config.Config
-	// Button instances
-	btnCreate     *telebot.InlineButton
-	btnList       *telebot.InlineButton
-	btnMarketplace *telebot.InlineButton
-	btnHelp       *telebot.InlineButton
-}
-
-// NewBot creates a new Bot instance
-func NewBot(cfg *config.Config) (*Bot, error) {
-	database, err := db.NewDatabase(cfg.DBPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize database: %v", err)
-	}
+	teleBot *telebot.Bot
+	shop    *shop.Service
+	config  *config.Config
+}
 
+// NewBot creates a new Bot instance serving the given shop
+func NewBot(cfg *config.Config, svc *shop.Service) (*Bot, error) {
 	bot, err := telebot.NewBot(telebot.Settings{
+		URL:    cfg.TelegramAPIURL,
 		Token:  cfg.TelegramToken,
 		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
 	})
@@ -54,435 +60,683 @@ func NewBot(cfg *config.Config) (*Bot, error) {
 		return nil, fmt.Errorf("failed to create bot: %v", err)
 	}
 
-	btcpayClient := btcpay.NewClient(cfg.BTCPayURL, cfg.BTCPayAPIKey, cfg.BTCPayStoreID)
+	b := &Bot{
+		teleBot: bot,
+		shop:    svc,
+		config:  cfg,
+	}
+
+	// Filter updates before they reach any handler
+	bot.Poller = telebot.NewMiddlewarePoller(bot.Poller, b.filter)
+
+	return b, nil
+}
+
+// Name implements shop.Frontend
+func (b *Bot) Name() string {
+	return shop.FrontendTelegram
+}
 
-	// Create button instances
-	btnCreate := telebot.InlineButton{
-		Unique: btnCreateOffer,
-		Text:   "🔄 Create Offer",
+// Send implements shop.Frontend by sending a message with an inline keyboard
+func (b *Bot) Send(chatID string, msg shop.Message) error {
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q: %v", chatID, err)
 	}
+	_, err = b.send(telebot.ChatID(id), msg)
+	return err
+}
 
-	btnList := telebot.InlineButton{
-		Unique: btnListOffers,
-		Text:   "📋 My Offers",
+// send renders a message as MarkdownV2 and sends it, split into several
+// messages when it is too long for Telegram. The inline keyboard is attached
+// to the last part, which is returned. A payment URI is first sent as a QR
+// code photo.
+func (b *Bot) send(to telebot.Recipient, msg shop.Message) (*telebot.Message, error) {
+	if msg.PaymentURI != "" {
+		if err := b.sendQRCode(to, msg.PaymentURI); err != nil {
+			log.Printf("Failed to send QR code to %s: %v", to.Recipient(), err)
+		}
 	}
-	
-	btnMarketplace := telebot.InlineButton{
-		Unique: btnMarketplace,
-		Text:   "🛒 Marketplace",
+	parts := markup.Split(msg.Text, maxMessageLength)
+	var sent *telebot.Message
+	for i, part := range parts {
+		options := []interface{}{telebot.ModeMarkdownV2}
+		if i == len(parts)-1 && len(msg.Actions) > 0 {
+			options = append(options, keyboard(msg.Actions))
+		}
+		m, err := b.teleBot.Send(to, markup.MarkdownV2(part), options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send message: %v", err)
+		}
+		sent = m
 	}
+	return sent, nil
+}
 
-	btnHelp := telebot.InlineButton{
-		Unique: btnHelp,
-		Text:   "❓ Help",
+// Edit implements shop.Editor. Actions missing from msg are removed from
+// the message.
+func (b *Bot) Edit(chatID, messageID string, msg shop.Message) error {
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q: %v", chatID, err)
 	}
+	stored := telebot.StoredMessage{ChatID: id, MessageID: messageID}
+	options := []interface{}{telebot.ModeMarkdownV2}
+	if len(msg.Actions) > 0 {
+		options = append(options, keyboard(msg.Actions))
+	}
+	_, err = b.teleBot.Edit(stored, markup.MarkdownV2(msg.Text), options...)
+	if err != nil && !notModified(err) {
+		return fmt.Errorf("failed to edit message: %v", err)
+	}
+	return nil
+}
 
-	return &Bot{
-		teleBot:       bot,
-		database:      database,
-		btcpay:        btcpayClient,
-		config:        cfg,
-		btnCreate:     &btnCreate,
-		btnList:       &btnList,
-		btnMarketplace: &btnMarketplace,
-		btnHelp:       &btnHelp,
-	}, nil
+// notModified reports whether an edit failed only because the message
+// already shows the new content
+func notModified(err error) bool {
+	return errors.Is(err, telebot.ErrMessageNotModified) || errors.Is(err, telebot.ErrSameMessageContent)
+}
+
+// reply sends a message to a user, logging failures
+func (b *Bot) reply(to *telebot.User, msg shop.Message) {
+	if _, err := b.send(to, msg); err != nil {
+		log.Printf("Failed to reply to user %d: %v", to.ID, err)
+	}
+}
+
+// replyText sends a text without actions to a user
+func (b *Bot) replyText(to *telebot.User, text string) {
+	b.reply(to, shop.Message{Text: text})
+}
+
+// keyboard converts message actions into an inline keyboard
+func keyboard(actions [][]shop.Action) *telebot.ReplyMarkup {
+	menu := &telebot.ReplyMarkup{}
+	for _, row := range actions {
+		var buttons []telebot.InlineButton
+		for _, a := range row {
+			buttons = append(buttons, telebot.InlineButton{
+				Text:   a.Label,
+				URL:    a.URL,
+				Unique: a.Command,
+				Data:   a.Data,
+			})
+		}
+		menu.InlineKeyboard = append(menu.InlineKeyboard, buttons)
+	}
+	return menu
+}
+
+// identity returns the shop identity of a Telegram user
+func identity(u *telebot.User) models.Identity {
+	id := strconv.FormatInt(u.ID, 10)
+	return models.Identity{
+		Frontend:   shop.FrontendTelegram,
+		ExternalID: id,
+		ChatID:     id,
+		Username:   u.Username,
+		Language:   u.LanguageCode,
+	}
+}
+
+// userID resolves the shop user of a Telegram user, falling back to the
+// Telegram ID for users who have not registered yet
+func (b *Bot) userID(u *telebot.User) int64 {
+	id, err := b.shop.UserID(shop.FrontendTelegram, strconv.FormatInt(u.ID, 10))
+	if err != nil {
+		if !errors.Is(err, shop.ErrNotRegistered) {
+			log.Printf("Failed to resolve user %d: %v", u.ID, err)
+		}
+		return u.ID
+	}
+	return id
+}
+
+// locale returns the locale to talk to a Telegram user in
+func (b *Bot) locale(u *telebot.User) *i18n.Locale {
+	return b.shop.Locale(b.userID(u), u.LanguageCode)
 }
 
 // sendMainMenu sends the main menu with buttons to the user
 func (b *Bot) sendMainMenu(m *telebot.Message) {
-	menu := &telebot.ReplyMarkup{}
-	
-	// Create rows with buttons
-	menu.InlineKeyboard = [][]telebot.InlineButton{
-		{*b.btnCreate, *b.btnList},
-		{*b.btnMarketplace},
-		{*b.btnHelp},
+	l := b.locale(m.Sender)
+	sent, err := b.send(m.Sender, shop.Message{
+		Text: l.T("menu.welcome"),
+		Actions: [][]shop.Action{
+			{
+				{Command: btnCreateOffer, Label: l.T("menu.create")},
+				{Command: btnListOffers, Label: l.T("menu.list")},
+			},
+			{{Command: btnMarketplace, Label: l.T("menu.marketplace")}},
+			{{Command: btnHelp, Label: l.T("menu.help")}},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to send menu to user %d: %v", m.Sender.ID, err)
+		return
 	}
 
-	b.teleBot.Send(m.Sender, "Welcome to P2P Bitcoin Shop! Choose an option:", menu)
+	// Only the latest menu keeps its buttons
+	chatID := strconv.FormatInt(m.Sender.ID, 10)
+	replaced, err := b.shop.TrackMenu(shop.FrontendTelegram, chatID, strconv.Itoa(sent.ID), b.userID(m.Sender))
+	if err != nil {
+		log.Printf("Failed to track menu: %v", err)
+		return
+	}
+	for _, id := range replaced {
+		stored := telebot.StoredMessage{ChatID: m.Sender.ID, MessageID: id}
+		if _, err := b.teleBot.EditReplyMarkup(stored, nil); err != nil && !notModified(err) {
+			log.Printf("Failed to remove buttons of menu %s: %v", id, err)
+		}
+	}
 }
 
-// registerUser registers a new user in the database
+// registerUser registers a new user in the database. Invite links record
+// who invited them.
 func (b *Bot) registerUser(m *telebot.Message) error {
-	if err := b.database.RegisterUser(m.Sender.ID, m.Sender.Username); err != nil {
+	code, _ := referralPayload(m.Payload)
+	if _, err := b.shop.RegisterReferred(identity(m.Sender), code); err != nil {
 		return err
 	}
-	
+
+	// Links from the marketplace channel open their offer directly
+	if offerID, ok := offerPayload(m.Payload); ok {
+		b.showOffer(m, offerID)
+		return nil
+	}
+
 	// Send welcome message with buttons
-	b.teleBot.Send(m.Sender, "Successfully registered!")
+	b.replyText(m.Sender, b.locale(m.Sender).T("register.success"))
 	b.sendMainMenu(m)
-	
+
 	return nil
 }
 
 // showCreateOfferForm displays the form to create a new offer
 func (b *Bot) showCreateOfferForm(m *telebot.Message) {
-	instructions := `To create a new offer, send a message in this format:
-	
-/sell <amount_btc> <price_usd>
-
-Example: /sell 0.01 500
-
-This will create an offer to sell 0.01 BTC for $500.`
-
-	b.teleBot.Send(m.Sender, instructions)
+	b.replyText(m.Sender, b.locale(m.Sender).T("sell.instructions"))
 }
 
 // createOffer creates a new Bitcoin selling offer
-func (b *Bot) createOffer(m *telebot.Message, amountBTC, priceUSD float64) error {
-	// Verify user exists
-	exists, err := b.database.UserExists(m.Sender.ID)
-	if err != nil || !exists {
-		b.teleBot.Send(m.Sender, "Please register first with /start")
+func (b *Bot) createOffer(m *telebot.Message, amountBTC, priceUSD float64, method models.PaymentMethod) error {
+	l := b.locale(m.Sender)
+	offer, err := b.shop.CreateOffer(b.userID(m.Sender), amountBTC, priceUSD, method)
+	switch {
+	case errors.Is(err, shop.ErrPaymentMethod):
+		b.replyText(m.Sender, l.T("sell.invalid_method"))
 		return nil
-	}
-
-	// Calculate amount in satoshis (1 BTC = 100,000,000 sats)
-	amountSats := int64(amountBTC * 100_000_000)
-
-	// Create BTCPay Server invoice
-	invoiceID, invoiceLink, err := b.btcpay.CreateInvoice(amountSats, fmt.Sprintf("BTC sell offer by %d", m.Sender.ID))
-	if err != nil {
-		b.teleBot.Send(m.Sender, "Failed to create Lightning invoice")
+	case errors.Is(err, shop.ErrNotRegistered):
+		b.replyText(m.Sender, l.T("register.first"))
+		return nil
+	case errors.Is(err, shop.ErrTooManyOffers):
+		b.replyText(m.Sender, l.N("sell.too_many", b.shop.Limits().MaxOpenOffers))
+		return nil
+	case errors.Is(err, shop.ErrThrottled):
+		b.replyText(m.Sender, shop.ThrottledText(l, err))
+		return nil
+	case errors.Is(err, shop.ErrCooldown):
+		b.replyText(m.Sender, l.T("sell.cooldown", shop.FormatWait(b.shop.CooldownRemaining(b.userID(m.Sender)))))
+		return nil
+	case errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		b.replyText(m.Sender, b.limitExceeded(m.Sender, err))
+		return nil
+	case errors.Is(err, shop.ErrInvoice):
+		b.replyText(m.Sender, l.T("sell.invoice_failed"))
 		return fmt.Errorf("failed to create invoice: %v", err)
-	}
-
-	// Store offer
-	if err := b.database.CreateOffer(m.Sender.ID, amountBTC, priceUSD, invoiceID, invoiceLink); err != nil {
-		b.teleBot.Send(m.Sender, "Failed to create offer")
+	case err != nil:
+		b.replyText(m.Sender, l.T("sell.failed"))
 		return fmt.Errorf("failed to create offer: %v", err)
 	}
 
-	// Create a button to view the invoice
-	menu := &telebot.ReplyMarkup{}
-	btnViewInvoice := &telebot.InlineButton{
-		Text: "View Invoice",
-		URL:  invoiceLink,
-	}
-	menu.InlineKeyboard = [][]telebot.InlineButton{{*btnViewInvoice}}
+	msg := shop.OfferCreatedMessage(l, offer)
+	b.reply(m.Sender, msg)
 
-	offerMsg := fmt.Sprintf("✅ Offer created!\n\n🔹 Amount: %f BTC\n🔹 Price: $%f\n\nClick the button below to view the Lightning invoice:", amountBTC, priceUSD)
-	b.teleBot.Send(m.Sender, offerMsg, menu)
-	
 	return nil
 }
 
 // listOffers lists all offers for a user
 func (b *Bot) listOffers(m *telebot.Message) error {
-	offers, err := b.database.GetUserOffers(m.Sender.ID)
+	l := b.locale(m.Sender)
+	offers, err := b.shop.ListOffers(b.userID(m.Sender))
+	if errors.Is(err, shop.ErrThrottled) {
+		b.replyText(m.Sender, shop.ThrottledText(l, err))
+		return nil
+	}
 	if err != nil {
-		b.teleBot.Send(m.Sender, "Failed to fetch offers")
+		b.replyText(m.Sender, l.T("list.failed"))
 		return fmt.Errorf("failed to fetch offers: %v", err)
 	}
 
 	if len(offers) == 0 {
-		b.teleBot.Send(m.Sender, "No offers found. Use the 'Create Offer' button to create your first offer.")
+		b.replyText(m.Sender, l.T("list.empty"))
 		return nil
 	}
 
 	// Send header message
-	b.teleBot.Send(m.Sender, "📋 *Your offers:*", telebot.ModeMarkdown)
-	
+	b.replyText(m.Sender, l.T("list.header"))
+
 	// Create a menu for each offer
 	for i, o := range offers {
-		// Check if the offer is already completed or cancelled
-		if o.Status == models.StatusCompleted || o.Status == models.StatusCancelled {
-			continue // Skip completed or cancelled offers
-		}
-		
-		// Check payment status if the offer is still pending
-		isPaid := false
-		if o.Status == models.StatusPending {
-			paid, err := b.btcpay.CheckInvoiceStatus(o.InvoiceID)
-			if err != nil {
-				log.Printf("Failed to check invoice status for offer %d: %v", o.ID, err)
-			}
-			
-			// If the invoice is paid but the status is still pending, update it
-			if paid && o.Status == models.StatusPending {
-				if err := b.database.UpdateOfferStatus(o.ID, models.StatusPaid); err != nil {
-					log.Printf("Failed to update offer status: %v", err)
-				} else {
-					o.Status = models.StatusPaid
-				}
-				isPaid = true
-			}
-		} else if o.Status == models.StatusPaid {
-			isPaid = true
-		}
-		
-		// Determine status emoji
-		statusEmoji := "⏳"
-		if o.Status == models.StatusPaid {
-			statusEmoji = "💰"
-		} else if o.Status == models.StatusCompleted {
-			statusEmoji = "✅"
-		} else if o.Status == models.StatusCancelled {
-			statusEmoji = "❌"
-		}
-		
-		// Format the offer details
-		offerDetails := fmt.Sprintf(
-			"*Offer #%d*\n"+
-			"🔹 Amount: %f BTC\n"+
-			"🔹 Price: $%f\n"+
-			"🔹 Date: %s\n"+
-			"🔹 Status: %s %s\n",
-			o.ID, o.AmountBTC, o.PriceUSD, o.CreatedAt.Format(time.RFC822), statusEmoji, o.Status)
-		
-		// Create buttons based on offer status
-		menu := &telebot.ReplyMarkup{}
-		var buttons []telebot.InlineButton
-		
-		// View invoice button
-		btnViewInvoice := telebot.InlineButton{
-			Text: "View Invoice",
-			URL:  o.InvoiceLink,
-		}
-		buttons = append(buttons, btnViewInvoice)
-		
-		// If the offer is paid, add confirm payment button
-		if isPaid {
-			btnConfirmPayment := telebot.InlineButton{
-				Text:   "✅ Confirm Payment Received",
-				Unique: fmt.Sprintf("%s%d", cbConfirmPayment, o.ID),
-			}
-			buttons = append(buttons, btnConfirmPayment)
-		}
-		
-		// Cancel offer button
-		if o.Status == models.StatusPending {
-			btnCancelOffer := telebot.InlineButton{
-				Text:   "❌ Cancel Offer",
-				Unique: fmt.Sprintf("%s%d", cbCancelOffer, o.ID),
-			}
-			buttons = append(buttons, btnCancelOffer)
+		// Check if the offer is already closed
+		if o.Status.Closed() {
+			continue // Skip closed offers
 		}
-		
-		// Add buttons to the menu
-		menu.InlineKeyboard = [][]telebot.InlineButton{buttons}
-		
+
 		// Send each offer as a separate message with its own buttons
 		if i < 10 { // Limit to 10 offers to avoid Telegram API limits
-			b.teleBot.Send(m.Sender, offerDetails, menu, telebot.ModeMarkdown)
+			sent, err := b.send(m.Sender, shop.OfferCardMessage(l, o))
+			if err != nil {
+				log.Printf("Failed to send card of offer %d: %v", o.ID, err)
+				continue
+			}
+			b.trackOfferCard(sent, b.userID(m.Sender), o.ID)
 		}
 	}
-	
+
 	// If there are more than 10 offers, send a summary message
 	if len(offers) > 10 {
-		b.teleBot.Send(m.Sender, fmt.Sprintf("Showing buttons for the first 10 offers. You have a total of %d offers.", len(offers)))
+		b.replyText(m.Sender, l.T("list.truncated", len(offers)))
 	}
-	
+
 	return nil
 }
 
 // confirmPayment confirms that payment has been received for an offer
 func (b *Bot) confirmPayment(c *telebot.Callback) error {
 	// Extract offer ID from callback data
-	idStr := strings.TrimPrefix(c.Data, cbConfirmPayment)
-	offerID, err := strconv.Atoi(idStr)
+	offerID, err := strconv.Atoi(c.Data)
 	if err != nil {
 		return fmt.Errorf("invalid offer ID: %v", err)
 	}
-	
-	// Get the offer
-	offer, err := b.database.GetOffer(offerID)
-	if err != nil {
-		return fmt.Errorf("failed to get offer: %v", err)
-	}
-	
-	// Check if the user is the owner of the offer
-	if offer.UserID != c.Sender.ID {
-		b.teleBot.Respond(c, &telebot.CallbackResponse{
-			Text:      "You are not authorized to confirm this payment",
-			ShowAlert: true,
-		})
+
+	l := b.locale(c.Sender)
+	offer, err := b.shop.ConfirmPayment(b.userID(c.Sender), offerID)
+	switch {
+	case errors.Is(err, shop.ErrNotOwner):
+		b.alert(c, l.T("confirm.unauthorized"))
 		return fmt.Errorf("unauthorized attempt to confirm payment for offer %d by user %d", offerID, c.Sender.ID)
-	}
-	
-	// Check if the offer is in the correct status
-	if offer.Status != models.StatusPaid {
-		b.teleBot.Respond(c, &telebot.CallbackResponse{
-			Text:      "This offer is not in the paid status",
-			ShowAlert: true,
-		})
+	case errors.Is(err, shop.ErrNotPaid):
+		b.alert(c, l.T("confirm.not_paid"))
 		return fmt.Errorf("attempt to confirm payment for offer %d with status %s", offerID, offer.Status)
-	}
-	
-	// Update the offer status
-	if err := b.database.UpdateOfferStatus(offerID, models.StatusCompleted); err != nil {
-		b.teleBot.Respond(c, &telebot.CallbackResponse{
-			Text:      "Failed to update offer status",
-			ShowAlert: true,
-		})
+	case errors.Is(err, shop.ErrNotTaken):
+		b.alert(c, l.T("confirm.not_taken"))
+		return nil
+	case errors.Is(err, shop.ErrDisputed):
+		b.alert(c, l.T("offer.disputed"))
+		return nil
+	case errors.Is(err, shop.ErrOfferNotFound):
+		b.alert(c, l.T("offer.not_found"))
+		return fmt.Errorf("failed to get offer: %v", err)
+	case err != nil:
+		b.alert(c, l.T("confirm.failed"))
 		return fmt.Errorf("failed to update offer status: %v", err)
 	}
-	
-	// Respond to the callback
+
+	// Respond to the callback and show the new status on the card
 	b.teleBot.Respond(c, &telebot.CallbackResponse{
-		Text: "Payment confirmed! Funds have been released.",
+		Text: l.T("confirm.done"),
 	})
-	
-	// Send a confirmation message
-	confirmMsg := fmt.Sprintf("✅ *Payment Confirmed*\n\nYou have confirmed receipt of payment for Offer #%d.\nThe transaction is now complete and funds have been released.", offerID)
-	b.teleBot.Send(c.Sender, confirmMsg, telebot.ModeMarkdown)
-	
+	b.updateCard(c, l, offer)
+
 	return nil
 }
 
 // cancelOffer cancels an offer
 func (b *Bot) cancelOffer(c *telebot.Callback) error {
 	// Extract offer ID from callback data
-	idStr := strings.TrimPrefix(c.Data, cbCancelOffer)
-	offerID, err := strconv.Atoi(idStr)
+	offerID, err := strconv.Atoi(c.Data)
 	if err != nil {
 		return fmt.Errorf("invalid offer ID: %v", err)
 	}
-	
-	// Get the offer
-	offer, err := b.database.GetOffer(offerID)
+
+	l := b.locale(c.Sender)
+	offer, err := b.shop.CancelOffer(b.userID(c.Sender), offerID)
+	switch {
+	case errors.Is(err, shop.ErrNotOwner):
+		b.alert(c, l.T("cancel.unauthorized"))
+		return fmt.Errorf("unauthorized attempt to cancel offer %d by user %d", offerID, c.Sender.ID)
+	case errors.Is(err, shop.ErrNotPending):
+		b.alert(c, l.T("cancel.not_pending"))
+		return fmt.Errorf("attempt to cancel offer %d with status %s", offerID, offer.Status)
+	case errors.Is(err, shop.ErrDisputed):
+		b.alert(c, l.T("offer.disputed"))
+		return nil
+	case errors.Is(err, shop.ErrOfferNotFound):
+		b.alert(c, l.T("offer.not_found"))
+		return fmt.Errorf("failed to get offer: %v", err)
+	case err != nil:
+		b.alert(c, l.T("cancel.failed"))
+		return fmt.Errorf("failed to update offer status: %v", err)
+	}
+
+	// Respond to the callback and show the new status on the card
+	b.teleBot.Respond(c, &telebot.CallbackResponse{
+		Text: l.T("cancel.done"),
+	})
+	b.updateCard(c, l, offer)
+
+	return nil
+}
+
+// refreshInvoice replaces the invoice of an offer and sends the new one
+func (b *Bot) refreshInvoice(c *telebot.Callback) error {
+	offerID, err := strconv.Atoi(c.Data)
 	if err != nil {
+		return fmt.Errorf("invalid offer ID: %v", err)
+	}
+
+	l := b.locale(c.Sender)
+	userID := b.userID(c.Sender)
+	offer, err := b.shop.RefreshInvoice(userID, offerID)
+	switch {
+	case errors.Is(err, shop.ErrNotOwner):
+		b.alert(c, l.T("refresh.unauthorized"))
+		return fmt.Errorf("unauthorized attempt to refresh offer %d by user %d", offerID, c.Sender.ID)
+	case errors.Is(err, shop.ErrNotRefreshable):
+		b.alert(c, l.T("refresh.not_refreshable"))
+		return nil
+	case errors.Is(err, shop.ErrTooManyInvoices):
+		b.alert(c, l.T("refresh.too_many", offerID, b.shop.Limits().MaxOfferInvoices))
+		return nil
+	case errors.Is(err, shop.ErrOfferNotFound):
+		b.alert(c, l.T("offer.not_found"))
 		return fmt.Errorf("failed to get offer: %v", err)
+	case errors.Is(err, shop.ErrTooManyOffers):
+		b.alert(c, l.N("sell.too_many", b.shop.Limits().MaxOpenOffers))
+		return nil
+	case errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		b.alert(c, b.limitExceeded(c.Sender, err))
+		return nil
+	case errors.Is(err, shop.ErrThrottled):
+		b.alert(c, shop.ThrottledText(l, err))
+		return nil
+	case err != nil:
+		b.alert(c, l.T("refresh.failed"))
+		return fmt.Errorf("failed to refresh invoice: %v", err)
 	}
-	
-	// Check if the user is the owner of the offer
-	if offer.UserID != c.Sender.ID {
-		b.teleBot.Respond(c, &telebot.CallbackResponse{
-			Text:      "You are not authorized to cancel this offer",
-			ShowAlert: true,
-		})
-		return fmt.Errorf("unauthorized attempt to cancel offer %d by user %d", offerID, c.Sender.ID)
+
+	b.teleBot.Respond(c, &telebot.CallbackResponse{
+		Text: l.T("refresh.done"),
+	})
+	b.updateCard(c, l, offer)
+	// Cards of expired offers were no longer tracked
+	if c.Message != nil && c.Message.Chat != nil {
+		b.trackOfferCard(c.Message, userID, offer.ID)
 	}
-	
-	// Check if the offer is in the correct status
-	if offer.Status != models.StatusPending {
-		b.teleBot.Respond(c, &telebot.CallbackResponse{
-			Text:      "Only pending offers can be cancelled",
-			ShowAlert: true,
-		})
-		return fmt.Errorf("attempt to cancel offer %d with status %s", offerID, offer.Status)
+	b.reply(c.Sender, shop.InvoiceRefreshedMessage(l, offer))
+	return nil
+}
+
+// trackOfferCard records a card showing an offer to its owner
+func (b *Bot) trackOfferCard(msg *telebot.Message, userID int64, offerID int) {
+	chatID := strconv.FormatInt(msg.Chat.ID, 10)
+	if err := b.shop.TrackOfferCard(shop.FrontendTelegram, chatID, strconv.Itoa(msg.ID), userID, offerID); err != nil {
+		log.Printf("Failed to track card of offer %d: %v", offerID, err)
 	}
-	
-	// Update the offer status
-	if err := b.database.UpdateOfferStatus(offerID, models.StatusCancelled); err != nil {
-		b.teleBot.Respond(c, &telebot.CallbackResponse{
-			Text:      "Failed to cancel offer",
-			ShowAlert: true,
-		})
-		return fmt.Errorf("failed to update offer status: %v", err)
+}
+
+// updateCard edits the card whose button was pressed to show the offer.
+// Tracked cards are already up to date, this covers cards sent before
+// cards were tracked.
+func (b *Bot) updateCard(c *telebot.Callback, l *i18n.Locale, offer *models.Offer) {
+	if c.Message == nil || c.Message.Chat == nil {
+		return
+	}
+	chatID := strconv.FormatInt(c.Message.Chat.ID, 10)
+	if err := b.Edit(chatID, strconv.Itoa(c.Message.ID), shop.OfferCardMessage(l, *offer)); err != nil {
+		log.Printf("Failed to update card of offer %d: %v", offer.ID, err)
 	}
-	
-	// Respond to the callback
+}
+
+// alert answers a callback with an alert popup
+func (b *Bot) alert(c *telebot.Callback, text string) {
 	b.teleBot.Respond(c, &telebot.CallbackResponse{
-		Text: "Offer cancelled successfully.",
+		Text:      text,
+		ShowAlert: true,
 	})
-	
-	// Send a confirmation message
-	cancelMsg := fmt.Sprintf("❌ *Offer Cancelled*\n\nYou have cancelled Offer #%d.", offerID)
-	b.teleBot.Send(c.Sender, cancelMsg, telebot.ModeMarkdown)
-	
+}
+
+// takeOffer opens a trade on a marketplace offer for the pressing user
+func (b *Bot) takeOffer(c *telebot.Callback) error {
+	offerID, err := strconv.Atoi(c.Data)
+	if err != nil {
+		return fmt.Errorf("invalid offer ID: %v", err)
+	}
+
+	l := b.locale(c.Sender)
+	trade, err := b.shop.TakeOffer(b.userID(c.Sender), offerID)
+	switch {
+	case errors.Is(err, shop.ErrNotRegistered):
+		b.alert(c, l.T("register.first"))
+		return nil
+	case errors.Is(err, shop.ErrOwnOffer):
+		b.alert(c, l.T("take.own"))
+		return nil
+	case errors.Is(err, shop.ErrNotAvailable), errors.Is(err, shop.ErrOfferNotFound):
+		b.alert(c, l.T("take.unavailable"))
+		return nil
+	case errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		b.alert(c, b.limitExceeded(c.Sender, err))
+		return nil
+	case err != nil:
+		b.alert(c, l.T("take.failed"))
+		return fmt.Errorf("failed to take offer %d: %v", offerID, err)
+	}
+
+	b.teleBot.Respond(c, &telebot.CallbackResponse{Text: l.T("take.done")})
+
+	offer, err := b.shop.Offer(offerID)
+	if err != nil {
+		return fmt.Errorf("failed to get offer: %v", err)
+	}
+	msg := shop.TradeStartedMessage(l, trade, offer, b.shop.Seller(*offer))
+	b.reply(c.Sender, msg)
+
 	return nil
 }
 
+// showOffer displays a single marketplace offer with its take button
+func (b *Bot) showOffer(m *telebot.Message, offerID int) {
+	l := b.locale(m.Sender)
+	seller, err := b.shop.MarketplaceOffer(offerID)
+	if err != nil {
+		if !errors.Is(err, shop.ErrNotAvailable) && !errors.Is(err, shop.ErrOfferNotFound) {
+			log.Printf("Failed to fetch offer %d: %v", offerID, err)
+		}
+		b.replyText(m.Sender, l.T("take.unavailable"))
+		b.sendMainMenu(m)
+		return
+	}
+
+	sent, err := b.send(m.Sender, shop.SellerOffersMessage(l, seller))
+	if err != nil {
+		log.Printf("Failed to send offer %d: %v", offerID, err)
+		return
+	}
+	chatID := strconv.FormatInt(sent.Chat.ID, 10)
+	if err := b.shop.TrackSellerCard(shop.FrontendTelegram, chatID, strconv.Itoa(sent.ID), b.userID(m.Sender), seller); err != nil {
+		log.Printf("Failed to track seller card: %v", err)
+	}
+}
+
 // showMarketplace displays all available offers from all users
 func (b *Bot) showMarketplace(m *telebot.Message) error {
-	// Get all offers, limit to 20 most recent
-	offers, err := b.database.GetAllOffers(20)
+	l := b.locale(m.Sender)
+
+	// Get pending offers among the 20 most recent, grouped by seller
+	sellers, err := b.shop.Marketplace(20)
 	if err != nil {
-		b.teleBot.Send(m.Sender, "Failed to fetch marketplace offers")
+		b.replyText(m.Sender, l.T("marketplace.failed"))
 		return fmt.Errorf("failed to fetch marketplace offers: %v", err)
 	}
 
-	if len(offers) == 0 {
-		b.teleBot.Send(m.Sender, "No offers available in the marketplace yet.")
+	external := b.shop.ExternalOrders(10)
+	if len(sellers) == 0 && len(external) == 0 {
+		b.replyText(m.Sender, l.T("marketplace.empty"))
 		return nil
 	}
 
 	// Send marketplace header
-	b.teleBot.Send(m.Sender, "🛒 *Bitcoin Marketplace*\n\nHere are the latest offers from all users:", telebot.ModeMarkdown)
-	
-	// Group offers by seller to avoid spam
-	sellerOffers := make(map[int64][]models.Offer)
-	for _, o := range offers {
-		// Only include pending offers in the marketplace
-		if o.Status == models.StatusPending {
-			sellerOffers[o.UserID] = append(sellerOffers[o.UserID], o)
-		}
-	}
-	
-	// If no pending offers, show a message
-	if len(sellerOffers) == 0 {
-		b.teleBot.Send(m.Sender, "No active offers available in the marketplace right now.")
-		return nil
+	if len(sellers) > 0 {
+		b.replyText(m.Sender, l.T("marketplace.header"))
 	}
-	
+
 	// Send offers grouped by seller
-	for userID, userOffers := range sellerOffers {
-		// Get the first offer to extract username
-		seller := userOffers[0].Username
-		if seller == "" {
-			seller = fmt.Sprintf("User #%d", userID)
-		}
-		
-		// Create a message for this seller's offers
-		var sellerMsg strings.Builder
-		sellerMsg.WriteString(fmt.Sprintf("👤 *Seller: @%s*\n\n", seller))
-		
-		// Add each offer from this seller
-		for _, o := range userOffers {
-			// Format the offer details
-			sellerMsg.WriteString(fmt.Sprintf(
-				"*Offer #%d*\n"+
-				"🔹 Amount: %f BTC\n"+
-				"🔹 Price: $%f\n"+
-				"🔹 Date: %s\n\n",
-				o.ID, o.AmountBTC, o.PriceUSD, o.CreatedAt.Format(time.RFC822)))
-		}
-		
-		// Create contact seller button
-		menu := &telebot.ReplyMarkup{}
-		contactButton := &telebot.InlineButton{
-			Text: fmt.Sprintf("Contact @%s", seller),
-			URL:  fmt.Sprintf("https://t.me/%s", seller),
-		}
-		menu.InlineKeyboard = [][]telebot.InlineButton{{*contactButton}}
-		
-		// Send the message with the contact button
-		b.teleBot.Send(m.Sender, sellerMsg.String(), menu, telebot.ModeMarkdown)
-	}
-	
+	for _, seller := range sellers {
+		sent, err := b.send(m.Sender, shop.SellerOffersMessage(l, seller))
+		if err != nil {
+			log.Printf("Failed to send offers of seller %d: %v", seller.UserID, err)
+			continue
+		}
+		chatID := strconv.FormatInt(sent.Chat.ID, 10)
+		if err := b.shop.TrackSellerCard(shop.FrontendTelegram, chatID, strconv.Itoa(sent.ID), b.userID(m.Sender), seller); err != nil {
+			log.Printf("Failed to track seller card: %v", err)
+		}
+	}
+
+	// Orders from other marketplaces can only be looked at
+	if len(external) > 0 {
+		b.reply(m.Sender, shop.ExternalOrdersMessage(l, external))
+	}
+
 	return nil
 }
 
-// showHelp displays help information
-func (b *Bot) showHelp(m *telebot.Message) {
-	helpText := `*P2P Bitcoin Shop Help*
+// linkAccount issues a link code, or links this Telegram account using a code
+// issued on another frontend
+func (b *Bot) linkAccount(m *telebot.Message) error {
+	l := b.locale(m.Sender)
+	code := strings.TrimSpace(m.Payload)
+	if code == "" {
+		userID, err := b.shop.UserID(shop.FrontendTelegram, strconv.FormatInt(m.Sender.ID, 10))
+		if err != nil {
+			b.replyText(m.Sender, l.T("register.first"))
+			return nil
+		}
+		code, err := b.shop.CreateLinkCode(userID)
+		if err != nil {
+			b.replyText(m.Sender, l.T("link.code_failed"))
+			return fmt.Errorf("failed to create link code: %v", err)
+		}
+		msg := shop.LinkCodeMessage(l, code)
+		b.reply(m.Sender, msg)
+		return nil
+	}
 
-*Available Commands:*
-/start - Register as a user and show main menu
-/sell <amount_btc> <price_usd> - Create a sell offer
-/list - List your offers
-/marketplace - Browse all available offers
-/help - Show this help message
+	_, err := b.shop.Link(identity(m.Sender), strings.ToUpper(code))
+	switch {
+	case errors.Is(err, shop.ErrInvalidLinkCode):
+		b.replyText(m.Sender, l.T("link.invalid"))
+		return nil
+	case errors.Is(err, shop.ErrAlreadyLinked):
+		b.replyText(m.Sender, l.T("link.already"))
+		return nil
+	case errors.Is(err, shop.ErrFrontendLinked):
+		b.replyText(m.Sender, l.T("link.frontend_linked", "Telegram"))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("link.failed"))
+		return fmt.Errorf("failed to link account: %v", err)
+	}
+	return nil
+}
 
-*How to use:*
-1. Register with /start
-2. Create an offer with /sell or use the button
-3. View your offers with /list or use the button
-4. Browse available offers in the marketplace
-5. When you receive payment, confirm it to release funds
+// apiToken issues a new API token, or revokes it with "/apitoken revoke"
+func (b *Bot) apiToken(m *telebot.Message) error {
+	l := b.locale(m.Sender)
+	userID, err := b.shop.UserID(shop.FrontendTelegram, strconv.FormatInt(m.Sender.ID, 10))
+	if err != nil {
+		b.replyText(m.Sender, l.T("register.first"))
+		return nil
+	}
 
-*Offer Status:*
-⏳ Pending - Waiting for payment
-💰 Paid - Payment received but not confirmed
-✅ Completed - Payment confirmed, funds released
-❌ Cancelled - Offer cancelled
+	if strings.TrimSpace(m.Payload) == "revoke" {
+		if err := b.shop.RevokeAPIToken(userID); err != nil {
+			b.replyText(m.Sender, l.T("apitoken.revoke_failed"))
+			return fmt.Errorf("failed to revoke API token: %v", err)
+		}
+		b.replyText(m.Sender, l.T("apitoken.revoked"))
+		return nil
+	}
 
-*Need more help?*
-Contact support at @YourSupportUsername`
+	token, err := b.shop.CreateAPIToken(userID)
+	if err != nil {
+		b.replyText(m.Sender, l.T("apitoken.failed"))
+		return fmt.Errorf("failed to create API token: %v", err)
+	}
+	msg := shop.APITokenMessage(l, token)
+	b.reply(m.Sender, msg)
+	return nil
+}
+
+// chooseLanguage shows the language picker, or sets the language with
+// "/language <code>". "/language auto" follows the Telegram app language.
+func (b *Bot) chooseLanguage(m *telebot.Message) error {
+	lang := strings.ToLower(strings.TrimSpace(m.Payload))
+	if lang != "" {
+		return b.setLanguage(m.Sender, lang, func(text string) { b.replyText(m.Sender, text) })
+	}
+
+	l := b.locale(m.Sender)
+	var actions [][]shop.Action
+	for _, code := range i18n.Languages() {
+		actions = append(actions, []shop.Action{
+			{Command: cbSetLanguage, Label: i18n.Get(code).T("language.name"), Data: code},
+		})
+	}
+	actions = append(actions, []shop.Action{
+		{Command: cbSetLanguage, Label: l.T("language.auto"), Data: "auto"},
+	})
+	b.reply(m.Sender, shop.Message{Text: l.T("language.prompt", l.T("language.name")), Actions: actions})
+	return nil
+}
+
+// setLanguage stores the language chosen by a Telegram user and replies in
+// the new language
+func (b *Bot) setLanguage(u *telebot.User, lang string, reply func(string)) error {
+	l := b.locale(u)
+	userID, err := b.shop.UserID(shop.FrontendTelegram, strconv.FormatInt(u.ID, 10))
+	if err != nil {
+		reply(l.T("register.first"))
+		return nil
+	}
+	if lang == "auto" {
+		lang = ""
+	}
+
+	switch err := b.shop.SetLanguage(userID, lang); {
+	case errors.Is(err, shop.ErrUnsupportedLanguage):
+		reply(l.T("language.unknown", strings.Join(i18n.Languages(), ", ")))
+		return nil
+	case err != nil:
+		reply(l.T("language.failed"))
+		return fmt.Errorf("failed to set language: %v", err)
+	}
+
+	l = b.locale(u)
+	if lang == "" {
+		reply(l.T("language.auto_set"))
+	} else {
+		reply(l.T("language.set", l.T("language.name")))
+	}
+	return nil
+}
+
+// showHelp displays help information
+func (b *Bot) showHelp(m *telebot.Message) {
+	l := b.locale(m.Sender)
+	helpText := l.T("help.text")
+
+	if b.shop.IsAdmin(b.userID(m.Sender)) {
+		helpText += l.T("help.admin")
+	}
+
+	if b.config.SupportUsername != "" {
+		helpText += l.T("help.support", markup.Escape(b.config.SupportUsername))
+	}
 
-	b.teleBot.Send(m.Sender, helpText, telebot.ModeMarkdown)
+	b.replyText(m.Sender, helpText)
 }
 
 // Start starts the bot and registers command handlers
@@ -499,7 +753,7 @@ func (b *Bot) Start() {
 			log.Printf("Error listing offers: %v", err)
 		}
 	})
-	
+
 	b.teleBot.Handle(&telebot.InlineButton{Unique: btnMarketplace}, func(c *telebot.Callback) {
 		b.teleBot.Respond(c, &telebot.CallbackResponse{})
 		if err := b.showMarketplace(&telebot.Message{Sender: c.Sender}); err != nil {
@@ -511,17 +765,93 @@ func (b *Bot) Start() {
 		b.teleBot.Respond(c, &telebot.CallbackResponse{})
 		b.showHelp(&telebot.Message{Sender: c.Sender})
 	})
-	
+
 	// Register handlers for confirm payment and cancel offer callbacks
-	b.teleBot.Handle(telebot.OnCallback, func(c *telebot.Callback) {
-		if strings.HasPrefix(c.Data, cbConfirmPayment) {
-			if err := b.confirmPayment(c); err != nil {
-				log.Printf("Error confirming payment: %v", err)
-			}
-		} else if strings.HasPrefix(c.Data, cbCancelOffer) {
-			if err := b.cancelOffer(c); err != nil {
-				log.Printf("Error cancelling offer: %v", err)
-			}
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbConfirmPayment}, func(c *telebot.Callback) {
+		if err := b.confirmPayment(c); err != nil {
+			log.Printf("Error confirming payment: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbCancelOffer}, func(c *telebot.Callback) {
+		if err := b.cancelOffer(c); err != nil {
+			log.Printf("Error cancelling offer: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbRefreshInvoice}, func(c *telebot.Callback) {
+		if err := b.refreshInvoice(c); err != nil {
+			log.Printf("Error refreshing invoice: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbTakeOffer}, func(c *telebot.Callback) {
+		if err := b.takeOffer(c); err != nil {
+			log.Printf("Error taking offer: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbTradeChat}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.openChat(c.Sender, c.Data); err != nil {
+			log.Printf("Error opening trade chat: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbContact}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.openContact(c.Sender, c.Data); err != nil {
+			log.Printf("Error opening contact: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbPayout}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.payout(c.Sender, c.Data); err != nil {
+			log.Printf("Error requesting payout: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbRefund}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.refund(c.Sender, c.Data); err != nil {
+			log.Printf("Error requesting refund: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbReferralPayout}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.referralPayout(c.Sender); err != nil {
+			log.Printf("Error paying out referral earnings: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbPostBond}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.bond(c.Sender, "post"); err != nil {
+			log.Printf("Error posting bond: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbReleaseBond}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.bond(c.Sender, "release"); err != nil {
+			log.Printf("Error releasing bond: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbClaimBond}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		if err := b.bond(c.Sender, c.Data); err != nil {
+			log.Printf("Error claiming bond: %v", err)
+		}
+	})
+
+	b.teleBot.Handle(&telebot.InlineButton{Unique: cbSetLanguage}, func(c *telebot.Callback) {
+		b.teleBot.Respond(c, &telebot.CallbackResponse{})
+		reply := func(text string) { b.replyText(c.Sender, text) }
+		if err := b.setLanguage(c.Sender, c.Data, reply); err != nil {
+			log.Printf("Error setting language: %v", err)
 		}
 	})
 
@@ -534,24 +864,29 @@ func (b *Bot) Start() {
 
 	b.teleBot.Handle("/sell", func(m *telebot.Message) {
 		args := strings.Fields(m.Text)
-		if len(args) != 3 {
+		if len(args) != 3 && len(args) != 4 {
 			b.showCreateOfferForm(m)
 			return
 		}
 
 		amountBTC, err := strconv.ParseFloat(args[1], 64)
 		if err != nil || amountBTC <= 0 {
-			b.teleBot.Send(m.Sender, "Invalid BTC amount")
+			b.replyText(m.Sender, b.locale(m.Sender).T("sell.invalid_amount"))
 			return
 		}
 
 		priceUSD, err := strconv.ParseFloat(args[2], 64)
 		if err != nil || priceUSD <= 0 {
-			b.teleBot.Send(m.Sender, "Invalid USD price")
+			b.replyText(m.Sender, b.locale(m.Sender).T("sell.invalid_price"))
 			return
 		}
 
-		if err := b.createOffer(m, amountBTC, priceUSD); err != nil {
+		method := models.PaymentLightning
+		if len(args) == 4 {
+			method = models.PaymentMethod(strings.ToLower(args[3]))
+		}
+
+		if err := b.createOffer(m, amountBTC, priceUSD, method); err != nil {
 			log.Printf("Error creating offer: %v", err)
 		}
 	})
@@ -561,25 +896,183 @@ func (b *Bot) Start() {
 			log.Printf("Error listing offers: %v", err)
 		}
 	})
-	
+
 	b.teleBot.Handle("/marketplace", func(m *telebot.Message) {
 		if err := b.showMarketplace(m); err != nil {
 			log.Printf("Error showing marketplace: %v", err)
 		}
 	})
-	
+
+	b.teleBot.Handle("/link", func(m *telebot.Message) {
+		if err := b.linkAccount(m); err != nil {
+			log.Printf("Error linking account: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/apitoken", func(m *telebot.Message) {
+		if err := b.apiToken(m); err != nil {
+			log.Printf("Error issuing API token: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/language", func(m *telebot.Message) {
+		if err := b.chooseLanguage(m); err != nil {
+			log.Printf("Error choosing language: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/chat", func(m *telebot.Message) {
+		if err := b.openChat(m.Sender, m.Payload); err != nil {
+			log.Printf("Error opening trade chat: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/dispute", func(m *telebot.Message) {
+		if err := b.dispute(m.Sender, m.Payload); err != nil {
+			log.Printf("Error opening dispute: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/rate", func(m *telebot.Message) {
+		if err := b.rate(m.Sender, m.Payload); err != nil {
+			log.Printf("Error rating trade: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/contact", func(m *telebot.Message) {
+		if err := b.openContact(m.Sender, m.Payload); err != nil {
+			log.Printf("Error opening contact: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/exit", func(m *telebot.Message) {
+		if err := b.exitChat(m); err != nil {
+			log.Printf("Error leaving chat: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/payout", func(m *telebot.Message) {
+		if err := b.payout(m.Sender, m.Payload); err != nil {
+			log.Printf("Error requesting payout: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/refund", func(m *telebot.Message) {
+		if err := b.refund(m.Sender, m.Payload); err != nil {
+			log.Printf("Error requesting refund: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/lnaddress", func(m *telebot.Message) {
+		if err := b.lightningAddress(m); err != nil {
+			log.Printf("Error setting Lightning address: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/balance", func(m *telebot.Message) {
+		if err := b.balance(m.Sender); err != nil {
+			log.Printf("Error showing balance: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/bond", func(m *telebot.Message) {
+		if err := b.bond(m.Sender, m.Payload); err != nil {
+			log.Printf("Error handling bond: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/limits", func(m *telebot.Message) {
+		if err := b.limits(m.Sender); err != nil {
+			log.Printf("Error showing trade limits: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/referrals", func(m *telebot.Message) {
+		if err := b.referrals(m.Sender); err != nil {
+			log.Printf("Error showing referrals: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/nick", func(m *telebot.Message) {
+		if err := b.nickname(m); err != nil {
+			log.Printf("Error setting nickname: %v", err)
+		}
+	})
+
+	// Register admin command handlers
+	b.teleBot.Handle("/stats", func(m *telebot.Message) {
+		if err := b.showStats(m); err != nil {
+			log.Printf("Error showing stats: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/ban", func(m *telebot.Message) {
+		if err := b.banUser(m); err != nil {
+			log.Printf("Error banning user: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/unban", func(m *telebot.Message) {
+		if err := b.unbanUser(m); err != nil {
+			log.Printf("Error unbanning user: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/forcecancel", func(m *telebot.Message) {
+		if err := b.forceCancel(m); err != nil {
+			log.Printf("Error force cancelling offer: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/resolve", func(m *telebot.Message) {
+		if err := b.resolveDispute(m); err != nil {
+			log.Printf("Error resolving dispute: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/broadcast", func(m *telebot.Message) {
+		if err := b.broadcast(m); err != nil {
+			log.Printf("Error broadcasting: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/lookup", func(m *telebot.Message) {
+		if err := b.lookupInvoice(m); err != nil {
+			log.Printf("Error looking up invoice: %v", err)
+		}
+	})
+
+	b.teleBot.Handle("/audit", func(m *telebot.Message) {
+		if err := b.showAuditLog(m); err != nil {
+			log.Printf("Error showing audit log: %v", err)
+		}
+	})
+
 	b.teleBot.Handle("/help", func(m *telebot.Message) {
 		b.showHelp(m)
 	})
-	
+
 	// Handle unknown commands
 	b.teleBot.Handle(telebot.OnText, func(m *telebot.Message) {
-		// If message doesn't start with a command, show the main menu
-		if !strings.HasPrefix(m.Text, "/") {
+		// Text in a chat goes to its other side, other text that
+		// doesn't start with a command shows the main menu
+		if !strings.HasPrefix(m.Text, "/") && !b.relay(m) {
 			b.sendMainMenu(m)
 		}
 	})
 
+	// Photos, e.g. payment receipts, can only be sent in a chat
+	b.teleBot.Handle(telebot.OnPhoto, func(m *telebot.Message) {
+		if !b.relay(m) {
+			b.replyText(m.Sender, b.locale(m.Sender).T("chat.not_in_chat"))
+		}
+	})
+
 	log.Println("Bot started and ready to accept commands...")
 	b.teleBot.Start()
-} 
\ No newline at end of file
+}
+
+// Stop stops polling for updates
+func (b *Bot) Stop() {
+	b.teleBot.Stop()
+}
@@ -0,0 +1,1482 @@
+package bot_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11/bolt11test"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bot"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bot/telegramtest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay/btcpaytest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/config"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/fees"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl/lnurltest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/ratelimit"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+var (
+	alice = telegramtest.User{ID: 1001, FirstName: "Alice", Username: "alice"}
+	bob   = telegramtest.User{ID: 1002, FirstName: "Bob", Username: "bob"}
+	admin = telegramtest.User{ID: 9001, FirstName: "Admin", Username: "admin"}
+)
+
+// harness runs a bot against fake Telegram and BTCPay servers
+type harness struct {
+	t    *testing.T
+	tg   *telegramtest.Server
+	pay  *btcpaytest.Server
+	shop *shop.Service
+}
+
+// newHarness starts a bot. setup may adjust the configuration and shop
+// before the bot is created.
+func newHarness(t *testing.T, setup ...func(*config.Config, *shop.Service)) *harness {
+	t.Helper()
+	tg := telegramtest.NewServer("test-token")
+	pay := btcpaytest.NewServer("key", "store")
+
+	cfg := &config.Config{
+		TelegramToken:  tg.Token,
+		TelegramAPIURL: tg.URL(),
+	}
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	svc := shop.NewService(database, pay.Client())
+	svc.SetAdmins([]int64{admin.ID})
+	for _, f := range setup {
+		f(cfg, svc)
+	}
+	b, err := bot.NewBot(cfg, svc)
+	if err != nil {
+		t.Fatalf("NewBot: %v", err)
+	}
+	svc.AddFrontend(b)
+	if cfg.MarketplaceChannelID != "" {
+		svc.AddPublisher(b)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.Start()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		b.Stop()
+		<-done
+		svc.WaitPublished()
+		database.Close()
+		tg.Close()
+		pay.Close()
+	})
+
+	return &harness{t: t, tg: tg, pay: pay, shop: svc}
+}
+
+// send delivers text from user and returns the next n bot messages to them
+func (h *harness) send(u telegramtest.User, text string, n int) []*telegramtest.Message {
+	h.t.Helper()
+	h.tg.SendText(u, text)
+	return h.expect(u, n)
+}
+
+// expect returns the next n bot messages sent to user
+func (h *harness) expect(u telegramtest.User, n int) []*telegramtest.Message {
+	h.t.Helper()
+	msgs, err := h.tg.WaitMessages(u.ID, n)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return msgs
+}
+
+// press taps a button and returns the callback answer
+func (h *harness) press(u telegramtest.User, msg *telegramtest.Message, button string) telegramtest.CallbackAnswer {
+	h.t.Helper()
+	id, err := h.tg.Press(u, msg, button)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	answer, err := h.tg.WaitAnswer(id)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return answer
+}
+
+// register runs /start for each user
+// register starts the bot for users, who take their username as nickname
+func (h *harness) register(users ...telegramtest.User) {
+	h.t.Helper()
+	for _, u := range users {
+		h.send(u, "/start", 2)
+		h.shop.SetNickname(u.ID, u.Username)
+	}
+}
+
+// sell creates an offer and returns the created invoice ID
+func (h *harness) sell(u telegramtest.User, args string) string {
+	h.t.Helper()
+	h.send(u, "/sell "+args, 2) // QR code and offer
+	invoices := h.pay.Invoices()
+	return invoices[len(invoices)-1].ID
+}
+
+func assertButtons(t *testing.T, msg *telegramtest.Message, want ...string) {
+	t.Helper()
+	if got := msg.Buttons(); !reflect.DeepEqual(got, want) {
+		t.Errorf("buttons = %q, want %q", got, want)
+	}
+}
+
+// assertQRCode checks that msg is a photo of a QR code uploaded by the bot
+func assertQRCode(t *testing.T, h *harness, msg *telegramtest.Message) {
+	t.Helper()
+	data, ok := h.tg.File(msg.Photo)
+	if !ok {
+		t.Fatalf("message %q is not an uploaded photo: %+v", msg.Text, msg)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("QR code is not a PNG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != size.Y || size.X < 256 {
+		t.Errorf("QR code size = %v", size)
+	}
+}
+
+func TestStart(t *testing.T) {
+	h := newHarness(t)
+
+	msgs := h.send(alice, "/start", 2)
+	if msgs[0].Text != "Successfully registered!" {
+		t.Errorf("first message = %q", msgs[0].Text)
+	}
+	if msgs[1].Text != "Welcome to P2P Bitcoin Shop! Choose an option:" {
+		t.Errorf("menu message = %q", msgs[1].Text)
+	}
+	assertButtons(t, msgs[1], "🔄 Create Offer", "📋 My Offers", "🛒 Marketplace", "❓ Help")
+}
+
+func TestPlainTextShowsMenu(t *testing.T) {
+	h := newHarness(t)
+
+	msgs := h.send(alice, "hello", 1)
+	assertButtons(t, msgs[0], "🔄 Create Offer", "📋 My Offers", "🛒 Marketplace", "❓ Help")
+
+	// Only the latest menu keeps its buttons
+	h.send(alice, "hello again", 1)
+	old, err := h.tg.WaitEdit(alice.ID, msgs[0].ID, func(m telegramtest.Message) bool { return len(m.Keyboard) == 0 })
+	if err != nil || old.Text != msgs[0].Text {
+		t.Errorf("replaced menu = %q with buttons %q", old.Text, old.Buttons())
+	}
+}
+
+func TestMenuButtons(t *testing.T) {
+	h := newHarness(t)
+	menu := h.send(alice, "/start", 2)[1]
+
+	tests := []struct {
+		button string
+		prefix string
+	}{
+		{"🔄 Create Offer", "To create a new offer"},
+		{"📋 My Offers", "No offers found."},
+		{"🛒 Marketplace", "No offers available in the marketplace yet."},
+		{"❓ Help", "P2P Bitcoin Shop Help"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.button, func(t *testing.T) {
+			h.press(alice, menu, tt.button)
+			msg := h.expect(alice, 1)[0]
+			if !strings.HasPrefix(msg.Text, tt.prefix) {
+				t.Errorf("reply = %q, want prefix %q", msg.Text, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestSellValidation(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice)
+
+	tests := []struct {
+		user telegramtest.User
+		text string
+		want string
+	}{
+		{alice, "/sell", "To create a new offer"},
+		{alice, "/sell 0.01", "To create a new offer"},
+		{alice, "/sell abc 500", "Invalid BTC amount"},
+		{alice, "/sell 0 500", "Invalid BTC amount"},
+		{alice, "/sell 0.01 -1", "Invalid USD price"},
+		{bob, "/sell 0.01 500", "Please register first with /start"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			msg := h.send(tt.user, tt.text, 1)[0]
+			if !strings.HasPrefix(msg.Text, tt.want) {
+				t.Errorf("reply = %q, want prefix %q", msg.Text, tt.want)
+			}
+		})
+	}
+	if n := len(h.pay.Invoices()); n != 0 {
+		t.Errorf("created %d invoices, want 0", n)
+	}
+}
+
+func TestSellCreatesInvoice(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice)
+
+	msgs := h.send(alice, "/sell 0.01 500", 2)
+	invoices := h.pay.Invoices()
+	if len(invoices) != 1 || invoices[0].Amount != "0.01" {
+		t.Fatalf("invoices = %+v, want one for 0.01 BTC", invoices)
+	}
+
+	// The Lightning invoice comes as a QR code and as copyable text
+	qr, msg := msgs[0], msgs[1]
+	assertQRCode(t, h, qr)
+	want := "✅ Offer created!\n\n🔹 Amount: 0.01 BTC\n🔹 Price: $500.00\n\n⚡ Lightning invoice to pay from your wallet:\n" + invoices[0].PaymentRequest + "\n"
+	if msg.Text != want {
+		t.Errorf("reply = %q, want %q", msg.Text, want)
+	}
+	if !strings.Contains(msg.Raw, "`"+invoices[0].PaymentRequest+"`") {
+		t.Errorf("invoice not sent as code: %q", msg.Raw)
+	}
+	assertButtons(t, msg, "View Invoice")
+	if url := msg.Button("View Invoice").URL; url != h.pay.URL()+"/i/"+invoices[0].ID {
+		t.Errorf("invoice URL = %q", url)
+	}
+}
+
+func TestSellOnChain(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice)
+
+	msgs := h.send(alice, "/sell 0.5 20000 paypal", 1)
+	if msgs[0].Text != "Invalid payment method. Use lightning, onchain or both." {
+		t.Errorf("reply = %q", msgs[0].Text)
+	}
+
+	msgs = h.send(alice, "/sell 0.5 20000 onchain", 2)
+	invoices := h.pay.Invoices()
+	if len(invoices) != 1 || invoices[0].Address == "" || invoices[0].PaymentRequest != "" {
+		t.Fatalf("invoices = %+v, want one payable on-chain", invoices)
+	}
+	assertQRCode(t, h, msgs[0])
+	if want := "\n⛓ Bitcoin address to pay 0.5 BTC on-chain:\n" + invoices[0].Address + "\n"; !strings.HasSuffix(msgs[1].Text, want) {
+		t.Errorf("reply = %q, want suffix %q", msgs[1].Text, want)
+	}
+
+	// The card shows the confirmations of the payment
+	h.pay.PayOnChain(invoices[0].ID, 0)
+	msgs = h.send(alice, "/list", 3)
+	if want := "\n⛓ On-chain payment received: 0/1 confirmations\n"; !strings.HasSuffix(msgs[2].Text, want) {
+		t.Errorf("card = %q, want suffix %q", msgs[2].Text, want)
+	}
+	h.pay.PayOnChain(invoices[0].ID, 1)
+	msgs = h.send(alice, "/list", 2)
+	if !strings.Contains(msgs[1].Text, "💰 paid") {
+		t.Errorf("card = %q, want paid", msgs[1].Text)
+	}
+}
+
+func TestListOffers(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+
+	msgs := h.send(alice, "/list", 3)
+	if msgs[0].Text != "📋 Your offers:" || msgs[0].ParseMode != "MarkdownV2" {
+		t.Errorf("header = %q (%s)", msgs[0].Text, msgs[0].ParseMode)
+	}
+	// Pending offers come with the QR code of their invoice
+	assertQRCode(t, h, msgs[1])
+	inv, _ := h.pay.Invoice(invoiceID)
+	if !strings.HasPrefix(msgs[2].Text, "Offer #1\n🔹 Amount: 0.01 BTC\n🔹 Price: $500.00\n") ||
+		!strings.HasSuffix(msgs[2].Text, "🔹 Status: ⏳ pending\n\n⚡ Lightning invoice to pay from your wallet:\n"+inv.PaymentRequest+"\n") {
+		t.Errorf("pending card = %q", msgs[2].Text)
+	}
+	assertButtons(t, msgs[2], "View Invoice", "❌ Cancel Offer", "🔄 Refresh Invoice")
+
+	// Settling the invoice is picked up on the next listing
+	if err := h.pay.MarkSettled(invoiceID); err != nil {
+		t.Fatal(err)
+	}
+	first := msgs[2].ID
+	msgs = h.send(alice, "/list", 2)
+	if !strings.HasSuffix(msgs[1].Text, "🔹 Status: 💰 paid\n") {
+		t.Errorf("paid card = %q", msgs[1].Text)
+	}
+	assertButtons(t, msgs[1], "View Invoice", "✅ Confirm Payment Received")
+
+	// The card of the first listing is updated as well
+	card, _ := h.tg.Message(alice.ID, first)
+	if !strings.HasSuffix(card.Text, "🔹 Status: 💰 paid\n") {
+		t.Errorf("first card = %q", card.Text)
+	}
+	assertButtons(t, &card, "View Invoice", "✅ Confirm Payment Received")
+}
+
+func TestPaymentUpdatesCard(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+	card := h.send(alice, "/list", 3)[2]
+
+	event := &btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: invoiceID}
+	if err := h.shop.HandleInvoiceEvent(event); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	updated, _ := h.tg.Message(alice.ID, card.ID)
+	if !strings.HasSuffix(updated.Text, "🔹 Status: 💰 paid\n") || updated.Edits != 1 {
+		t.Errorf("card after payment = %q (%d edits)", updated.Text, updated.Edits)
+	}
+	assertButtons(t, &updated, "View Invoice", "✅ Confirm Payment Received")
+}
+
+func TestConfirmPayment(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+	h.pay.MarkSettled(invoiceID)
+	card := h.send(alice, "/list", 2)[1]
+
+	answer := h.press(bob, card, "✅ Confirm Payment Received")
+	if !answer.ShowAlert || answer.Text != "You are not authorized to confirm this payment" {
+		t.Errorf("answer to other user = %+v", answer)
+	}
+
+	stale := *card
+	answer = h.press(alice, card, "✅ Confirm Payment Received")
+	if answer.Text != "Payment confirmed! Funds have been released." {
+		t.Errorf("answer = %+v", answer)
+	}
+
+	// The card is edited in place instead of sending a new message
+	if updated, _ := h.tg.Message(alice.ID, card.ID); !strings.HasSuffix(updated.Text, "🔹 Status: ✅ completed\n") {
+		t.Errorf("completed card = %q", updated.Text)
+	} else {
+		assertButtons(t, &updated, "View Invoice")
+	}
+	if msgs := h.tg.Messages(alice.ID); len(msgs) != 7 {
+		t.Errorf("sent %d messages, want 7", len(msgs))
+	}
+
+	answer = h.press(alice, &stale, "✅ Confirm Payment Received")
+	if !answer.ShowAlert || answer.Text != "This offer is not in the paid status" {
+		t.Errorf("answer to repeated confirmation = %+v", answer)
+	}
+
+	// Completed offers are no longer listed
+	if msgs := h.send(alice, "/list", 1); msgs[0].Text != "📋 Your offers:" {
+		t.Errorf("header = %q", msgs[0].Text)
+	}
+}
+
+func TestCancelOffer(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	h.sell(alice, "0.01 500")
+	card := h.send(alice, "/list", 3)[2]
+
+	answer := h.press(bob, card, "❌ Cancel Offer")
+	if !answer.ShowAlert || answer.Text != "You are not authorized to cancel this offer" {
+		t.Errorf("answer to other user = %+v", answer)
+	}
+
+	stale := *card
+	answer = h.press(alice, card, "❌ Cancel Offer")
+	if answer.Text != "Offer cancelled successfully." {
+		t.Errorf("answer = %+v", answer)
+	}
+	if updated, _ := h.tg.Message(alice.ID, card.ID); !strings.HasSuffix(updated.Text, "🔹 Status: ❌ cancelled\n") {
+		t.Errorf("cancelled card = %q", updated.Text)
+	} else {
+		assertButtons(t, &updated, "View Invoice")
+	}
+
+	answer = h.press(alice, &stale, "❌ Cancel Offer")
+	if !answer.ShowAlert || answer.Text != "Only pending offers, and paid offers nobody took, can be cancelled" {
+		t.Errorf("answer to repeated cancel = %+v", answer)
+	}
+}
+
+func TestRefreshInvoice(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	first := h.sell(alice, "0.01 500")
+	card := h.send(alice, "/list", 3)[2]
+
+	answer := h.press(bob, card, "🔄 Refresh Invoice")
+	if !answer.ShowAlert || answer.Text != "You are not authorized to refresh the invoice of this offer" {
+		t.Errorf("answer to other user = %+v", answer)
+	}
+
+	stale := *card
+	answer = h.press(alice, card, "🔄 Refresh Invoice")
+	if answer.Text != "New invoice created." {
+		t.Errorf("answer = %+v", answer)
+	}
+	msgs, err := h.tg.WaitMessages(alice.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new invoice comes with its QR code
+	assertQRCode(t, h, msgs[0])
+	invoices := h.pay.Invoices()
+	second := invoices[len(invoices)-1]
+	if second.ID == first || !strings.HasPrefix(msgs[1].Text, "🔄 New invoice for Offer #1\n") || !strings.Contains(msgs[1].Text, second.PaymentRequest) {
+		t.Errorf("refreshed invoice = %q", msgs[1].Text)
+	}
+	if old, _ := h.pay.Invoice(first); old.Status != btcpaytest.StatusInvalid {
+		t.Errorf("replaced invoice = %s, want Invalid", old.Status)
+	}
+	if updated, _ := h.tg.Message(alice.ID, card.ID); !strings.Contains(updated.Text, second.PaymentRequest) {
+		t.Errorf("updated card = %q", updated.Text)
+	}
+
+	h.pay.MarkSettled(second.ID)
+	h.send(alice, "/list", 2)
+	answer = h.press(alice, &stale, "🔄 Refresh Invoice")
+	if !answer.ShowAlert || answer.Text != "Only unpaid pending or expired offers can get a new invoice" {
+		t.Errorf("answer for paid offer = %+v", answer)
+	}
+}
+
+func TestMarketplace(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+
+	if msg := h.send(bob, "/marketplace", 1)[0]; msg.Text != "No offers available in the marketplace yet." {
+		t.Errorf("empty marketplace = %q", msg.Text)
+	}
+
+	h.sell(alice, "0.01 500")
+	h.pay.MarkSettled(h.sell(alice, "0.02 900"))
+	h.send(alice, "/list", 3) // detect the paid offer
+
+	msgs := h.send(bob, "/marketplace", 2)
+	if !strings.HasPrefix(msgs[0].Text, "🛒 Bitcoin Marketplace") {
+		t.Errorf("header = %q", msgs[0].Text)
+	}
+	card := msgs[1]
+	if !strings.HasPrefix(card.Text, "👤 Seller: alice\n\nOffer #1\n🔹 Amount: 0.01 BTC\n") {
+		t.Errorf("seller card = %q", card.Text)
+	}
+	if strings.Contains(card.Text, "Offer #2") {
+		t.Errorf("paid offer listed in marketplace: %q", card.Text)
+	}
+	assertButtons(t, card, "💬 Contact alice", "🤝 Take Offer #1")
+	if button := card.Button("💬 Contact alice"); button.URL != "" {
+		t.Errorf("contact URL = %q, want a callback", button.URL)
+	}
+}
+
+// orderSource is a fixed source of external orders
+type orderSource []shop.ExternalOrder
+
+func (s orderSource) ExternalOrders() []shop.ExternalOrder { return s }
+
+func TestMarketplaceExternalOrders(t *testing.T) {
+	h := newHarness(t, func(_ *config.Config, svc *shop.Service) {
+		svc.AddOrderSource(orderSource{
+			{ID: "a", Type: "sell", AmountBTC: 0.05, FiatAmount: 2500, Currency: "EUR", Platform: "mostro", CreatedAt: time.Now()},
+			{ID: "b", Type: "buy", FiatAmount: 100, Currency: "USD", Platform: "*bold*", CreatedAt: time.Now().Add(-time.Hour)},
+		})
+	})
+	h.register(bob)
+
+	msg := h.send(bob, "/marketplace", 1)[0]
+	want := "🌐 Orders from other marketplaces\nRead-only: contact the author on their platform.\n\n" +
+		"🔸 Selling 0.05 BTC for 2,500.00 EUR on mostro\n🔹 Buying bitcoin for 100.00 USD on *bold*\n"
+	if msg.Text != want {
+		t.Errorf("external orders = %q, want %q", msg.Text, want)
+	}
+	assertButtons(t, msg)
+}
+
+func TestMarketplaceChannel(t *testing.T) {
+	const channelID = -1001234567890
+	h := newHarness(t, func(cfg *config.Config, _ *shop.Service) {
+		cfg.MarketplaceChannelID = strconv.Itoa(channelID)
+	})
+	h.register(alice, bob)
+	h.sell(alice, "0.01 500")
+
+	posts, err := h.tg.WaitMessages(channelID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := posts[0]
+	if !strings.HasPrefix(post.Text, "👤 Seller: alice\n\nOffer #1\n🔹 Amount: 0.01 BTC\n🔹 Price: $500.00\n") {
+		t.Errorf("post = %q", post.Text)
+	}
+	if button := post.Button("🤝 Take offer"); button == nil || button.URL != "https://t.me/shop_bot?start=offer_1" {
+		t.Errorf("take button = %+v", button)
+	}
+
+	// The link opens the offer in the bot
+	card := h.send(bob, "/start offer_1", 1)[0]
+	if !strings.HasPrefix(card.Text, "👤 Seller: alice\n\nOffer #1\n") {
+		t.Errorf("linked offer = %q", card.Text)
+	}
+	assertButtons(t, card, "💬 Contact alice", "🤝 Take Offer #1")
+
+	// Taken offers stay posted without their link
+	h.press(bob, card, "🤝 Take Offer #1")
+	h.expect(bob, 1)
+	h.expect(alice, 1)
+	h.shop.WaitPublished()
+	updated, _ := h.tg.Message(channelID, post.ID)
+	if !strings.HasSuffix(updated.Text, "\n🔒 No longer available") || updated.Deleted {
+		t.Errorf("taken post = %q (deleted: %v)", updated.Text, updated.Deleted)
+	}
+	assertButtons(t, &updated)
+	if msgs := h.send(bob, "/start offer_1", 2); msgs[0].Text != "This offer is no longer available" {
+		t.Errorf("link to taken offer = %q", msgs[0].Text)
+	}
+
+	// Posts of cancelled and expired offers are deleted
+	h.sell(alice, "0.02 900")
+	invoiceID := h.sell(alice, "0.03 1300")
+	posts, err = h.tg.WaitMessages(channelID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.shop.CancelOffer(alice.ID, 2); err != nil {
+		t.Fatalf("CancelOffer: %v", err)
+	}
+	event := &btcpay.WebhookEvent{Type: btcpay.EventInvoiceExpired, InvoiceID: invoiceID}
+	if err := h.shop.HandleInvoiceEvent(event); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	h.shop.WaitPublished()
+	for _, p := range posts {
+		if msg, _ := h.tg.Message(channelID, p.ID); !msg.Deleted {
+			t.Errorf("post %q was not deleted", msg.Text)
+		}
+	}
+	if offer, _ := h.shop.Offer(3); offer.Status != models.StatusExpired {
+		t.Errorf("offer status = %q, want expired", offer.Status)
+	}
+}
+
+func TestNicknames(t *testing.T) {
+	h := newHarness(t)
+	carol := telegramtest.User{ID: 1003, FirstName: "Carol"}
+	h.send(carol, "/start", 2)
+
+	// Users without a username are known by a generated nickname
+	msg := h.send(carol, "/nick", 1)[0]
+	if !strings.HasPrefix(msg.Text, "Your nickname is trader_") {
+		t.Errorf("nickname = %q", msg.Text)
+	}
+	if msg := h.send(carol, "/nick x", 1)[0]; !strings.HasPrefix(msg.Text, "Nicknames are 3 to 20") {
+		t.Errorf("invalid nickname = %q", msg.Text)
+	}
+	if msg := h.send(carol, "/nick carol_1", 1)[0]; msg.Text != "Your nickname is now carol_1" {
+		t.Errorf("nickname set = %q", msg.Text)
+	}
+	h.register(bob)
+	if msg := h.send(bob, "/nick Carol_1", 1)[0]; msg.Text != "The nickname Carol_1 is already taken" {
+		t.Errorf("taken nickname = %q", msg.Text)
+	}
+
+	h.sell(carol, "0.01 500")
+	card := h.send(bob, "/marketplace", 2)[1]
+	if !strings.HasPrefix(card.Raw, `👤 *Seller: carol\_1*`) {
+		t.Errorf("seller card markup = %q", card.Raw)
+	}
+	assertButtons(t, card, "💬 Contact carol_1", "🤝 Take Offer #1")
+
+	// Usernames are picked up as soon as they are set
+	carol.Username = "carol"
+	h.send(carol, "/nick", 1)
+	if u, _ := h.shop.User(carol.ID); u.Username != "carol" {
+		t.Errorf("username = %q, want carol", u.Username)
+	}
+}
+
+func TestContactSeller(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	h.sell(alice, "0.01 500")
+
+	if msg := h.send(bob, "/contact nobody", 1)[0]; msg.Text != "No user is called nobody" {
+		t.Errorf("unknown contact = %q", msg.Text)
+	}
+	card := h.send(bob, "/marketplace", 2)[1]
+	h.press(bob, card, "💬 Contact alice")
+	if opened := h.expect(bob, 1)[0]; !strings.HasPrefix(opened.Text, "💬 Chat with alice") {
+		t.Errorf("contact opened = %q", opened.Text)
+	}
+
+	h.send(bob, "Can you do $490?", 0)
+	msg := h.expect(alice, 1)[0]
+	if msg.Text != "💬 bob:\n\nCan you do $490?" {
+		t.Errorf("relayed message = %q", msg.Text)
+	}
+	h.press(alice, msg, "💬 Reply")
+	h.expect(alice, 1)
+	h.send(alice, "Sorry, no", 0)
+	if msg := h.expect(bob, 1)[0]; msg.Text != "💬 alice:\n\nSorry, no" {
+		t.Errorf("reply = %q", msg.Text)
+	}
+
+	msgs := h.send(bob, "/exit", 2)
+	if msgs[0].Text != "You left the chat with alice." {
+		t.Errorf("exit = %q", msgs[0].Text)
+	}
+}
+
+func TestLongMessagesAreSplit(t *testing.T) {
+	h := newHarness(t)
+	h.register(admin)
+
+	text := strings.Repeat("All systems go. ", 200) + "\n" + strings.Repeat(" (_maintenance_)", 200)
+	msgs := h.send(admin, "/broadcast "+text, 3)
+	if got := msgs[0].Text + "\n" + msgs[1].Text; got != "📢 Announcement\n\n"+strings.TrimSpace(text) {
+		t.Errorf("announcement parts = %q, %q", msgs[0].Text, msgs[1].Text)
+	}
+	if msgs[2].Text != "Broadcast sent to 1 user." {
+		t.Errorf("confirmation = %q", msgs[2].Text)
+	}
+}
+
+func TestTakeOffer(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	h.sell(alice, "0.01 500")
+
+	card := h.send(bob, "/marketplace", 2)[1]
+
+	answer := h.press(alice, card, "🤝 Take Offer #1")
+	if !answer.ShowAlert || answer.Text != "You cannot take your own offer" {
+		t.Errorf("answer to seller = %+v", answer)
+	}
+	stale := *card
+
+	if answer := h.press(bob, card, "🤝 Take Offer #1"); answer.Text != "Offer taken!" {
+		t.Errorf("answer = %+v", answer)
+	}
+	started := h.expect(bob, 1)[0]
+	if !strings.HasPrefix(started.Text, "🤝 Trade #1 started\n\nYou are buying 0.01 BTC for $500.00 from alice (Offer #1).") {
+		t.Errorf("trade started = %q", started.Text)
+	}
+	assertButtons(t, started, "💬 Chat")
+	if taken := h.expect(alice, 1)[0]; !strings.HasPrefix(taken.Text, "🤝 Offer #1 taken\n\nbob wants to buy") {
+		t.Errorf("seller notification = %q", taken.Text)
+	}
+
+	// The marketplace card no longer offers the taken offer
+	if updated, _ := h.tg.Message(bob.ID, card.ID); updated.Text != card.Text {
+		t.Errorf("marketplace card = %q", updated.Text)
+	} else {
+		assertButtons(t, &updated, "💬 Contact alice")
+	}
+
+	answer = h.press(bob, &stale, "🤝 Take Offer #1")
+	if !answer.ShowAlert || answer.Text != "This offer is no longer available" {
+		t.Errorf("answer to repeated take = %+v", answer)
+	}
+	if msg := h.send(bob, "/marketplace", 1)[0]; msg.Text != "No offers available in the marketplace yet." {
+		t.Errorf("taken offer still listed: %q", msg.Text)
+	}
+
+	card = h.send(alice, "/list", 3)[2]
+	h.press(alice, card, "❌ Cancel Offer")
+	if msg := h.expect(bob, 1)[0]; msg.Text != "❌ Trade #1 cancelled\n\nThe seller cancelled Offer #1." {
+		t.Errorf("buyer notification = %q", msg.Text)
+	}
+}
+
+func TestTradeChat(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob)
+	h.sell(alice, "0.01 500")
+
+	card := h.send(bob, "/marketplace", 2)[1]
+	h.press(bob, card, "🤝 Take Offer #1")
+	started := h.expect(bob, 1)[0]
+	taken := h.expect(alice, 1)[0]
+	assertButtons(t, taken, "💬 Chat")
+
+	// Outside a chat, text shows the menu and photos are refused
+	if msg := h.send(bob, "hello", 1)[0]; msg.Text != "Welcome to P2P Bitcoin Shop! Choose an option:" {
+		t.Errorf("text outside chat = %q", msg.Text)
+	}
+	h.tg.SendPhoto(bob, "receipt-0", "")
+	if msg := h.expect(bob, 1)[0]; msg.Text != "You are not in a chat." {
+		t.Errorf("photo outside chat = %q", msg.Text)
+	}
+
+	h.press(bob, started, "💬 Chat")
+	if msg := h.expect(bob, 1)[0]; !strings.HasPrefix(msg.Text, "💬 Trade #1 chat\n\nYou are now chatting with the seller.") {
+		t.Errorf("chat opened = %q", msg.Text)
+	}
+	h.tg.SendText(bob, "I sent the payment")
+	relayed := h.expect(alice, 1)[0]
+	if relayed.Text != "💬 Trade #1 · Buyer:\n\nI sent the payment" {
+		t.Errorf("relayed message = %q", relayed.Text)
+	}
+	assertButtons(t, relayed, "💬 Reply")
+
+	if msg := h.send(alice, "/chat", 1)[0]; msg.Text != "Please specify the trade number, e.g. /chat 3" {
+		t.Errorf("/chat without trade = %q", msg.Text)
+	}
+	if msg := h.send(alice, "/chat 2", 1)[0]; msg.Text != "Trade #2 not found among your trades" {
+		t.Errorf("/chat of unknown trade = %q", msg.Text)
+	}
+	h.press(alice, relayed, "💬 Reply")
+	if msg := h.expect(alice, 1)[0]; !strings.HasPrefix(msg.Text, "💬 Trade #1 chat\n\nYou are now chatting with the buyer.") {
+		t.Errorf("chat opened = %q", msg.Text)
+	}
+	h.tg.SendText(alice, "Thanks *bob*, got it")
+	if msg := h.expect(bob, 1)[0]; msg.Text != "💬 Trade #1 · Seller:\n\nThanks *bob*, got it" || strings.Contains(msg.Raw, "alice") {
+		t.Errorf("relayed reply = %q (raw %q)", msg.Text, msg.Raw)
+	}
+
+	// Photos such as payment receipts are relayed with their caption
+	h.tg.SendPhoto(bob, "receipt-1", "Receipt")
+	if msg := h.expect(alice, 1)[0]; msg.Photo != "receipt-1" || msg.Text != "💬 Trade #1 · Buyer:\n\nReceipt" {
+		t.Errorf("relayed photo = %+v", msg)
+	}
+
+	// The chat is kept as evidence for the participants and admins
+	messages, err := h.shop.TradeMessages(admin.ID, 1)
+	if err != nil {
+		t.Fatalf("TradeMessages: %v", err)
+	}
+	var got []string
+	for _, m := range messages {
+		got = append(got, fmt.Sprintf("%d:%s:%s", m.SenderID, m.Text, m.PhotoID))
+	}
+	want := []string{"1002:I sent the payment:", "1001:Thanks *bob*, got it:", "1002:Receipt:receipt-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trade messages = %q, want %q", got, want)
+	}
+	if _, err := h.shop.TradeMessages(admin.ID+1, 1); !errors.Is(err, shop.ErrNotParticipant) {
+		t.Errorf("TradeMessages of outsider: %v", err)
+	}
+
+	msgs := h.send(bob, "/exit", 2)
+	if msgs[0].Text != "You left the chat of Trade #1." {
+		t.Errorf("/exit = %q", msgs[0].Text)
+	}
+	if msg := h.send(bob, "/exit", 1)[0]; msg.Text != "You are not in a chat." {
+		t.Errorf("second /exit = %q", msg.Text)
+	}
+
+	// Closing the trade ends its chat
+	card = h.send(alice, "/list", 3)[2]
+	h.press(alice, card, "❌ Cancel Offer")
+	h.expect(bob, 1)
+	if msg := h.send(alice, "still there?", 1)[0]; msg.Text != "This trade is closed, so its chat has ended." {
+		t.Errorf("message after close = %q", msg.Text)
+	}
+	if msg := h.send(alice, "hello", 1)[0]; msg.Text != "Welcome to P2P Bitcoin Shop! Choose an option:" {
+		t.Errorf("text after chat ended = %q", msg.Text)
+	}
+}
+
+func TestPayout(t *testing.T) {
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	h := newHarness(t, func(_ *config.Config, svc *shop.Service) { svc.SetLNURLClient(ln.Client()) })
+	h.register(alice, bob)
+	address := ln.Add("bob", lnurltest.Recipient{})
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+
+	if msg := h.send(bob, "/payout", 1)[0]; msg.Text != "You have no payouts yet." {
+		t.Errorf("empty payouts = %q", msg.Text)
+	}
+	if msg := h.send(alice, "/payout 1 "+address, 1)[0]; msg.Text != "Only the buyer of Trade #1 receives its bitcoin" {
+		t.Errorf("seller payout = %q", msg.Text)
+	}
+
+	h.pay.MarkSettled(invoiceID)
+	card := h.send(alice, "/list", 2)[1]
+	h.press(alice, card, "✅ Confirm Payment Received")
+	completed := h.expect(bob, 1)[0]
+	if !strings.Contains(completed.Text, "Tell the shop where to send your bitcoin") {
+		t.Errorf("trade completed = %q", completed.Text)
+	}
+	assertButtons(t, completed, "⚡ Receive bitcoin")
+	h.press(bob, completed, "⚡ Receive bitcoin")
+	if msg := h.expect(bob, 1)[0]; !strings.HasPrefix(msg.Text, "Send /payout 1 <destination>") {
+		t.Errorf("payout usage = %q", msg.Text)
+	}
+
+	if msg := h.send(bob, "/payout 1 nowhere", 1)[0]; msg.Text != "That is not a Lightning address, LNURL or Lightning invoice the shop can pay" {
+		t.Errorf("invalid destination = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/payout 1 "+ln.Address("carol"), 1)[0]; msg.Text != "That Lightning address or LNURL could not be reached. Check it and try again." {
+		t.Errorf("unknown Lightning address = %q", msg.Text)
+	}
+	signer := bolt11test.NewSigner()
+	if msg := h.send(bob, "/payout 1 "+signer.Sign(bolt11test.Invoice{AmountMsat: 1_000}), 1)[0]; !strings.HasPrefix(msg.Text, "That invoice is not for the amount of Trade #1.") {
+		t.Errorf("wrong invoice amount = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/payout 1 "+signer.Sign(bolt11test.Invoice{Network: bolt11.Regtest, AmountMsat: 1_000_000_000}), 1)[0]; msg.Text != "That invoice is for another Bitcoin network. The shop pays out on mainnet." {
+		t.Errorf("wrong invoice network = %q", msg.Text)
+	}
+	msg := h.send(bob, "/payout 1 "+address, 1)[0]
+	if !strings.HasPrefix(msg.Text, "⚡ Payout of Trade #1\n\n🔹 Amount: 0.01 BTC\n🔹 To: "+address+"\n🔹 Status: ⚡ In progress") {
+		t.Errorf("payout = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/payout 1 "+address, 1)[0]; msg.Text != "The bitcoin of Trade #1 is already being sent" {
+		t.Errorf("repeated payout = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/payout", 1)[0]; !strings.Contains(msg.Text, "Trade #1: 0.01 BTC") {
+		t.Errorf("payouts = %q", msg.Text)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	h := newHarness(t, func(_ *config.Config, svc *shop.Service) { svc.SetLNURLClient(ln.Client()) })
+	h.register(alice, bob, admin)
+	address := ln.Add("alice", lnurltest.Recipient{})
+	invoiceID := h.sell(alice, "0.01 500")
+	h.pay.MarkSettled(invoiceID)
+	h.send(alice, "/list", 2)
+
+	if msg := h.send(alice, "/refund", 1)[0]; msg.Text != "You have no refunds." {
+		t.Errorf("empty refunds = %q", msg.Text)
+	}
+	h.send(admin, "/forcecancel 1", 1)
+	msgs := h.expect(alice, 2)
+	request := msgs[1]
+	if !strings.HasPrefix(request.Text, "↩️ Refund of Offer #1\n\nThe offer was cancelled after you paid its invoice, so the 0.01 BTC you paid are returned to you.") {
+		t.Errorf("refund request = %q", request.Text)
+	}
+	assertButtons(t, request, "↩️ Get refund")
+	h.press(alice, request, "↩️ Get refund")
+	if msg := h.expect(alice, 1)[0]; !strings.HasPrefix(msg.Text, "Send /refund 1 <destination>") {
+		t.Errorf("refund usage = %q", msg.Text)
+	}
+
+	if msg := h.send(bob, "/refund 1 "+address, 1)[0]; msg.Text != "Offer #1 has no refund for you" {
+		t.Errorf("refund by another user = %q", msg.Text)
+	}
+	msg := h.send(alice, "/refund 1 "+address, 1)[0]
+	if !strings.HasPrefix(msg.Text, "↩️ Refund of Offer #1\n\n🔹 Amount: 0.01 BTC\n🔹 To: "+address+"\n🔹 Status: ⏳ Awaiting approval") {
+		t.Errorf("refund = %q", msg.Text)
+	}
+	if msg := h.send(alice, "/refund 1 "+address, 1)[0]; msg.Text != "The refund of Offer #1 is already being sent" {
+		t.Errorf("repeated refund = %q", msg.Text)
+	}
+	if msg := h.send(alice, "/refund", 1)[0]; !strings.Contains(msg.Text, "Offer #1: 0.01 BTC, ⏳ Awaiting approval") {
+		t.Errorf("refunds = %q", msg.Text)
+	}
+}
+
+func TestLightningAddress(t *testing.T) {
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	h := newHarness(t, func(_ *config.Config, svc *shop.Service) { svc.SetLNURLClient(ln.Client()) })
+	h.register(alice, bob)
+	address := ln.Add("bob", lnurltest.Recipient{})
+
+	if msg := h.send(bob, "/lnaddress", 1)[0]; !strings.HasPrefix(msg.Text, "You have no Lightning address.") {
+		t.Errorf("no address = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/lnaddress bob", 1)[0]; msg.Text != "That is not a Lightning address (name@domain) or LNURL" {
+		t.Errorf("invalid address = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/lnaddress "+ln.Address("carol"), 1)[0]; msg.Text != "That Lightning address could not be reached. Check it and try again." {
+		t.Errorf("unknown address = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/lnaddress "+address, 1)[0]; msg.Text != "⚡ Payouts will be sent to "+address+" from now on" {
+		t.Errorf("set address = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/lnaddress", 1)[0]; !strings.HasPrefix(msg.Text, "⚡ Your Lightning address is "+address+".") {
+		t.Errorf("address = %q", msg.Text)
+	}
+
+	// The completed trade is paid out without asking for a destination
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+	h.pay.MarkSettled(invoiceID)
+	card := h.send(alice, "/list", 2)[1]
+	h.press(alice, card, "✅ Confirm Payment Received")
+	msgs := h.expect(bob, 2)
+	if !strings.HasPrefix(msgs[0].Text, "✅ Trade #1 completed") || len(msgs[0].Buttons()) != 0 {
+		t.Errorf("trade completed = %q %q", msgs[0].Text, msgs[0].Buttons())
+	}
+	if !strings.HasPrefix(msgs[1].Text, "⚡ Payout of Trade #1") || len(ln.Invoices()) != 1 {
+		t.Errorf("payout = %q", msgs[1].Text)
+	}
+
+	if msg := h.send(bob, "/lnaddress off", 1)[0]; msg.Text != "Your Lightning address was removed" {
+		t.Errorf("remove address = %q", msg.Text)
+	}
+}
+
+func TestReferrals(t *testing.T) {
+	h := newHarness(t, func(_ *config.Config, svc *shop.Service) {
+		svc.SetFees(fees.Schedule{Default: fees.Rule{Percent: 1}, MakerPercent: 50})
+		svc.SetReferralProgram(shop.ReferralProgram{SharePercent: 20, MinPayoutSats: 1_000})
+	})
+	h.register(alice)
+
+	msg := h.send(alice, "/referrals", 1)[0]
+	_, link, ok := strings.Cut(msg.Text, "?start=ref_")
+	if !ok || !strings.Contains(msg.Text, "Invited users: 0") {
+		t.Fatalf("referrals = %q", msg.Text)
+	}
+	code, _, _ := strings.Cut(link, "\n")
+	assertButtons(t, msg)
+
+	// Bob registers with alice's invite link and sells to her
+	h.send(bob, "/start ref_"+code, 2)
+	if u, _ := h.shop.User(bob.ID); u.ReferrerID != alice.ID {
+		t.Fatalf("bob referrer = %d, want %d", u.ReferrerID, alice.ID)
+	}
+	invoiceID := h.sell(bob, "0.01 500")
+	h.shop.TakeOffer(alice.ID, 1)
+	h.expect(bob, 1)
+	h.pay.MarkSettled(invoiceID)
+	card := h.send(bob, "/list", 2)[1]
+	h.press(bob, card, "✅ Confirm Payment Received")
+	msgs := h.expect(alice, 2)
+	if msgs[1].Text != "🤝 You earned 0.00001 BTC from the fee of Trade #1, paid by a user you invited." {
+		t.Errorf("credit = %q", msgs[1].Text)
+	}
+
+	msg = h.send(alice, "/referrals", 1)[0]
+	if !strings.Contains(msg.Text, "Invited users: 1") || !strings.Contains(msg.Text, "Available: 0.00001 BTC") {
+		t.Errorf("referrals = %q", msg.Text)
+	}
+	assertButtons(t, msg, "⚡ Pay out earnings")
+	h.press(alice, msg, "⚡ Pay out earnings")
+	if msg := h.expect(alice, 1)[0]; msg.Text != "Set a Lightning address with /lnaddress to receive your referral earnings." {
+		t.Errorf("payout without address = %q", msg.Text)
+	}
+}
+
+func TestRate(t *testing.T) {
+	h := newHarness(t)
+	carol := telegramtest.User{ID: 1003, FirstName: "Carol", Username: "carol"}
+	h.register(alice, bob, carol)
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+
+	if msg := h.send(bob, "/rate", 1)[0]; !strings.HasPrefix(msg.Text, "Please specify the trade and a score from 1 to 5") {
+		t.Errorf("usage = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/rate 1 5", 1)[0]; msg.Text != "Trade #1 is not completed yet and cannot be rated" {
+		t.Errorf("open trade = %q", msg.Text)
+	}
+
+	h.pay.MarkSettled(invoiceID)
+	card := h.send(alice, "/list", 2)[1]
+	h.press(alice, card, "✅ Confirm Payment Received")
+	h.expect(bob, 1)
+
+	if msg := h.send(carol, "/rate 1 5", 1)[0]; msg.Text != "Trade #1 not found among your trades" {
+		t.Errorf("rating by a stranger = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/rate 1 6", 1)[0]; !strings.HasPrefix(msg.Text, "Please specify the trade and a score from 1 to 5") {
+		t.Errorf("score out of range = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/rate #1 5", 1)[0]; msg.Text != "⭐ You rated your counterparty in Trade #1. Thank you!" {
+		t.Errorf("rating = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/rate 1 4", 1)[0]; msg.Text != "You already rated Trade #1" {
+		t.Errorf("rating twice = %q", msg.Text)
+	}
+	if rating, n, err := h.shop.Rating(alice.ID); err != nil || n != 1 || rating != 5 {
+		t.Errorf("seller rating = %v from %d ratings, %v", rating, n, err)
+	}
+}
+
+func TestTradeLimits(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config, svc *shop.Service) {
+		svc.SetLimits(shop.Limits{Tiers: []models.Tier{
+			{Name: "new", MaxTradeSats: 1_000_000, MaxDailySats: 1_500_000},
+			{Name: "trusted", MinAccountAge: 30 * 24 * time.Hour, MinTrades: 5, Bonded: true},
+		}})
+	})
+	h.register(alice)
+
+	msg := h.send(alice, "/limits", 1)[0]
+	for _, want := range []string{"Tier: new", "Per trade: 0.01 BTC", "Remaining: 0.015 BTC", "Completed trades: 0", "Next tier: trusted",
+		"Requires an account age of 30 days and 5 completed trades and an active seller bond"} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("limits = %q, want %q", msg.Text, want)
+		}
+	}
+	if msg := h.send(alice, "/sell 0.02 1000", 1)[0]; msg.Text != "Your tier (new) allows at most 0.01 BTC per trade. Send /limits to see how to raise your limits." {
+		t.Errorf("offer over the trade limit = %q", msg.Text)
+	}
+	h.sell(alice, "0.01 500")
+	if msg := h.send(alice, "/sell 0.01 500", 1)[0]; !strings.HasPrefix(msg.Text, "Your tier (new) allows at most 0.015 BTC of trades per 24 hours, and only 0.005 BTC remains.") {
+		t.Errorf("offer over the daily limit = %q", msg.Text)
+	}
+	if n := len(h.pay.Invoices()); n != 1 {
+		t.Errorf("limited offers created invoices: %d invoices", n)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice)
+
+	if msg := h.send(alice, "/balance", 1)[0]; !strings.HasPrefix(msg.Text, "💼 Your balance\n\n🔹 Available: 0 BTC\n🔹 In escrow: 0 BTC") ||
+		strings.Contains(msg.Text, "Latest entries") {
+		t.Errorf("empty balance = %q", msg.Text)
+	}
+	invoiceID := h.sell(alice, "0.01 500")
+	h.pay.MarkSettled(invoiceID)
+	h.send(alice, "/list", 2)
+	msg := h.send(alice, "/balance", 1)[0]
+	if !strings.Contains(msg.Text, "🔹 In escrow: 0.01 BTC") || !strings.Contains(msg.Text, "Held in escrow: -0.01 BTC available, +0.01 BTC in escrow") ||
+		!strings.Contains(msg.Text, "Invoice paid: +0.01 BTC available") {
+		t.Errorf("balance = %q", msg.Text)
+	}
+}
+
+func TestBonds(t *testing.T) {
+	h := newHarness(t, func(_ *config.Config, svc *shop.Service) {
+		svc.SetBonds(shop.Bonds{AmountSats: 50_000, Required: true})
+	})
+	h.register(alice, bob, admin)
+
+	msg := h.send(alice, "/bond", 1)[0]
+	if !strings.Contains(msg.Text, "You have no bond") || !strings.Contains(msg.Text, "not listed in the marketplace") {
+		t.Errorf("no bond = %q", msg.Text)
+	}
+	assertButtons(t, msg, "🛡 Post bond")
+	h.press(alice, msg, "🛡 Post bond")
+	if msg := h.expect(alice, 2)[1]; !strings.Contains(msg.Text, "Pay 0.0005 BTC to post your bond") {
+		t.Errorf("pending bond = %q", msg.Text)
+	}
+	invoices := h.pay.Invoices()
+	bondInvoice := invoices[len(invoices)-1].ID
+	h.pay.MarkSettled(bondInvoice)
+	h.shop.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: bondInvoice})
+	active := h.expect(alice, 1)[0]
+	if !strings.Contains(active.Text, "Your bond of 0.0005 BTC is active") {
+		t.Errorf("active bond = %q", active.Text)
+	}
+	assertButtons(t, active, "↩️ Release bond")
+
+	// Bonded sellers carry a badge and keep their bond while a trade is open
+	h.sell(alice, "0.01 500")
+	card := h.send(bob, "/marketplace", 2)[1]
+	if !strings.Contains(card.Text, "🛡 Bonded seller") {
+		t.Errorf("marketplace card = %q", card.Text)
+	}
+	h.press(bob, card, "🤝 Take Offer #1")
+	h.expect(bob, 1)
+	h.expect(alice, 1)
+	h.press(alice, active, "↩️ Release bond")
+	if msg := h.expect(alice, 1)[0]; msg.Text != "You can release your bond once all your trades as a seller are closed" {
+		t.Errorf("release with open trade = %q", msg.Text)
+	}
+
+	// Admins settle disputes, slashing the bond of a losing seller
+	if msg := h.send(admin, "/resolve 1", 1)[0]; msg.Text != "Usage: /resolve <trade_id> <buyer|seller>" {
+		t.Errorf("resolve usage = %q", msg.Text)
+	}
+	if msg := h.send(admin, "/resolve 1 buyer", 1)[0]; msg.Text != "⚖️ The dispute over Trade #1 was settled in favour of the buyer." {
+		t.Errorf("resolve reply = %q", msg.Text)
+	}
+	if msgs := h.expect(alice, 2); !strings.Contains(msgs[1].Text, "Your bond of 0.0005 BTC was given to the buyer of Trade #1") {
+		t.Errorf("seller notifications = %q, %q", msgs[0].Text, msgs[1].Text)
+	}
+	msgs := h.expect(bob, 3)
+	claim := msgs[2]
+	if !strings.Contains(claim.Text, "You won the dispute over Trade #1, so the seller's bond of 0.0005 BTC goes to you") {
+		t.Errorf("buyer notifications = %q, %q, %q", msgs[0].Text, msgs[1].Text, claim.Text)
+	}
+	h.press(bob, claim, "⚡ Receive bitcoin")
+	if msg := h.expect(bob, 1)[0]; !strings.Contains(msg.Text, "/bond 1 <destination>") {
+		t.Errorf("claim usage = %q", msg.Text)
+	}
+	if msg := h.send(alice, "/bond 1 alice@example.com", 1)[0]; msg.Text != "Bond #1 is not yours to receive" {
+		t.Errorf("claim by seller = %q", msg.Text)
+	}
+	if msg := h.send(admin, "/resolve 1 seller", 1)[0]; msg.Text != "Trade #1 is no longer open" {
+		t.Errorf("resolving twice = %q", msg.Text)
+	}
+}
+
+func TestDispute(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob, admin)
+	invoiceID := h.sell(alice, "0.01 500")
+	h.shop.TakeOffer(bob.ID, 1)
+	h.expect(alice, 1)
+	h.pay.MarkSettled(invoiceID)
+	card := h.send(alice, "/list", 2)[1]
+
+	if msg := h.send(bob, "/dispute", 1)[0]; msg.Text != "Please specify the trade number, e.g. /dispute 3" {
+		t.Errorf("dispute usage = %q", msg.Text)
+	}
+	if msg := h.send(bob, "/dispute 1", 1)[0]; !strings.HasPrefix(msg.Text, "⚖️ You opened a dispute over Trade #1.") {
+		t.Errorf("dispute = %q", msg.Text)
+	}
+	if msg := h.expect(alice, 1)[0]; !strings.HasPrefix(msg.Text, "⚖️ The buyer opened a dispute over Trade #1.") {
+		t.Errorf("seller notification = %q", msg.Text)
+	}
+	if msg := h.expect(admin, 1)[0]; !strings.Contains(msg.Text, "/resolve 1 buyer") {
+		t.Errorf("admin notification = %q", msg.Text)
+	}
+	if msg := h.send(alice, "/dispute 1", 1)[0]; msg.Text != "Trade #1 is already disputed" {
+		t.Errorf("repeated dispute = %q", msg.Text)
+	}
+
+	// The seller waits for an admin to settle the dispute
+	answer := h.press(alice, card, "✅ Confirm Payment Received")
+	if !answer.ShowAlert || answer.Text != "The trade of this offer is disputed. An admin will settle it." {
+		t.Errorf("confirming a disputed trade = %+v", answer)
+	}
+	if msg := h.send(admin, "/resolve 1 seller", 1)[0]; msg.Text != "⚖️ The dispute over Trade #1 was settled in favour of the seller." {
+		t.Errorf("resolve reply = %q", msg.Text)
+	}
+	h.expect(bob, 2) // trade closed and dispute settled
+	if msg := h.send(bob, "/dispute 1", 1)[0]; msg.Text != "Trade #1 is closed and can no longer be disputed" {
+		t.Errorf("dispute of a closed trade = %q", msg.Text)
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	h := newHarness(t)
+
+	if msg := h.send(alice, "/apitoken", 1)[0]; msg.Text != "Please register first with /start" {
+		t.Errorf("unregistered /apitoken = %q", msg.Text)
+	}
+	h.register(alice)
+
+	msg := h.send(alice, "/apitoken", 1)[0]
+	match := regexp.MustCompile(`(p2ps_[0-9a-f]+)`).FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("token message = %q", msg.Text)
+	}
+	if userID, err := h.shop.Authenticate(match[1]); err != nil || userID != alice.ID {
+		t.Errorf("Authenticate = %d, %v", userID, err)
+	}
+
+	if msg := h.send(alice, "/apitoken revoke", 1)[0]; msg.Text != "Your API token has been revoked." {
+		t.Errorf("revoke reply = %q", msg.Text)
+	}
+	if _, err := h.shop.Authenticate(match[1]); !errors.Is(err, shop.ErrInvalidToken) {
+		t.Errorf("Authenticate after revoke = %v", err)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	h := newHarness(t)
+
+	msg := h.send(alice, "/help", 1)[0]
+	if !strings.Contains(msg.Text, "/sell <amount_btc> <price_usd> [lightning|onchain|both] - Create a sell offer") {
+		t.Errorf("help = %q", msg.Text)
+	}
+}
+
+func TestLinkAccount(t *testing.T) {
+	h := newHarness(t)
+
+	if msg := h.send(alice, "/link", 1)[0]; msg.Text != "Please register first with /start" {
+		t.Errorf("unregistered /link = %q", msg.Text)
+	}
+	h.register(alice)
+
+	msg := h.send(alice, "/link", 1)[0]
+	match := regexp.MustCompile(`/link ([A-Z0-9]+)`).FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("link code message = %q", msg.Text)
+	}
+
+	matrixAlice := models.Identity{Frontend: shop.FrontendMatrix, ExternalID: "@alice:example.org", ChatID: "!dm:example.org", Username: "alice:example.org"}
+	if _, err := h.shop.Link(matrixAlice, match[1]); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if msg := h.expect(alice, 1)[0]; !strings.HasPrefix(msg.Text, "🔗 Account linked") || msg.ParseMode != "MarkdownV2" {
+		t.Errorf("link notification = %q (%s)", msg.Text, msg.ParseMode)
+	}
+
+	if msg := h.send(bob, "/link NOPE1234", 1)[0]; msg.Text != "Invalid or expired link code" {
+		t.Errorf("invalid code reply = %q", msg.Text)
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice)
+
+	for _, cmd := range []string{"/stats", "/ban @bob", "/unban @bob", "/forcecancel 1", "/broadcast hi", "/lookup inv_0001", "/audit"} {
+		if msg := h.send(alice, cmd, 1)[0]; msg.Text != "This command is only available to admins" {
+			t.Errorf("%s by non-admin = %q", cmd, msg.Text)
+		}
+	}
+	if msg := h.send(alice, "/help", 1)[0]; strings.Contains(msg.Text, "Admin Commands") {
+		t.Errorf("admin commands shown to user: %q", msg.Text)
+	}
+	if msg := h.send(admin, "/help", 1)[0]; !strings.Contains(msg.Text, "/forcecancel <offer>") {
+		t.Errorf("admin help = %q", msg.Text)
+	}
+}
+
+func TestBan(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob, admin)
+	h.sell(alice, "0.01 500")
+
+	if msg := h.send(admin, "/ban @Alice spam", 1)[0]; msg.Text != "User @Alice has been banned." {
+		t.Errorf("ban reply = %q", msg.Text)
+	}
+	if msg := h.expect(alice, 1)[0]; msg.Text != "🚫 Account suspended\n\nYour account has been suspended by an administrator.\nReason: spam" {
+		t.Errorf("ban notification = %q", msg.Text)
+	}
+
+	// Banned users are stopped before any handler runs
+	for _, cmd := range []string{"/list", "/sell 0.01 500", "hello"} {
+		if msg := h.send(alice, cmd, 1)[0]; msg.Text != "🚫 Your account has been suspended." {
+			t.Errorf("%q by banned user = %q", cmd, msg.Text)
+		}
+	}
+	if msg := h.send(bob, "/marketplace", 1)[0]; msg.Text != "No offers available in the marketplace yet." {
+		t.Errorf("banned seller listed: %q", msg.Text)
+	}
+
+	if msg := h.send(admin, "/ban @admin", 1)[0]; msg.Text != "Admins cannot be banned" {
+		t.Errorf("self ban = %q", msg.Text)
+	}
+	if msg := h.send(admin, "/ban @nobody", 1)[0]; msg.Text != "User @nobody not found" {
+		t.Errorf("unknown user = %q", msg.Text)
+	}
+
+	if msg := h.send(admin, "/unban 1001", 1)[0]; msg.Text != "User 1001 has been unbanned." {
+		t.Errorf("unban reply = %q", msg.Text)
+	}
+	h.expect(alice, 1)
+	if msg := h.send(alice, "/list", 2)[0]; msg.Text != "📋 Your offers:" {
+		t.Errorf("/list after unban = %q", msg.Text)
+	}
+	if msg := h.send(admin, "/unban 1001", 1)[0]; msg.Text != "User 1001 is not banned" {
+		t.Errorf("repeated unban = %q", msg.Text)
+	}
+
+	entries, err := h.shop.AuditLog(admin.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action+" "+e.Target)
+	}
+	if want := []string{"unban 1001", "ban 1001"}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("audit log = %q, want %q", actions, want)
+	}
+}
+
+func TestBanCheckFails(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice)
+
+	// Updates are dropped when bans cannot be checked
+	h.shop.Database().Close()
+	for _, cmd := range []string{"/list", "hello"} {
+		if msg := h.send(alice, cmd, 1)[0]; msg.Text != "⚠️ The shop cannot handle your request right now. Please try again later." {
+			t.Errorf("%q without database = %q", cmd, msg.Text)
+		}
+	}
+}
+
+func TestAdminTools(t *testing.T) {
+	h := newHarness(t)
+	h.register(alice, bob, admin)
+	invoiceID := h.sell(alice, "0.01 500")
+	h.sell(alice, "0.02 900")
+	card := h.send(bob, "/marketplace", 2)[1]
+	h.press(bob, card, "🤝 Take Offer #1")
+	h.expect(bob, 1)
+	h.expect(alice, 1)
+
+	msg := h.send(admin, "/stats", 1)[0]
+	for _, want := range []string{"👤 Users: 3 (0 banned)", "🤝 Trades: 1", "Offers: 2", "⏳ Pending: 2"} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("stats lack %q: %q", want, msg.Text)
+		}
+	}
+
+	msg = h.send(admin, "/lookup "+invoiceID, 1)[0]
+	if !strings.HasPrefix(msg.Text, "🔎 Offer #1\n🔹 Seller: alice (ID 1001)") || !strings.Contains(msg.Text, "🔹 Invoice: New") {
+		t.Errorf("lookup = %q", msg.Text)
+	}
+	if msg := h.send(admin, "/lookup inv_9999", 1)[0]; msg.Text != "No offer uses this invoice" {
+		t.Errorf("unknown invoice = %q", msg.Text)
+	}
+
+	if msg := h.send(admin, "/forcecancel 1", 1)[0]; msg.Text != "Offer #1 has been cancelled." {
+		t.Errorf("forcecancel reply = %q", msg.Text)
+	}
+	if msg := h.expect(alice, 1)[0]; msg.Text != "❌ Offer Cancelled\n\nOffer #1 has been cancelled by an administrator." {
+		t.Errorf("seller notification = %q", msg.Text)
+	}
+	if msg := h.expect(bob, 1)[0]; msg.Text != "❌ Trade #1 cancelled\n\nThe seller cancelled Offer #1." {
+		t.Errorf("buyer notification = %q", msg.Text)
+	}
+	if msg := h.send(admin, "/forcecancel 1", 1)[0]; msg.Text != "This offer is already completed or cancelled" {
+		t.Errorf("repeated forcecancel = %q", msg.Text)
+	}
+
+	h.send(admin, "/ban @bob", 1)
+	h.expect(bob, 1)
+	if msg := h.send(admin, "/broadcast Maintenance tonight\nBe back soon", 2); msg[0].Text != "📢 Announcement\n\nMaintenance tonight\nBe back soon" || msg[1].Text != "Broadcast sent to 2 users." {
+		t.Errorf("broadcast = %q, %q", msg[0].Text, msg[1].Text)
+	}
+	if msg := h.expect(alice, 1)[0]; msg.Text != "📢 Announcement\n\nMaintenance tonight\nBe back soon" {
+		t.Errorf("announcement = %q", msg.Text)
+	}
+	if msgs := h.tg.Messages(bob.ID); strings.HasPrefix(msgs[len(msgs)-1].Text, "📢") {
+		t.Errorf("banned user received broadcast")
+	}
+
+	msg = h.send(admin, "/audit", 1)[0]
+	for _, want := range []string{"9001: broadcast", "9001: ban 1002", "9001: force_cancel 1", "9001: lookup inv_9999", "9001: stats"} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("audit log lacks %q: %q", want, msg.Text)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config, svc *shop.Service) {
+		svc.SetRateLimits(shop.RateLimits{
+			User:    ratelimit.New(7, time.Hour),
+			Invoice: ratelimit.New(2, time.Hour),
+		})
+	})
+	h.register(alice, bob)
+
+	h.sell(alice, "0.01 500")
+	h.sell(alice, "0.01 500")
+	if msg := h.send(alice, "/sell 0.01 500", 1)[0]; msg.Text != "⏳ Slow down! You are sending commands too quickly. Please try again in 30m0s." {
+		t.Errorf("throttled /sell = %q", msg.Text)
+	}
+	if n := len(h.pay.Invoices()); n != 2 {
+		t.Errorf("throttled /sell created an invoice: %d invoices", n)
+	}
+	if msg := h.send(bob, "/sell 0.01 500", 2)[1]; !strings.HasPrefix(msg.Text, "✅ Offer created!") {
+		t.Errorf("other user throttled: %q", msg.Text)
+	}
+
+	// Other commands draw from the per-user bucket
+	card := h.send(alice, "/list", 5)[2]
+	h.send(alice, "/help", 1)
+	h.send(alice, "hello", 1)
+	if msg := h.send(alice, "/help", 1)[0]; !strings.HasPrefix(msg.Text, "⏳ Slow down!") {
+		t.Errorf("throttled /help = %q", msg.Text)
+	}
+	answer := h.press(alice, card, "❌ Cancel Offer")
+	if !answer.ShowAlert || !strings.HasPrefix(answer.Text, "⏳ Slow down!") {
+		t.Errorf("throttled button = %+v", answer)
+	}
+
+	// Admins are not throttled
+	for i := 0; i < 10; i++ {
+		h.send(admin, "/help", 1)
+	}
+}
+
+func TestOfferLimits(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config, svc *shop.Service) {
+		svc.SetLimits(shop.Limits{MaxOpenOffers: 2, CancelCooldown: time.Hour})
+	})
+	h.register(alice)
+
+	h.sell(alice, "0.01 500")
+	h.sell(alice, "0.02 900")
+	if msg := h.send(alice, "/sell 0.03 1200", 1)[0]; msg.Text != "You already have 2 open offers. Cancel or complete one before creating another." {
+		t.Errorf("third offer = %q", msg.Text)
+	}
+
+	card := h.send(alice, "/list", 5)[2]
+	h.press(alice, card, "❌ Cancel Offer")
+	if msg := h.send(alice, "/sell 0.03 1200", 1)[0]; !strings.HasPrefix(msg.Text, "You cancelled an offer recently. Please wait 1h0m0s") {
+		t.Errorf("offer during cooldown = %q", msg.Text)
+	}
+	if n := len(h.pay.Invoices()); n != 2 {
+		t.Errorf("limited offers created invoices: %d invoices", n)
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	h := newHarness(t)
+	carlos := telegramtest.User{ID: 1003, FirstName: "Carlos", Username: "carlos", LanguageCode: "es-MX"}
+
+	msgs := h.send(carlos, "/start", 2)
+	if msgs[0].Text != "¡Registro completado!" {
+		t.Errorf("registration in Spanish = %q", msgs[0].Text)
+	}
+	assertButtons(t, msgs[1], "🔄 Crear oferta", "📋 Mis ofertas", "🛒 Mercado", "❓ Ayuda")
+
+	msg := h.send(carlos, "/sell 0.015 1234.5", 2)[1]
+	if !strings.Contains(msg.Text, "🔹 Cantidad: 0,015 BTC\n🔹 Precio: 1.234,50 US$") {
+		t.Errorf("offer created = %q", msg.Text)
+	}
+
+	// Notifications use the language of the recipient
+	h.register(alice)
+	market := h.send(alice, "/marketplace", 2)
+	h.press(alice, market[1], "🤝 Take Offer #1")
+	h.expect(alice, 1)
+	if msg := h.expect(carlos, 1)[0]; !strings.HasPrefix(msg.Text, "🤝 Oferta #1 aceptada") {
+		t.Errorf("offer taken notification = %q", msg.Text)
+	}
+
+	// An explicit choice overrides the Telegram language
+	picker := h.send(carlos, "/language", 1)[0]
+	if picker.Text != "🌐 Tu idioma es Español. Elige un idioma:" {
+		t.Errorf("language prompt = %q", picker.Text)
+	}
+	assertButtons(t, picker, "Deutsch", "English", "Español", "Português", "🔄 Automático")
+	h.press(carlos, picker, "Português")
+	if msg := h.expect(carlos, 1)[0]; msg.Text != "✅ Idioma alterado para Português." {
+		t.Errorf("language set = %q", msg.Text)
+	}
+	if msg := h.send(carlos, "/help", 1)[0]; !strings.HasPrefix(msg.Text, "Ajuda da P2P Bitcoin Shop") {
+		t.Errorf("help after override = %q", msg.Text)
+	}
+
+	if msg := h.send(carlos, "/language fr", 1)[0]; msg.Text != "Idioma desconhecido. Idiomas disponíveis: de, en, es, pt" {
+		t.Errorf("unknown language = %q", msg.Text)
+	}
+	if msg := h.send(carlos, "/language auto", 1)[0]; msg.Text != "✅ Idioma en modo automático." {
+		t.Errorf("automatic language = %q", msg.Text)
+	}
+}
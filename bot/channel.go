@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// offerPayloadPrefix starts the /start payload of links opening an offer
+const offerPayloadPrefix = "offer_"
+
+// Publish implements shop.Publisher by posting offers to the marketplace
+// channel with a link to take them in the bot. Posts of taken or completed
+// offers lose their link; those of cancelled or expired offers are deleted.
+func (b *Bot) Publish(listing shop.Listing) error {
+	chatID := b.config.MarketplaceChannelID
+	if chatID == "" {
+		return nil
+	}
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q: %v", chatID, err)
+	}
+	o := listing.Offer
+	postID, err := b.shop.ChannelPost(shop.FrontendTelegram, chatID, o.ID)
+	if err != nil {
+		return err
+	}
+	msg := shop.ChannelPostMessage(i18n.Get(i18n.Default), listing, b.offerLink(o.ID))
+
+	switch {
+	case postID == "":
+		if !listing.Available {
+			return nil
+		}
+		sent, err := b.send(telebot.ChatID(id), msg)
+		if err != nil {
+			return err
+		}
+		return b.shop.TrackChannelPost(shop.FrontendTelegram, chatID, strconv.Itoa(sent.ID), o.ID)
+	case o.Status == models.StatusCancelled || o.Status == models.StatusExpired:
+		if err := b.teleBot.Delete(telebot.StoredMessage{ChatID: id, MessageID: postID}); err != nil {
+			log.Printf("Failed to delete post of offer %d: %v", o.ID, err)
+		}
+		return b.shop.ForgetChannelPost(shop.FrontendTelegram, chatID, postID)
+	default:
+		if err := b.Edit(chatID, postID, msg); err != nil {
+			return err
+		}
+		if o.Status.Closed() {
+			return b.shop.ForgetChannelPost(shop.FrontendTelegram, chatID, postID)
+		}
+		return nil
+	}
+}
+
+// offerLink returns the link opening an offer in the bot
+func (b *Bot) offerLink(offerID int) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s%d", b.teleBot.Me.Username, offerPayloadPrefix, offerID)
+}
+
+// offerPayload extracts the offer opened by a /start payload
+func offerPayload(payload string) (int, bool) {
+	if !strings.HasPrefix(payload, offerPayloadPrefix) {
+		return 0, false
+	}
+	offerID, err := strconv.Atoi(strings.TrimPrefix(payload, offerPayloadPrefix))
+	return offerID, err == nil
+}
@@ -0,0 +1,197 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/markup"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// maxCaptionLength is the longest caption Telegram accepts on a photo
+const maxCaptionLength = 1024
+
+// SendPhoto implements shop.PhotoSender. Captions too long for Telegram are
+// sent as a message after the photo.
+func (b *Bot) SendPhoto(chatID, photoID string, msg shop.Message) error {
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q: %v", chatID, err)
+	}
+	photo := &telebot.Photo{File: telebot.File{FileID: photoID}}
+	options := []interface{}{telebot.ModeMarkdownV2}
+	fits := len(markup.Split(msg.Text, maxCaptionLength)) == 1
+	if fits {
+		photo.Caption = markup.MarkdownV2(msg.Text)
+		if len(msg.Actions) > 0 {
+			options = append(options, keyboard(msg.Actions))
+		}
+	}
+	if _, err := b.teleBot.Send(telebot.ChatID(id), photo, options...); err != nil {
+		return fmt.Errorf("failed to send photo: %v", err)
+	}
+	if !fits {
+		_, err = b.send(telebot.ChatID(id), msg)
+	}
+	return err
+}
+
+// openChat enters the chat of the trade given with "/chat <trade>"
+func (b *Bot) openChat(u *telebot.User, arg string) error {
+	l := b.locale(u)
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(arg), "#"))
+	if err != nil {
+		b.replyText(u, l.T("chat.usage", "/chat"))
+		return nil
+	}
+
+	userID := b.userID(u)
+	trade, err := b.shop.OpenTradeChat(userID, tradeID)
+	switch {
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		b.replyText(u, l.T("chat.not_found", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrTradeClosed):
+		b.replyText(u, l.T("chat.trade_closed"))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("chat.failed"))
+		return fmt.Errorf("failed to open chat of trade %d: %v", tradeID, err)
+	}
+	b.reply(u, shop.TradeChatOpenedMessage(l, trade, userID, "/exit"))
+	return nil
+}
+
+// dispute opens a dispute over the trade given with "/dispute <trade>"
+func (b *Bot) dispute(u *telebot.User, arg string) error {
+	l := b.locale(u)
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(arg), "#"))
+	if err != nil {
+		b.replyText(u, l.T("chat.usage", "/dispute"))
+		return nil
+	}
+
+	userID := b.userID(u)
+	trade, err := b.shop.OpenDispute(userID, tradeID)
+	switch {
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		b.replyText(u, l.T("chat.not_found", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrTradeClosed):
+		b.replyText(u, l.T("dispute.trade_closed", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrDisputed):
+		b.replyText(u, l.T("dispute.exists", tradeID))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("dispute.failed"))
+		return fmt.Errorf("failed to dispute trade %d: %v", tradeID, err)
+	}
+	b.reply(u, shop.DisputeOpenedMessage(l, trade, userID))
+	return nil
+}
+
+// openContact enters a direct chat with the user given with
+// "/contact <nickname>"
+func (b *Bot) openContact(u *telebot.User, nickname string) error {
+	l := b.locale(u)
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		b.replyText(u, l.T("contact.usage", "/contact"))
+		return nil
+	}
+
+	peer, err := b.shop.OpenContact(b.userID(u), nickname)
+	switch {
+	case errors.Is(err, shop.ErrUserNotFound):
+		b.replyText(u, l.T("contact.not_found", markup.Escape(nickname)))
+		return nil
+	case errors.Is(err, shop.ErrOwnContact):
+		b.replyText(u, l.T("contact.self"))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("chat.failed"))
+		return fmt.Errorf("failed to contact %q: %v", nickname, err)
+	}
+	b.reply(u, shop.ContactOpenedMessage(l, peer.Nickname, "/exit"))
+	return nil
+}
+
+// exitChat leaves the current chat
+func (b *Bot) exitChat(m *telebot.Message) error {
+	l := b.locale(m.Sender)
+	chat, err := b.shop.CloseChat(b.userID(m.Sender))
+	switch {
+	case errors.Is(err, shop.ErrNotInChat), errors.Is(err, shop.ErrNotRegistered):
+		b.replyText(m.Sender, l.T("chat.not_in_chat"))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("chat.failed"))
+		return fmt.Errorf("failed to leave chat: %v", err)
+	}
+	if chat.Trade != nil {
+		b.replyText(m.Sender, l.T("chat.closed", chat.Trade.ID))
+	} else {
+		b.replyText(m.Sender, l.T("chat.closed_contact", markup.Escape(chat.Peer.Nickname)))
+	}
+	b.sendMainMenu(m)
+	return nil
+}
+
+// relay forwards a text or photo to the other side of the sender's chat,
+// and reports whether the sender was in one
+func (b *Bot) relay(m *telebot.Message) bool {
+	text, photoID := m.Text, ""
+	if m.Photo != nil {
+		text, photoID = m.Caption, m.Photo.FileID
+	}
+
+	_, err := b.shop.RelayMessage(b.userID(m.Sender), shop.FrontendTelegram, text, photoID)
+	switch {
+	case errors.Is(err, shop.ErrNotInChat), errors.Is(err, shop.ErrNotRegistered):
+		return false
+	case errors.Is(err, shop.ErrTradeClosed):
+		b.replyText(m.Sender, b.locale(m.Sender).T("chat.trade_closed"))
+	case err != nil:
+		log.Printf("Failed to relay message of user %d: %v", m.Sender.ID, err)
+		b.replyText(m.Sender, b.locale(m.Sender).T("chat.failed"))
+	}
+	return true
+}
+
+// nickname shows the sender's nickname, or changes it to the one given with
+// "/nick <nickname>"
+func (b *Bot) nickname(m *telebot.Message) error {
+	l := b.locale(m.Sender)
+	userID := b.userID(m.Sender)
+	nickname := strings.TrimPrefix(strings.TrimSpace(m.Payload), "@")
+	if nickname == "" {
+		current, err := b.shop.Nickname(userID)
+		if errors.Is(err, shop.ErrNotRegistered) {
+			b.replyText(m.Sender, l.T("register.first"))
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b.reply(m.Sender, shop.NicknameMessage(l, current, "/nick"))
+		return nil
+	}
+
+	err := b.shop.SetNickname(userID, nickname)
+	switch {
+	case errors.Is(err, shop.ErrInvalidNickname):
+		b.replyText(m.Sender, l.T("nick.invalid"))
+		return nil
+	case errors.Is(err, shop.ErrNicknameTaken):
+		b.replyText(m.Sender, l.T("nick.taken", markup.Escape(nickname)))
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to set nickname: %v", err)
+	}
+	b.replyText(m.Sender, l.T("nick.set", markup.Escape(nickname)))
+	return nil
+}
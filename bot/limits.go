@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// limits shows the sender's tier and trade limits
+func (b *Bot) limits(u *telebot.User) error {
+	l := b.locale(u)
+	limits, err := b.shop.TradeLimits(b.userID(u))
+	switch {
+	case errors.Is(err, shop.ErrNotRegistered):
+		b.replyText(u, l.T("register.first"))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("limits.failed"))
+		return fmt.Errorf("failed to get trade limits: %v", err)
+	}
+	b.reply(u, shop.LimitsMessage(l, limits))
+	return nil
+}
+
+// limitExceeded explains to u why err, a trade or daily limit error, rejected
+// their offer or trade
+func (b *Bot) limitExceeded(u *telebot.User, err error) string {
+	l := b.locale(u)
+	limits, lerr := b.shop.TradeLimits(b.userID(u))
+	if lerr != nil {
+		return l.T("limits.failed")
+	}
+	return shop.LimitExceededText(l, limits, err, "/limits")
+}
@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// updateSender returns the user who triggered an update, if any
+func updateSender(upd *telebot.Update) *telebot.User {
+	switch {
+	case upd.Message != nil:
+		return upd.Message.Sender
+	case upd.Callback != nil:
+		return upd.Callback.Sender
+	}
+	return nil
+}
+
+// filter runs on every update before any handler. It refreshes the sender's
+// username, drops updates from banned users and throttles users exceeding
+// their rate limits. Updates are dropped too when the ban cannot be checked.
+func (b *Bot) filter(upd *telebot.Update) bool {
+	sender := updateSender(upd)
+	if sender == nil {
+		return true
+	}
+	userID := b.userID(sender)
+
+	// Usernames may be set or changed at any time
+	if err := b.shop.RefreshIdentity(identity(sender)); err != nil {
+		log.Printf("Failed to refresh identity of user %d: %v", sender.ID, err)
+	}
+
+	banned, err := b.shop.IsBanned(userID)
+	if err != nil {
+		log.Printf("Failed to check ban of user %d: %v", sender.ID, err)
+		b.reject(upd, b.locale(sender).T("unavailable"))
+		return false
+	}
+	if banned {
+		b.reject(upd, b.locale(sender).T("banned"))
+		return false
+	}
+
+	if err := b.shop.Throttle(userID); err != nil {
+		b.reject(upd, shop.ThrottledText(b.locale(sender), err))
+		return false
+	}
+	return true
+}
+
+// reject answers a dropped update with text
+func (b *Bot) reject(upd *telebot.Update, text string) {
+	switch {
+	case upd.Callback != nil:
+		b.alert(upd.Callback, text)
+	case upd.Message != nil:
+		b.replyText(upd.Message.Sender, text)
+	}
+}
@@ -0,0 +1,204 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/markup"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// payout lists the sender's payouts, or with "/payout <trade> <destination>"
+// sets where the bitcoin of a trade is sent
+func (b *Bot) payout(u *telebot.User, payload string) error {
+	l := b.locale(u)
+	userID := b.userID(u)
+	args := strings.Fields(payload)
+	if len(args) == 0 {
+		payouts, err := b.shop.Payouts(userID)
+		if err != nil {
+			b.replyText(u, l.T("payout.failed"))
+			return err
+		}
+		b.reply(u, shop.PayoutsMessage(l, payouts))
+		return nil
+	}
+
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		b.replyText(u, l.T("chat.usage", "/payout"))
+		return nil
+	}
+	if len(args) != 2 {
+		b.replyText(u, l.T("payout.usage", "/payout", tradeID))
+		return nil
+	}
+
+	payout, err := b.shop.SetPayoutDestination(userID, tradeID, args[1])
+	switch {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		b.replyText(u, l.T("payout.invalid"))
+		return nil
+	case errors.Is(err, shop.ErrUnresolvable):
+		b.replyText(u, l.T("payout.unresolvable"))
+		return nil
+	case errors.Is(err, shop.ErrPayoutAmount):
+		b.replyText(u, l.T("payout.amount_rejected", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		b.replyText(u, l.T("payout.wrong_network", b.shop.Network()))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		b.replyText(u, l.T("payout.wrong_amount", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		b.replyText(u, l.T("payout.expired"))
+		return nil
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		b.replyText(u, l.T("chat.not_found", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrNotBuyer):
+		b.replyText(u, l.T("payout.not_buyer", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrTradeClosed):
+		b.replyText(u, l.T("payout.trade_cancelled", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrPayoutExists):
+		b.replyText(u, l.T("payout.exists", tradeID))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("payout.failed"))
+		return fmt.Errorf("failed to pay out trade %d: %v", tradeID, err)
+	}
+	if payout == nil {
+		b.replyText(u, l.T("payout.saved", tradeID))
+		return nil
+	}
+	b.reply(u, shop.PayoutMessage(l, payout))
+	return nil
+}
+
+// balance shows the sender's ledger balance and latest entries
+func (b *Bot) balance(u *telebot.User) error {
+	l := b.locale(u)
+	balance, err := b.shop.Balance(b.userID(u))
+	if errors.Is(err, shop.ErrNotRegistered) {
+		b.replyText(u, l.T("register.first"))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	b.reply(u, shop.BalanceMessage(l, balance))
+	return nil
+}
+
+// lightningAddress shows the sender's Lightning address, or with
+// "/lnaddress <address>" sets it and with "/lnaddress off" removes it
+func (b *Bot) lightningAddress(m *telebot.Message) error {
+	l := b.locale(m.Sender)
+	userID := b.userID(m.Sender)
+	address := strings.TrimSpace(m.Payload)
+	if address == "" {
+		current, err := b.shop.LightningAddress(userID)
+		if errors.Is(err, shop.ErrNotRegistered) {
+			b.replyText(m.Sender, l.T("register.first"))
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b.reply(m.Sender, shop.LightningAddressMessage(l, current, "/lnaddress"))
+		return nil
+	}
+	if strings.EqualFold(address, "off") {
+		address = ""
+	}
+
+	err := b.shop.SetLightningAddress(userID, address)
+	switch {
+	case errors.Is(err, shop.ErrNotRegistered):
+		b.replyText(m.Sender, l.T("register.first"))
+		return nil
+	case errors.Is(err, shop.ErrInvalidDestination):
+		b.replyText(m.Sender, l.T("lnaddress.invalid"))
+		return nil
+	case errors.Is(err, shop.ErrUnresolvable):
+		b.replyText(m.Sender, l.T("lnaddress.unresolvable"))
+		return nil
+	case err != nil:
+		b.replyText(m.Sender, l.T("lnaddress.failed"))
+		return fmt.Errorf("failed to set Lightning address: %v", err)
+	}
+	if address == "" {
+		b.replyText(m.Sender, l.T("lnaddress.removed"))
+		return nil
+	}
+	current, err := b.shop.LightningAddress(userID)
+	if err != nil {
+		return err
+	}
+	b.replyText(m.Sender, l.T("lnaddress.set", markup.Escape(current)))
+	return nil
+}
+
+// refund lists the sender's refunds, or with "/refund <offer> <destination>"
+// sets where the refund of a cancelled paid offer is sent
+func (b *Bot) refund(u *telebot.User, payload string) error {
+	l := b.locale(u)
+	userID := b.userID(u)
+	args := strings.Fields(payload)
+	if len(args) == 0 {
+		refunds, err := b.shop.Refunds(userID)
+		if err != nil {
+			b.replyText(u, l.T("refund.failed"))
+			return err
+		}
+		b.reply(u, shop.RefundsMessage(l, refunds))
+		return nil
+	}
+
+	offerID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		b.replyText(u, l.T("refund.offer_usage", "/refund"))
+		return nil
+	}
+	if len(args) != 2 {
+		b.replyText(u, l.T("refund.usage", "/refund", offerID))
+		return nil
+	}
+
+	refund, err := b.shop.SetRefundDestination(userID, offerID, args[1])
+	switch {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		b.replyText(u, l.T("payout.invalid"))
+		return nil
+	case errors.Is(err, shop.ErrUnresolvable):
+		b.replyText(u, l.T("payout.unresolvable"))
+		return nil
+	case errors.Is(err, shop.ErrPayoutAmount):
+		b.replyText(u, l.T("refund.amount_rejected", offerID))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		b.replyText(u, l.T("payout.wrong_network", b.shop.Network()))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		b.replyText(u, l.T("refund.wrong_amount", offerID))
+		return nil
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		b.replyText(u, l.T("payout.expired"))
+		return nil
+	case errors.Is(err, shop.ErrRefundNotFound), errors.Is(err, shop.ErrNotOwner):
+		b.replyText(u, l.T("refund.not_found", offerID))
+		return nil
+	case errors.Is(err, shop.ErrRefundExists):
+		b.replyText(u, l.T("refund.exists", offerID))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("refund.failed"))
+		return fmt.Errorf("failed to refund offer %d: %v", offerID, err)
+	}
+	b.reply(u, shop.RefundMessage(l, refund))
+	return nil
+}
@@ -0,0 +1,40 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// qrSize is the width and height in pixels of QR codes sent by the bot
+const qrSize = 512
+
+// qrPhoto renders a payment URI as a QR code photo. lightning: URIs are
+// uppercased, which BOLT11 allows, so that they fit the denser alphanumeric
+// mode wallets scan faster. bitcoin: URIs are left alone, as their query
+// parameters are case-sensitive.
+func qrPhoto(uri string) (*telebot.Photo, error) {
+	if strings.HasPrefix(uri, "lightning:") {
+		uri = strings.ToUpper(uri)
+	}
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %v", err)
+	}
+	return &telebot.Photo{File: telebot.FromReader(bytes.NewReader(png))}, nil
+}
+
+// sendQRCode sends a payment URI as a QR code photo
+func (b *Bot) sendQRCode(to telebot.Recipient, uri string) error {
+	photo, err := qrPhoto(uri)
+	if err != nil {
+		return err
+	}
+	if _, err := b.teleBot.Send(to, photo); err != nil {
+		return fmt.Errorf("failed to send QR code: %v", err)
+	}
+	return nil
+}
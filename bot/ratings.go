@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// rate rates the counterparty of the trade given with
+// "/rate <trade> <score>"
+func (b *Bot) rate(u *telebot.User, payload string) error {
+	l := b.locale(u)
+	args := strings.Fields(payload)
+	if len(args) != 2 {
+		b.replyText(u, l.T("rate.usage", "/rate"))
+		return nil
+	}
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		b.replyText(u, l.T("rate.usage", "/rate"))
+		return nil
+	}
+	score, err := strconv.Atoi(args[1])
+	if err != nil {
+		b.replyText(u, l.T("rate.usage", "/rate"))
+		return nil
+	}
+
+	_, err = b.shop.RateTrade(b.userID(u), tradeID, score)
+	switch {
+	case errors.Is(err, shop.ErrInvalidScore):
+		b.replyText(u, l.T("rate.usage", "/rate"))
+		return nil
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		b.replyText(u, l.T("chat.not_found", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrNotCompleted):
+		b.replyText(u, l.T("rate.not_completed", tradeID))
+		return nil
+	case errors.Is(err, shop.ErrRated):
+		b.replyText(u, l.T("rate.exists", tradeID))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("rate.failed"))
+		return fmt.Errorf("failed to rate trade %d: %v", tradeID, err)
+	}
+	b.replyText(u, l.T("rate.done", tradeID))
+	return nil
+}
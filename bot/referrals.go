@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+	"gopkg.in/tucnak/telebot.v2"
+)
+
+// referralPayloadPrefix starts the /start payload of invite links
+const referralPayloadPrefix = "ref_"
+
+// referralLink returns the invite link of a referral code
+func (b *Bot) referralLink(code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s%s", b.teleBot.Me.Username, referralPayloadPrefix, code)
+}
+
+// referralPayload extracts the referral code of a /start payload
+func referralPayload(payload string) (string, bool) {
+	if !strings.HasPrefix(payload, referralPayloadPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(payload, referralPayloadPrefix), true
+}
+
+// referrals shows the sender's invite link and referral earnings
+func (b *Bot) referrals(u *telebot.User) error {
+	l := b.locale(u)
+	summary, err := b.shop.Referrals(b.userID(u))
+	if errors.Is(err, shop.ErrNotRegistered) {
+		b.replyText(u, l.T("register.first"))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	b.reply(u, shop.ReferralsMessage(l, summary, b.referralLink(summary.Code)))
+	return nil
+}
+
+// referralPayout pays the sender's available referral earnings out to their
+// Lightning address
+func (b *Bot) referralPayout(u *telebot.User) error {
+	l := b.locale(u)
+	payout, err := b.shop.RequestReferralPayout(b.userID(u))
+	switch {
+	case errors.Is(err, shop.ErrNotRegistered):
+		b.replyText(u, l.T("register.first"))
+		return nil
+	case errors.Is(err, shop.ErrNoReferralEarnings):
+		b.replyText(u, l.T("referral.nothing"))
+		return nil
+	case errors.Is(err, shop.ErrNoLightningAddress):
+		b.replyText(u, l.T("referral.no_address", "/lnaddress"))
+		return nil
+	case errors.Is(err, shop.ErrReferralPayoutExists):
+		b.replyText(u, l.T("referral.exists"))
+		return nil
+	case err != nil:
+		b.replyText(u, l.T("referral.failed"))
+		return fmt.Errorf("failed to pay out referral earnings: %v", err)
+	}
+	b.reply(u, shop.ReferralPayoutMessage(l, payout))
+	return nil
+}
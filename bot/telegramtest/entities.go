@@ -0,0 +1,159 @@
+package telegramtest
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// MaxMessageLength is the longest message text Telegram accepts, in UTF-16
+// code units after entities are parsed
+const MaxMessageLength = 4096
+
+// MaxCaptionLength is the longest photo caption Telegram accepts, counted
+// like MaxMessageLength
+const MaxCaptionLength = 1024
+
+// markdownV2Reserved are the characters MarkdownV2 requires to be escaped
+// outside of entities
+const markdownV2Reserved = "_*[]()~`>#+-=|{}.!"
+
+// parseText returns the text users see for a message sent with parseMode,
+// failing like Telegram when the markup is invalid or the text too long
+func parseText(text, parseMode string) (string, error) {
+	var plain string
+	var err error
+	switch parseMode {
+	case "MarkdownV2":
+		plain, err = parseMarkdownV2(text)
+	case "Markdown":
+		plain, err = parseMarkdown(text)
+	default:
+		plain = text
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't parse entities: %v", err)
+	}
+	if len(utf16.Encode([]rune(plain))) > MaxMessageLength {
+		return "", fmt.Errorf("message is too long")
+	}
+	return plain, nil
+}
+
+// parseMarkdownV2 strips MarkdownV2 entities from text. It supports bold,
+// italic, underline, strikethrough, spoiler, code, pre and links.
+func parseMarkdownV2(text string) (string, error) {
+	var b strings.Builder
+	var open []string // entity markers in nesting order
+	toggle := func(marker string) {
+		if n := len(open); n > 0 && open[n-1] == marker {
+			open = open[:n-1]
+			return
+		}
+		open = append(open, marker)
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(text) {
+				return "", fmt.Errorf("character '\\' is reserved and must be escaped with the preceding '\\'")
+			}
+			i++
+			b.WriteByte(text[i])
+		case strings.HasPrefix(text[i:], "```"):
+			end := strings.Index(text[i+3:], "```")
+			if end < 0 {
+				return "", fmt.Errorf("can't find end of pre entity at byte offset %d", i)
+			}
+			b.WriteString(unescapeCode(text[i+3 : i+3+end]))
+			i += 5 + end
+		case c == '`':
+			end := closingBacktick(text, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("can't find end of code entity at byte offset %d", i)
+			}
+			b.WriteString(unescapeCode(text[i+1 : end]))
+			i = end
+		case strings.HasPrefix(text[i:], "__"), strings.HasPrefix(text[i:], "||"):
+			toggle(text[i : i+2])
+			i++
+		case c == '*' || c == '_' || c == '~':
+			toggle(string(c))
+		case c == '[':
+			toggle("[")
+		case c == ']':
+			if n := len(open); n == 0 || open[n-1] != "[" {
+				return "", fmt.Errorf("character ']' is reserved and must be escaped with the preceding '\\'")
+			}
+			open = open[:len(open)-1]
+			if !strings.HasPrefix(text[i+1:], "(") {
+				return "", fmt.Errorf("can't find end of text URL at byte offset %d", i)
+			}
+			end := strings.IndexByte(text[i+1:], ')')
+			if end < 0 {
+				return "", fmt.Errorf("can't find end of URL at byte offset %d", i)
+			}
+			i += 1 + end
+		case strings.IndexByte(markdownV2Reserved, c) >= 0:
+			return "", fmt.Errorf("character '%c' is reserved and must be escaped with the preceding '\\'", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if len(open) > 0 {
+		return "", fmt.Errorf("can't find end of %s entity", open[len(open)-1])
+	}
+	return b.String(), nil
+}
+
+// closingBacktick returns the index of the next unescaped backtick, or -1
+func closingBacktick(text string, from int) int {
+	for i := from; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '`':
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeCode removes the escapes MarkdownV2 allows inside code
+func unescapeCode(code string) string {
+	return strings.NewReplacer("\\\\", "\\", "\\`", "`").Replace(code)
+}
+
+// parseMarkdown strips legacy Markdown entities from text
+func parseMarkdown(text string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case '*', '_', '`':
+			end := strings.IndexByte(text[i+1:], c)
+			if end < 0 {
+				return "", fmt.Errorf("can't find end of the entity starting at byte offset %d", i)
+			}
+			b.WriteString(text[i+1 : i+1+end])
+			i += 1 + end
+		case '[':
+			end := strings.Index(text[i:], "](")
+			if end < 0 {
+				b.WriteByte(c)
+				continue
+			}
+			close := strings.IndexByte(text[i+end:], ')')
+			if close < 0 {
+				return "", fmt.Errorf("can't find end of the entity starting at byte offset %d", i)
+			}
+			b.WriteString(text[i+1 : i+end])
+			i += end + close
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,629 @@
+// Package telegramtest provides an in-process fake Telegram Bot API server for
+// scripting conversations with the bot in end-to-end tests.
+package telegramtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// DefaultWait is how long Wait helpers block for the bot to respond
+const DefaultWait = 5 * time.Second
+
+// User is a Telegram user taking part in a scripted conversation
+type User struct {
+	ID           int64  `json:"id"`
+	FirstName    string `json:"first_name"`
+	Username     string `json:"username,omitempty"`
+	LanguageCode string `json:"language_code,omitempty"`
+}
+
+// Button is an inline keyboard button attached to a bot message
+type Button struct {
+	Text         string `json:"text"`
+	URL          string `json:"url,omitempty"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
+
+// Message is a message sent by the bot, reflecting any later edits. Text is
+// what users see once entities are parsed, Raw the text as the bot sent it.
+// Photos hold their file ID in Photo and their caption in Text.
+type Message struct {
+	ID        int
+	ChatID    int64
+	Photo     string
+	Text      string
+	Raw       string
+	ParseMode string
+	Keyboard  [][]Button
+	Edits     int
+	Deleted   bool
+}
+
+// Button returns the keyboard button with the given text, or nil
+func (m *Message) Button(text string) *Button {
+	for _, row := range m.Keyboard {
+		for i := range row {
+			if row[i].Text == text {
+				return &row[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Buttons returns the texts of all keyboard buttons in order
+func (m *Message) Buttons() []string {
+	var texts []string
+	for _, row := range m.Keyboard {
+		for _, b := range row {
+			texts = append(texts, b.Text)
+		}
+	}
+	return texts
+}
+
+// CallbackAnswer is the bot's answer to a button press
+type CallbackAnswer struct {
+	CallbackID string `json:"callback_query_id"`
+	Text       string `json:"text"`
+	ShowAlert  bool   `json:"show_alert"`
+}
+
+// Server is a fake Telegram Bot API server backed by httptest.Server
+type Server struct {
+	Token string
+	Bot   User
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	updated  chan struct{}
+	done     chan struct{}
+	updates  []json.RawMessage
+	nextMsg  int
+	messages []*Message
+	read     map[int64]int
+	answers  map[string]CallbackAnswer
+	files    map[string][]byte
+}
+
+// NewServer starts a fake Bot API server for the given bot token
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:   token,
+		Bot:     User{ID: 1, FirstName: "Shop", Username: "shop_bot"},
+		updated: make(chan struct{}),
+		done:    make(chan struct{}),
+		read:    make(map[int64]int),
+		answers: make(map[string]CallbackAnswer),
+		files:   make(map[string][]byte),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the base URL to configure the bot with
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Close shuts the fake server down, releasing pending long polls
+func (s *Server) Close() {
+	close(s.done)
+	s.srv.Close()
+}
+
+// SendText delivers a text message from user to the bot
+func (s *Server) SendText(from User, text string) {
+	s.pushUpdate(func(id int) interface{} {
+		return map[string]interface{}{
+			"message": s.incoming(id, from, map[string]interface{}{"text": text}),
+		}
+	})
+}
+
+// SendPhoto delivers a photo with an optional caption from user to the bot.
+// fileID identifies the photo in later messages of the bot.
+func (s *Server) SendPhoto(from User, fileID, caption string) {
+	s.pushUpdate(func(id int) interface{} {
+		fields := map[string]interface{}{"photo": photoSizes(fileID)}
+		if caption != "" {
+			fields["caption"] = caption
+		}
+		return map[string]interface{}{
+			"message": s.incoming(id, from, fields),
+		}
+	})
+}
+
+// Press taps the button with the given text on a bot message and returns
+// the callback query ID
+func (s *Server) Press(from User, msg *Message, text string) (string, error) {
+	button := msg.Button(text)
+	if button == nil {
+		return "", fmt.Errorf("message %d has no button %q (buttons: %q)", msg.ID, text, msg.Buttons())
+	}
+	if button.CallbackData == "" {
+		return "", fmt.Errorf("button %q is not a callback button", text)
+	}
+
+	var callbackID string
+	s.pushUpdate(func(id int) interface{} {
+		callbackID = fmt.Sprintf("cb_%d", id)
+		return map[string]interface{}{
+			"callback_query": map[string]interface{}{
+				"id":   callbackID,
+				"from": from,
+				"message": map[string]interface{}{
+					"message_id": msg.ID,
+					"date":       time.Now().Unix(),
+					"chat":       map[string]interface{}{"id": msg.ChatID, "type": "private"},
+					"text":       msg.Text,
+				},
+				"data": button.CallbackData,
+			},
+		}
+	})
+	return callbackID, nil
+}
+
+// WaitMessages waits for n messages the caller has not seen yet in chatID
+func (s *Server) WaitMessages(chatID int64, n int) ([]*Message, error) {
+	deadline := time.Now().Add(DefaultWait)
+	for {
+		s.mu.Lock()
+		var unseen []*Message
+		for _, m := range s.messages {
+			if m.ChatID == chatID && m.ID > s.read[chatID] {
+				unseen = append(unseen, m)
+			}
+		}
+		if len(unseen) >= n {
+			unseen = unseen[:n]
+			if n > 0 {
+				s.read[chatID] = unseen[n-1].ID
+			}
+			s.mu.Unlock()
+			return unseen, nil
+		}
+		s.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("chat %d: got %d new messages, want %d", chatID, len(unseen), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// WaitEdit waits until message id of chatID satisfies done, as edits are
+// applied after the bot has already sent its reply
+func (s *Server) WaitEdit(chatID int64, id int, done func(Message) bool) (Message, error) {
+	deadline := time.Now().Add(DefaultWait)
+	for {
+		m, ok := s.Message(chatID, id)
+		if ok && done(m) {
+			return m, nil
+		}
+		if time.Now().After(deadline) {
+			return m, fmt.Errorf("chat %d: message %d was not edited", chatID, id)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// WaitAnswer waits for the bot to answer the given callback query
+func (s *Server) WaitAnswer(callbackID string) (CallbackAnswer, error) {
+	deadline := time.Now().Add(DefaultWait)
+	for {
+		s.mu.Lock()
+		answer, ok := s.answers[callbackID]
+		s.mu.Unlock()
+		if ok {
+			return answer, nil
+		}
+		if time.Now().After(deadline) {
+			return CallbackAnswer{}, fmt.Errorf("callback %s was not answered", callbackID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Messages returns copies of every message sent to chatID
+func (s *Server) Messages(chatID int64) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []Message
+	for _, m := range s.messages {
+		if m.ChatID == chatID {
+			msgs = append(msgs, *m)
+		}
+	}
+	return msgs
+}
+
+// Message returns a copy of the current state of a sent message
+func (s *Server) Message(chatID int64, id int) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.find(chatID, id); m != nil {
+		return *m, true
+	}
+	return Message{}, false
+}
+
+// File returns the content of a file uploaded by the bot, e.g. a photo it
+// sent, by the file ID it got
+func (s *Server) File(fileID string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[fileID]
+	return data, ok
+}
+
+// pushUpdate queues an update built by fn and wakes pending long polls
+func (s *Server) pushUpdate(fn func(id int) interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.updates) + 1
+	update := fn(id)
+	update.(map[string]interface{})["update_id"] = id
+	data, _ := json.Marshal(update)
+	s.updates = append(s.updates, data)
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// incoming builds a private chat message sent by a user
+func (s *Server) incoming(id int, from User, fields map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{
+		"message_id": 100000 + id,
+		"from":       from,
+		"date":       time.Now().Unix(),
+		"chat":       map[string]interface{}{"id": from.ID, "type": "private", "username": from.Username},
+	}
+	for k, v := range fields {
+		msg[k] = v
+	}
+	return msg
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	prefix := "/bot" + s.Token + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	params, err := s.readParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+
+	switch method := strings.TrimPrefix(r.URL.Path, prefix); method {
+	case "getMe":
+		writeResult(w, s.Bot)
+	case "getUpdates":
+		s.getUpdates(w, params)
+	case "sendMessage":
+		s.sendMessage(w, params)
+	case "sendPhoto":
+		s.sendPhoto(w, params)
+	case "editMessageText":
+		s.editMessage(w, params, true)
+	case "editMessageReplyMarkup":
+		s.editMessage(w, params, false)
+	case "deleteMessage":
+		s.deleteMessage(w, params)
+	case "answerCallbackQuery":
+		s.answerCallback(w, params)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found: method "+method+" not supported by fake")
+	}
+}
+
+func (s *Server) getUpdates(w http.ResponseWriter, params map[string]string) {
+	offset, _ := strconv.Atoi(params["offset"])
+	timeout, _ := strconv.Atoi(params["timeout"])
+	deadline := time.After(time.Duration(timeout) * time.Second)
+
+	for {
+		s.mu.Lock()
+		var pending []json.RawMessage
+		if offset < 1 {
+			offset = 1
+		}
+		if offset <= len(s.updates) {
+			pending = s.updates[offset-1:]
+		}
+		wake := s.updated
+		s.mu.Unlock()
+
+		if len(pending) > 0 {
+			writeResult(w, pending)
+			return
+		}
+		select {
+		case <-wake:
+		case <-deadline:
+			writeResult(w, []json.RawMessage{})
+			return
+		case <-s.done:
+			writeResult(w, []json.RawMessage{})
+			return
+		}
+	}
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, params map[string]string) {
+	chatID, err := strconv.ParseInt(params["chat_id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: chat not found")
+		return
+	}
+	if params["text"] == "" {
+		writeError(w, http.StatusBadRequest, "Bad Request: message text is empty")
+		return
+	}
+	keyboard, err := parseKeyboard(params["reply_markup"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	text, err := parseText(params["text"], params["parse_mode"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.nextMsg++
+	msg := &Message{
+		ID:        s.nextMsg,
+		ChatID:    chatID,
+		Text:      text,
+		Raw:       params["text"],
+		ParseMode: params["parse_mode"],
+		Keyboard:  keyboard,
+	}
+	s.messages = append(s.messages, msg)
+	result := s.messageJSON(msg)
+	s.mu.Unlock()
+
+	writeResult(w, result)
+}
+
+func (s *Server) sendPhoto(w http.ResponseWriter, params map[string]string) {
+	chatID, err := strconv.ParseInt(params["chat_id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: chat not found")
+		return
+	}
+	if params["photo"] == "" {
+		writeError(w, http.StatusBadRequest, "Bad Request: there is no photo in the request")
+		return
+	}
+	keyboard, err := parseKeyboard(params["reply_markup"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	caption, err := parseText(params["caption"], params["parse_mode"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	if len(utf16.Encode([]rune(caption))) > MaxCaptionLength {
+		writeError(w, http.StatusBadRequest, "Bad Request: message caption is too long")
+		return
+	}
+
+	s.mu.Lock()
+	s.nextMsg++
+	msg := &Message{
+		ID:        s.nextMsg,
+		ChatID:    chatID,
+		Photo:     params["photo"],
+		Text:      caption,
+		Raw:       params["caption"],
+		ParseMode: params["parse_mode"],
+		Keyboard:  keyboard,
+	}
+	s.messages = append(s.messages, msg)
+	result := s.messageJSON(msg)
+	s.mu.Unlock()
+
+	writeResult(w, result)
+}
+
+func (s *Server) editMessage(w http.ResponseWriter, params map[string]string, text bool) {
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+	msgID, _ := strconv.Atoi(params["message_id"])
+	keyboard, err := parseKeyboard(params["reply_markup"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	var newText string
+	if text {
+		if newText, err = parseText(params["text"], params["parse_mode"]); err != nil {
+			writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.find(chatID, msgID)
+	if msg == nil || msg.Deleted {
+		writeError(w, http.StatusBadRequest, "Bad Request: message to edit not found")
+		return
+	}
+	if (!text || params["text"] == msg.Raw) && reflect.DeepEqual(keyboard, msg.Keyboard) {
+		writeError(w, http.StatusBadRequest, "Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message")
+		return
+	}
+	if text {
+		msg.Text = newText
+		msg.Raw = params["text"]
+		msg.ParseMode = params["parse_mode"]
+	}
+	msg.Keyboard = keyboard
+	msg.Edits++
+	writeResult(w, s.messageJSON(msg))
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, params map[string]string) {
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+	msgID, _ := strconv.Atoi(params["message_id"])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.find(chatID, msgID)
+	if msg == nil || msg.Deleted {
+		writeError(w, http.StatusBadRequest, "Bad Request: message to delete not found")
+		return
+	}
+	msg.Deleted = true
+	writeResult(w, true)
+}
+
+func (s *Server) answerCallback(w http.ResponseWriter, params map[string]string) {
+	answer := CallbackAnswer{
+		CallbackID: params["callback_query_id"],
+		Text:       params["text"],
+		ShowAlert:  params["show_alert"] == "true",
+	}
+	s.mu.Lock()
+	s.answers[answer.CallbackID] = answer
+	s.mu.Unlock()
+	writeResult(w, true)
+}
+
+// find returns the message with the given chat and ID; the caller holds s.mu
+func (s *Server) find(chatID int64, id int) *Message {
+	for _, m := range s.messages {
+		if m.ChatID == chatID && m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// messageJSON renders a sent message as the Bot API does, in a channel for
+// negative chat IDs; the caller holds s.mu
+func (s *Server) messageJSON(m *Message) map[string]interface{} {
+	chatType := "private"
+	if m.ChatID < 0 {
+		chatType = "channel"
+	}
+	msg := map[string]interface{}{
+		"message_id": m.ID,
+		"from":       s.Bot,
+		"date":       time.Now().Unix(),
+		"chat":       map[string]interface{}{"id": m.ChatID, "type": chatType},
+	}
+	if m.Photo != "" {
+		msg["photo"] = photoSizes(m.Photo)
+		msg["caption"] = m.Text
+	} else {
+		msg["text"] = m.Text
+	}
+	return msg
+}
+
+// photoSizes renders a photo as the sizes the Bot API lists for it
+func photoSizes(fileID string) []map[string]interface{} {
+	return []map[string]interface{}{
+		{"file_id": fileID + "_small", "file_unique_id": fileID + "_small", "width": 90, "height": 90},
+		{"file_id": fileID, "file_unique_id": fileID, "width": 1280, "height": 960},
+	}
+}
+
+// readParams decodes Bot API parameters from a JSON or form request body.
+// Uploaded files are stored and replaced by the file ID they get.
+func (s *Server) readParams(r *http.Request) (map[string]string, error) {
+	params := make(map[string]string)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		// Uploads are the parts of type application/octet-stream, which may
+		// have no file name
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			if part.Header.Get("Content-Type") != "application/octet-stream" {
+				params[part.FormName()] = string(data)
+				continue
+			}
+			s.mu.Lock()
+			id := fmt.Sprintf("upload_%d", len(s.files)+1)
+			s.files[id] = data
+			s.mu.Unlock()
+			params[part.FormName()] = id
+		}
+	case "application/json":
+		var raw map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil && err.Error() != "EOF" {
+			return nil, err
+		}
+		for k, v := range raw {
+			switch v := v.(type) {
+			case string:
+				params[k] = v
+			case nil:
+			default:
+				data, _ := json.Marshal(v)
+				params[k] = string(data)
+			}
+		}
+	}
+	return params, nil
+}
+
+// parseKeyboard extracts the inline keyboard from a reply_markup parameter
+func parseKeyboard(markup string) ([][]Button, error) {
+	if markup == "" {
+		return nil, nil
+	}
+	var m struct {
+		InlineKeyboard [][]Button `json:"inline_keyboard"`
+	}
+	if err := json.Unmarshal([]byte(markup), &m); err != nil {
+		return nil, fmt.Errorf("can't parse reply keyboard markup JSON object")
+	}
+	return m.InlineKeyboard, nil
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+func writeError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": code, "description": description})
+}
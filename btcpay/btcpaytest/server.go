@@ -0,0 +1,812 @@
+// Package btcpaytest provides an in-process fake BTCPay Server Greenfield API
+// for exercising btcpay.Client and the bot flows without network access.
+package btcpaytest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11/bolt11test"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+)
+
+// Invoice statuses used by the Greenfield API
+const (
+	StatusNew        = "New"
+	StatusProcessing = "Processing"
+	StatusSettled    = "Settled"
+	StatusExpired    = "Expired"
+	StatusInvalid    = "Invalid"
+)
+
+// Additional invoice statuses used by the Greenfield API
+const (
+	AdditionalStatusNone     = "None"
+	AdditionalStatusPaidLate = "PaidLate"
+)
+
+// Invoice is the fake server's record of a created invoice
+type Invoice struct {
+	ID             string
+	StoreID        string
+	Amount         string
+	Currency       string
+	Status         string
+	Additional     string // Additional status, AdditionalStatusPaidLate once paid after expiring
+	Metadata       map[string]interface{}
+	Checkout       map[string]interface{}
+	PaymentMethods []string
+	PaymentRequest string // BOLT11 invoice of the Lightning payment method
+	Address        string // Bitcoin address of the on-chain payment method
+	Confirmations  int    // of the on-chain payment, -1 until one is received
+	CreatedTime    time.Time
+	ExpirationTime time.Time
+}
+
+// PullPayment is the fake server's record of a created pull payment
+type PullPayment struct {
+	ID                string
+	StoreID           string
+	Name              string
+	Amount            string
+	Currency          string
+	AutoApproveClaims bool
+	Archived          bool
+	InvoiceID         string // Invoice refunded by the pull payment, if any
+}
+
+// Payout is the fake server's record of a claim on a pull payment
+type Payout struct {
+	ID            string
+	PullPaymentID string
+	Destination   string
+	Amount        string
+	PaymentMethod string
+	State         string
+}
+
+// Delivery records a webhook delivery attempt made by the fake server
+type Delivery struct {
+	URL        string
+	Event      btcpay.WebhookEvent
+	StatusCode int
+	Err        error
+}
+
+type webhook struct {
+	id     string
+	url    string
+	secret string
+}
+
+// Server is a fake BTCPay Server backed by httptest.Server
+type Server struct {
+	APIKey  string
+	StoreID string
+
+	srv    *httptest.Server
+	signer *bolt11test.Signer
+
+	mu           sync.Mutex
+	nextID       int
+	invoices     map[string]*Invoice
+	pullPayments map[string]*PullPayment
+	payouts      []*Payout
+	webhooks     []webhook
+	deliveries   []Delivery
+}
+
+// NewServer starts a fake BTCPay Server accepting the given API key and store
+func NewServer(apiKey, storeID string) *Server {
+	s := &Server{
+		APIKey:       apiKey,
+		StoreID:      storeID,
+		invoices:     make(map[string]*Invoice),
+		pullPayments: make(map[string]*PullPayment),
+		signer:       bolt11test.NewSigner(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/stores/{storeId}/invoices", s.authorized(s.createInvoice))
+	mux.HandleFunc("GET /api/v1/stores/{storeId}/invoices/{invoiceId}", s.authorized(s.getInvoice))
+	mux.HandleFunc("GET /api/v1/stores/{storeId}/invoices/{invoiceId}/payment-methods", s.authorized(s.getPaymentMethods))
+	mux.HandleFunc("POST /api/v1/stores/{storeId}/invoices/{invoiceId}/status", s.authorized(s.markInvoiceStatus))
+	mux.HandleFunc("POST /api/v1/stores/{storeId}/invoices/{invoiceId}/refund", s.authorized(s.refundInvoice))
+	mux.HandleFunc("POST /api/v1/stores/{storeId}/webhooks", s.authorized(s.createWebhook))
+	mux.HandleFunc("POST /api/v1/stores/{storeId}/pull-payments", s.authorized(s.createPullPayment))
+	mux.HandleFunc("DELETE /api/v1/stores/{storeId}/pull-payments/{pullPaymentId}", s.authorized(s.archivePullPayment))
+	mux.HandleFunc("GET /api/v1/stores/{storeId}/payouts/{payoutId}", s.authorized(s.getPayout))
+	mux.HandleFunc("POST /api/v1/pull-payments/{pullPaymentId}/payouts", s.createPayout)
+	mux.HandleFunc("GET /i/{invoiceId}", s.checkoutPage)
+
+	s.srv = httptest.NewServer(mux)
+	return s
+}
+
+// URL returns the base URL of the fake server
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns a btcpay.Client configured for the fake server
+func (s *Server) Client() *btcpay.Client {
+	return btcpay.NewClient(s.srv.URL, s.APIKey, s.StoreID)
+}
+
+// Close shuts the fake server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Invoice returns a copy of the invoice with the given ID
+func (s *Server) Invoice(id string) (Invoice, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invoices[id]
+	if !ok {
+		return Invoice{}, false
+	}
+	return *inv, true
+}
+
+// Invoices returns copies of all invoices in creation order
+func (s *Server) Invoices() []Invoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoices := make([]Invoice, 0, len(s.invoices))
+	for i := 1; i <= s.nextID; i++ {
+		if inv, ok := s.invoices[invoiceID(i)]; ok {
+			invoices = append(invoices, *inv)
+		}
+	}
+	return invoices
+}
+
+// AddWebhook registers a webhook endpoint that receives signed invoice events
+func (s *Server) AddWebhook(url, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhooks = append(s.webhooks, webhook{
+		id:     fmt.Sprintf("wh_%d", len(s.webhooks)+1),
+		url:    url,
+		secret: secret,
+	})
+}
+
+// Deliveries returns all webhook deliveries attempted so far
+func (s *Server) Deliveries() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Delivery(nil), s.deliveries...)
+}
+
+// MarkProcessing moves an invoice to the Processing state
+func (s *Server) MarkProcessing(id string) error {
+	return s.setStatus(id, StatusProcessing, btcpay.EventInvoiceProcessing)
+}
+
+// MarkSettled moves an invoice to the Settled state. Like BTCPay Server, an
+// invoice that expired or was invalidated instead stays Expired with the
+// PaidLate additional status, and only emits a received payment event.
+func (s *Server) MarkSettled(id string) error {
+	s.mu.Lock()
+	inv, ok := s.invoices[id]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("invoice %s not found", id)
+	}
+	if inv.Status != StatusExpired && inv.Status != StatusInvalid {
+		s.mu.Unlock()
+		return s.setStatus(id, StatusSettled, btcpay.EventInvoiceSettled)
+	}
+	inv.Status, inv.Additional = StatusExpired, AdditionalStatusPaidLate
+	metadata := inv.Metadata
+	s.mu.Unlock()
+
+	s.emit(btcpay.WebhookEvent{Type: btcpay.EventInvoiceReceivedPayment, InvoiceID: id, Metadata: metadata})
+	return nil
+}
+
+// PayOnChain records an on-chain payment of the full amount of an invoice
+// with the given confirmations. The first payment moves the invoice to the
+// Processing state; later calls only update the confirmations, as BTCPay
+// Server sends no event for new blocks.
+func (s *Server) PayOnChain(id string, confirmations int) error {
+	s.mu.Lock()
+	inv, ok := s.invoices[id]
+	if !ok || inv.Address == "" {
+		s.mu.Unlock()
+		return fmt.Errorf("invoice %s has no on-chain payment method", id)
+	}
+	received := inv.Confirmations < 0
+	inv.Confirmations = confirmations
+	metadata := inv.Metadata
+	s.mu.Unlock()
+
+	if !received {
+		return nil
+	}
+	s.emit(btcpay.WebhookEvent{Type: btcpay.EventInvoiceReceivedPayment, InvoiceID: id, Metadata: metadata})
+	return s.MarkProcessing(id)
+}
+
+// Expire moves an invoice to the Expired state
+func (s *Server) Expire(id string) error {
+	return s.setStatus(id, StatusExpired, btcpay.EventInvoiceExpired)
+}
+
+// Invalidate moves an invoice to the Invalid state
+func (s *Server) Invalidate(id string) error {
+	return s.setStatus(id, StatusInvalid, btcpay.EventInvoiceInvalid)
+}
+
+// setStatus updates an invoice and emits the matching webhook event
+func (s *Server) setStatus(id, status, eventType string) error {
+	s.mu.Lock()
+	inv, ok := s.invoices[id]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("invoice %s not found", id)
+	}
+	inv.Status = status
+	metadata := inv.Metadata
+	s.mu.Unlock()
+
+	s.emit(btcpay.WebhookEvent{Type: eventType, InvoiceID: id, Metadata: metadata})
+	return nil
+}
+
+// PullPayments returns copies of all pull payments in creation order
+func (s *Server) PullPayments() []PullPayment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pullPayments []PullPayment
+	for i := 1; i <= len(s.pullPayments); i++ {
+		pullPayments = append(pullPayments, *s.pullPayments[pullPaymentID(i)])
+	}
+	return pullPayments
+}
+
+// Payouts returns copies of all payouts in creation order
+func (s *Server) Payouts() []Payout {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payouts := make([]Payout, 0, len(s.payouts))
+	for _, p := range s.payouts {
+		payouts = append(payouts, *p)
+	}
+	return payouts
+}
+
+// ApprovePayout moves a payout awaiting approval to AwaitingPayment
+func (s *Server) ApprovePayout(id string) error {
+	return s.setPayoutState(id, btcpay.PayoutAwaitingPayment, btcpay.EventPayoutApproved)
+}
+
+// StartPayout moves a payout to InProgress, as when its payment is sent
+func (s *Server) StartPayout(id string) error {
+	return s.setPayoutState(id, btcpay.PayoutInProgress, btcpay.EventPayoutUpdated)
+}
+
+// CompletePayout moves a payout to Completed
+func (s *Server) CompletePayout(id string) error {
+	return s.setPayoutState(id, btcpay.PayoutCompleted, btcpay.EventPayoutUpdated)
+}
+
+// CancelPayout moves a payout to Cancelled
+func (s *Server) CancelPayout(id string) error {
+	return s.setPayoutState(id, btcpay.PayoutCancelled, btcpay.EventPayoutUpdated)
+}
+
+// setPayoutState updates a payout and emits the matching webhook event
+func (s *Server) setPayoutState(id, state, eventType string) error {
+	s.mu.Lock()
+	p := s.payout(id)
+	if p == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("payout %s not found", id)
+	}
+	p.State = state
+	event := btcpay.WebhookEvent{Type: eventType, PayoutID: p.ID, PullPaymentID: p.PullPaymentID, PayoutState: state}
+	s.mu.Unlock()
+
+	s.emit(event)
+	return nil
+}
+
+// payout returns the payout with the given ID; the caller holds s.mu
+func (s *Server) payout(id string) *Payout {
+	for _, p := range s.payouts {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// emit delivers an event to every registered webhook synchronously
+func (s *Server) emit(event btcpay.WebhookEvent) {
+	s.mu.Lock()
+	hooks := append([]webhook(nil), s.webhooks...)
+	s.mu.Unlock()
+
+	event.Timestamp = time.Now().Unix()
+	event.StoreID = s.StoreID
+	for _, hook := range hooks {
+		s.mu.Lock()
+		deliveryID := fmt.Sprintf("del_%d", len(s.deliveries)+1)
+		s.mu.Unlock()
+
+		event.DeliveryID = deliveryID
+		event.WebhookID = hook.id
+		event.OriginalDeliveryID = deliveryID
+		delivery := Delivery{URL: hook.url, Event: event}
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			delivery.Err = err
+		} else {
+			delivery.StatusCode, delivery.Err = post(hook.url, body, btcpay.SignWebhook(body, hook.secret))
+		}
+
+		s.mu.Lock()
+		s.deliveries = append(s.deliveries, delivery)
+		s.mu.Unlock()
+	}
+}
+
+// post sends a signed webhook body to url
+func post(url string, body []byte, signature string) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(btcpay.SignatureHeader, signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// authorized rejects requests with a wrong API key or store ID
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+s.APIKey {
+			writeError(w, http.StatusUnauthorized, "unauthenticated", "Authentication is required for accessing this endpoint")
+			return
+		}
+		if r.PathValue("storeId") != s.StoreID {
+			writeError(w, http.StatusForbidden, "unauthorized", "The API key does not have permission for this store")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) createInvoice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Amount   json.Number            `json:"amount"`
+		Currency string                 `json:"currency"`
+		Metadata map[string]interface{} `json:"metadata"`
+		Checkout map[string]interface{} `json:"checkout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-request", "Invalid JSON body")
+		return
+	}
+	amount, err := strconv.ParseFloat(string(req.Amount), 64)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation-error", "Invalid amount")
+		return
+	}
+
+	methods := []string{btcpay.PaymentMethodLightning}
+	if list, ok := req.Checkout["paymentMethods"].([]interface{}); ok {
+		methods = nil
+		for _, m := range list {
+			if m, ok := m.(string); ok {
+				methods = append(methods, m)
+			}
+		}
+	}
+
+	expiration := 15 * time.Minute
+	if minutes, ok := req.Checkout["expirationMinutes"].(float64); ok {
+		expiration = time.Duration(minutes) * time.Minute
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	s.nextID++
+	inv := &Invoice{
+		ID:             invoiceID(s.nextID),
+		StoreID:        s.StoreID,
+		Amount:         string(req.Amount),
+		Currency:       req.Currency,
+		Status:         StatusNew,
+		Metadata:       req.Metadata,
+		Checkout:       req.Checkout,
+		PaymentMethods: methods,
+		Confirmations:  -1,
+		CreatedTime:    now,
+		ExpirationTime: now.Add(expiration),
+	}
+	for _, m := range methods {
+		switch m {
+		case btcpay.PaymentMethodLightning:
+			inv.PaymentRequest = s.signer.Sign(bolt11test.Invoice{
+				AmountMsat:  int64(math.Round(amount*100_000_000)) * 1000,
+				Timestamp:   now,
+				Expiry:      expiration,
+				Description: inv.ID,
+			})
+		case btcpay.PaymentMethodOnChain:
+			inv.Address = address()
+		}
+	}
+	s.invoices[inv.ID] = inv
+	resp := s.invoiceJSON(inv)
+	s.mu.Unlock()
+
+	s.emit(btcpay.WebhookEvent{Type: btcpay.EventInvoiceCreated, InvoiceID: inv.ID, Metadata: inv.Metadata})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getInvoice(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	inv, ok := s.invoices[r.PathValue("invoiceId")]
+	var resp map[string]interface{}
+	if ok {
+		resp = s.invoiceJSON(inv)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "invoice-not-found", "The invoice was not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	inv, ok := s.Invoice(r.PathValue("invoiceId"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "invoice-not-found", "The invoice was not found")
+		return
+	}
+	due := inv.Amount
+	if inv.Status == StatusSettled || inv.Status == StatusProcessing || inv.Additional == AdditionalStatusPaidLate {
+		due = "0"
+	}
+	methods := []map[string]interface{}{}
+	for _, m := range inv.PaymentMethods {
+		method := map[string]interface{}{
+			"paymentMethod": m,
+			"amount":        inv.Amount,
+			"due":           due,
+			"activated":     true,
+			"payments":      []map[string]interface{}{},
+		}
+		switch m {
+		case btcpay.PaymentMethodLightning:
+			method["destination"] = inv.PaymentRequest
+			method["paymentLink"] = "lightning:" + inv.PaymentRequest
+		case btcpay.PaymentMethodOnChain:
+			method["destination"] = inv.Address
+			method["paymentLink"] = fmt.Sprintf("bitcoin:%s?amount=%s", inv.Address, inv.Amount)
+			if inv.Confirmations >= 0 {
+				status := btcpay.PaymentProcessing
+				if inv.Status == StatusSettled {
+					status = btcpay.PaymentSettled
+				}
+				method["payments"] = []map[string]interface{}{{
+					"id":            inv.ID + "-0",
+					"value":         inv.Amount,
+					"status":        status,
+					"destination":   inv.Address,
+					"confirmations": inv.Confirmations,
+				}}
+			}
+		}
+		methods = append(methods, method)
+	}
+	writeJSON(w, http.StatusOK, methods)
+}
+
+func (s *Server) markInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-request", "Invalid JSON body")
+		return
+	}
+
+	id := r.PathValue("invoiceId")
+	var err error
+	switch req.Status {
+	case StatusSettled:
+		err = s.MarkSettled(id)
+	case StatusInvalid:
+		err = s.Invalidate(id)
+	default:
+		writeError(w, http.StatusUnprocessableEntity, "validation-error", "Status can only be Settled or Invalid")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, "invoice-not-found", err.Error())
+		return
+	}
+	s.getInvoice(w, r)
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		writeError(w, http.StatusUnprocessableEntity, "validation-error", "A webhook URL is required")
+		return
+	}
+	s.AddWebhook(req.URL, req.Secret)
+
+	s.mu.Lock()
+	id := s.webhooks[len(s.webhooks)-1].id
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "url": req.URL, "enabled": true})
+}
+
+func (s *Server) createPullPayment(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name              string      `json:"name"`
+		Amount            json.Number `json:"amount"`
+		Currency          string      `json:"currency"`
+		AutoApproveClaims bool        `json:"autoApproveClaims"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-request", "Invalid JSON body")
+		return
+	}
+	if amount, err := strconv.ParseFloat(string(req.Amount), 64); err != nil || amount <= 0 {
+		writeError(w, http.StatusUnprocessableEntity, "validation-error", "Invalid amount")
+		return
+	}
+
+	s.mu.Lock()
+	pp := &PullPayment{
+		ID:                pullPaymentID(len(s.pullPayments) + 1),
+		StoreID:           s.StoreID,
+		Name:              req.Name,
+		Amount:            string(req.Amount),
+		Currency:          req.Currency,
+		AutoApproveClaims: req.AutoApproveClaims,
+	}
+	s.pullPayments[pp.ID] = pp
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id": pp.ID, "name": pp.Name, "amount": pp.Amount, "currency": pp.Currency,
+		"autoApproveClaims": pp.AutoApproveClaims, "archived": false,
+	})
+}
+
+func (s *Server) refundInvoice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string `json:"name"`
+		PaymentMethod string `json:"paymentMethod"`
+		RefundVariant string `json:"refundVariant"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-request", "Invalid JSON body")
+		return
+	}
+	if req.RefundVariant != "RateThen" {
+		writeError(w, http.StatusUnprocessableEntity, "validation-error", "Only the RateThen refund variant is supported")
+		return
+	}
+
+	s.mu.Lock()
+	inv, ok := s.invoices[r.PathValue("invoiceId")]
+	switch {
+	case !ok:
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, "invoice-not-found", "The invoice was not found")
+		return
+	case inv.Status != StatusSettled && inv.Additional != AdditionalStatusPaidLate:
+		s.mu.Unlock()
+		writeError(w, http.StatusBadRequest, "non-refundable", "Cannot refund this invoice")
+		return
+	}
+	pp := &PullPayment{
+		ID:        pullPaymentID(len(s.pullPayments) + 1),
+		StoreID:   s.StoreID,
+		Name:      req.Name,
+		Amount:    inv.Amount,
+		Currency:  inv.Currency,
+		InvoiceID: inv.ID,
+	}
+	s.pullPayments[pp.ID] = pp
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id": pp.ID, "name": pp.Name, "amount": pp.Amount, "currency": pp.Currency,
+		"autoApproveClaims": false, "archived": false,
+	})
+}
+
+func (s *Server) archivePullPayment(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	pp, ok := s.pullPayments[r.PathValue("pullPaymentId")]
+	if ok {
+		pp.Archived = true
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "pullpayment-not-found", "The pull payment was not found")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// destinationPattern matches the Lightning destinations the fake server
+// pays: Lightning addresses, LNURLs and BOLT11 invoices
+var destinationPattern = regexp.MustCompile(`^([a-z0-9._+-]+@[a-z0-9.-]+\.[a-z]{2,}|lnurl1[02-9ac-hj-np-z]+|ln(bc|tb|bcrt)[0-9a-z]+)$`)
+
+func (s *Server) createPayout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Destination   string `json:"destination"`
+		PaymentMethod string `json:"paymentMethod"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-request", "Invalid JSON body")
+		return
+	}
+	if !destinationPattern.MatchString(strings.ToLower(req.Destination)) {
+		writeError(w, http.StatusUnprocessableEntity, "validation-error", "The destination is not a valid Lightning destination")
+		return
+	}
+
+	s.mu.Lock()
+	pp, ok := s.pullPayments[r.PathValue("pullPaymentId")]
+	claimed := false
+	for _, p := range s.payouts {
+		claimed = claimed || (ok && p.PullPaymentID == pp.ID && p.State != btcpay.PayoutCancelled)
+	}
+	switch {
+	case !ok:
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, "pullpayment-not-found", "The pull payment was not found")
+		return
+	case pp.Archived:
+		s.mu.Unlock()
+		writeError(w, http.StatusUnprocessableEntity, "archived", "The pull payment has been archived")
+		return
+	case claimed:
+		s.mu.Unlock()
+		writeError(w, http.StatusUnprocessableEntity, "overdraft", "The payout amount exceeds what is left on the pull payment")
+		return
+	}
+	p := &Payout{
+		ID:            fmt.Sprintf("po_%04d", len(s.payouts)+1),
+		PullPaymentID: pp.ID,
+		Destination:   req.Destination,
+		Amount:        pp.Amount,
+		PaymentMethod: req.PaymentMethod,
+		State:         btcpay.PayoutAwaitingApproval,
+	}
+	if pp.AutoApproveClaims {
+		p.State = btcpay.PayoutAwaitingPayment
+	}
+	s.payouts = append(s.payouts, p)
+	resp := payoutJSON(p)
+	s.mu.Unlock()
+
+	s.emit(btcpay.WebhookEvent{Type: btcpay.EventPayoutCreated, PayoutID: p.ID, PullPaymentID: p.PullPaymentID, PayoutState: p.State})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getPayout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p := s.payout(r.PathValue("payoutId"))
+	var resp map[string]interface{}
+	if p != nil {
+		resp = payoutJSON(p)
+	}
+	s.mu.Unlock()
+
+	if p == nil {
+		writeError(w, http.StatusNotFound, "payout-not-found", "The payout was not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// payoutJSON renders a payout the way the Greenfield API does; the caller holds s.mu
+func payoutJSON(p *Payout) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            p.ID,
+		"pullPaymentId": p.PullPaymentID,
+		"destination":   p.Destination,
+		"amount":        p.Amount,
+		"paymentMethod": p.PaymentMethod,
+		"state":         p.State,
+	}
+}
+
+func (s *Server) checkoutPage(w http.ResponseWriter, r *http.Request) {
+	inv, ok := s.Invoice(r.PathValue("invoiceId"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, "Invoice %s: %s %s (%s)", inv.ID, inv.Amount, inv.Currency, inv.Status)
+}
+
+// invoiceJSON renders an invoice the way the Greenfield API does; the caller holds s.mu
+func (s *Server) invoiceJSON(inv *Invoice) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               inv.ID,
+		"storeId":          inv.StoreID,
+		"amount":           inv.Amount,
+		"currency":         inv.Currency,
+		"status":           inv.Status,
+		"additionalStatus": additionalStatus(inv),
+		"metadata":         inv.Metadata,
+		"checkout":         inv.Checkout,
+		"checkoutLink":     fmt.Sprintf("%s/i/%s", s.srv.URL, inv.ID),
+		"createdTime":      inv.CreatedTime.Unix(),
+		"expirationTime":   inv.ExpirationTime.Unix(),
+	}
+}
+
+// additionalStatus returns the additional status of an invoice, None unless
+// it was paid late
+func additionalStatus(inv *Invoice) string {
+	if inv.Additional == "" {
+		return AdditionalStatusNone
+	}
+	return inv.Additional
+}
+
+// address returns a random P2WPKH mainnet address
+func address() string {
+	program := make([]byte, 20)
+	rand.Read(program)
+	groups, _ := bech32.ConvertBits(program, 8, 5, true)
+	return bech32.Encode("bc", append([]byte{0}, groups...))
+}
+
+func invoiceID(n int) string {
+	return fmt.Sprintf("inv_%04d", n)
+}
+
+func pullPaymentID(n int) string {
+	return fmt.Sprintf("pp_%04d", n)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
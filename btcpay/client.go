@@ -1,8 +1,6 @@
 package btcpay
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,10 +8,10 @@ import (
 
 // Client wraps the BTCPay Server API client
 type Client struct {
-	client   *http.Client
-	baseURL  string
-	apiKey   string
-	storeID  string
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	storeID string
 }
 
 // NewClient initializes a BTCPay Server client
@@ -26,8 +24,12 @@ func NewClient(baseURL, apiKey, storeID string) *Client {
 	}
 }
 
-// CreateInvoice creates a BTCPay Server Lightning invoice
-func (bc *Client) CreateInvoice(amountSats int64, description string) (string, string, error) {
+// CreateInvoice creates a BTCPay Server invoice payable with the given
+// payment methods, over Lightning if none is given
+func (bc *Client) CreateInvoice(amountSats int64, description string, methods ...string) (string, string, error) {
+	if len(methods) == 0 {
+		methods = []string{PaymentMethodLightning}
+	}
 	url := fmt.Sprintf("%s/api/v1/stores/%s/invoices", bc.baseURL, bc.storeID)
 	body := map[string]interface{}{
 		"amount":   float64(amountSats) / 100_000_000, // Convert satoshis to BTC
@@ -36,98 +38,173 @@ func (bc *Client) CreateInvoice(amountSats int64, description string) (string, s
 			"orderId": description,
 		},
 		"checkout": map[string]interface{}{
-			"paymentMethods": []string{"BTC-LightningNetwork"},
+			"paymentMethods":    methods,
 			"expirationMinutes": 60,
 		},
 	}
 
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to marshal invoice request: %v", err)
+	var created struct {
+		ID string `json:"id"`
 	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create request: %v", err)
+	if err := bc.do("POST", url, body, &created); err != nil {
+		return "", "", err
+	}
+	if created.ID == "" {
+		return "", "", fmt.Errorf("invalid invoice ID in response")
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", bc.apiKey))
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := bc.client.Do(req)
+	// Fetch invoice to get its checkout link
+	invoice, err := bc.GetInvoice(created.ID)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to send request: %v", err)
+		return "", "", err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if invoice.CheckoutLink == "" {
+		return "", "", fmt.Errorf("invalid checkout link in response")
 	}
+	return created.ID, invoice.CheckoutLink, nil
+}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", "", fmt.Errorf("failed to decode response: %v", err)
-	}
+// Invoice holds the details of a BTCPay Server invoice
+type Invoice struct {
+	ID               string    `json:"id"`
+	Status           string    `json:"status"`
+	AdditionalStatus string    `json:"additionalStatus"`
+	Amount           string    `json:"amount"`
+	Currency         string    `json:"currency"`
+	CheckoutLink     string    `json:"checkoutLink"`
+	CreatedTime      time.Time `json:"-"`
+	ExpirationTime   time.Time `json:"-"`
+}
 
-	invoiceID, ok := result["id"].(string)
-	if !ok {
-		return "", "", fmt.Errorf("invalid invoice ID in response")
-	}
+// IsPaid reports whether the invoice has been paid in full
+func (i *Invoice) IsPaid() bool {
+	return i.Status == "Settled" || i.Status == "Complete"
+}
 
-	// Fetch invoice to get Lightning payment details
-	invoiceURL := fmt.Sprintf("%s/api/v1/stores/%s/invoices/%s", bc.baseURL, bc.storeID, invoiceID)
-	req, err = http.NewRequest("GET", invoiceURL, nil)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create invoice fetch request: %v", err)
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", bc.apiKey))
+// IsPaidLate reports whether the invoice was paid in full after it expired,
+// which BTCPay Server reports as Expired with the PaidLate additional status
+func (i *Invoice) IsPaidLate() bool {
+	return i.Status == "Expired" && i.AdditionalStatus == "PaidLate"
+}
 
-	resp, err = bc.client.Do(req)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to fetch invoice: %v", err)
-	}
-	defer resp.Body.Close()
+// IsNew reports whether the invoice is still waiting for payment
+func (i *Invoice) IsNew() bool {
+	return i.Status == "New"
+}
 
-	var invoiceData map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&invoiceData); err != nil {
-		return "", "", fmt.Errorf("failed to decode invoice response: %v", err)
-	}
+// IsProcessing reports whether the invoice has been paid in full with
+// payments that BTCPay does not consider settled yet, such as on-chain
+// transactions waiting for confirmations
+func (i *Invoice) IsProcessing() bool {
+	return i.Status == "Processing"
+}
 
-	paymentMethods, ok := invoiceData["checkoutLink"].(string)
-	if !ok {
-		return "", "", fmt.Errorf("invalid checkout link in response")
+// GetInvoice fetches a BTCPay Server invoice
+func (bc *Client) GetInvoice(invoiceID string) (*Invoice, error) {
+	url := fmt.Sprintf("%s/api/v1/stores/%s/invoices/%s", bc.baseURL, bc.storeID, invoiceID)
+	var result struct {
+		Invoice
+		CreatedTime    int64 `json:"createdTime"`
+		ExpirationTime int64 `json:"expirationTime"`
+	}
+	if err := bc.do("GET", url, nil, &result); err != nil {
+		return nil, err
+	}
+	if result.Status == "" {
+		return nil, fmt.Errorf("invalid status in response")
 	}
 
-	return invoiceID, paymentMethods, nil
+	invoice := result.Invoice
+	invoice.CreatedTime = time.Unix(result.CreatedTime, 0)
+	invoice.ExpirationTime = time.Unix(result.ExpirationTime, 0)
+	return &invoice, nil
 }
 
 // CheckInvoiceStatus checks if a BTCPay Server invoice has been paid
 func (bc *Client) CheckInvoiceStatus(invoiceID string) (bool, error) {
-	url := fmt.Sprintf("%s/api/v1/stores/%s/invoices/%s", bc.baseURL, bc.storeID, invoiceID)
-	req, err := http.NewRequest("GET", url, nil)
+	invoice, err := bc.GetInvoice(invoiceID)
 	if err != nil {
-		return false, fmt.Errorf("failed to create request: %v", err)
+		return false, err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", bc.apiKey))
+	return invoice.IsPaid(), nil
+}
 
-	resp, err := bc.client.Do(req)
-	if err != nil {
-		return false, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
+// InvalidateInvoice marks a BTCPay Server invoice as invalid, so that it can
+// no longer be paid
+func (bc *Client) InvalidateInvoice(invoiceID string) error {
+	url := fmt.Sprintf("%s/api/v1/stores/%s/invoices/%s/status", bc.baseURL, bc.storeID, invoiceID)
+	return bc.do("POST", url, map[string]string{"status": "Invalid"}, nil)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
+// PaymentMethod describes how an invoice can be paid with one payment method
+type PaymentMethod struct {
+	PaymentMethod string    `json:"paymentMethod"`
+	Destination   string    `json:"destination"` // BOLT11 invoice or Bitcoin address
+	PaymentLink   string    `json:"paymentLink"`
+	Amount        string    `json:"amount"`
+	Due           string    `json:"due"`
+	Activated     bool      `json:"activated"`
+	Payments      []Payment `json:"payments"`
+}
+
+// Payment statuses reported by the Greenfield API
+const (
+	PaymentInvalid    = "Invalid"
+	PaymentProcessing = "Processing"
+	PaymentSettled    = "Settled"
+)
+
+// Payment is a payment received by an invoice with one payment method
+type Payment struct {
+	ID          string `json:"id"`
+	Value       string `json:"value"`
+	Status      string `json:"status"`
+	Destination string `json:"destination"`
+	// Confirmations of an on-chain payment, as reported by BTCPay Server
+	Confirmations int `json:"confirmations"`
+}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return false, fmt.Errorf("failed to decode response: %v", err)
+// GetPaymentMethods fetches the payment methods of a BTCPay Server invoice
+func (bc *Client) GetPaymentMethods(invoiceID string) ([]PaymentMethod, error) {
+	url := fmt.Sprintf("%s/api/v1/stores/%s/invoices/%s/payment-methods", bc.baseURL, bc.storeID, invoiceID)
+	var methods []PaymentMethod
+	if err := bc.do("GET", url, nil, &methods); err != nil {
+		return nil, err
 	}
+	return methods, nil
+}
 
-	status, ok := result["status"].(string)
-	if !ok {
-		return false, fmt.Errorf("invalid status in response")
+// LightningPaymentRequest returns the BOLT11 invoice to pay a BTCPay Server
+// invoice over Lightning
+func (bc *Client) LightningPaymentRequest(invoiceID string) (string, error) {
+	methods, err := bc.GetPaymentMethods(invoiceID)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range methods {
+		if m.PaymentMethod == PaymentMethodLightning && m.Activated && m.Destination != "" {
+			return m.Destination, nil
+		}
 	}
+	return "", fmt.Errorf("invoice %s has no Lightning payment method", invoiceID)
+}
 
-	return status == "Settled" || status == "Complete", nil
-} 
\ No newline at end of file
+// OnChainConfirmations returns the confirmations of the least confirmed
+// valid on-chain payment among methods, or -1 if none was received
+func OnChainConfirmations(methods []PaymentMethod) int {
+	confirmations := -1
+	for _, m := range methods {
+		if m.PaymentMethod != PaymentMethodOnChain {
+			continue
+		}
+		for _, p := range m.Payments {
+			if p.Status == PaymentInvalid {
+				continue
+			}
+			if confirmations < 0 || p.Confirmations < confirmations {
+				confirmations = p.Confirmations
+			}
+		}
+	}
+	return confirmations
+}
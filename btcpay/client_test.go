@@ -0,0 +1,304 @@
+package btcpay_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay/btcpaytest"
+)
+
+func TestCreateInvoice(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+
+	invoiceID, link, err := srv.Client().CreateInvoice(1_000_000, "offer 1")
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+
+	inv, ok := srv.Invoice(invoiceID)
+	if !ok {
+		t.Fatalf("invoice %s not recorded by server", invoiceID)
+	}
+	if inv.Amount != "0.01" || inv.Currency != "BTC" {
+		t.Errorf("invoice amount = %s %s, want 0.01 BTC", inv.Amount, inv.Currency)
+	}
+	if inv.Metadata["orderId"] != "offer 1" {
+		t.Errorf("orderId = %v, want %q", inv.Metadata["orderId"], "offer 1")
+	}
+	if want := srv.URL() + "/i/" + invoiceID; link != want {
+		t.Errorf("checkout link = %q, want %q", link, want)
+	}
+}
+
+func TestLightningPaymentRequest(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+	client := srv.Client()
+
+	invoiceID, _, err := client.CreateInvoice(1_000_000, "offer 1")
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	pr, err := client.LightningPaymentRequest(invoiceID)
+	if err != nil {
+		t.Fatalf("LightningPaymentRequest: %v", err)
+	}
+	if inv, _ := srv.Invoice(invoiceID); pr != inv.PaymentRequest {
+		t.Errorf("payment request = %q, want %q", pr, inv.PaymentRequest)
+	}
+	decoded, err := bolt11.Decode(pr)
+	if err != nil || decoded.AmountMsat != 1_000_000_000 {
+		t.Errorf("Decode(%q) = %+v, %v", pr, decoded, err)
+	}
+	if _, err := client.LightningPaymentRequest("inv_9999"); err == nil {
+		t.Error("payment request of unknown invoice")
+	}
+}
+
+func TestOnChainPayments(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+	client := srv.Client()
+
+	invoiceID, _, err := client.CreateInvoice(1_000_000, "offer 1", btcpay.PaymentMethodOnChain)
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	methods, err := client.GetPaymentMethods(invoiceID)
+	if err != nil {
+		t.Fatalf("GetPaymentMethods: %v", err)
+	}
+	inv, _ := srv.Invoice(invoiceID)
+	if len(methods) != 1 || methods[0].PaymentMethod != btcpay.PaymentMethodOnChain || methods[0].Destination != inv.Address {
+		t.Fatalf("payment methods = %+v", methods)
+	}
+	if _, err := client.LightningPaymentRequest(invoiceID); err == nil {
+		t.Error("Lightning payment request of an on-chain invoice")
+	}
+	if n := btcpay.OnChainConfirmations(methods); n != -1 {
+		t.Errorf("confirmations before payment = %d", n)
+	}
+
+	srv.PayOnChain(invoiceID, 0)
+	srv.PayOnChain(invoiceID, 3)
+	methods, _ = client.GetPaymentMethods(invoiceID)
+	if n := btcpay.OnChainConfirmations(methods); n != 3 {
+		t.Errorf("confirmations = %d, want 3", n)
+	}
+	if invoice, _ := client.GetInvoice(invoiceID); !invoice.IsProcessing() || invoice.IsPaid() {
+		t.Errorf("invoice status = %s, want Processing", invoice.Status)
+	}
+}
+
+func TestCheckInvoiceStatus(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+	client := srv.Client()
+
+	tests := []struct {
+		name   string
+		mutate func(id string) error
+		paid   bool
+	}{
+		{"new", func(string) error { return nil }, false},
+		{"processing", srv.MarkProcessing, false},
+		{"settled", srv.MarkSettled, true},
+		{"expired", srv.Expire, false},
+		{"invalid", srv.Invalidate, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoiceID, _, err := client.CreateInvoice(1000, tt.name)
+			if err != nil {
+				t.Fatalf("CreateInvoice: %v", err)
+			}
+			if err := tt.mutate(invoiceID); err != nil {
+				t.Fatalf("mutate: %v", err)
+			}
+			paid, err := client.CheckInvoiceStatus(invoiceID)
+			if err != nil {
+				t.Fatalf("CheckInvoiceStatus: %v", err)
+			}
+			if paid != tt.paid {
+				t.Errorf("paid = %v, want %v", paid, tt.paid)
+			}
+		})
+	}
+}
+
+func TestClientRejected(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		client *btcpay.Client
+	}{
+		{"wrong api key", btcpay.NewClient(srv.URL(), "other", "store")},
+		{"wrong store", btcpay.NewClient(srv.URL(), "key", "other")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var apiErr *btcpay.APIError
+			if _, _, err := tt.client.CreateInvoice(1000, "rejected"); !errors.As(err, &apiErr) {
+				t.Errorf("CreateInvoice err = %v, want *APIError", err)
+			}
+			if _, err := tt.client.CheckInvoiceStatus("inv_0001"); err == nil {
+				t.Error("CheckInvoiceStatus succeeded, want error")
+			}
+		})
+	}
+	if n := len(srv.Invoices()); n != 0 {
+		t.Errorf("server recorded %d invoices, want 0", n)
+	}
+
+	// Invoice calls report Greenfield errors as *APIError
+	client := srv.Client()
+	var apiErr *btcpay.APIError
+	if _, err := client.GetInvoice("inv_unknown"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetInvoice err = %v, want not found", err)
+	}
+	if _, err := client.GetPaymentMethods("inv_unknown"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetPaymentMethods err = %v, want not found", err)
+	}
+	if err := client.InvalidateInvoice("inv_unknown"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("InvalidateInvoice err = %v, want not found", err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+
+	events := make(chan *btcpay.WebhookEvent, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		event, err := btcpay.ParseWebhook(body, r.Header.Get(btcpay.SignatureHeader), "secret")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		events <- event
+	}))
+	defer receiver.Close()
+	srv.AddWebhook(receiver.URL, "secret")
+	srv.AddWebhook(receiver.URL, "wrong secret")
+
+	invoiceID, _, err := srv.Client().CreateInvoice(1000, "webhook")
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	if err := srv.MarkSettled(invoiceID); err != nil {
+		t.Fatalf("MarkSettled: %v", err)
+	}
+
+	for _, want := range []string{btcpay.EventInvoiceCreated, btcpay.EventInvoiceSettled} {
+		event := <-events
+		if event.Type != want || event.InvoiceID != invoiceID || event.StoreID != "store" {
+			t.Errorf("event = %+v, want %s for %s", event, want, invoiceID)
+		}
+	}
+
+	var rejected int
+	for _, d := range srv.Deliveries() {
+		if d.StatusCode == http.StatusUnauthorized {
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("rejected deliveries = %d, want 2", rejected)
+	}
+}
+
+func TestPayouts(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+	client := srv.Client()
+
+	tests := []struct {
+		name        string
+		autoApprove bool
+		destination string
+		wantState   string
+		rejected    bool
+	}{
+		{"auto approved", true, "alice@example.com", btcpay.PayoutAwaitingPayment, false},
+		{"manual approval", false, "lnbc10u1pexample", btcpay.PayoutAwaitingApproval, false},
+		{"invalid destination", true, "not a destination", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ppID, err := client.CreatePullPayment(tt.name, 1_000_000, tt.autoApprove)
+			if err != nil {
+				t.Fatalf("CreatePullPayment: %v", err)
+			}
+			payout, err := client.CreatePayout(ppID, tt.destination)
+			if tt.rejected {
+				var apiErr *btcpay.APIError
+				if !errors.As(err, &apiErr) || !apiErr.Rejected() {
+					t.Fatalf("CreatePayout err = %v, want rejection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreatePayout: %v", err)
+			}
+			if payout.State != tt.wantState || payout.Destination != tt.destination || payout.PullPaymentID != ppID {
+				t.Errorf("payout = %+v", payout)
+			}
+			if _, err := client.CreatePayout(ppID, tt.destination); err == nil {
+				t.Error("claiming a pull payment twice succeeded")
+			}
+		})
+	}
+
+	ppID, _ := client.CreatePullPayment("archived", 1000, true)
+	if err := client.ArchivePullPayment(ppID); err != nil {
+		t.Fatalf("ArchivePullPayment: %v", err)
+	}
+	if _, err := client.CreatePayout(ppID, "alice@example.com"); err == nil {
+		t.Error("claiming an archived pull payment succeeded")
+	}
+
+	id := srv.Payouts()[0].ID
+	if err := srv.CompletePayout(id); err != nil {
+		t.Fatalf("CompletePayout: %v", err)
+	}
+	if p, err := client.GetPayout(id); err != nil || p.State != btcpay.PayoutCompleted {
+		t.Errorf("GetPayout = %+v, %v", p, err)
+	}
+	if _, err := btcpay.NewClient(srv.URL(), "key", "other").GetPayout(id); err == nil {
+		t.Error("GetPayout from another store succeeded")
+	}
+}
+
+func TestRefundInvoice(t *testing.T) {
+	srv := btcpaytest.NewServer("key", "store")
+	defer srv.Close()
+	client := srv.Client()
+
+	id, _, err := client.CreateInvoice(1_000_000, "refunded")
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	if _, err := client.RefundInvoice(id, "unpaid"); err == nil {
+		t.Error("refunding an unpaid invoice succeeded")
+	}
+	srv.MarkSettled(id)
+	ppID, err := client.RefundInvoice(id, "Refund")
+	if err != nil {
+		t.Fatalf("RefundInvoice: %v", err)
+	}
+	if pp := srv.PullPayments(); len(pp) != 1 || pp[0].ID != ppID || pp[0].InvoiceID != id || pp[0].Amount != "0.01" {
+		t.Errorf("pull payments = %+v", pp)
+	}
+	if p, err := client.CreatePayout(ppID, "alice@example.com"); err != nil || p.State != btcpay.PayoutAwaitingApproval {
+		t.Errorf("CreatePayout = %+v, %v", p, err)
+	}
+}
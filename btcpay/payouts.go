@@ -0,0 +1,179 @@
+package btcpay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Payment methods of the Greenfield API
+const (
+	PaymentMethodLightning = "BTC-LightningNetwork"
+	PaymentMethodOnChain   = "BTC-OnChain"
+)
+
+// Payout states reported by the Greenfield API
+const (
+	PayoutAwaitingApproval = "AwaitingApproval"
+	PayoutAwaitingPayment  = "AwaitingPayment"
+	PayoutInProgress       = "InProgress"
+	PayoutCompleted        = "Completed"
+	PayoutCancelled        = "Cancelled"
+)
+
+// Payout holds the details of a BTCPay Server payout
+type Payout struct {
+	ID            string `json:"id"`
+	PullPaymentID string `json:"pullPaymentId"`
+	Destination   string `json:"destination"`
+	Amount        string `json:"amount"`
+	PaymentMethod string `json:"paymentMethod"`
+	State         string `json:"state"`
+}
+
+// APIError is an error response of the Greenfield API
+type APIError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code: %d: %s", e.StatusCode, e.Message)
+}
+
+// Rejected reports whether the request itself was refused, e.g. because of
+// an invalid destination, rather than the server failing
+func (e *APIError) Rejected() bool {
+	return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+}
+
+// CreatePullPayment creates a pull payment of amountSats that can be claimed
+// over Lightning and returns its ID. Unless autoApprove is set, claims wait
+// for the store owner to approve them.
+func (bc *Client) CreatePullPayment(name string, amountSats int64, autoApprove bool) (string, error) {
+	body := map[string]interface{}{
+		"name":              name,
+		"amount":            float64(amountSats) / 100_000_000,
+		"currency":          "BTC",
+		"paymentMethods":    []string{PaymentMethodLightning},
+		"autoApproveClaims": autoApprove,
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	url := fmt.Sprintf("%s/api/v1/stores/%s/pull-payments", bc.baseURL, bc.storeID)
+	if err := bc.do("POST", url, body, &result); err != nil {
+		return "", err
+	}
+	if result.ID == "" {
+		return "", fmt.Errorf("invalid pull payment ID in response")
+	}
+	return result.ID, nil
+}
+
+// RefundInvoice creates the pull payment returning what was paid to a
+// settled invoice, at the rate of the payment, and returns its ID. The
+// refund is claimed over Lightning like any pull payment.
+func (bc *Client) RefundInvoice(invoiceID, name string) (string, error) {
+	body := map[string]interface{}{
+		"name":          name,
+		"paymentMethod": PaymentMethodLightning,
+		"refundVariant": "RateThen",
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	url := fmt.Sprintf("%s/api/v1/stores/%s/invoices/%s/refund", bc.baseURL, bc.storeID, invoiceID)
+	if err := bc.do("POST", url, body, &result); err != nil {
+		return "", err
+	}
+	if result.ID == "" {
+		return "", fmt.Errorf("invalid pull payment ID in response")
+	}
+	return result.ID, nil
+}
+
+// ArchivePullPayment archives a pull payment so that it can no longer be claimed
+func (bc *Client) ArchivePullPayment(pullPaymentID string) error {
+	url := fmt.Sprintf("%s/api/v1/stores/%s/pull-payments/%s", bc.baseURL, bc.storeID, pullPaymentID)
+	return bc.do("DELETE", url, nil, nil)
+}
+
+// CreatePayout claims the full amount of a pull payment to a Lightning
+// address, LNURL or BOLT11 invoice
+func (bc *Client) CreatePayout(pullPaymentID, destination string) (*Payout, error) {
+	body := map[string]interface{}{
+		"destination":   destination,
+		"paymentMethod": PaymentMethodLightning,
+	}
+	var payout Payout
+	url := fmt.Sprintf("%s/api/v1/pull-payments/%s/payouts", bc.baseURL, pullPaymentID)
+	if err := bc.do("POST", url, body, &payout); err != nil {
+		return nil, err
+	}
+	if payout.ID == "" {
+		return nil, fmt.Errorf("invalid payout ID in response")
+	}
+	return &payout, nil
+}
+
+// GetPayout fetches a BTCPay Server payout
+func (bc *Client) GetPayout(payoutID string) (*Payout, error) {
+	var payout Payout
+	url := fmt.Sprintf("%s/api/v1/stores/%s/payouts/%s", bc.baseURL, bc.storeID, payoutID)
+	if err := bc.do("GET", url, nil, &payout); err != nil {
+		return nil, err
+	}
+	if payout.State == "" {
+		return nil, fmt.Errorf("invalid state in response")
+	}
+	return &payout, nil
+}
+
+// do sends an authenticated request with a JSON body, if any, and decodes
+// the JSON response into result, if any. Error responses are returned as
+// *APIError.
+func (bc *Client) do(method, url string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonBody, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(jsonBody)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", bc.apiKey))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return apiErr
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package btcpay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Webhook event types sent by BTCPay Server
+const (
+	EventInvoiceCreated         = "InvoiceCreated"
+	EventInvoiceReceivedPayment = "InvoiceReceivedPayment"
+	EventInvoicePaymentSettled  = "InvoicePaymentSettled"
+	EventInvoiceProcessing      = "InvoiceProcessing"
+	EventInvoiceSettled         = "InvoiceSettled"
+	EventInvoiceExpired         = "InvoiceExpired"
+	EventInvoiceInvalid         = "InvoiceInvalid"
+	EventPayoutCreated          = "PayoutCreated"
+	EventPayoutApproved         = "PayoutApproved"
+	EventPayoutUpdated          = "PayoutUpdated"
+)
+
+// SignatureHeader is the HTTP header carrying the webhook signature
+const SignatureHeader = "BTCPay-Sig"
+
+// WebhookEvent represents an invoice or payout event delivered by a BTCPay
+// Server webhook
+type WebhookEvent struct {
+	DeliveryID         string                 `json:"deliveryId"`
+	WebhookID          string                 `json:"webhookId"`
+	OriginalDeliveryID string                 `json:"originalDeliveryId"`
+	IsRedelivery       bool                   `json:"isRedelivery"`
+	Type               string                 `json:"type"`
+	Timestamp          int64                  `json:"timestamp"`
+	StoreID            string                 `json:"storeId"`
+	InvoiceID          string                 `json:"invoiceId,omitempty"`
+	Metadata           map[string]interface{} `json:"metadata,omitempty"`
+	PayoutID           string                 `json:"payoutId,omitempty"`
+	PullPaymentID      string                 `json:"pullPaymentId,omitempty"`
+	PayoutState        string                 `json:"payoutState,omitempty"`
+}
+
+// IsPayout reports whether the event is about a payout rather than an invoice
+func (e *WebhookEvent) IsPayout() bool {
+	return e.PayoutID != ""
+}
+
+// SignWebhook computes the BTCPay-Sig header value for a webhook body
+func SignWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseWebhook verifies the signature of a webhook body and decodes the event
+func ParseWebhook(body []byte, signature, secret string) (*WebhookEvent, error) {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return nil, fmt.Errorf("missing webhook signature")
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignWebhook(body, secret))) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook event: %v", err)
+	}
+	return &event, nil
+}
@@ -1,19 +1,91 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/fees"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
 )
 
+// RateLimit is a token bucket allowing Burst events per Per
+type RateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
 // Config holds the application configuration
 type Config struct {
-	TelegramToken string
-	BTCPayURL     string
-	BTCPayAPIKey  string
-	BTCPayStoreID string
-	DBPath        string
+	TelegramToken  string
+	TelegramAPIURL string
+	BTCPayURL      string
+	BTCPayAPIKey   string
+	BTCPayStoreID  string
+	DBPath         string
+
+	// Secret of the BTCPay webhook served by the API, empty to disable it
+	BTCPayWebhookSecret string
+	// Pay buyers out without waiting for the store owner to approve payouts
+	PayoutAutoApprove bool
+	// Bitcoin network of the BTCPay store: mainnet, testnet, signet or regtest
+	BTCPayNetwork string
+	// Confirmations an on-chain payment needs before its offer is paid
+	OnChainConfirmations int
+
+	// Telegram user IDs allowed to run admin commands
+	AdminIDs []int64
+	// Username users are pointed to for support, without @
+	SupportUsername string
+	// Numeric ID of the Telegram channel new offers are posted to, e.g.
+	// "-1001234567890". Empty disables publishing.
+	MarketplaceChannelID string
+
+	// Matrix frontend, enabled when a homeserver and access token are set
+	MatrixHomeserverURL string
+	MatrixAccessToken   string
+	MatrixUserID        string
+
+	// Anti-spam limits. Rate limits allow Burst commands per Per, refilled
+	// continuously; a zero limit disables it.
+	UserRateLimit    RateLimit // Any command or button, per user
+	SellRateLimit    RateLimit // Offer creation, which creates a BTCPay invoice
+	ListRateLimit    RateLimit // Offer listing, which queries BTCPay
+	MaxOpenOffers    int       // Pending and paid offers per user, 0 for no cap
+	MaxOfferInvoices int       // Invoices per offer, refreshes included, 0 for no cap
+	CancelCooldown   time.Duration
+	// Account tiers capping the size and daily volume of trades, from the
+	// lowest to the highest; no caps when empty
+	TradeTiers []models.Tier
+
+	// Platform fee charged on trades. The default rule is a percentage
+	// bounded in sats, currencies can override it, and promotions waive it.
+	Fees fees.Schedule
+
+	// Referral program: share of the fees paid by invited users credited to
+	// the user who invited them, paid out to their Lightning address
+	ReferralSharePercent  int
+	ReferralMinPayoutSats int64
+
+	// Seller bonds: the refundable bond sellers post, 0 to disable bonds,
+	// and whether offers of sellers without one are left out of the
+	// marketplace
+	BondSats     int64
+	BondRequired bool
+
+	// Nostr publishing of offers as NIP-69 orders, enabled when a secret key
+	// (hex) and relays are set
+	NostrPrivateKey string
+	NostrRelays     []string
+	NostrNetwork    string // Bitcoin network announced in orders
+	NostrIngest     bool   // List orders of other marketplaces read from the relays
+
+	// Address of the REST API server, e.g. ":8080". Empty disables the API.
+	APIAddr string
 }
 
 // NewConfig creates a new configuration from environment variables
@@ -25,11 +97,59 @@ func NewConfig() *Config {
 	}
 
 	return &Config{
-		TelegramToken: getEnv("TELEGRAM_BOT_TOKEN", "YOUR_TELEGRAM_BOT_TOKEN"),
-		BTCPayURL:     getEnv("BTCPAY_URL", "https://your.btcpayserver.com"),
-		BTCPayAPIKey:  getEnv("BTCPAY_API_KEY", "YOUR_BTCPAY_API_KEY"),
-		BTCPayStoreID: getEnv("BTCPAY_STORE_ID", "YOUR_BTCPAY_STORE_ID"),
-		DBPath:        getEnv("DB_PATH", "./btc_trades.db"),
+		TelegramToken:  getEnv("TELEGRAM_BOT_TOKEN", "YOUR_TELEGRAM_BOT_TOKEN"),
+		TelegramAPIURL: getEnv("TELEGRAM_API_URL", "https://api.telegram.org"),
+		BTCPayURL:      getEnv("BTCPAY_URL", "https://your.btcpayserver.com"),
+		BTCPayAPIKey:   getEnv("BTCPAY_API_KEY", "YOUR_BTCPAY_API_KEY"),
+		BTCPayStoreID:  getEnv("BTCPAY_STORE_ID", "YOUR_BTCPAY_STORE_ID"),
+		DBPath:         getEnv("DB_PATH", "./btc_trades.db"),
+
+		BTCPayWebhookSecret: getEnv("BTCPAY_WEBHOOK_SECRET", ""),
+		PayoutAutoApprove:   getEnvBool("PAYOUT_AUTO_APPROVE", true),
+		BTCPayNetwork:       getEnv("BTCPAY_NETWORK", "mainnet"),
+
+		OnChainConfirmations: getEnvInt("ONCHAIN_CONFIRMATIONS", 1),
+
+		AdminIDs:        getEnvIDs("ADMIN_IDS"),
+		SupportUsername: strings.TrimPrefix(getEnv("SUPPORT_USERNAME", ""), "@"),
+
+		MarketplaceChannelID: getEnv("MARKETPLACE_CHANNEL_ID", ""),
+
+		MatrixHomeserverURL: getEnv("MATRIX_HOMESERVER_URL", ""),
+		MatrixAccessToken:   getEnv("MATRIX_ACCESS_TOKEN", ""),
+		MatrixUserID:        getEnv("MATRIX_USER_ID", ""),
+
+		UserRateLimit:    getEnvRateLimit("RATE_LIMIT_USER", "20/1m"),
+		SellRateLimit:    getEnvRateLimit("RATE_LIMIT_SELL", "5/1h"),
+		ListRateLimit:    getEnvRateLimit("RATE_LIMIT_LIST", "10/1m"),
+		MaxOpenOffers:    getEnvInt("MAX_OPEN_OFFERS", 10),
+		MaxOfferInvoices: getEnvInt("MAX_OFFER_INVOICES", 10),
+		CancelCooldown:   getEnvDuration("CANCEL_COOLDOWN", time.Minute),
+		TradeTiers:       getEnvTiers("TRADE_TIERS"),
+
+		Fees: fees.Schedule{
+			Default: fees.Rule{
+				Percent: getEnvFloat("FEE_PERCENT", 0),
+				MinSats: int64(getEnvInt("FEE_MIN_SATS", 0)),
+				MaxSats: int64(getEnvInt("FEE_MAX_SATS", 0)),
+			},
+			MakerPercent: getEnvInt("FEE_MAKER_PERCENT", 50),
+			Overrides:    getEnvFeeOverrides("FEE_OVERRIDES"),
+			Promotions:   getEnvPromotions("FEE_PROMOTIONS"),
+		},
+
+		ReferralSharePercent:  getEnvInt("REFERRAL_SHARE_PERCENT", 20),
+		ReferralMinPayoutSats: int64(getEnvInt("REFERRAL_MIN_PAYOUT_SATS", 1000)),
+
+		BondSats:     int64(getEnvInt("BOND_SATS", 0)),
+		BondRequired: getEnvBool("BOND_REQUIRED", true),
+
+		NostrPrivateKey: getEnv("NOSTR_PRIVATE_KEY", ""),
+		NostrRelays:     getEnvList("NOSTR_RELAYS"),
+		NostrNetwork:    getEnv("NOSTR_NETWORK", "mainnet"),
+		NostrIngest:     getEnvBool("NOSTR_INGEST", false),
+
+		APIAddr: getEnv("API_ADDR", ""),
 	}
 }
 
@@ -40,4 +160,263 @@ func getEnv(key, defaultValue string) string {
 		return defaultValue
 	}
 	return value
-} 
\ No newline at end of file
+}
+
+// getEnvIDs parses a comma-separated list of user IDs, skipping invalid entries
+func getEnvIDs(key string) []int64 {
+	var ids []int64
+	for _, field := range strings.Split(os.Getenv(key), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid ID %q in %s", field, key)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// getEnvList parses a comma-separated list, skipping empty entries
+func getEnvList(key string) []string {
+	var values []string
+	for _, field := range strings.Split(os.Getenv(key), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	return values
+}
+
+// getEnvBool gets a boolean environment variable or returns a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// getEnvInt gets an integer environment variable or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvFloat gets a decimal environment variable or returns a default value
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+// getEnvDuration gets a duration environment variable such as "90s" or
+// returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// getEnvRateLimit gets a rate limit written as "<burst>/<period>", e.g.
+// "5/1h", or parses the default value. "0" disables the limit.
+func getEnvRateLimit(key, defaultValue string) RateLimit {
+	value := getEnv(key, defaultValue)
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, defaultValue)
+		limit, _ = parseRateLimit(defaultValue)
+	}
+	return limit
+}
+
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "0" {
+		return RateLimit{}, nil
+	}
+	burst, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("missing period")
+	}
+	n, err := strconv.Atoi(burst)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	return RateLimit{Burst: n, Per: d}, nil
+}
+
+// getEnvFeeOverrides parses a comma-separated list of fee rules written as
+// "<currency>:<percent>[:<min sats>[:<max sats>]]", e.g. "EUR:0.5:1000",
+// skipping invalid entries
+func getEnvFeeOverrides(key string) map[string]fees.Rule {
+	overrides := make(map[string]fees.Rule)
+	for _, field := range getEnvList(key) {
+		currency, rule, err := parseFeeOverride(field)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid fee rule %q in %s: %v", field, key, err)
+			continue
+		}
+		overrides[currency] = rule
+	}
+	return overrides
+}
+
+func parseFeeOverride(value string) (string, fees.Rule, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] == "" {
+		return "", fees.Rule{}, fmt.Errorf("expected <currency>:<percent>[:<min>[:<max>]]")
+	}
+	var rule fees.Rule
+	var err error
+	if rule.Percent, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return "", fees.Rule{}, err
+	}
+	if len(parts) > 2 {
+		if rule.MinSats, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+			return "", fees.Rule{}, err
+		}
+	}
+	if len(parts) > 3 {
+		if rule.MaxSats, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+			return "", fees.Rule{}, err
+		}
+	}
+	return strings.ToUpper(parts[0]), rule, nil
+}
+
+// getEnvPromotions parses a comma-separated list of fee-free periods written
+// as "[<currency>@]<start>/<end>" with RFC 3339 times, e.g.
+// "USD@2026-12-24T00:00:00Z/2026-12-27T00:00:00Z", skipping invalid entries
+func getEnvPromotions(key string) []fees.Promotion {
+	var promotions []fees.Promotion
+	for _, field := range getEnvList(key) {
+		p, err := parsePromotion(field)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid promotion %q in %s: %v", field, key, err)
+			continue
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions
+}
+
+func parsePromotion(value string) (fees.Promotion, error) {
+	var p fees.Promotion
+	if currency, period, ok := strings.Cut(value, "@"); ok {
+		p.Currency, value = strings.ToUpper(currency), period
+	}
+	start, end, ok := strings.Cut(value, "/")
+	if !ok {
+		return p, fmt.Errorf("missing end")
+	}
+	var err error
+	if p.Start, err = time.Parse(time.RFC3339, start); err != nil {
+		return p, err
+	}
+	if p.End, err = time.Parse(time.RFC3339, end); err != nil {
+		return p, err
+	}
+	if !p.End.After(p.Start) {
+		return p, fmt.Errorf("end is not after start")
+	}
+	return p, nil
+}
+
+// getEnvTiers parses a comma-separated list of account tiers written as
+// "<name>:<min account age>:<min trades>:<max trade sats>:<max daily sats>[:bond][:rating=<min>]",
+// e.g. "new:0:0:100000:200000,trusted:30d:10:0:0:bond:rating=4.5", skipping
+// invalid entries. Ages are Go durations or whole days like "30d", 0 sats
+// means no cap and the minimum rating is an average score from 1 to 5.
+func getEnvTiers(key string) []models.Tier {
+	var tiers []models.Tier
+	for _, field := range getEnvList(key) {
+		tier, err := parseTier(field)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid tier %q in %s: %v", field, key, err)
+			continue
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
+
+func parseTier(value string) (models.Tier, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 5 || len(parts) > 7 || parts[0] == "" {
+		return models.Tier{}, fmt.Errorf("expected <name>:<min age>:<min trades>:<max trade sats>:<max daily sats>[:bond][:rating=<min>]")
+	}
+	tier := models.Tier{Name: parts[0]}
+	var err error
+	if tier.MinAccountAge, err = parseAge(parts[1]); err != nil {
+		return models.Tier{}, err
+	}
+	if tier.MinTrades, err = strconv.Atoi(parts[2]); err != nil {
+		return models.Tier{}, err
+	}
+	if tier.MaxTradeSats, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+		return models.Tier{}, err
+	}
+	if tier.MaxDailySats, err = strconv.ParseInt(parts[4], 10, 64); err != nil {
+		return models.Tier{}, err
+	}
+	for _, requirement := range parts[5:] {
+		if requirement == "bond" {
+			tier.Bonded = true
+			continue
+		}
+		rating, ok := strings.CutPrefix(requirement, "rating=")
+		if !ok {
+			return models.Tier{}, fmt.Errorf("unknown requirement %q", requirement)
+		}
+		if tier.MinRating, err = strconv.ParseFloat(rating, 64); err != nil {
+			return models.Tier{}, err
+		}
+		if tier.MinRating < 0 || tier.MinRating > 5 {
+			return models.Tier{}, fmt.Errorf("minimum rating %v is not between 0 and 5", tier.MinRating)
+		}
+	}
+	return tier, nil
+}
+
+// parseAge parses a Go duration or a whole number of days like "30d"
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(value)
+}
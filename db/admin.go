@@ -0,0 +1,182 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Stats summarizes the shop activity
+type Stats struct {
+	Users       int
+	BannedUsers int
+	Offers      map[models.OfferStatus]int
+	Trades      int
+	// Volume of completed offers
+	VolumeBTC float64
+	VolumeUSD float64
+	// Platform fees of completed trades, paid by sellers and buyers
+	MakerFeesSats int64
+	TakerFeesSats int64
+}
+
+// GetStats computes the shop statistics
+func (d *Database) GetStats() (*Stats, error) {
+	stats := &Stats{Offers: make(map[models.OfferStatus]int)}
+
+	err := d.db.QueryRow("SELECT (SELECT COUNT(*) FROM users), (SELECT COUNT(*) FROM bans), (SELECT COUNT(*) FROM trades)").
+		Scan(&stats.Users, &stats.BannedUsers, &stats.Trades)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count users: %v", err)
+	}
+
+	err = d.db.QueryRow(
+		"SELECT COALESCE(SUM(maker_fee_sats), 0), COALESCE(SUM(taker_fee_sats), 0) FROM trades WHERE status = ?",
+		models.TradeCompleted,
+	).Scan(&stats.MakerFeesSats, &stats.TakerFeesSats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum fees: %v", err)
+	}
+
+	rows, err := d.db.Query("SELECT status, COUNT(*), COALESCE(SUM(amount_btc), 0), COALESCE(SUM(price_usd), 0) FROM offers GROUP BY status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count offers: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		var btc, usd float64
+		if err := rows.Scan(&status, &count, &btc, &usd); err != nil {
+			return nil, fmt.Errorf("failed to scan offer counts: %v", err)
+		}
+		stats.Offers[models.OfferStatus(status)] = count
+		if models.OfferStatus(status) == models.StatusCompleted {
+			stats.VolumeBTC, stats.VolumeUSD = btc, usd
+		}
+	}
+	return stats, nil
+}
+
+// FindUserByUsername returns the ID of the user with the given username on
+// any frontend, ignoring case
+func (d *Database) FindUserByUsername(username string) (int64, error) {
+	var userID int64
+	err := d.db.QueryRow(`
+		SELECT user_id FROM identities WHERE username = ? COLLATE NOCASE
+		UNION
+		SELECT user_id FROM users WHERE username = ? COLLATE NOCASE
+		LIMIT 1`, username, username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("user %w", ErrNotFound)
+		}
+		return 0, fmt.Errorf("failed to find user: %v", err)
+	}
+	return userID, nil
+}
+
+// GetUserIDs retrieves the IDs of all users
+func (d *Database) GetUserIDs() ([]int64, error) {
+	rows, err := d.db.Query("SELECT user_id FROM users ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch users: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// GetOfferByInvoiceID retrieves the offer a BTCPay invoice was created for,
+// whether it is the active invoice of the offer or one it replaced
+func (d *Database) GetOfferByInvoiceID(invoiceID string) (*models.Offer, error) {
+	var offerID int
+	err := d.db.QueryRow("SELECT offer_id FROM offer_invoices WHERE invoice_id = ?", invoiceID).Scan(&offerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("offer %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch offer: %v", err)
+	}
+	return d.GetOffer(offerID)
+}
+
+// BanUser bans a user. Banning a banned user updates the reason.
+func (d *Database) BanUser(userID, adminID int64, reason string) error {
+	_, err := d.db.Exec(
+		"INSERT OR REPLACE INTO bans (user_id, admin_id, reason, created_at) VALUES (?, ?, ?, ?)",
+		userID, adminID, reason, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to ban user: %v", err)
+	}
+	return nil
+}
+
+// UnbanUser lifts the ban of a user and reports whether the user was banned
+func (d *Database) UnbanUser(userID int64) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM bans WHERE user_id = ?", userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to unban user: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to unban user: %v", err)
+	}
+	return n > 0, nil
+}
+
+// IsBanned checks if a user is banned
+func (d *Database) IsBanned(userID int64) (bool, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM bans WHERE user_id = ?", userID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check ban: %v", err)
+	}
+	return count > 0, nil
+}
+
+// AddAuditEntry records an admin action
+func (d *Database) AddAuditEntry(adminID int64, action, target, details string) error {
+	_, err := d.db.Exec(
+		"INSERT INTO audit_log (admin_id, action, target, details, created_at) VALUES (?, ?, ?, ?, ?)",
+		adminID, action, target, details, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write audit entry: %v", err)
+	}
+	return nil
+}
+
+// GetAuditLog retrieves the latest admin actions, most recent first
+func (d *Database) GetAuditLog(limit int) ([]models.AuditEntry, error) {
+	rows, err := d.db.Query(
+		"SELECT id, admin_id, action, target, details, created_at FROM audit_log ORDER BY id DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch audit log: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []models.AuditEntry
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.AdminID, &e.Action, &e.Target, &e.Details, &e.CreatedAt); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+const bondColumns = `id, user_id, amount_sats, invoice_id, invoice_link, payment_request, status, trade_id,
+	recipient_id, destination, pull_payment_id, btcpay_id, payout_status, created_at, updated_at`
+
+// scanBond scans a row selected with bondColumns
+func scanBond(row interface{ Scan(...interface{}) error }) (*models.Bond, error) {
+	var b models.Bond
+	var status, payoutStatus string
+	err := row.Scan(&b.ID, &b.UserID, &b.AmountSats, &b.InvoiceID, &b.InvoiceLink, &b.PaymentRequest, &status, &b.TradeID,
+		&b.RecipientID, &b.Destination, &b.PullPaymentID, &b.BTCPayID, &payoutStatus, &b.CreatedAt, &b.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	b.Status = models.BondStatus(status)
+	b.PayoutStatus = models.PayoutStatus(payoutStatus)
+	return &b, nil
+}
+
+// CreateBond stores a pending bond of a seller and returns its ID. It
+// returns ErrDuplicate if the seller already has a pending or active bond.
+func (d *Database) CreateBond(b models.Bond) (int, error) {
+	now := time.Now()
+	res, err := d.db.Exec(
+		`INSERT INTO bonds (user_id, amount_sats, invoice_id, invoice_link, payment_request, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.UserID, b.AmountSats, b.InvoiceID, b.InvoiceLink, b.PaymentRequest, models.BondPending, now, now,
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return 0, fmt.Errorf("bond %w", ErrDuplicate)
+		}
+		return 0, fmt.Errorf("failed to create bond: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get bond ID: %v", err)
+	}
+	return int(id), nil
+}
+
+// GetBond retrieves a bond by ID
+func (d *Database) GetBond(bondID int) (*models.Bond, error) {
+	return d.getBond("id = ?", bondID)
+}
+
+// GetUserBond retrieves the latest bond of a seller
+func (d *Database) GetUserBond(userID int64) (*models.Bond, error) {
+	return d.getBond("user_id = ?", userID)
+}
+
+// GetBondByInvoiceID retrieves the bond paid with an invoice
+func (d *Database) GetBondByInvoiceID(invoiceID string) (*models.Bond, error) {
+	return d.getBond("invoice_id = ?", invoiceID)
+}
+
+// GetBondByBTCPayID retrieves the bond paid out with the given BTCPay payout
+// ID
+func (d *Database) GetBondByBTCPayID(btcpayID string) (*models.Bond, error) {
+	return d.getBond("btcpay_id = ?", btcpayID)
+}
+
+// getBond retrieves the latest bond matching a condition
+func (d *Database) getBond(where string, args ...interface{}) (*models.Bond, error) {
+	b, err := scanBond(d.db.QueryRow("SELECT "+bondColumns+" FROM bonds WHERE "+where+" ORDER BY id DESC LIMIT 1", args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("bond %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch bond: %v", err)
+	}
+	return b, nil
+}
+
+// GetBondedUserIDs returns the sellers with an active bond
+func (d *Database) GetBondedUserIDs() (map[int64]bool, error) {
+	rows, err := d.db.Query("SELECT user_id FROM bonds WHERE status = ?", models.BondActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bonded users: %v", err)
+	}
+	defer rows.Close()
+
+	bonded := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan bonded user: %v", err)
+		}
+		bonded[id] = true
+	}
+	return bonded, rows.Err()
+}
+
+// SetBondStatus moves a bond from one status to another. Released and
+// slashed bonds record the user they are paid to and, when slashed, the
+// trade whose dispute slashed them. It returns ErrClaimed if the bond is no
+// longer in the from status.
+func (d *Database) SetBondStatus(bondID int, from, to models.BondStatus, tradeID int, recipientID int64) error {
+	res, err := d.db.Exec(
+		"UPDATE bonds SET status = ?, trade_id = ?, recipient_id = ?, updated_at = ? WHERE id = ? AND status = ?",
+		to, tradeID, recipientID, time.Now(), bondID, from,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update bond status: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update bond status: %v", err)
+	} else if n == 0 {
+		return ErrClaimed
+	}
+	return nil
+}
+
+// SetBondPayout records the payout sending a released or slashed bond to
+// destination, or clears it with empty values
+func (d *Database) SetBondPayout(bondID int, destination, pullPaymentID, btcpayID string, status models.PayoutStatus) error {
+	_, err := d.db.Exec(
+		`UPDATE bonds SET destination = ?, pull_payment_id = ?, btcpay_id = ?, payout_status = ?, updated_at = ?
+		WHERE id = ?`,
+		destination, pullPaymentID, btcpayID, status, time.Now(), bondID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update bond payout: %v", err)
+	}
+	return nil
+}
@@ -2,12 +2,34 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
 )
 
+// Errors returned by database operations
+var (
+	// ErrNotFound is returned when a requested record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a value that must be unique is taken
+	ErrDuplicate = errors.New("already taken")
+	// ErrClaimed is returned when the payment of an offer is already being
+	// paid out to its buyer or refunded to its payer
+	ErrClaimed = errors.New("payment already paid out or refunded")
+	// ErrUnbalanced is returned when the postings of a ledger entry do not
+	// sum to zero
+	ErrUnbalanced = errors.New("ledger entry is unbalanced")
+	// ErrInsufficientBalance is returned when a ledger entry would leave a
+	// user account with a negative balance
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	// ErrStale is returned when a conditional update finds the record no
+	// longer in the state it was read in
+	ErrStale = errors.New("record changed concurrently")
+)
+
 // Database wraps the SQL database connection
 type Database struct {
 	db *sql.DB
@@ -15,7 +37,9 @@ type Database struct {
 
 // NewDatabase initializes the database connection and schema
 func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// Transactions take the write lock when they begin, so that concurrent
+	// writers wait for each other instead of failing with "database is locked"
+	db, err := sql.Open("sqlite3", dbPath+"?_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
@@ -39,12 +63,296 @@ func NewDatabase(dbPath string) (*Database, error) {
 			updated_at TIMESTAMP,
 			FOREIGN KEY(user_id) REFERENCES users(user_id)
 		);
+		CREATE TABLE IF NOT EXISTS identities (
+			frontend TEXT,
+			external_id TEXT,
+			user_id INTEGER,
+			chat_id TEXT,
+			username TEXT,
+			PRIMARY KEY(frontend, external_id),
+			FOREIGN KEY(user_id) REFERENCES users(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS trades (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			offer_id INTEGER,
+			seller_id INTEGER,
+			buyer_id INTEGER,
+			status TEXT DEFAULT 'open',
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			FOREIGN KEY(offer_id) REFERENCES offers(id)
+		);
+		CREATE TABLE IF NOT EXISTS trade_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			trade_id INTEGER,
+			sender_id INTEGER,
+			text TEXT,
+			photo_id TEXT,
+			frontend TEXT,
+			created_at TIMESTAMP,
+			FOREIGN KEY(trade_id) REFERENCES trades(id)
+		);
+		CREATE TABLE IF NOT EXISTS ratings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			trade_id INTEGER,
+			rater_id INTEGER,
+			rated_id INTEGER,
+			score INTEGER,
+			created_at TIMESTAMP,
+			UNIQUE(trade_id, rater_id),
+			FOREIGN KEY(trade_id) REFERENCES trades(id)
+		);
+		CREATE TABLE IF NOT EXISTS payouts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			trade_id INTEGER,
+			user_id INTEGER,
+			destination TEXT,
+			amount_sats INTEGER,
+			pull_payment_id TEXT,
+			btcpay_id TEXT,
+			status TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			FOREIGN KEY(trade_id) REFERENCES trades(id)
+		);
+		CREATE TABLE IF NOT EXISTS refunds (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			offer_id INTEGER,
+			trade_id INTEGER,
+			user_id INTEGER,
+			invoice_id TEXT UNIQUE,
+			amount_sats INTEGER,
+			destination TEXT,
+			pull_payment_id TEXT,
+			btcpay_id TEXT,
+			status TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			FOREIGN KEY(offer_id) REFERENCES offers(id)
+		);
+		CREATE TABLE IF NOT EXISTS referral_credits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			referrer_id INTEGER,
+			referred_id INTEGER,
+			trade_id INTEGER,
+			fee_sats INTEGER,
+			amount_sats INTEGER,
+			payout_id INTEGER DEFAULT 0,
+			created_at TIMESTAMP,
+			UNIQUE(trade_id, referred_id),
+			FOREIGN KEY(trade_id) REFERENCES trades(id)
+		);
+		CREATE TABLE IF NOT EXISTS referral_payouts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			destination TEXT,
+			amount_sats INTEGER,
+			pull_payment_id TEXT,
+			btcpay_id TEXT,
+			status TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS bonds (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			amount_sats INTEGER,
+			invoice_id TEXT UNIQUE,
+			invoice_link TEXT,
+			payment_request TEXT DEFAULT '',
+			status TEXT,
+			trade_id INTEGER DEFAULT 0,
+			recipient_id INTEGER DEFAULT 0,
+			destination TEXT DEFAULT '',
+			pull_payment_id TEXT DEFAULT '',
+			btcpay_id TEXT DEFAULT '',
+			payout_status TEXT DEFAULT '',
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS ledger_accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER DEFAULT 0,
+			name TEXT,
+			UNIQUE(user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS ledger_entries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			reference TEXT UNIQUE,
+			kind TEXT,
+			created_at TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS ledger_postings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			entry_id INTEGER,
+			account_id INTEGER,
+			amount_sats INTEGER,
+			FOREIGN KEY(entry_id) REFERENCES ledger_entries(id),
+			FOREIGN KEY(account_id) REFERENCES ledger_accounts(id)
+		);
+		CREATE INDEX IF NOT EXISTS ledger_postings_account ON ledger_postings (account_id);
+		CREATE VIEW IF NOT EXISTS ledger_balances AS
+			SELECT a.id AS account_id, a.user_id, a.name, COALESCE(SUM(p.amount_sats), 0) AS balance_sats
+			FROM ledger_accounts a
+			LEFT JOIN ledger_postings p ON p.account_id = a.id
+			GROUP BY a.id;
+		CREATE TRIGGER IF NOT EXISTS ledger_entries_no_update BEFORE UPDATE ON ledger_entries
+		BEGIN SELECT RAISE(ABORT, 'ledger entries are immutable'); END;
+		CREATE TRIGGER IF NOT EXISTS ledger_entries_no_delete BEFORE DELETE ON ledger_entries
+		BEGIN SELECT RAISE(ABORT, 'ledger entries are immutable'); END;
+		CREATE TRIGGER IF NOT EXISTS ledger_postings_no_update BEFORE UPDATE ON ledger_postings
+		BEGIN SELECT RAISE(ABORT, 'ledger postings are immutable'); END;
+		CREATE TRIGGER IF NOT EXISTS ledger_postings_no_delete BEFORE DELETE ON ledger_postings
+		BEGIN SELECT RAISE(ABORT, 'ledger postings are immutable'); END;
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER,
+			created_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS bans (
+			user_id INTEGER PRIMARY KEY,
+			admin_id INTEGER,
+			reason TEXT,
+			created_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			admin_id INTEGER,
+			action TEXT,
+			target TEXT,
+			details TEXT,
+			created_at TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS sent_messages (
+			frontend TEXT,
+			chat_id TEXT,
+			message_id TEXT,
+			kind TEXT,
+			offer_id INTEGER DEFAULT 0,
+			user_id INTEGER,
+			created_at TIMESTAMP,
+			PRIMARY KEY(frontend, chat_id, message_id, offer_id)
+		);
+		CREATE TABLE IF NOT EXISTS link_codes (
+			code TEXT PRIMARY KEY,
+			user_id INTEGER,
+			expires_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS offer_invoices (
+			invoice_id TEXT PRIMARY KEY,
+			offer_id INTEGER,
+			invoice_link TEXT,
+			active INTEGER DEFAULT 1,
+			created_at TIMESTAMP,
+			FOREIGN KEY(offer_id) REFERENCES offers(id)
+		);
+
+		-- Users registered before frontends existed are Telegram users
+		INSERT OR IGNORE INTO identities (frontend, external_id, user_id, chat_id, username)
+			SELECT 'telegram', CAST(user_id AS TEXT), user_id, CAST(user_id AS TEXT), username
+			FROM users WHERE user_id > 0;
+
+		-- Offers created before invoices could be refreshed have a single invoice
+		INSERT OR IGNORE INTO offer_invoices (invoice_id, offer_id, invoice_link, active, created_at)
+			SELECT invoice_id, id, invoice_link, 1, created_at FROM offers;
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create schema: %v", err)
 	}
 
-	return &Database{db: db}, nil
+	d := &Database{db: db}
+	if err := d.migrate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// migrate adds the columns introduced after the tables were first created
+func (d *Database) migrate() error {
+	columns := []struct{ table, column, definition string }{
+		{"users", "language", "TEXT DEFAULT ''"},                  // language chosen with /language
+		{"identities", "language", "TEXT DEFAULT ''"},             // language reported by the frontend
+		{"users", "chat_trade_id", "INTEGER DEFAULT 0"},           // trade chat the user is in
+		{"users", "nickname", "TEXT DEFAULT ''"},                  // public handle chosen with /nick
+		{"users", "chat_peer_id", "INTEGER DEFAULT 0"},            // user the user is messaging
+		{"trades", "payout_destination", "TEXT DEFAULT ''"},       // where the buyer is paid out
+		{"users", "lightning_address", "TEXT DEFAULT ''"},         // default payout destination
+		{"offers", "payment_request", "TEXT DEFAULT ''"},          // BOLT11 invoice of the offer
+		{"offers", "payment_method", "TEXT DEFAULT 'lightning'"},  // how the invoice is paid
+		{"offers", "payment_address", "TEXT DEFAULT ''"},          // on-chain address of the offer
+		{"offers", "confirmations", "INTEGER DEFAULT -1"},         // of the on-chain payment
+		{"offers", "confirmations_required", "INTEGER DEFAULT 0"}, // before the offer is paid
+		{"offers", "maker_fee_sats", "INTEGER DEFAULT 0"},         // fee included in the invoice
+		{"trades", "maker_fee_sats", "INTEGER DEFAULT 0"},         // fee paid by the seller
+		{"trades", "taker_fee_sats", "INTEGER DEFAULT 0"},         // fee deducted from the payout
+		{"users", "referral_code", "TEXT DEFAULT ''"},             // code of the invite link
+		{"users", "referrer_id", "INTEGER DEFAULT 0"},             // user who invited the user
+		{"trades", "disputed_by", "INTEGER DEFAULT 0"},            // participant who opened a dispute
+		{"refunds", "duplicate", "INTEGER DEFAULT 0"},             // refund of a second payment
+		{"users", "last_cancel_at", "DATETIME"},                   // last offer the user cancelled
+	}
+	for _, c := range columns {
+		if err := d.addColumn(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// Nicknames are unique regardless of case
+	if _, err := d.db.Exec(
+		"CREATE UNIQUE INDEX IF NOT EXISTS users_nickname ON users (nickname COLLATE NOCASE) WHERE nickname != ''",
+	); err != nil {
+		return fmt.Errorf("failed to create nickname index: %v", err)
+	}
+	// Referral codes are unique regardless of case
+	if _, err := d.db.Exec(
+		"CREATE UNIQUE INDEX IF NOT EXISTS users_referral_code ON users (referral_code COLLATE NOCASE) WHERE referral_code != ''",
+	); err != nil {
+		return fmt.Errorf("failed to create referral code index: %v", err)
+	}
+	// Offers have a single active invoice
+	if _, err := d.db.Exec(
+		"CREATE UNIQUE INDEX IF NOT EXISTS offer_invoices_active ON offer_invoices (offer_id) WHERE active = 1",
+	); err != nil {
+		return fmt.Errorf("failed to create offer invoice index: %v", err)
+	}
+	// Sellers have a single pending or active bond
+	if _, err := d.db.Exec(
+		"CREATE UNIQUE INDEX IF NOT EXISTS bonds_open ON bonds (user_id) WHERE status IN ('pending', 'active')",
+	); err != nil {
+		return fmt.Errorf("failed to create bond index: %v", err)
+	}
+	return nil
+}
+
+// addColumn adds a column to a table unless it already exists
+func (d *Database) addColumn(table, column, definition string) error {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
+	return nil
 }
 
 // RegisterUser registers a new user in the database
@@ -59,6 +367,89 @@ func (d *Database) RegisterUser(userID int64, username string) error {
 	return nil
 }
 
+// GetUser retrieves a user by ID
+func (d *Database) GetUser(userID int64) (*models.User, error) {
+	return d.getUser("user_id = ?", userID)
+}
+
+// GetUserByNickname retrieves a user by nickname, ignoring case
+func (d *Database) GetUserByNickname(nickname string) (*models.User, error) {
+	return d.getUser("nickname = ? COLLATE NOCASE AND nickname != ''", nickname)
+}
+
+// getUser retrieves the user matching a WHERE clause
+func (d *Database) getUser(where string, args ...interface{}) (*models.User, error) {
+	var u models.User
+	var username sql.NullString
+	err := d.db.QueryRow(
+		`SELECT user_id, username, COALESCE(nickname, ''), COALESCE(language, ''), COALESCE(lightning_address, ''),
+			COALESCE(referral_code, ''), COALESCE(referrer_id, 0), created_at
+		FROM users WHERE `+where, args...,
+	).Scan(&u.ID, &username, &u.Nickname, &u.Language, &u.LightningAddress, &u.ReferralCode, &u.ReferrerID, &u.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("user %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	u.Username = username.String
+	return &u, nil
+}
+
+// SetNickname stores the public handle of a user. It returns ErrDuplicate if
+// another user has the nickname.
+func (d *Database) SetNickname(userID int64, nickname string) error {
+	_, err := d.db.Exec("UPDATE users SET nickname = ? WHERE user_id = ?", nickname, userID)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return fmt.Errorf("nickname %w", ErrDuplicate)
+		}
+		return fmt.Errorf("failed to set nickname: %v", err)
+	}
+	return nil
+}
+
+// SetLightningAddress stores the default payout destination of a user. An
+// empty address clears it.
+func (d *Database) SetLightningAddress(userID int64, address string) error {
+	_, err := d.db.Exec("UPDATE users SET lightning_address = ? WHERE user_id = ?", address, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set Lightning address: %v", err)
+	}
+	return nil
+}
+
+// SetLastCancel records when a user last cancelled one of their offers
+func (d *Database) SetLastCancel(userID int64, at time.Time) error {
+	_, err := d.db.Exec("UPDATE users SET last_cancel_at = ? WHERE user_id = ?", at, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set last cancellation: %v", err)
+	}
+	return nil
+}
+
+// GetLastCancel returns when a user last cancelled one of their offers, or
+// the zero time if they never did
+func (d *Database) GetLastCancel(userID int64) (time.Time, error) {
+	var at sql.NullTime
+	err := d.db.QueryRow("SELECT last_cancel_at FROM users WHERE user_id = ?", userID).Scan(&at)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("failed to fetch last cancellation: %v", err)
+	}
+	return at.Time, nil
+}
+
+// SetUserLanguage stores the language chosen by a user. An empty language
+// clears the choice.
+func (d *Database) SetUserLanguage(userID int64, lang string) error {
+	_, err := d.db.Exec("UPDATE users SET language = ? WHERE user_id = ?", lang, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set user language: %v", err)
+	}
+	return nil
+}
+
 // UserExists checks if a user exists in the database
 func (d *Database) UserExists(userID int64) (bool, error) {
 	var count int
@@ -69,22 +460,44 @@ func (d *Database) UserExists(userID int64) (bool, error) {
 	return count > 0, nil
 }
 
-// CreateOffer creates a new offer in the database
-func (d *Database) CreateOffer(userID int64, amountBTC, priceUSD float64, invoiceID, invoiceLink string) error {
+// CreateOffer creates a new offer in the database and returns its ID. On-chain
+// payments of the offer need confirmationsRequired confirmations, and its
+// invoice includes a platform fee of makerFeeSats.
+func (d *Database) CreateOffer(userID int64, amountBTC, priceUSD float64, method models.PaymentMethod, confirmationsRequired int, makerFeeSats int64, invoiceID, invoiceLink string) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
 	now := time.Now()
-	_, err := d.db.Exec(
-		"INSERT INTO offers (user_id, amount_btc, price_usd, invoice_id, invoice_link, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		userID, amountBTC, priceUSD, invoiceID, invoiceLink, models.StatusPending, now, now,
+	res, err := tx.Exec(
+		`INSERT INTO offers (user_id, amount_btc, price_usd, payment_method, confirmations_required, maker_fee_sats, invoice_id, invoice_link, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, amountBTC, priceUSD, method, confirmationsRequired, makerFeeSats, invoiceID, invoiceLink, models.StatusPending, now, now,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create offer: %v", err)
+		return 0, fmt.Errorf("failed to create offer: %v", err)
 	}
-	return nil
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get offer ID: %v", err)
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO offer_invoices (invoice_id, offer_id, invoice_link, active, created_at) VALUES (?, ?, ?, 1, ?)",
+		invoiceID, id, invoiceLink, now,
+	); err != nil {
+		return 0, fmt.Errorf("failed to record offer invoice: %v", err)
+	}
+	return int(id), tx.Commit()
 }
 
+// offerTaken selects whether the offer o has an open trade
+const offerTaken = "EXISTS (SELECT 1 FROM trades t WHERE t.offer_id = o.id AND t.status = 'open')"
+
 // GetUserOffers retrieves all offers for a specific user
 func (d *Database) GetUserOffers(userID int64) ([]models.Offer, error) {
-	rows, err := d.db.Query("SELECT id, user_id, amount_btc, price_usd, invoice_id, invoice_link, status, created_at, updated_at FROM offers WHERE user_id = ? ORDER BY created_at DESC", userID)
+	rows, err := d.db.Query("SELECT o.id, o.user_id, o.amount_btc, o.price_usd, o.invoice_id, o.invoice_link, o.payment_request, o.payment_method, o.payment_address, o.confirmations, o.confirmations_required, o.maker_fee_sats, o.status, o.created_at, o.updated_at, "+offerTaken+" FROM offers o WHERE o.user_id = ? ORDER BY o.created_at DESC", userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch offers: %v", err)
 	}
@@ -94,7 +507,7 @@ func (d *Database) GetUserOffers(userID int64) ([]models.Offer, error) {
 	for rows.Next() {
 		var o models.Offer
 		var status string
-		if err := rows.Scan(&o.ID, &o.UserID, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &status, &o.CreatedAt, &o.UpdatedAt); err != nil {
+		if err := rows.Scan(&o.ID, &o.UserID, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &o.PaymentRequest, &o.PaymentMethod, &o.PaymentAddress, &o.Confirmations, &o.ConfirmationsRequired, &o.MakerFeeSats, &status, &o.CreatedAt, &o.UpdatedAt, &o.Taken); err != nil {
 			continue
 		}
 		o.Status = models.OfferStatus(status)
@@ -111,15 +524,15 @@ func (d *Database) GetOffer(offerID int) (*models.Offer, error) {
 	var username string
 
 	err := d.db.QueryRow(`
-		SELECT o.id, o.user_id, u.username, o.amount_btc, o.price_usd, o.invoice_id, o.invoice_link, o.status, o.created_at, o.updated_at 
+		SELECT o.id, o.user_id, u.username, o.amount_btc, o.price_usd, o.invoice_id, o.invoice_link, o.payment_request, o.payment_method, o.payment_address, o.confirmations, o.confirmations_required, o.maker_fee_sats, o.status, o.created_at, o.updated_at, `+offerTaken+`
 		FROM offers o 
 		JOIN users u ON o.user_id = u.user_id 
 		WHERE o.id = ?`, offerID).Scan(
-		&o.ID, &o.UserID, &username, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &status, &o.CreatedAt, &o.UpdatedAt)
+		&o.ID, &o.UserID, &username, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &o.PaymentRequest, &o.PaymentMethod, &o.PaymentAddress, &o.Confirmations, &o.ConfirmationsRequired, &o.MakerFeeSats, &status, &o.CreatedAt, &o.UpdatedAt, &o.Taken)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("offer not found")
+			return nil, fmt.Errorf("offer %w", ErrNotFound)
 		}
 		return nil, fmt.Errorf("failed to fetch offer: %v", err)
 	}
@@ -130,30 +543,79 @@ func (d *Database) GetOffer(offerID int) (*models.Offer, error) {
 	return &o, nil
 }
 
-// UpdateOfferStatus updates the status of an offer
-func (d *Database) UpdateOfferStatus(offerID int, status models.OfferStatus) error {
-	_, err := d.db.Exec(
-		"UPDATE offers SET status = ?, updated_at = ? WHERE id = ?",
-		status, time.Now(), offerID,
+// SetOfferPaymentRequest stores the BOLT11 invoice the seller pays to fund
+// an offer
+func (d *Database) SetOfferPaymentRequest(offerID int, paymentRequest string) error {
+	_, err := d.db.Exec("UPDATE offers SET payment_request = ?, updated_at = ? WHERE id = ?", paymentRequest, time.Now(), offerID)
+	if err != nil {
+		return fmt.Errorf("failed to set payment request: %v", err)
+	}
+	return nil
+}
+
+// SetOfferPaymentAddress stores the Bitcoin address the seller pays to fund
+// an offer on-chain
+func (d *Database) SetOfferPaymentAddress(offerID int, address string) error {
+	_, err := d.db.Exec("UPDATE offers SET payment_address = ?, updated_at = ? WHERE id = ?", address, time.Now(), offerID)
+	if err != nil {
+		return fmt.Errorf("failed to set payment address: %v", err)
+	}
+	return nil
+}
+
+// SetOfferConfirmations stores the confirmations of the on-chain payment of
+// an offer
+func (d *Database) SetOfferConfirmations(offerID int, confirmations int) error {
+	_, err := d.db.Exec("UPDATE offers SET confirmations = ?, updated_at = ? WHERE id = ?", confirmations, time.Now(), offerID)
+	if err != nil {
+		return fmt.Errorf("failed to set confirmations: %v", err)
+	}
+	return nil
+}
+
+// CountOpenOffers counts the pending and paid offers of a user
+func (d *Database) CountOpenOffers(userID int64) (int, error) {
+	var count int
+	err := d.db.QueryRow(
+		"SELECT COUNT(*) FROM offers WHERE user_id = ? AND status IN (?, ?)",
+		userID, models.StatusPending, models.StatusPaid,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count offers: %v", err)
+	}
+	return count, nil
+}
+
+// UpdateOfferStatus moves an offer from one status to another, returning
+// ErrStale if the offer is no longer in the status it was read in
+func (d *Database) UpdateOfferStatus(offerID int, from, to models.OfferStatus) error {
+	res, err := d.db.Exec(
+		"UPDATE offers SET status = ?, updated_at = ? WHERE id = ? AND status = ?",
+		to, time.Now(), offerID, from,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update offer status: %v", err)
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update offer status: %v", err)
+	} else if n == 0 {
+		return fmt.Errorf("offer %d %w", offerID, ErrStale)
+	}
 	return nil
 }
 
 // GetAllOffers retrieves all offers from all users, with optional limit
 func (d *Database) GetAllOffers(limit int) ([]models.Offer, error) {
 	query := `
-		SELECT o.id, o.user_id, u.username, o.amount_btc, o.price_usd, o.invoice_id, o.invoice_link, o.status, o.created_at, o.updated_at 
+		SELECT o.id, o.user_id, u.username, o.amount_btc, o.price_usd, o.invoice_id, o.invoice_link, o.payment_request, o.payment_method, o.payment_address, o.confirmations, o.confirmations_required, o.maker_fee_sats, o.status, o.created_at, o.updated_at, ` + offerTaken + `
 		FROM offers o 
 		JOIN users u ON o.user_id = u.user_id 
 		ORDER BY o.created_at DESC`
-	
+
 	if limit > 0 {
 		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
-	
+
 	rows, err := d.db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch all offers: %v", err)
@@ -164,7 +626,65 @@ func (d *Database) GetAllOffers(limit int) ([]models.Offer, error) {
 	for rows.Next() {
 		var o models.Offer
 		var status string
-		if err := rows.Scan(&o.ID, &o.UserID, &o.Username, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &status, &o.CreatedAt, &o.UpdatedAt); err != nil {
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Username, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &o.PaymentRequest, &o.PaymentMethod, &o.PaymentAddress, &o.Confirmations, &o.ConfirmationsRequired, &o.MakerFeeSats, &status, &o.CreatedAt, &o.UpdatedAt, &o.Taken); err != nil {
+			continue
+		}
+		o.Status = models.OfferStatus(status)
+		offers = append(offers, o)
+	}
+
+	return offers, nil
+}
+
+// OfferFilter selects offers in ListOffers. Zero values match everything.
+type OfferFilter struct {
+	Status       models.OfferStatus
+	UserID       int64
+	MinAmountBTC float64
+	MaxAmountBTC float64
+	Limit        int
+}
+
+// ListOffers retrieves the offers matching filter, most recent first
+func (d *Database) ListOffers(filter OfferFilter) ([]models.Offer, error) {
+	query := `
+		SELECT o.id, o.user_id, u.username, o.amount_btc, o.price_usd, o.invoice_id, o.invoice_link, o.payment_request, o.payment_method, o.payment_address, o.confirmations, o.confirmations_required, o.maker_fee_sats, o.status, o.created_at, o.updated_at, ` + offerTaken + `
+		FROM offers o
+		JOIN users u ON o.user_id = u.user_id
+		WHERE 1 = 1`
+	var args []interface{}
+	if filter.Status != "" {
+		query += " AND o.status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.UserID != 0 {
+		query += " AND o.user_id = ?"
+		args = append(args, filter.UserID)
+	}
+	if filter.MinAmountBTC > 0 {
+		query += " AND o.amount_btc >= ?"
+		args = append(args, filter.MinAmountBTC)
+	}
+	if filter.MaxAmountBTC > 0 {
+		query += " AND o.amount_btc <= ?"
+		args = append(args, filter.MaxAmountBTC)
+	}
+	query += " ORDER BY o.created_at DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list offers: %v", err)
+	}
+	defer rows.Close()
+
+	var offers []models.Offer
+	for rows.Next() {
+		var o models.Offer
+		var status string
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Username, &o.AmountBTC, &o.PriceUSD, &o.InvoiceID, &o.InvoiceLink, &o.PaymentRequest, &o.PaymentMethod, &o.PaymentAddress, &o.Confirmations, &o.ConfirmationsRequired, &o.MakerFeeSats, &status, &o.CreatedAt, &o.UpdatedAt, &o.Taken); err != nil {
 			continue
 		}
 		o.Status = models.OfferStatus(status)
@@ -177,4 +697,4 @@ func (d *Database) GetAllOffers(limit int) ([]models.Offer, error) {
 // Close closes the database connection
 func (d *Database) Close() error {
 	return d.db.Close()
-} 
\ No newline at end of file
+}
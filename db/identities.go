@@ -0,0 +1,198 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// RegisterIdentity registers a frontend identity and returns the user it
+// belongs to. Known identities get their chat, username and language
+// refreshed, and so does the username of their user. New identities create a
+// user with the given ID, or with a fresh negative ID when userID is zero so
+// that they never collide with Telegram user IDs. A new user records
+// referrerID, when not zero, as the user who invited them.
+func (d *Database) RegisterIdentity(identity models.Identity, userID, referrerID int64) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var existing int64
+	err = tx.QueryRow(
+		"SELECT user_id FROM identities WHERE frontend = ? AND external_id = ?",
+		identity.Frontend, identity.ExternalID,
+	).Scan(&existing)
+	switch {
+	case err == nil:
+		if _, err := tx.Exec(
+			"UPDATE identities SET chat_id = ?, username = ?, language = ? WHERE frontend = ? AND external_id = ?",
+			identity.ChatID, identity.Username, identity.Language, identity.Frontend, identity.ExternalID,
+		); err != nil {
+			return 0, fmt.Errorf("failed to update identity: %v", err)
+		}
+		// Users are known by their Telegram username when they have one
+		if _, err := tx.Exec(
+			`UPDATE users SET username = ? WHERE user_id = ? AND (? = 'telegram'
+				OR NOT EXISTS (SELECT 1 FROM identities WHERE user_id = ? AND frontend = 'telegram'))`,
+			identity.Username, existing, identity.Frontend, existing,
+		); err != nil {
+			return 0, fmt.Errorf("failed to update username: %v", err)
+		}
+		return existing, tx.Commit()
+	case err != sql.ErrNoRows:
+		return 0, fmt.Errorf("failed to look up identity: %v", err)
+	}
+
+	if userID == 0 {
+		if err := tx.QueryRow("SELECT COALESCE(MIN(user_id), 0) - 1 FROM users WHERE user_id < 0").Scan(&userID); err != nil {
+			return 0, fmt.Errorf("failed to allocate user ID: %v", err)
+		}
+	}
+
+	if _, err := tx.Exec(
+		"INSERT OR IGNORE INTO users (user_id, username, referrer_id, created_at) VALUES (?, ?, ?, ?)",
+		userID, identity.Username, referrerID, time.Now(),
+	); err != nil {
+		return 0, fmt.Errorf("failed to register user: %v", err)
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO identities (frontend, external_id, user_id, chat_id, username, language) VALUES (?, ?, ?, ?, ?, ?)",
+		identity.Frontend, identity.ExternalID, userID, identity.ChatID, identity.Username, identity.Language,
+	); err != nil {
+		return 0, fmt.Errorf("failed to register identity: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit identity: %v", err)
+	}
+	return userID, nil
+}
+
+// GetIdentity retrieves the identity of a frontend user
+func (d *Database) GetIdentity(frontend, externalID string) (*models.Identity, error) {
+	var i models.Identity
+	err := d.db.QueryRow(
+		"SELECT frontend, external_id, user_id, chat_id, username, COALESCE(language, '') FROM identities WHERE frontend = ? AND external_id = ?",
+		frontend, externalID,
+	).Scan(&i.Frontend, &i.ExternalID, &i.UserID, &i.ChatID, &i.Username, &i.Language)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("identity %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch identity: %v", err)
+	}
+	return &i, nil
+}
+
+// GetUserIdentities retrieves all frontend identities of a user
+func (d *Database) GetUserIdentities(userID int64) ([]models.Identity, error) {
+	rows, err := d.db.Query(
+		"SELECT frontend, external_id, user_id, chat_id, username, COALESCE(language, '') FROM identities WHERE user_id = ? ORDER BY frontend",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch identities: %v", err)
+	}
+	defer rows.Close()
+
+	var identities []models.Identity
+	for rows.Next() {
+		var i models.Identity
+		if err := rows.Scan(&i.Frontend, &i.ExternalID, &i.UserID, &i.ChatID, &i.Username, &i.Language); err != nil {
+			continue
+		}
+		identities = append(identities, i)
+	}
+	return identities, nil
+}
+
+// CreateLinkCode stores a one-time code that links another identity to userID
+func (d *Database) CreateLinkCode(code string, userID int64, expiresAt time.Time) error {
+	_, err := d.db.Exec(
+		"INSERT INTO link_codes (code, user_id, expires_at) VALUES (?, ?, ?)",
+		code, userID, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create link code: %v", err)
+	}
+	return nil
+}
+
+// ConsumeLinkCode deletes a link code and returns its user if it has not
+// expired
+func (d *Database) ConsumeLinkCode(code string) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var expiresAt time.Time
+	err = tx.QueryRow("SELECT user_id, expires_at FROM link_codes WHERE code = ?", code).Scan(&userID, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("link code %w", ErrNotFound)
+		}
+		return 0, fmt.Errorf("failed to fetch link code: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM link_codes WHERE code = ?", code); err != nil {
+		return 0, fmt.Errorf("failed to delete link code: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit link code: %v", err)
+	}
+
+	if time.Now().After(expiresAt) {
+		return 0, fmt.Errorf("link code %w", ErrNotFound)
+	}
+	return userID, nil
+}
+
+// LinkIdentity attaches a frontend identity to userID. If the identity
+// belonged to another user, that user's offers are merged into userID and the
+// old account is removed once it has no identities left.
+func (d *Database) LinkIdentity(identity models.Identity, userID int64) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var previous int64
+	err = tx.QueryRow(
+		"SELECT user_id FROM identities WHERE frontend = ? AND external_id = ?",
+		identity.Frontend, identity.ExternalID,
+	).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look up identity: %v", err)
+	}
+
+	if _, err := tx.Exec(
+		"INSERT OR REPLACE INTO identities (frontend, external_id, user_id, chat_id, username, language) VALUES (?, ?, ?, ?, ?, ?)",
+		identity.Frontend, identity.ExternalID, userID, identity.ChatID, identity.Username, identity.Language,
+	); err != nil {
+		return fmt.Errorf("failed to link identity: %v", err)
+	}
+
+	if previous != 0 && previous != userID {
+		if _, err := tx.Exec("UPDATE offers SET user_id = ? WHERE user_id = ?", userID, previous); err != nil {
+			return fmt.Errorf("failed to merge offers: %v", err)
+		}
+		if _, err := tx.Exec(
+			"DELETE FROM users WHERE user_id = ? AND NOT EXISTS (SELECT 1 FROM identities WHERE user_id = ?)",
+			previous, previous,
+		); err != nil {
+			return fmt.Errorf("failed to remove merged user: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit identity link: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// ReplaceOfferInvoice makes a new BTCPay invoice the active invoice of an
+// offer in the pending or expired status from, which is pending again. The
+// payment details of the previous invoice are cleared; the invoice itself
+// stays in the history of the offer. ErrStale is returned if the offer is no
+// longer in status from, e.g. because it was paid in the meantime.
+func (d *Database) ReplaceOfferInvoice(offerID int, from models.OfferStatus, invoiceID, invoiceLink string) error {
+	if from != models.StatusPending && from != models.StatusExpired {
+		return fmt.Errorf("offer %d %w", offerID, ErrStale)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE offer_invoices SET active = 0 WHERE offer_id = ?", offerID); err != nil {
+		return fmt.Errorf("failed to deactivate offer invoices: %v", err)
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO offer_invoices (invoice_id, offer_id, invoice_link, active, created_at) VALUES (?, ?, ?, 1, ?)",
+		invoiceID, offerID, invoiceLink, now,
+	); err != nil {
+		return fmt.Errorf("failed to record offer invoice: %v", err)
+	}
+	res, err := tx.Exec(
+		`UPDATE offers SET invoice_id = ?, invoice_link = ?, payment_request = '', payment_address = '',
+		confirmations = -1, status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		invoiceID, invoiceLink, models.StatusPending, now, offerID, from,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update offer invoice: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update offer invoice: %v", err)
+	} else if n == 0 {
+		return fmt.Errorf("offer %d %w", offerID, ErrStale)
+	}
+	return tx.Commit()
+}
+
+// GetOfferInvoices retrieves the invoices created for an offer, oldest first
+func (d *Database) GetOfferInvoices(offerID int) ([]models.OfferInvoice, error) {
+	rows, err := d.db.Query(
+		"SELECT invoice_id, offer_id, invoice_link, active, created_at FROM offer_invoices WHERE offer_id = ? ORDER BY created_at, rowid",
+		offerID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offer invoices: %v", err)
+	}
+	defer rows.Close()
+
+	var invoices []models.OfferInvoice
+	for rows.Next() {
+		var inv models.OfferInvoice
+		if err := rows.Scan(&inv.InvoiceID, &inv.OfferID, &inv.InvoiceLink, &inv.Active, &inv.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan offer invoice: %v", err)
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
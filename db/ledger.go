@@ -0,0 +1,212 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// PostLedgerEntry records a journal entry in the ledger and reports whether
+// it was recorded. An entry whose reference was already recorded is
+// ignored. It returns ErrUnbalanced if the postings do not sum to zero and
+// ErrInsufficientBalance if they would leave a user account negative, and
+// records nothing then.
+func (d *Database) PostLedgerEntry(e models.LedgerEntry) (bool, error) {
+	if e.Reference == "" || len(e.Postings) < 2 {
+		return false, fmt.Errorf("%w: needs a reference and two postings", ErrUnbalanced)
+	}
+	var sum int64
+	for _, p := range e.Postings {
+		sum += p.AmountSats
+	}
+	if sum != 0 {
+		return false, fmt.Errorf("%w: postings sum to %d", ErrUnbalanced, sum)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT OR IGNORE INTO ledger_entries (reference, kind, created_at) VALUES (?, ?, ?)",
+		e.Reference, e.Kind, time.Now(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create ledger entry: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	entryID, err := res.LastInsertId()
+	if err != nil {
+		return false, fmt.Errorf("failed to get ledger entry ID: %v", err)
+	}
+
+	for _, p := range e.Postings {
+		accountID, err := ledgerAccountID(tx, p.Account)
+		if err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO ledger_postings (entry_id, account_id, amount_sats) VALUES (?, ?, ?)",
+			entryID, accountID, p.AmountSats,
+		); err != nil {
+			return false, fmt.Errorf("failed to create ledger posting: %v", err)
+		}
+		if p.Account.UserID == 0 || p.AmountSats >= 0 {
+			continue
+		}
+		var balance int64
+		if err := tx.QueryRow(
+			"SELECT balance_sats FROM ledger_balances WHERE account_id = ?", accountID,
+		).Scan(&balance); err != nil {
+			return false, fmt.Errorf("failed to fetch ledger balance: %v", err)
+		}
+		if balance < 0 {
+			return false, fmt.Errorf("%w: %s account of user %d", ErrInsufficientBalance, p.Account.Name, p.Account.UserID)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to create ledger entry: %v", err)
+	}
+	return true, nil
+}
+
+// ledgerAccountID returns the ID of a ledger account, opening it the first
+// time
+func ledgerAccountID(tx *sql.Tx, account models.LedgerAccount) (int64, error) {
+	if _, err := tx.Exec(
+		"INSERT OR IGNORE INTO ledger_accounts (user_id, name) VALUES (?, ?)",
+		account.UserID, account.Name,
+	); err != nil {
+		return 0, fmt.Errorf("failed to open ledger account: %v", err)
+	}
+	var id int64
+	if err := tx.QueryRow(
+		"SELECT id FROM ledger_accounts WHERE user_id = ? AND name = ?", account.UserID, account.Name,
+	).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to fetch ledger account: %v", err)
+	}
+	return id, nil
+}
+
+// HasLedgerEntry reports whether an entry with the given reference was
+// recorded
+func (d *Database) HasLedgerEntry(reference string) (bool, error) {
+	var exists bool
+	if err := d.db.QueryRow("SELECT EXISTS (SELECT 1 FROM ledger_entries WHERE reference = ?)", reference).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to fetch ledger entry: %v", err)
+	}
+	return exists, nil
+}
+
+// GetLedgerBalance returns the balance of a ledger account, zero for
+// accounts without entries
+func (d *Database) GetLedgerBalance(account models.LedgerAccount) (int64, error) {
+	var balance int64
+	err := d.db.QueryRow(
+		"SELECT balance_sats FROM ledger_balances WHERE user_id = ? AND name = ?", account.UserID, account.Name,
+	).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to fetch ledger balance: %v", err)
+	}
+	return balance, nil
+}
+
+// GetLedgerBalances returns the balances of all ledger accounts, platform
+// accounts first
+func (d *Database) GetLedgerBalances() ([]models.LedgerBalance, error) {
+	rows, err := d.db.Query("SELECT user_id, name, balance_sats FROM ledger_balances ORDER BY user_id, name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ledger balances: %v", err)
+	}
+	defer rows.Close()
+
+	var balances []models.LedgerBalance
+	for rows.Next() {
+		var b models.LedgerBalance
+		if err := rows.Scan(&b.Account.UserID, &b.Account.Name, &b.BalanceSats); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger balance: %v", err)
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// GetLedgerEntries retrieves the latest ledger entries, newest first, up to
+// limit
+func (d *Database) GetLedgerEntries(limit int) ([]models.LedgerEntry, error) {
+	return d.getLedgerEntries("", limit)
+}
+
+// GetUserLedgerEntries retrieves the latest ledger entries posting to the
+// accounts of a user, newest first, up to limit
+func (d *Database) GetUserLedgerEntries(userID int64, limit int) ([]models.LedgerEntry, error) {
+	return d.getLedgerEntries(`WHERE e.id IN (
+		SELECT p.entry_id FROM ledger_postings p
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE a.user_id = ?)`, limit, userID)
+}
+
+// getLedgerEntries retrieves the latest ledger entries matching a condition
+// with all their postings
+func (d *Database) getLedgerEntries(where string, limit int, args ...interface{}) ([]models.LedgerEntry, error) {
+	rows, err := d.db.Query(
+		"SELECT e.id, e.reference, e.kind, e.created_at FROM ledger_entries e "+where+" ORDER BY e.id DESC LIMIT ?",
+		append(args, limit)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ledger entries: %v", err)
+	}
+	var entries []models.LedgerEntry
+	for rows.Next() {
+		var e models.LedgerEntry
+		var kind string
+		if err := rows.Scan(&e.ID, &e.Reference, &kind, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan ledger entry: %v", err)
+		}
+		e.Kind = models.LedgerKind(kind)
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch ledger entries: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	// Fetch the postings of all entries at once
+	ids := make([]interface{}, len(entries))
+	index := make(map[int]int, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+		index[e.ID] = i
+	}
+	rows, err = d.db.Query(
+		`SELECT p.entry_id, a.user_id, a.name, p.amount_sats FROM ledger_postings p
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE p.entry_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) ORDER BY p.id`,
+		ids...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ledger postings: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entryID int
+		var p models.LedgerPosting
+		if err := rows.Scan(&entryID, &p.Account.UserID, &p.Account.Name, &p.AmountSats); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger posting: %v", err)
+		}
+		e := &entries[index[entryID]]
+		e.Postings = append(e.Postings, p)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,163 @@
+package db_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+func newDatabase(t *testing.T) *db.Database {
+	t.Helper()
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+var (
+	btcpayAccount  = models.PlatformAccount(models.AccountBTCPay)
+	aliceAvailable = models.UserAccount(1001, models.AccountAvailable)
+	aliceEscrow    = models.UserAccount(1001, models.AccountEscrow)
+	bobAvailable   = models.UserAccount(1002, models.AccountAvailable)
+)
+
+// transfer builds an entry moving amountSats from one account to another
+func transfer(reference string, kind models.LedgerKind, from, to models.LedgerAccount, amountSats int64) models.LedgerEntry {
+	return models.LedgerEntry{Reference: reference, Kind: kind, Postings: []models.LedgerPosting{
+		{Account: from, AmountSats: -amountSats},
+		{Account: to, AmountSats: amountSats},
+	}}
+}
+
+func balance(t *testing.T, database *db.Database, account models.LedgerAccount) int64 {
+	t.Helper()
+	b, err := database.GetLedgerBalance(account)
+	if err != nil {
+		t.Fatalf("GetLedgerBalance(%+v): %v", account, err)
+	}
+	return b
+}
+
+func TestPostLedgerEntry(t *testing.T) {
+	database := newDatabase(t)
+
+	// Entries without a reference, with a single posting or whose postings
+	// do not sum to zero are rejected
+	invalid := []models.LedgerEntry{
+		transfer("", models.LedgerInvoiceReceipt, btcpayAccount, aliceAvailable, 1_000),
+		{Reference: "single", Kind: models.LedgerFee, Postings: []models.LedgerPosting{{Account: aliceAvailable, AmountSats: 1_000}}},
+		{Reference: "unbalanced", Kind: models.LedgerFee, Postings: []models.LedgerPosting{
+			{Account: btcpayAccount, AmountSats: -1_000}, {Account: aliceAvailable, AmountSats: 999},
+		}},
+	}
+	for _, e := range invalid {
+		if posted, err := database.PostLedgerEntry(e); posted || !errors.Is(err, db.ErrUnbalanced) {
+			t.Errorf("PostLedgerEntry(%q) = %v, %v, want ErrUnbalanced", e.Reference, posted, err)
+		}
+		if exists, err := database.HasLedgerEntry(e.Reference); exists || err != nil {
+			t.Errorf("HasLedgerEntry(%q) = %v, %v", e.Reference, exists, err)
+		}
+	}
+
+	// Each reference is recorded once
+	receipt := transfer("invoice:a", models.LedgerInvoiceReceipt, btcpayAccount, aliceAvailable, 1_000)
+	for i, want := range []bool{true, false} {
+		if posted, err := database.PostLedgerEntry(receipt); posted != want || err != nil {
+			t.Errorf("posting %d = %v, %v, want %v", i, posted, err, want)
+		}
+	}
+	if exists, err := database.HasLedgerEntry("invoice:a"); !exists || err != nil {
+		t.Errorf("HasLedgerEntry = %v, %v", exists, err)
+	}
+	if b := balance(t, database, aliceAvailable); b != 1_000 {
+		t.Errorf("available balance = %d, want 1000", b)
+	}
+	// Platform accounts may go negative
+	if b := balance(t, database, btcpayAccount); b != -1_000 {
+		t.Errorf("btcpay balance = %d, want -1000", b)
+	}
+	if b := balance(t, database, bobAvailable); b != 0 {
+		t.Errorf("balance of an account without entries = %d", b)
+	}
+
+	// User accounts never go negative, and a rejected entry records nothing
+	overdrawn := transfer("escrow:a", models.LedgerEscrowHold, aliceAvailable, aliceEscrow, 1_001)
+	if posted, err := database.PostLedgerEntry(overdrawn); posted || !errors.Is(err, db.ErrInsufficientBalance) {
+		t.Errorf("overdrawn entry = %v, %v, want ErrInsufficientBalance", posted, err)
+	}
+	if exists, _ := database.HasLedgerEntry("escrow:a"); exists {
+		t.Error("overdrawn entry was recorded")
+	}
+	if b := balance(t, database, aliceAvailable); b != 1_000 {
+		t.Errorf("available balance after overdrawn entry = %d", b)
+	}
+	overdrawn.Postings[0].AmountSats, overdrawn.Postings[1].AmountSats = -1_000, 1_000
+	if posted, err := database.PostLedgerEntry(overdrawn); !posted || err != nil {
+		t.Errorf("entry emptying the account = %v, %v", posted, err)
+	}
+	if available, escrow := balance(t, database, aliceAvailable), balance(t, database, aliceEscrow); available != 0 || escrow != 1_000 {
+		t.Errorf("balances = %d available, %d in escrow", available, escrow)
+	}
+}
+
+func TestLedgerEntries(t *testing.T) {
+	database := newDatabase(t)
+	entries := []models.LedgerEntry{
+		transfer("invoice:a", models.LedgerInvoiceReceipt, btcpayAccount, aliceAvailable, 1_000),
+		transfer("escrow:a", models.LedgerEscrowHold, aliceAvailable, aliceEscrow, 1_000),
+		transfer("trade:1:settlement", models.LedgerTradeSettlement, aliceEscrow, bobAvailable, 1_000),
+		transfer("payout:1", models.LedgerPayout, bobAvailable, btcpayAccount, 1_000),
+	}
+	for _, e := range entries {
+		if _, err := database.PostLedgerEntry(e); err != nil {
+			t.Fatalf("PostLedgerEntry(%q): %v", e.Reference, err)
+		}
+	}
+
+	// Entries come newest first with their postings, up to the limit
+	all, err := database.GetLedgerEntries(10)
+	if err != nil || len(all) != 4 {
+		t.Fatalf("GetLedgerEntries = %+v, %v", all, err)
+	}
+	for i, e := range all {
+		want := entries[len(entries)-1-i]
+		if e.Reference != want.Reference || e.Kind != want.Kind || len(e.Postings) != 2 ||
+			e.Postings[0] != want.Postings[0] || e.Postings[1] != want.Postings[1] {
+			t.Errorf("entry %d = %+v, want %+v", i, e, want)
+		}
+	}
+	if latest, err := database.GetLedgerEntries(1); err != nil || len(latest) != 1 || latest[0].Reference != "payout:1" {
+		t.Errorf("GetLedgerEntries(1) = %+v, %v", latest, err)
+	}
+
+	// Users see the entries posting to any of their accounts
+	alice, err := database.GetUserLedgerEntries(1001, 10)
+	if err != nil || len(alice) != 3 || alice[0].Reference != "trade:1:settlement" || alice[2].Reference != "invoice:a" {
+		t.Fatalf("entries of alice = %+v, %v", alice, err)
+	}
+	if got := alice[0].AmountSats(aliceEscrow); got != -1_000 {
+		t.Errorf("escrow change of the settlement = %d", got)
+	}
+	if none, err := database.GetUserLedgerEntries(1003, 10); err != nil || len(none) != 0 {
+		t.Errorf("entries of a user without accounts = %+v, %v", none, err)
+	}
+
+	// Balances list every account, platform accounts first
+	balances, err := database.GetLedgerBalances()
+	if err != nil || len(balances) != 4 {
+		t.Fatalf("GetLedgerBalances = %+v, %v", balances, err)
+	}
+	if balances[0].Account != btcpayAccount {
+		t.Errorf("first balance = %+v, want the btcpay account", balances[0])
+	}
+	for _, b := range balances {
+		if b.BalanceSats != 0 {
+			t.Errorf("balance of %+v = %d, want 0", b.Account, b.BalanceSats)
+		}
+	}
+}
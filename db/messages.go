@@ -0,0 +1,76 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+const sentMessageColumns = "frontend, chat_id, message_id, kind, offer_id, user_id, created_at"
+
+// TrackMessage records a sent message so that it can be edited later
+func (d *Database) TrackMessage(m models.SentMessage) error {
+	_, err := d.db.Exec(
+		"INSERT OR REPLACE INTO sent_messages ("+sentMessageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		m.Frontend, m.ChatID, m.MessageID, m.Kind, m.OfferID, m.UserID, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to track message: %v", err)
+	}
+	return nil
+}
+
+// GetOfferMessages returns the tracked messages showing an offer
+func (d *Database) GetOfferMessages(offerID int) ([]models.SentMessage, error) {
+	return d.querySentMessages("WHERE offer_id = ? ORDER BY created_at", offerID)
+}
+
+// GetMessageOffers returns the tracking entries of a single message, one per
+// offer it shows
+func (d *Database) GetMessageOffers(frontend, chatID, messageID string) ([]models.SentMessage, error) {
+	return d.querySentMessages("WHERE frontend = ? AND chat_id = ? AND message_id = ? ORDER BY offer_id", frontend, chatID, messageID)
+}
+
+// GetChatMessages returns the tracked messages of a kind in a chat
+func (d *Database) GetChatMessages(frontend, chatID string, kind models.MessageKind) ([]models.SentMessage, error) {
+	return d.querySentMessages("WHERE frontend = ? AND chat_id = ? AND kind = ? ORDER BY created_at", frontend, chatID, kind)
+}
+
+// ForgetMessage stops tracking a message
+func (d *Database) ForgetMessage(frontend, chatID, messageID string) error {
+	_, err := d.db.Exec("DELETE FROM sent_messages WHERE frontend = ? AND chat_id = ? AND message_id = ?", frontend, chatID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to forget message: %v", err)
+	}
+	return nil
+}
+
+// ForgetOfferCards stops tracking the cards showing an offer to its owner
+func (d *Database) ForgetOfferCards(offerID int) error {
+	_, err := d.db.Exec("DELETE FROM sent_messages WHERE offer_id = ? AND kind = ?", offerID, models.MessageOfferCard)
+	if err != nil {
+		return fmt.Errorf("failed to forget offer cards: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) querySentMessages(where string, args ...interface{}) ([]models.SentMessage, error) {
+	rows, err := d.db.Query("SELECT "+sentMessageColumns+" FROM sent_messages "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []models.SentMessage
+	for rows.Next() {
+		var m models.SentMessage
+		var kind string
+		if err := rows.Scan(&m.Frontend, &m.ChatID, &m.MessageID, &kind, &m.OfferID, &m.UserID, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+		m.Kind = models.MessageKind(kind)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+const payoutColumns = "id, trade_id, user_id, destination, amount_sats, pull_payment_id, btcpay_id, status, created_at, updated_at"
+
+// scanPayout scans a row selected with payoutColumns
+func scanPayout(row interface{ Scan(...interface{}) error }) (*models.Payout, error) {
+	var p models.Payout
+	var status string
+	err := row.Scan(&p.ID, &p.TradeID, &p.UserID, &p.Destination, &p.AmountSats,
+		&p.PullPaymentID, &p.BTCPayID, &status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.Status = models.PayoutStatus(status)
+	return &p, nil
+}
+
+// CreatePayout stores a payout and returns its ID. It returns ErrClaimed if
+// the trade has a payout that was not cancelled or if its offer is being
+// refunded; refunds of duplicate payments do not count.
+func (d *Database) CreatePayout(p models.Payout) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var claims int
+	if err := tx.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM refunds WHERE offer_id = (SELECT offer_id FROM trades WHERE id = ?) AND duplicate = 0) +
+		(SELECT COUNT(*) FROM payouts WHERE trade_id = ? AND status != ?)`,
+		p.TradeID, p.TradeID, models.PayoutCancelled,
+	).Scan(&claims); err != nil {
+		return 0, fmt.Errorf("failed to check refunds: %v", err)
+	}
+	if claims > 0 {
+		return 0, ErrClaimed
+	}
+
+	now := time.Now()
+	res, err := tx.Exec(
+		`INSERT INTO payouts (trade_id, user_id, destination, amount_sats, pull_payment_id, btcpay_id, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.TradeID, p.UserID, p.Destination, p.AmountSats, p.PullPaymentID, p.BTCPayID, p.Status, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create payout: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get payout ID: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to create payout: %v", err)
+	}
+	return int(id), nil
+}
+
+// GetPayout retrieves a payout by ID
+func (d *Database) GetPayout(payoutID int) (*models.Payout, error) {
+	return d.getPayout("id = ?", payoutID)
+}
+
+// GetPayoutByBTCPayID retrieves the payout with the given BTCPay payout ID
+func (d *Database) GetPayoutByBTCPayID(btcpayID string) (*models.Payout, error) {
+	return d.getPayout("btcpay_id = ?", btcpayID)
+}
+
+// GetTradePayout retrieves the latest payout of a trade
+func (d *Database) GetTradePayout(tradeID int) (*models.Payout, error) {
+	return d.getPayout("trade_id = ?", tradeID)
+}
+
+// getPayout retrieves the latest payout matching a condition
+func (d *Database) getPayout(where string, args ...interface{}) (*models.Payout, error) {
+	p, err := scanPayout(d.db.QueryRow("SELECT "+payoutColumns+" FROM payouts WHERE "+where+" ORDER BY id DESC LIMIT 1", args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("payout %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch payout: %v", err)
+	}
+	return p, nil
+}
+
+// GetUserPayouts retrieves the payouts a user receives, newest first
+func (d *Database) GetUserPayouts(userID int64) ([]models.Payout, error) {
+	rows, err := d.db.Query("SELECT "+payoutColumns+" FROM payouts WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch payouts: %v", err)
+	}
+	defer rows.Close()
+
+	var payouts []models.Payout
+	for rows.Next() {
+		p, err := scanPayout(rows)
+		if err != nil {
+			continue
+		}
+		payouts = append(payouts, *p)
+	}
+	return payouts, nil
+}
+
+// SetPayoutClaim records the BTCPay pull payment and payout claiming a
+// payout and its status
+func (d *Database) SetPayoutClaim(payoutID int, pullPaymentID, btcpayID string, status models.PayoutStatus) error {
+	_, err := d.db.Exec(
+		"UPDATE payouts SET pull_payment_id = ?, btcpay_id = ?, status = ?, updated_at = ? WHERE id = ?",
+		pullPaymentID, btcpayID, status, time.Now(), payoutID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update payout: %v", err)
+	}
+	return nil
+}
+
+// UpdatePayoutStatus updates the status of a payout
+func (d *Database) UpdatePayoutStatus(payoutID int, status models.PayoutStatus) error {
+	_, err := d.db.Exec(
+		"UPDATE payouts SET status = ?, updated_at = ? WHERE id = ?",
+		status, time.Now(), payoutID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update payout status: %v", err)
+	}
+	return nil
+}
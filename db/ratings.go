@@ -0,0 +1,42 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// CreateRating stores the rating a participant of a trade gave their
+// counterparty. It returns ErrDuplicate if they already rated the trade.
+func (d *Database) CreateRating(r models.Rating) error {
+	_, err := d.db.Exec(
+		"INSERT INTO ratings (trade_id, rater_id, rated_id, score, created_at) VALUES (?, ?, ?, ?, ?)",
+		r.TradeID, r.RaterID, r.RatedID, r.Score, time.Now(),
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return fmt.Errorf("rating %w", ErrDuplicate)
+		}
+		return fmt.Errorf("failed to create rating: %v", err)
+	}
+	return nil
+}
+
+// GetUserRating returns the average score a user received and the number of
+// ratings it is based on, 0 and 0 if they have none
+func (d *Database) GetUserRating(userID int64) (float64, int, error) {
+	var average float64
+	var count int
+	err := d.db.QueryRow(
+		"SELECT COALESCE(AVG(score), 0), COUNT(*) FROM ratings WHERE rated_id = ?",
+		userID,
+	).Scan(&average, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to fetch rating: %v", err)
+	}
+	return average, count, nil
+}
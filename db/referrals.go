@@ -0,0 +1,192 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+const referralPayoutColumns = "id, user_id, destination, amount_sats, pull_payment_id, btcpay_id, status, created_at, updated_at"
+
+// scanReferralPayout scans a row selected with referralPayoutColumns
+func scanReferralPayout(row interface{ Scan(...interface{}) error }) (*models.ReferralPayout, error) {
+	var p models.ReferralPayout
+	var status string
+	err := row.Scan(&p.ID, &p.UserID, &p.Destination, &p.AmountSats,
+		&p.PullPaymentID, &p.BTCPayID, &status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.Status = models.PayoutStatus(status)
+	return &p, nil
+}
+
+// SetReferralCode stores the code of the invite link of a user. It returns
+// ErrDuplicate if another user has the code.
+func (d *Database) SetReferralCode(userID int64, code string) error {
+	_, err := d.db.Exec("UPDATE users SET referral_code = ? WHERE user_id = ?", code, userID)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return fmt.Errorf("referral code %w", ErrDuplicate)
+		}
+		return fmt.Errorf("failed to set referral code: %v", err)
+	}
+	return nil
+}
+
+// GetUserByReferralCode retrieves the user owning a referral code, ignoring
+// case
+func (d *Database) GetUserByReferralCode(code string) (*models.User, error) {
+	return d.getUser("referral_code = ? COLLATE NOCASE AND referral_code != ''", code)
+}
+
+// AddReferralCredit credits a referrer with their share of the fee a referred
+// user paid on a trade. A trade credits each referred user at most once;
+// crediting it again is ignored.
+func (d *Database) AddReferralCredit(c models.ReferralCredit) error {
+	_, err := d.db.Exec(
+		`INSERT OR IGNORE INTO referral_credits (referrer_id, referred_id, trade_id, fee_sats, amount_sats, payout_id, created_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?)`,
+		c.ReferrerID, c.ReferredID, c.TradeID, c.FeeSats, c.AmountSats, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to credit referrer: %v", err)
+	}
+	return nil
+}
+
+// GetReferralEarnings sums the invites and referral credits of a user
+func (d *Database) GetReferralEarnings(userID int64) (*models.ReferralEarnings, error) {
+	var e models.ReferralEarnings
+	err := d.db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM users WHERE referrer_id = ?),
+			COALESCE(SUM(c.amount_sats), 0),
+			COALESCE(SUM(CASE WHEN p.status = ? THEN c.amount_sats END), 0),
+			COALESCE(SUM(CASE WHEN c.payout_id != 0 AND p.status != ? THEN c.amount_sats END), 0),
+			COALESCE(SUM(CASE WHEN c.payout_id = 0 THEN c.amount_sats END), 0)
+		FROM referral_credits c
+		LEFT JOIN referral_payouts p ON p.id = c.payout_id
+		WHERE c.referrer_id = ?`,
+		userID, models.PayoutCompleted, models.PayoutCompleted, userID,
+	).Scan(&e.Invites, &e.EarnedSats, &e.PaidSats, &e.PendingSats, &e.AvailableSats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum referral credits: %v", err)
+	}
+	return &e, nil
+}
+
+// CreateReferralPayout stores a payout of the referral credits of a user and
+// assigns it every credit not paid out yet, returning its ID. It returns
+// ErrClaimed if those credits do not add up to the amount of the payout.
+func (d *Database) CreateReferralPayout(p models.ReferralPayout) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var available int64
+	if err := tx.QueryRow(
+		"SELECT COALESCE(SUM(amount_sats), 0) FROM referral_credits WHERE referrer_id = ? AND payout_id = 0", p.UserID,
+	).Scan(&available); err != nil {
+		return 0, fmt.Errorf("failed to sum referral credits: %v", err)
+	}
+	if available != p.AmountSats {
+		return 0, ErrClaimed
+	}
+
+	now := time.Now()
+	res, err := tx.Exec(
+		`INSERT INTO referral_payouts (user_id, destination, amount_sats, pull_payment_id, btcpay_id, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.UserID, p.Destination, p.AmountSats, p.PullPaymentID, p.BTCPayID, p.Status, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create referral payout: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get referral payout ID: %v", err)
+	}
+	if _, err := tx.Exec(
+		"UPDATE referral_credits SET payout_id = ? WHERE referrer_id = ? AND payout_id = 0", id, p.UserID,
+	); err != nil {
+		return 0, fmt.Errorf("failed to assign referral credits: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to create referral payout: %v", err)
+	}
+	return int(id), nil
+}
+
+// GetReferralPayout retrieves a referral payout by ID
+func (d *Database) GetReferralPayout(payoutID int) (*models.ReferralPayout, error) {
+	return d.getReferralPayout("id = ?", payoutID)
+}
+
+// GetReferralPayoutByBTCPayID retrieves the referral payout with the given
+// BTCPay payout ID
+func (d *Database) GetReferralPayoutByBTCPayID(btcpayID string) (*models.ReferralPayout, error) {
+	return d.getReferralPayout("btcpay_id = ?", btcpayID)
+}
+
+// getReferralPayout retrieves the latest referral payout matching a condition
+func (d *Database) getReferralPayout(where string, args ...interface{}) (*models.ReferralPayout, error) {
+	p, err := scanReferralPayout(d.db.QueryRow("SELECT "+referralPayoutColumns+" FROM referral_payouts WHERE "+where+" ORDER BY id DESC LIMIT 1", args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("referral payout %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch referral payout: %v", err)
+	}
+	return p, nil
+}
+
+// GetUserReferralPayouts retrieves the referral payouts of a user, newest
+// first
+func (d *Database) GetUserReferralPayouts(userID int64) ([]models.ReferralPayout, error) {
+	rows, err := d.db.Query("SELECT "+referralPayoutColumns+" FROM referral_payouts WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch referral payouts: %v", err)
+	}
+	defer rows.Close()
+
+	var payouts []models.ReferralPayout
+	for rows.Next() {
+		p, err := scanReferralPayout(rows)
+		if err != nil {
+			continue
+		}
+		payouts = append(payouts, *p)
+	}
+	return payouts, nil
+}
+
+// UpdateReferralPayoutStatus updates the status of a referral payout. The
+// credits of a cancelled payout can be paid out again.
+func (d *Database) UpdateReferralPayoutStatus(payoutID int, status models.PayoutStatus) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE referral_payouts SET status = ?, updated_at = ? WHERE id = ?",
+		status, time.Now(), payoutID,
+	); err != nil {
+		return fmt.Errorf("failed to update referral payout status: %v", err)
+	}
+	if status == models.PayoutCancelled {
+		if _, err := tx.Exec("UPDATE referral_credits SET payout_id = 0 WHERE payout_id = ?", payoutID); err != nil {
+			return fmt.Errorf("failed to release referral credits: %v", err)
+		}
+	}
+	return tx.Commit()
+}
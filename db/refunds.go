@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+const refundColumns = "id, offer_id, trade_id, user_id, invoice_id, amount_sats, destination, pull_payment_id, btcpay_id, status, duplicate, created_at, updated_at"
+
+// scanRefund scans a row selected with refundColumns
+func scanRefund(row interface{ Scan(...interface{}) error }) (*models.Refund, error) {
+	var r models.Refund
+	var status string
+	err := row.Scan(&r.ID, &r.OfferID, &r.TradeID, &r.UserID, &r.InvoiceID, &r.AmountSats,
+		&r.Destination, &r.PullPaymentID, &r.BTCPayID, &status, &r.Duplicate, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.Status = models.RefundStatus(status)
+	return &r, nil
+}
+
+// CreateRefund stores a refund and returns its ID. It returns ErrClaimed if
+// the invoice is already refunded and, unless the refund is of a duplicate
+// payment, if the offer is already refunded or one of its trades has a
+// payout that was not cancelled.
+func (d *Database) CreateRefund(r models.Refund) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var claims int
+	if r.Duplicate {
+		err = tx.QueryRow("SELECT COUNT(*) FROM refunds WHERE invoice_id = ?", r.InvoiceID).Scan(&claims)
+	} else {
+		err = tx.QueryRow(
+			`SELECT (SELECT COUNT(*) FROM refunds WHERE (offer_id = ? AND duplicate = 0) OR invoice_id = ?) +
+			(SELECT COUNT(*) FROM payouts p JOIN trades t ON t.id = p.trade_id WHERE t.offer_id = ? AND p.status != ?)`,
+			r.OfferID, r.InvoiceID, r.OfferID, models.PayoutCancelled,
+		).Scan(&claims)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to check payouts: %v", err)
+	}
+	if claims > 0 {
+		return 0, ErrClaimed
+	}
+
+	now := time.Now()
+	res, err := tx.Exec(
+		`INSERT INTO refunds (offer_id, trade_id, user_id, invoice_id, amount_sats, destination, pull_payment_id, btcpay_id, status, duplicate, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.OfferID, r.TradeID, r.UserID, r.InvoiceID, r.AmountSats, r.Destination, r.PullPaymentID, r.BTCPayID, r.Status, r.Duplicate, now, now,
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return 0, ErrClaimed
+		}
+		return 0, fmt.Errorf("failed to create refund: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get refund ID: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to create refund: %v", err)
+	}
+	return int(id), nil
+}
+
+// GetRefund retrieves a refund by ID
+func (d *Database) GetRefund(refundID int) (*models.Refund, error) {
+	return d.getRefund("id = ?", "id DESC", refundID)
+}
+
+// GetRefundByBTCPayID retrieves the refund claimed by the given BTCPay payout
+func (d *Database) GetRefundByBTCPayID(btcpayID string) (*models.Refund, error) {
+	return d.getRefund("btcpay_id = ?", "id DESC", btcpayID)
+}
+
+// GetOfferRefund retrieves the refund of an offer, refunds of duplicate
+// payments aside
+func (d *Database) GetOfferRefund(offerID int) (*models.Refund, error) {
+	return d.getRefund("offer_id = ? AND duplicate = 0", "id DESC", offerID)
+}
+
+// GetClaimableOfferRefund retrieves a refund of an offer awaiting a
+// destination, or its latest refund if none is, refunds of duplicate
+// payments included
+func (d *Database) GetClaimableOfferRefund(offerID int) (*models.Refund, error) {
+	return d.getRefund("offer_id = ?", "status = ? DESC, id DESC", offerID, models.RefundAwaitingDestination)
+}
+
+// getRefund retrieves the first refund matching a condition in the given
+// order
+func (d *Database) getRefund(where, order string, args ...interface{}) (*models.Refund, error) {
+	r, err := scanRefund(d.db.QueryRow("SELECT "+refundColumns+" FROM refunds WHERE "+where+" ORDER BY "+order+" LIMIT 1", args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("refund %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch refund: %v", err)
+	}
+	return r, nil
+}
+
+// GetUserRefunds retrieves the refunds a user receives, newest first
+func (d *Database) GetUserRefunds(userID int64) ([]models.Refund, error) {
+	rows, err := d.db.Query("SELECT "+refundColumns+" FROM refunds WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch refunds: %v", err)
+	}
+	defer rows.Close()
+
+	var refunds []models.Refund
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			continue
+		}
+		refunds = append(refunds, *r)
+	}
+	return refunds, nil
+}
+
+// SetRefundPullPayment records the pull payment BTCPay created for a refund
+func (d *Database) SetRefundPullPayment(refundID int, pullPaymentID string) error {
+	_, err := d.db.Exec(
+		"UPDATE refunds SET pull_payment_id = ?, updated_at = ? WHERE id = ?",
+		pullPaymentID, time.Now(), refundID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set refund pull payment: %v", err)
+	}
+	return nil
+}
+
+// SetRefundClaim records where a refund is sent, the BTCPay payout claiming
+// it and its status. An empty destination and payout put the refund back to
+// awaiting a destination.
+func (d *Database) SetRefundClaim(refundID int, destination, btcpayID string, status models.RefundStatus) error {
+	_, err := d.db.Exec(
+		"UPDATE refunds SET destination = ?, btcpay_id = ?, status = ?, updated_at = ? WHERE id = ?",
+		destination, btcpayID, status, time.Now(), refundID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update refund: %v", err)
+	}
+	return nil
+}
+
+// UpdateRefundStatus updates the status of a refund
+func (d *Database) UpdateRefundStatus(refundID int, status models.RefundStatus) error {
+	_, err := d.db.Exec(
+		"UPDATE refunds SET status = ?, updated_at = ? WHERE id = ?",
+		status, time.Now(), refundID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update refund status: %v", err)
+	}
+	return nil
+}
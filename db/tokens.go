@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ReplaceAPIToken stores the hash of a new API token for a user, revoking
+// any token issued before
+func (d *Database) ReplaceAPIToken(userID int64, tokenHash string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to revoke API tokens: %v", err)
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO api_tokens (token_hash, user_id, created_at) VALUES (?, ?, ?)",
+		tokenHash, userID, time.Now(),
+	); err != nil {
+		return fmt.Errorf("failed to store API token: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit API token: %v", err)
+	}
+	return nil
+}
+
+// RevokeAPITokens deletes all API tokens of a user
+func (d *Database) RevokeAPITokens(userID int64) error {
+	if _, err := d.db.Exec("DELETE FROM api_tokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to revoke API tokens: %v", err)
+	}
+	return nil
+}
+
+// GetAPITokenUser returns the user owning the token with the given hash
+func (d *Database) GetAPITokenUser(tokenHash string) (int64, error) {
+	var userID int64
+	err := d.db.QueryRow("SELECT user_id FROM api_tokens WHERE token_hash = ?", tokenHash).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("API token %w", ErrNotFound)
+		}
+		return 0, fmt.Errorf("failed to fetch API token: %v", err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+const tradeColumns = "id, offer_id, seller_id, buyer_id, status, COALESCE(payout_destination, ''), maker_fee_sats, taker_fee_sats, disputed_by, created_at, updated_at"
+
+// scanTrade scans a row selected with tradeColumns
+func scanTrade(row interface{ Scan(...interface{}) error }) (*models.Trade, error) {
+	var t models.Trade
+	var status string
+	if err := row.Scan(&t.ID, &t.OfferID, &t.SellerID, &t.BuyerID, &status, &t.PayoutDestination, &t.MakerFeeSats, &t.TakerFeeSats, &t.DisputedBy, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	t.Status = models.TradeStatus(status)
+	return &t, nil
+}
+
+// CreateTrade opens a trade for an offer with the platform fee paid by its
+// seller and buyer, and returns its ID
+func (d *Database) CreateTrade(offerID int, sellerID, buyerID int64, makerFeeSats, takerFeeSats int64) (int, error) {
+	now := time.Now()
+	res, err := d.db.Exec(
+		"INSERT INTO trades (offer_id, seller_id, buyer_id, status, maker_fee_sats, taker_fee_sats, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		offerID, sellerID, buyerID, models.TradeOpen, makerFeeSats, takerFeeSats, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create trade: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get trade ID: %v", err)
+	}
+	return int(id), nil
+}
+
+// GetTrade retrieves a trade by ID
+func (d *Database) GetTrade(tradeID int) (*models.Trade, error) {
+	t, err := scanTrade(d.db.QueryRow("SELECT "+tradeColumns+" FROM trades WHERE id = ?", tradeID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("trade %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch trade: %v", err)
+	}
+	return t, nil
+}
+
+// GetOpenTrade retrieves the open trade of an offer
+func (d *Database) GetOpenTrade(offerID int) (*models.Trade, error) {
+	t, err := scanTrade(d.db.QueryRow(
+		"SELECT "+tradeColumns+" FROM trades WHERE offer_id = ? AND status = ? ORDER BY id DESC LIMIT 1",
+		offerID, models.TradeOpen,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("open trade %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch open trade: %v", err)
+	}
+	return t, nil
+}
+
+// GetUserTrades retrieves all trades where the user is buyer or seller
+func (d *Database) GetUserTrades(userID int64) ([]models.Trade, error) {
+	rows, err := d.db.Query(
+		"SELECT "+tradeColumns+" FROM trades WHERE seller_id = ? OR buyer_id = ? ORDER BY created_at DESC",
+		userID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch trades: %v", err)
+	}
+	defer rows.Close()
+
+	var trades []models.Trade
+	for rows.Next() {
+		t, err := scanTrade(rows)
+		if err != nil {
+			continue
+		}
+		trades = append(trades, *t)
+	}
+	return trades, nil
+}
+
+// CountCompletedTrades counts the completed trades where the user is buyer or
+// seller
+func (d *Database) CountCompletedTrades(userID int64) (int, error) {
+	var count int
+	err := d.db.QueryRow(
+		"SELECT COUNT(*) FROM trades WHERE (seller_id = ? OR buyer_id = ?) AND status = ?",
+		userID, userID, models.TradeCompleted,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count trades: %v", err)
+	}
+	return count, nil
+}
+
+// GetTradedVolume sums, in BTC, the offers a user created since a time that
+// were not cancelled or expired, and the offers of the trades they opened as
+// buyer since then that were not cancelled or refunded
+func (d *Database) GetTradedVolume(userID int64, since time.Time) (float64, error) {
+	var sold, bought float64
+	err := d.db.QueryRow(
+		"SELECT COALESCE(SUM(amount_btc), 0) FROM offers WHERE user_id = ? AND created_at >= ? AND status NOT IN (?, ?)",
+		userID, since, models.StatusCancelled, models.StatusExpired,
+	).Scan(&sold)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum offers: %v", err)
+	}
+	err = d.db.QueryRow(
+		`SELECT COALESCE(SUM(o.amount_btc), 0) FROM trades t JOIN offers o ON o.id = t.offer_id
+		WHERE t.buyer_id = ? AND t.created_at >= ? AND t.status IN (?, ?)`,
+		userID, since, models.TradeOpen, models.TradeCompleted,
+	).Scan(&bought)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum trades: %v", err)
+	}
+	return sold + bought, nil
+}
+
+// UpdateTradeStatus updates the status of a trade
+func (d *Database) UpdateTradeStatus(tradeID int, status models.TradeStatus) error {
+	_, err := d.db.Exec(
+		"UPDATE trades SET status = ?, updated_at = ? WHERE id = ?",
+		status, time.Now(), tradeID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update trade status: %v", err)
+	}
+	return nil
+}
+
+// SetTradeDispute records that a participant disputes an open trade. It
+// returns ErrStale if the trade is closed or already disputed.
+func (d *Database) SetTradeDispute(tradeID int, userID int64) error {
+	res, err := d.db.Exec(
+		"UPDATE trades SET disputed_by = ?, updated_at = ? WHERE id = ? AND status = ? AND disputed_by = 0",
+		userID, time.Now(), tradeID, models.TradeOpen,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to dispute trade: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to dispute trade: %v", err)
+	} else if n == 0 {
+		return fmt.Errorf("trade %d %w", tradeID, ErrStale)
+	}
+	return nil
+}
+
+// SetPayoutDestination sets where the buyer of a trade receives the bitcoin
+func (d *Database) SetPayoutDestination(tradeID int, destination string) error {
+	_, err := d.db.Exec(
+		"UPDATE trades SET payout_destination = ?, updated_at = ? WHERE id = ?",
+		destination, time.Now(), tradeID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set payout destination: %v", err)
+	}
+	return nil
+}
+
+// AddTradeMessage stores a message relayed between the counterparties of a
+// trade and returns its ID
+func (d *Database) AddTradeMessage(m models.TradeMessage) (int, error) {
+	res, err := d.db.Exec(
+		"INSERT INTO trade_messages (trade_id, sender_id, text, photo_id, frontend, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		m.TradeID, m.SenderID, m.Text, m.PhotoID, m.Frontend, time.Now(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store trade message: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get trade message ID: %v", err)
+	}
+	return int(id), nil
+}
+
+// GetTradeMessages retrieves the messages of a trade, oldest first
+func (d *Database) GetTradeMessages(tradeID int) ([]models.TradeMessage, error) {
+	rows, err := d.db.Query(
+		"SELECT id, trade_id, sender_id, text, photo_id, frontend, created_at FROM trade_messages WHERE trade_id = ? ORDER BY id",
+		tradeID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch trade messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []models.TradeMessage
+	for rows.Next() {
+		var m models.TradeMessage
+		if err := rows.Scan(&m.ID, &m.TradeID, &m.SenderID, &m.Text, &m.PhotoID, &m.Frontend, &m.CreatedAt); err != nil {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// SetChatTrade puts a user in the chat of a trade, 0 leaves it
+func (d *Database) SetChatTrade(userID int64, tradeID int) error {
+	_, err := d.db.Exec("UPDATE users SET chat_trade_id = ?, chat_peer_id = 0 WHERE user_id = ?", tradeID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set chat trade: %v", err)
+	}
+	return nil
+}
+
+// SetChatPeer puts a user in a direct chat with another user, 0 leaves it
+func (d *Database) SetChatPeer(userID, peerID int64) error {
+	_, err := d.db.Exec("UPDATE users SET chat_peer_id = ?, chat_trade_id = 0 WHERE user_id = ?", peerID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set chat peer: %v", err)
+	}
+	return nil
+}
+
+// GetChat returns the trade or the user a user is chatting with, 0 if none
+func (d *Database) GetChat(userID int64) (int, int64, error) {
+	var tradeID int
+	var peerID int64
+	err := d.db.QueryRow(
+		"SELECT COALESCE(chat_trade_id, 0), COALESCE(chat_peer_id, 0) FROM users WHERE user_id = ?", userID,
+	).Scan(&tradeID, &peerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, fmt.Errorf("user %w", ErrNotFound)
+		}
+		return 0, 0, fmt.Errorf("failed to fetch chat: %v", err)
+	}
+	return tradeID, peerID, nil
+}
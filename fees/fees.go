@@ -0,0 +1,121 @@
+// Package fees computes the platform fees charged on trades.
+package fees
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Rule charges Percent of the traded amount, at least MinSats and at most
+// MaxSats. A zero MaxSats leaves the fee uncapped.
+type Rule struct {
+	Percent float64
+	MinSats int64
+	MaxSats int64
+}
+
+// Promotion waives fees between Start, inclusive, and End, exclusive. An
+// empty Currency applies it to all currencies.
+type Promotion struct {
+	Currency string
+	Start    time.Time
+	End      time.Time
+}
+
+// Active reports whether the promotion waives the fees of a trade priced in
+// currency at time at
+func (p Promotion) Active(currency string, at time.Time) bool {
+	if p.Currency != "" && !strings.EqualFold(p.Currency, currency) {
+		return false
+	}
+	return !at.Before(p.Start) && at.Before(p.End)
+}
+
+// Schedule is the fee model of the marketplace. The fee of a trade follows
+// the rule of its currency, or Default, and is split between the maker, who
+// pays it on top of the invoice funding the offer, and the taker, whose
+// payout it is deducted from.
+type Schedule struct {
+	Default Rule
+	// Rules replacing Default for trades priced in a currency, keyed by
+	// upper case currency code
+	Overrides map[string]Rule
+	// Share of the fee paid by the maker, in percent; the taker pays the rest
+	MakerPercent int
+	Promotions   []Promotion
+}
+
+// Fee is the platform fee of a trade, in satoshis
+type Fee struct {
+	MakerSats int64
+	TakerSats int64
+}
+
+// Sats returns the total fee
+func (f Fee) Sats() int64 {
+	return f.MakerSats + f.TakerSats
+}
+
+// Rule returns the rule applied to trades priced in currency
+func (s Schedule) Rule(currency string) Rule {
+	if r, ok := s.Overrides[strings.ToUpper(currency)]; ok {
+		return r
+	}
+	return s.Default
+}
+
+// Promotion returns the promotion waiving the fees of a trade priced in
+// currency at time at, if any
+func (s Schedule) Promotion(currency string, at time.Time) (Promotion, bool) {
+	for _, p := range s.Promotions {
+		if p.Active(currency, at) {
+			return p, true
+		}
+	}
+	return Promotion{}, false
+}
+
+// Compute returns the fee of a trade of amountSats priced in currency at
+// time at. The percentage is applied in parts per million and rounded down,
+// then bounded by the rule, and the fee never exceeds the amount. The maker
+// share is rounded down too, so the same inputs always give the same fee.
+func (s Schedule) Compute(amountSats int64, currency string, at time.Time) Fee {
+	if amountSats <= 0 {
+		return Fee{}
+	}
+	if _, ok := s.Promotion(currency, at); ok {
+		return Fee{}
+	}
+	r := s.Rule(currency)
+	if r.Percent <= 0 && r.MinSats <= 0 {
+		return Fee{}
+	}
+
+	ppm := int64(math.Round(r.Percent * 10_000))
+	total := mulDiv(amountSats, ppm, 1_000_000)
+	if total < r.MinSats {
+		total = r.MinSats
+	}
+	if r.MaxSats > 0 && total > r.MaxSats {
+		total = r.MaxSats
+	}
+	if total > amountSats {
+		total = amountSats
+	}
+
+	share := int64(s.MakerPercent)
+	if share < 0 {
+		share = 0
+	} else if share > 100 {
+		share = 100
+	}
+	maker := total * share / 100
+	return Fee{MakerSats: maker, TakerSats: total - maker}
+}
+
+// mulDiv returns a*b/c rounded down without overflowing for amounts up to
+// the bitcoin supply
+func mulDiv(a, b, c int64) int64 {
+	return a/c*b + a%c*b/c
+}
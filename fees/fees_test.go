@@ -0,0 +1,92 @@
+package fees_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/fees"
+)
+
+var now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestCompute(t *testing.T) {
+	schedule := fees.Schedule{
+		Default:      fees.Rule{Percent: 1, MinSats: 500, MaxSats: 50_000},
+		MakerPercent: 60,
+		Overrides: map[string]fees.Rule{
+			"EUR": {Percent: 0.25},
+			"CHF": {},
+		},
+		Promotions: []fees.Promotion{
+			{Start: now.Add(24 * time.Hour), End: now.Add(48 * time.Hour)},
+			{Currency: "eur", Start: now.Add(-time.Hour), End: now.Add(time.Hour)},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		schedule   fees.Schedule
+		amountSats int64
+		currency   string
+		at         time.Time
+		maker      int64
+		taker      int64
+	}{
+		{"percentage", schedule, 1_000_000, "USD", now, 6_000, 4_000},
+		{"rounded down", schedule, 123_456, "USD", now, 740, 494},
+		{"minimum", schedule, 10_000, "USD", now, 300, 200},
+		{"maximum", schedule, 100_000_000, "USD", now, 30_000, 20_000},
+		{"never above amount", schedule, 300, "USD", now, 180, 120},
+		{"zero amount", schedule, 0, "USD", now, 0, 0},
+		{"currency override", schedule, 1_000_000, "GBP", now, 6_000, 4_000},
+		{"override without minimum", schedule, 1_000, "EUR", now.Add(2 * time.Hour), 1, 1},
+		{"fee-free currency", schedule, 1_000_000, "chf", now, 0, 0},
+		{"currency promotion", schedule, 1_000_000, "EUR", now, 0, 0},
+		{"promotion of another currency", schedule, 1_000_000, "USD", now.Add(-time.Minute), 6_000, 4_000},
+		{"promotion start is inclusive", schedule, 1_000_000, "USD", now.Add(24 * time.Hour), 0, 0},
+		{"promotion end is exclusive", schedule, 1_000_000, "USD", now.Add(48 * time.Hour), 6_000, 4_000},
+		{"no fee configured", fees.Schedule{}, 1_000_000, "USD", now, 0, 0},
+		{"maker pays all", fees.Schedule{Default: fees.Rule{Percent: 0.5}, MakerPercent: 100}, 1_000_000, "USD", now, 5_000, 0},
+		{"taker pays all", fees.Schedule{Default: fees.Rule{Percent: 0.5}}, 1_000_000, "USD", now, 0, 5_000},
+		{"odd fee split", fees.Schedule{Default: fees.Rule{MinSats: 3}, MakerPercent: 50}, 1_000, "USD", now, 1, 2},
+		{"fractional percent", fees.Schedule{Default: fees.Rule{Percent: 0.1234}, MakerPercent: 50}, 21_000_000_000_000, "USD", now, 12_957_000_000, 12_957_000_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				fee := tt.schedule.Compute(tt.amountSats, tt.currency, tt.at)
+				if fee.MakerSats != tt.maker || fee.TakerSats != tt.taker {
+					t.Fatalf("Compute() = %+v, want maker %d and taker %d", fee, tt.maker, tt.taker)
+				}
+				if fee.Sats() != tt.maker+tt.taker {
+					t.Fatalf("Sats() = %d, want %d", fee.Sats(), tt.maker+tt.taker)
+				}
+			}
+		})
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	schedule := fees.Schedule{Promotions: []fees.Promotion{
+		{Currency: "USD", Start: now, End: now.Add(time.Hour)},
+	}}
+
+	tests := []struct {
+		name     string
+		currency string
+		at       time.Time
+		active   bool
+	}{
+		{"during", "usd", now.Add(time.Minute), true},
+		{"before", "USD", now.Add(-time.Minute), false},
+		{"after", "USD", now.Add(time.Hour), false},
+		{"other currency", "EUR", now.Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := schedule.Promotion(tt.currency, tt.at); ok != tt.active {
+				t.Errorf("Promotion() active = %v, want %v", ok, tt.active)
+			}
+		})
+	}
+}
@@ -3,8 +3,17 @@ module github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop
 go 1.23.3
 
 require (
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4
+	github.com/coder/websocket v1.8.15
+	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	gopkg.in/tucnak/telebot.v2 v2.5.0
+)
+
+require (
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.0.1 // indirect
+	github.com/decred/dcrd/crypto/blake256 v1.0.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
-	gopkg.in/tucnak/telebot.v2 v2.5.0 // indirect
 )
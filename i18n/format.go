@@ -0,0 +1,64 @@
+package i18n
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number formats f with the given number of decimals, e.g. "1,234.50"
+func (l *Locale) Number(f float64, decimals int) string {
+	return l.localize(strconv.FormatFloat(f, 'f', decimals, 64))
+}
+
+// Integer formats n with digit grouping, e.g. "1,234"
+func (l *Locale) Integer(n int) string {
+	return l.localize(strconv.Itoa(n))
+}
+
+// BTC formats a bitcoin amount with up to 8 decimals, e.g. "0.015 BTC"
+func (l *Locale) BTC(amount float64) string {
+	s := strconv.FormatFloat(amount, 'f', 8, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	return l.localize(s) + " BTC"
+}
+
+// USD formats a dollar amount with the locale currency pattern, e.g. "$500.00"
+func (l *Locale) USD(amount float64) string {
+	return strings.Replace(l.format.Currency, "%s", l.Number(amount, 2), 1)
+}
+
+// Date formats a date and time, e.g. "Jan 2, 2006 15:04 UTC"
+func (l *Locale) Date(t time.Time) string {
+	return strings.NewReplacer(
+		"{d}", strconv.Itoa(t.Day()),
+		"{mon}", l.format.Months[t.Month()-1],
+		"{yyyy}", strconv.Itoa(t.Year()),
+		"{HH}", t.Format("15"),
+		"{mm}", t.Format("04"),
+		"{zone}", t.Format("MST"),
+	).Replace(l.format.Date)
+}
+
+// localize applies the locale separators to a number formatted by strconv
+func (l *Locale) localize(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	integer, fraction, hasFraction := strings.Cut(s, ".")
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteString(l.format.Group)
+		}
+		b.WriteRune(digit)
+	}
+	if hasFraction {
+		b.WriteString(l.format.Decimal)
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
@@ -0,0 +1,173 @@
+// Package i18n provides the message catalogues of the bot and locale-aware
+// formatting of numbers, amounts and dates.
+//
+// Each locale is a JSON file in locales/ holding its formatting rules and
+// messages. Messages are fmt format strings; plural messages hold one form
+// per plural category ("one", "other").
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default is the language used when no catalogue matches
+const Default = "en"
+
+//go:embed locales/*.json
+var files embed.FS
+
+// locales maps language codes to their loaded catalogue
+var locales = mustLoad()
+
+// Locale is the message catalogue and formatting rules of a language
+type Locale struct {
+	Lang     string
+	format   format
+	messages map[string]message
+	fallback *Locale
+}
+
+type format struct {
+	Decimal  string   `json:"decimal"`
+	Group    string   `json:"group"`
+	Currency string   `json:"currency"` // e.g. "$%s"
+	Date     string   `json:"date"`     // e.g. "{mon} {d}, {yyyy} {HH}:{mm} {zone}"
+	Months   []string `json:"months"`
+}
+
+// message holds the forms of a message by plural category. Messages
+// without plural forms only have "other".
+type message map[string]string
+
+func (m *message) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*m = message{"other": s}
+		return nil
+	}
+	forms := map[string]string{}
+	if err := json.Unmarshal(data, &forms); err != nil {
+		return err
+	}
+	if forms["other"] == "" {
+		return fmt.Errorf("plural message lacks the other form")
+	}
+	*m = forms
+	return nil
+}
+
+func mustLoad() map[string]*Locale {
+	entries, err := files.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	loaded := make(map[string]*Locale)
+	for _, e := range entries {
+		data, err := files.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalogue struct {
+			Format   format             `json:"format"`
+			Messages map[string]message `json:"messages"`
+		}
+		if err := json.Unmarshal(data, &catalogue); err != nil {
+			panic(fmt.Sprintf("i18n: invalid catalogue %s: %v", e.Name(), err))
+		}
+		lang := strings.TrimSuffix(e.Name(), ".json")
+		loaded[lang] = &Locale{Lang: lang, format: catalogue.Format, messages: catalogue.Messages}
+	}
+	for lang, l := range loaded {
+		if lang != Default {
+			l.fallback = loaded[Default]
+		}
+	}
+	return loaded
+}
+
+// Languages returns the supported language codes in alphabetical order
+func Languages() []string {
+	var langs []string
+	for lang := range locales {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Supported reports whether a language has a catalogue
+func Supported(lang string) bool {
+	_, ok := locales[lang]
+	return ok
+}
+
+// Get returns the locale for a language code such as "pt-BR", falling back
+// to the base language and then to the default language
+func Get(code string) *Locale {
+	code = strings.ToLower(code)
+	if l, ok := locales[code]; ok {
+		return l
+	}
+	if base, _, ok := strings.Cut(strings.ReplaceAll(code, "_", "-"), "-"); ok {
+		if l, ok := locales[base]; ok {
+			return l
+		}
+	}
+	return locales[Default]
+}
+
+// lookup returns a message of the locale or its fallback
+func (l *Locale) lookup(key string) (message, bool) {
+	for c := l; c != nil; c = c.fallback {
+		if m, ok := c.messages[key]; ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// T returns the message key formatted with args
+func (l *Locale) T(key string, args ...interface{}) string {
+	m, ok := l.lookup(key)
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return m["other"]
+	}
+	return fmt.Sprintf(m["other"], args...)
+}
+
+// N returns the plural form of message key for count n, formatted with n
+// followed by args
+func (l *Locale) N(key string, n int, args ...interface{}) string {
+	m, ok := l.lookup(key)
+	if !ok {
+		return key
+	}
+	form, ok := m[pluralCategory(l.Lang, n)]
+	if !ok {
+		form = m["other"]
+	}
+	return fmt.Sprintf(form, append([]interface{}{n}, args...)...)
+}
+
+// pluralCategory returns the CLDR plural category of n in a language
+func pluralCategory(lang string, n int) string {
+	switch lang {
+	case "pt":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+	default:
+		if n == 1 {
+			return "one"
+		}
+	}
+	return "other"
+}
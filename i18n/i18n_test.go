@@ -0,0 +1,129 @@
+package i18n
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var verbRe = regexp.MustCompile(`%[a-z]`)
+
+func TestCataloguesComplete(t *testing.T) {
+	en := locales[Default]
+	for _, lang := range Languages() {
+		l := locales[lang]
+		if len(l.format.Months) != 12 {
+			t.Errorf("%s: %d month names, want 12", lang, len(l.format.Months))
+		}
+		for key, want := range en.messages {
+			m, ok := l.messages[key]
+			if !ok {
+				t.Errorf("%s: missing message %q", lang, key)
+				continue
+			}
+			wantVerbs := verbRe.FindAllString(want["other"], -1)
+			for form, text := range m {
+				if got := verbRe.FindAllString(text, -1); !reflect.DeepEqual(got, wantVerbs) {
+					t.Errorf("%s: %s (%s) has verbs %v, want %v", lang, key, form, got, wantVerbs)
+				}
+			}
+		}
+		for key := range l.messages {
+			if _, ok := en.messages[key]; !ok {
+				t.Errorf("%s: message %q is not in the %s catalogue", lang, key, Default)
+			}
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"es", "es"},
+		{"pt-BR", "pt"},
+		{"pt_br", "pt"},
+		{"DE", "de"},
+		{"fr", "en"},
+		{"", "en"},
+	}
+	for _, tt := range tests {
+		if got := Get(tt.code).Lang; got != tt.want {
+			t.Errorf("Get(%q) = %s, want %s", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2024, time.March, 5, 9, 7, 0, 0, time.UTC)
+	tests := []struct {
+		lang           string
+		btc, usd, date string
+		number         string
+	}{
+		{"en", "0.015 BTC", "$1,234.50", "Mar 5, 2024 09:07 UTC", "-1,234,567.891"},
+		{"es", "0,015 BTC", "1.234,50 US$", "5 mar 2024, 09:07 UTC", "-1.234.567,891"},
+		{"pt", "0,015 BTC", "US$ 1.234,50", "5 de mar. de 2024 09:07 UTC", "-1.234.567,891"},
+		{"de", "0,015 BTC", "1.234,50 $", "5. März 2024, 09:07 UTC", "-1.234.567,891"},
+	}
+	for _, tt := range tests {
+		l := Get(tt.lang)
+		if got := l.BTC(0.015); got != tt.btc {
+			t.Errorf("%s: BTC = %q, want %q", tt.lang, got, tt.btc)
+		}
+		if got := l.USD(1234.5); got != tt.usd {
+			t.Errorf("%s: USD = %q, want %q", tt.lang, got, tt.usd)
+		}
+		if got := l.Date(date); got != tt.date {
+			t.Errorf("%s: Date = %q, want %q", tt.lang, got, tt.date)
+		}
+		if got := l.Number(-1234567.891, 3); got != tt.number {
+			t.Errorf("%s: Number = %q, want %q", tt.lang, got, tt.number)
+		}
+	}
+
+	en := Get("en")
+	if got := en.BTC(1); got != "1 BTC" {
+		t.Errorf("BTC(1) = %q", got)
+	}
+	if got := en.BTC(0.00000001); got != "0.00000001 BTC" {
+		t.Errorf("BTC(1 sat) = %q", got)
+	}
+	if got := en.Integer(100); got != "100" {
+		t.Errorf("Integer(100) = %q", got)
+	}
+}
+
+func TestPlural(t *testing.T) {
+	tests := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"en", 0, "Broadcast sent to 0 users."},
+		{"en", 1, "Broadcast sent to 1 user."},
+		{"en", 2, "Broadcast sent to 2 users."},
+		{"pt", 0, "Aviso enviado para 0 usuário."},
+		{"pt", 1, "Aviso enviado para 1 usuário."},
+		{"pt", 5, "Aviso enviado para 5 usuários."},
+		{"es", 0, "Anuncio enviado a 0 usuarios."},
+	}
+	for _, tt := range tests {
+		if got := Get(tt.lang).N("admin.broadcast_sent", tt.n); got != tt.want {
+			t.Errorf("%s N(%d) = %q, want %q", tt.lang, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	de := &Locale{Lang: "de", messages: map[string]message{}, fallback: Get(Default)}
+
+	if got := de.T("offer.not_found"); got != "Offer not found" {
+		t.Errorf("fallback = %q", got)
+	}
+	if got := de.T("no.such.key"); got != "no.such.key" {
+		t.Errorf("missing key = %q", got)
+	}
+}
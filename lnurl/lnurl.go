@@ -0,0 +1,198 @@
+// Package lnurl resolves Lightning addresses (LUD-16) and LNURL-pay strings
+// (LUD-01, LUD-06) to Lightning invoices.
+package lnurl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+)
+
+// Errors returned when resolving a destination
+var (
+	ErrInvalidDestination = errors.New("not a Lightning address or LNURL")
+	ErrAmountOutOfRange   = errors.New("amount outside the range accepted by the recipient")
+)
+
+// maxResponseBody is the largest response accepted from an LNURL service
+const maxResponseBody = 1 << 20
+
+// addressPattern matches Lightning addresses. The domain may carry a port.
+var addressPattern = regexp.MustCompile(`^([a-z0-9._+-]+)@([a-z0-9.-]+\.[a-z0-9]+(:[0-9]+)?)$`)
+
+// PayParams describes what an LNURL-pay service accepts
+type PayParams struct {
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"` // millisatoshis
+	MaxSendable int64  `json:"maxSendable"` // millisatoshis
+	Metadata    string `json:"metadata"`
+	Tag         string `json:"tag"`
+}
+
+// Client talks to LNURL-pay services
+type Client struct {
+	client *http.Client
+}
+
+// NewClient creates a client sending requests with httpClient, or with a
+// client with a 10 second timeout when nil
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{client: httpClient}
+}
+
+// IsDestination reports whether s is a Lightning address or a bech32 LNURL
+func IsDestination(s string) bool {
+	_, err := ParseDestination(s)
+	return err == nil
+}
+
+// ParseDestination returns the URL of the LNURL-pay endpoint behind a
+// Lightning address or a bech32 LNURL
+func ParseDestination(s string) (string, error) {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "lightning:"))
+	if m := addressPattern.FindStringSubmatch(s); m != nil {
+		return fmt.Sprintf("https://%s/.well-known/lnurlp/%s", m[2], m[1]), nil
+	}
+	if !strings.HasPrefix(s, "lnurl1") {
+		return "", ErrInvalidDestination
+	}
+	hrp, data, err := bech32.Decode(s)
+	if err != nil || hrp != "lnurl" {
+		return "", ErrInvalidDestination
+	}
+	decoded, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil {
+		return "", ErrInvalidDestination
+	}
+	if err := checkURL(string(decoded)); err != nil {
+		return "", ErrInvalidDestination
+	}
+	return string(decoded), nil
+}
+
+// checkURL verifies that an LNURL endpoint is served over HTTPS, or over
+// plain HTTP on an onion service
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme == "https" || (u.Scheme == "http" && strings.HasSuffix(u.Hostname(), ".onion")) {
+		return nil
+	}
+	return fmt.Errorf("insecure URL %q", raw)
+}
+
+// Resolve fetches the pay parameters of a Lightning address or LNURL
+func (c *Client) Resolve(destination string) (*PayParams, error) {
+	endpoint, err := ParseDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	var params PayParams
+	if err := c.get(endpoint, &params); err != nil {
+		return nil, err
+	}
+	if params.Tag != "payRequest" {
+		return nil, fmt.Errorf("not an LNURL-pay service: tag %q", params.Tag)
+	}
+	if err := checkURL(params.Callback); err != nil {
+		return nil, fmt.Errorf("invalid callback: %v", err)
+	}
+	if params.MinSendable <= 0 || params.MaxSendable < params.MinSendable {
+		return nil, fmt.Errorf("invalid sendable range %d-%d", params.MinSendable, params.MaxSendable)
+	}
+	var metadata [][]interface{}
+	if err := json.Unmarshal([]byte(params.Metadata), &metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	return &params, nil
+}
+
+// FetchInvoice asks the service for an invoice of amountMsat and checks
+// that it is signed, for that amount and commits to the service metadata
+func (c *Client) FetchInvoice(params *PayParams, amountMsat int64) (string, error) {
+	if amountMsat < params.MinSendable || amountMsat > params.MaxSendable {
+		return "", fmt.Errorf("%w: %d not in %d-%d msat", ErrAmountOutOfRange, amountMsat, params.MinSendable, params.MaxSendable)
+	}
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return "", fmt.Errorf("invalid callback: %v", err)
+	}
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(amountMsat, 10))
+	callback.RawQuery = query.Encode()
+
+	var result struct {
+		PR string `json:"pr"`
+	}
+	if err := c.get(callback.String(), &result); err != nil {
+		return "", err
+	}
+
+	invoice, err := bolt11.Decode(result.PR)
+	if err != nil {
+		return "", fmt.Errorf("invalid invoice: %v", err)
+	}
+	if invoice.AmountMsat != amountMsat {
+		return "", fmt.Errorf("invoice is for %d msat instead of %d", invoice.AmountMsat, amountMsat)
+	}
+	if hash := sha256.Sum256([]byte(params.Metadata)); !bytes.Equal(invoice.DescriptionHash, hash[:]) {
+		return "", fmt.Errorf("invoice description hash does not match the metadata")
+	}
+	return result.PR, nil
+}
+
+// Invoice resolves a Lightning address or LNURL and fetches an invoice of
+// amountMsat from it
+func (c *Client) Invoice(destination string, amountMsat int64) (string, error) {
+	params, err := c.Resolve(destination)
+	if err != nil {
+		return "", err
+	}
+	return c.FetchInvoice(params, amountMsat)
+}
+
+// get fetches a JSON document from an LNURL service, turning LUD-06 error
+// responses into errors
+func (c *Client) get(endpoint string, result interface{}) error {
+	resp, err := c.client.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	var status struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &status); err == nil && strings.EqualFold(status.Status, "ERROR") {
+		return fmt.Errorf("service error: %s", status.Reason)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
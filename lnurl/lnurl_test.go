@@ -0,0 +1,86 @@
+package lnurl_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl/lnurltest"
+)
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{"alice@example.com", "https://example.com/.well-known/lnurlp/alice"},
+		{"lightning:Bob.Smith@Pay.Example.org", "https://pay.example.org/.well-known/lnurlp/bob.smith"},
+		// LUD-01 example
+		{"LNURL1DP68GURN8GHJ7UM9WFMXJCM99E3K7MF0V9CXJ0M385EKVCENXC6R2C35XVUKXEFCV5MKVV34X5EKZD3EV56NYD3HXQURZEPEXEJXXEPNXSCRVWFNV9NXZCN9XQ6XYEFHVGCXXCMYXYMNSERXFQ5FNS",
+			"https://service.com/api?q=3fc3645b439ce8e7f2553a69e5267081d96dcd340693afabe04be7b0ccd178df"},
+	}
+	for _, tt := range tests {
+		got, err := lnurl.ParseDestination(tt.destination)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDestination(%q) = %q, %v, want %q", tt.destination, got, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "alice", "alice@localhost", "@example.com", "lnbc10u1pexample", "lnurl1invalid"} {
+		if _, err := lnurl.ParseDestination(s); !errors.Is(err, lnurl.ErrInvalidDestination) {
+			t.Errorf("ParseDestination(%q): err = %v", s, err)
+		}
+	}
+}
+
+func TestInvoice(t *testing.T) {
+	srv := lnurltest.NewServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	alice := srv.Add("alice", lnurltest.Recipient{MinSendable: 10_000, MaxSendable: 1_000_000_000})
+	params, err := client.Resolve(alice)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if params.MinSendable != 10_000 || params.MaxSendable != 1_000_000_000 {
+		t.Errorf("params = %+v", params)
+	}
+
+	for _, destination := range []string{alice, srv.LNURL("alice")} {
+		pr, err := client.Invoice(destination, 250_000_000)
+		if err != nil {
+			t.Fatalf("Invoice(%s): %v", destination, err)
+		}
+		if invoices := srv.Invoices(); invoices[len(invoices)-1].PR != pr {
+			t.Errorf("invoice = %q, server issued %+v", pr, invoices)
+		}
+	}
+
+	if _, err := client.Invoice(alice, 1_000); !errors.Is(err, lnurl.ErrAmountOutOfRange) {
+		t.Errorf("amount below minimum: err = %v", err)
+	}
+	if _, err := client.Invoice(alice, 2_000_000_000); !errors.Is(err, lnurl.ErrAmountOutOfRange) {
+		t.Errorf("amount above maximum: err = %v", err)
+	}
+	if n := len(srv.Invoices()); n != 2 {
+		t.Errorf("server issued %d invoices, want 2", n)
+	}
+
+	faults := map[string]lnurltest.Recipient{
+		"wrong amount":           {WrongAmount: true},
+		"wrong description hash": {WrongDescriptionHash: true},
+		"service error":          {Fail: true},
+	}
+	for name, r := range faults {
+		if _, err := client.Invoice(srv.Add("faulty", r), 100_000); err == nil {
+			t.Errorf("%s: Invoice succeeded", name)
+		}
+	}
+	if _, err := client.Resolve(srv.Address("carol")); err == nil {
+		t.Error("resolving unknown address succeeded")
+	}
+	if _, err := lnurl.NewClient(nil).Resolve(alice); err == nil {
+		t.Error("resolving without trusting the certificate succeeded")
+	}
+}
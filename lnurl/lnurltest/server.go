@@ -0,0 +1,186 @@
+// Package lnurltest provides an in-process LNURL-pay service for tests. It
+// serves Lightning addresses over HTTPS and answers callbacks with signed
+// BOLT11 invoices committing to the recipient's metadata.
+package lnurltest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bech32"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11/bolt11test"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl"
+)
+
+// Recipient configures a Lightning address served by the fake service
+type Recipient struct {
+	MinSendable int64 // millisatoshis, defaults to 1 sat
+	MaxSendable int64 // millisatoshis, defaults to 1 BTC
+
+	// Faults injected in the invoices returned to callbacks
+	WrongAmount          bool
+	WrongDescriptionHash bool
+	Fail                 bool // answer callbacks with an LNURL error
+}
+
+// Invoice records an invoice issued by the fake service
+type Invoice struct {
+	Username   string
+	AmountMsat int64
+	PR         string
+}
+
+// Server is a fake LNURL-pay service backed by httptest.Server
+type Server struct {
+	srv     *httptest.Server
+	signer  *bolt11test.Signer
+	network bolt11.Network
+
+	mu         sync.Mutex
+	recipients map[string]*Recipient
+	invoices   []Invoice
+}
+
+// NewServer starts a fake LNURL-pay service
+func NewServer() *Server {
+	s := &Server{signer: bolt11test.NewSigner(), network: bolt11.Mainnet, recipients: make(map[string]*Recipient)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/lnurlp/{username}", s.payRequest)
+	mux.HandleFunc("GET /callback/{username}", s.callback)
+	s.srv = httptest.NewTLSServer(mux)
+	return s
+}
+
+// Close shuts the service down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetNetwork sets the network of the invoices issued, mainnet by default
+func (s *Server) SetNetwork(network bolt11.Network) {
+	s.mu.Lock()
+	s.network = network
+	s.mu.Unlock()
+}
+
+// Client returns an LNURL client trusting the service's certificate
+func (s *Server) Client() *lnurl.Client {
+	return lnurl.NewClient(s.srv.Client())
+}
+
+// Add registers a recipient and returns its Lightning address
+func (s *Server) Add(username string, r Recipient) string {
+	if r.MinSendable == 0 {
+		r.MinSendable = 1000
+	}
+	if r.MaxSendable == 0 {
+		r.MaxSendable = 100_000_000_000
+	}
+	s.mu.Lock()
+	s.recipients[username] = &r
+	s.mu.Unlock()
+	return s.Address(username)
+}
+
+// Address returns the Lightning address of a recipient
+func (s *Server) Address(username string) string {
+	return username + "@" + s.srv.Listener.Addr().String()
+}
+
+// LNURL returns the bech32 LNURL of a recipient's pay endpoint
+func (s *Server) LNURL(username string) string {
+	groups, _ := bech32.ConvertBits([]byte(s.srv.URL+"/.well-known/lnurlp/"+username), 8, 5, true)
+	return strings.ToUpper(bech32.Encode("lnurl", groups))
+}
+
+// Invoices returns the invoices issued so far
+func (s *Server) Invoices() []Invoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Invoice(nil), s.invoices...)
+}
+
+// metadata returns the LUD-06 metadata of a recipient
+func metadata(username string) string {
+	m, _ := json.Marshal([][]string{
+		{"text/plain", "Payment to " + username},
+		{"text/identifier", username},
+	})
+	return string(m)
+}
+
+func (s *Server) recipient(username string) (Recipient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.recipients[username]
+	if !ok {
+		return Recipient{}, false
+	}
+	return *r, true
+}
+
+func (s *Server) payRequest(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	rec, ok := s.recipient(username)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown user")
+		return
+	}
+	writeJSON(w, http.StatusOK, lnurl.PayParams{
+		Callback:    s.srv.URL + "/callback/" + username,
+		MinSendable: rec.MinSendable,
+		MaxSendable: rec.MaxSendable,
+		Metadata:    metadata(username),
+		Tag:         "payRequest",
+	})
+}
+
+func (s *Server) callback(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	rec, ok := s.recipient(username)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown user")
+		return
+	}
+	if rec.Fail {
+		writeError(w, http.StatusOK, "Recipient unavailable")
+		return
+	}
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	if err != nil || amount < rec.MinSendable || amount > rec.MaxSendable {
+		writeError(w, http.StatusOK, "Amount out of range")
+		return
+	}
+
+	descriptionHash := sha256.Sum256([]byte(metadata(username)))
+	if rec.WrongDescriptionHash {
+		descriptionHash = sha256.Sum256([]byte("something else"))
+	}
+	invoiceAmount := amount
+	if rec.WrongAmount {
+		invoiceAmount += 1000
+	}
+
+	s.mu.Lock()
+	pr := s.signer.Sign(bolt11test.Invoice{Network: s.network, AmountMsat: invoiceAmount, DescriptionHash: &descriptionHash})
+	s.invoices = append(s.invoices, Invoice{Username: username, AmountMsat: invoiceAmount, PR: pr})
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pr": pr, "routes": []string{}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an LUD-06 error response
+func writeError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, map[string]string{"status": "ERROR", "reason": reason})
+}
@@ -2,25 +2,118 @@ package main
 
 import (
 	"log"
+	"net/http"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/api"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
 	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bot"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
 	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/config"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/matrix"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/nostr"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/ratelimit"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
 )
 
 // P2P Telegram Bitcoin Shop is an interactive Telegram bot that allows users to sell Bitcoin
 // via Lightning Network using BTCPay Server. It provides a user-friendly interface with
 // buttons for easier navigation and formatted messages for better readability.
+// The same marketplace can optionally be served to Matrix users.
 func main() {
 	// Load configuration
 	cfg := config.NewConfig()
 
-	// Initialize and start the bot
-	telegramBot, err := bot.NewBot(cfg)
+	// Initialize the shop shared by all frontends
+	database, err := db.NewDatabase(cfg.DBPath)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer database.Close()
+
+	btcpayClient := btcpay.NewClient(cfg.BTCPayURL, cfg.BTCPayAPIKey, cfg.BTCPayStoreID)
+	svc := shop.NewService(database, btcpayClient)
+	svc.SetAdmins(cfg.AdminIDs)
+	svc.SetLimits(shop.Limits{
+		MaxOpenOffers:    cfg.MaxOpenOffers,
+		MaxOfferInvoices: cfg.MaxOfferInvoices,
+		CancelCooldown:   cfg.CancelCooldown,
+		Tiers:            cfg.TradeTiers,
+	})
+	svc.SetRateLimits(shop.RateLimits{
+		User:    newLimiter(cfg.UserRateLimit),
+		Invoice: newLimiter(cfg.SellRateLimit),
+		List:    newLimiter(cfg.ListRateLimit),
+	})
+	svc.SetFees(cfg.Fees)
+	svc.SetReferralProgram(shop.ReferralProgram{
+		SharePercent:  cfg.ReferralSharePercent,
+		MinPayoutSats: cfg.ReferralMinPayoutSats,
+	})
+	svc.SetBonds(shop.Bonds{
+		AmountSats: cfg.BondSats,
+		Required:   cfg.BondRequired,
+	})
+	svc.SetAutoApprovePayouts(cfg.PayoutAutoApprove)
+	network, err := bolt11.ParseNetwork(cfg.BTCPayNetwork)
+	if err != nil {
+		log.Fatalf("Invalid BTCPAY_NETWORK: %v", err)
+	}
+	svc.SetNetwork(network)
+	svc.SetConfirmations(cfg.OnChainConfirmations)
+
+	// Initialize the Telegram bot
+	telegramBot, err := bot.NewBot(cfg, svc)
 	if err != nil {
 		log.Fatalf("Failed to initialize bot: %v", err)
 	}
+	svc.AddFrontend(telegramBot)
+	if cfg.MarketplaceChannelID != "" {
+		svc.AddPublisher(telegramBot)
+	}
+
+	// Start the Matrix frontend if configured
+	if cfg.MatrixHomeserverURL != "" && cfg.MatrixAccessToken != "" {
+		matrixClient := matrix.NewClient(cfg.MatrixHomeserverURL, cfg.MatrixAccessToken)
+		matrixFrontend := matrix.NewFrontend(matrixClient, cfg.MatrixUserID, svc)
+		svc.AddFrontend(matrixFrontend)
+		go matrixFrontend.Start()
+		log.Println("Matrix frontend started...")
+	}
+
+	// Publish offers to Nostr relays if configured
+	if cfg.NostrPrivateKey != "" && len(cfg.NostrRelays) > 0 {
+		keys, err := nostr.ParseKeys(cfg.NostrPrivateKey)
+		if err != nil {
+			log.Fatalf("Invalid NOSTR_PRIVATE_KEY: %v", err)
+		}
+		publisher := nostr.NewPublisher(svc, keys, cfg.NostrRelays, cfg.NostrNetwork)
+		svc.AddPublisher(publisher)
+		if cfg.NostrIngest {
+			svc.AddOrderSource(publisher)
+			go publisher.Ingest()
+		}
+		log.Printf("Publishing offers to Nostr as %s...", keys.PublicKey())
+	}
+
+	// Serve the REST API if configured
+	if cfg.APIAddr != "" {
+		apiServer := api.NewServer(svc)
+		apiServer.SetWebhookSecret(cfg.BTCPayWebhookSecret, cfg.BTCPayStoreID)
+		go func() {
+			log.Printf("API server listening on %s...", cfg.APIAddr)
+			if err := http.ListenAndServe(cfg.APIAddr, apiServer); err != nil {
+				log.Fatalf("API server failed: %v", err)
+			}
+		}()
+	}
 
 	log.Println("Bot started...")
 	telegramBot.Start()
-}
\ No newline at end of file
+}
+
+// newLimiter creates the rate limiter of a configured limit
+func newLimiter(l config.RateLimit) *ratelimit.Limiter {
+	return ratelimit.New(l.Burst, l.Per)
+}
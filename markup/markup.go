@@ -0,0 +1,243 @@
+// Package markup renders the text of shop messages for each frontend.
+//
+// Message text uses a small markup: *bold* and `code` spans that do not
+// cross lines. Everything else is literal, and a backslash makes the next
+// character literal too. User-supplied content must be inserted with Escape
+// so that it is never read as markup. Renderers escape whatever their target
+// format reserves, so any text renders to a valid message.
+package markup
+
+import (
+	"html"
+	"strings"
+	"unicode/utf16"
+)
+
+// spanKind is the formatting of a span of text
+type spanKind int
+
+const (
+	plainSpan spanKind = iota
+	boldSpan
+	codeSpan
+)
+
+// span is a run of literal text with a single formatting
+type span struct {
+	kind spanKind
+	text string
+}
+
+// char is a character of the source text, escaped characters are never markup
+type char struct {
+	r       rune
+	escaped bool
+}
+
+// Escape returns s with its markup characters escaped
+func Escape(s string) string {
+	return escaper.Replace(s)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, "`", "\\`")
+
+// parse splits text into spans. Markers without a closing marker on the
+// same line, or enclosing nothing, are literal.
+func parse(text string) []span {
+	var chars []char
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\\' && i+1 < len(runes) {
+			i++
+			chars = append(chars, char{runes[i], true})
+			continue
+		}
+		chars = append(chars, char{runes[i], false})
+	}
+
+	var spans []span
+	var literal []rune
+	flush := func() {
+		if len(literal) > 0 {
+			spans = append(spans, span{plainSpan, string(literal)})
+			literal = nil
+		}
+	}
+	for i := 0; i < len(chars); i++ {
+		c := chars[i]
+		kind, ok := markerKind(c)
+		if !ok {
+			literal = append(literal, c.r)
+			continue
+		}
+		end := closingMarker(chars, i)
+		if end < 0 {
+			literal = append(literal, c.r)
+			continue
+		}
+		flush()
+		var content []rune
+		for _, c := range chars[i+1 : end] {
+			content = append(content, c.r)
+		}
+		spans = append(spans, span{kind, string(content)})
+		i = end
+	}
+	flush()
+	return spans
+}
+
+// markerKind returns the span opened by c if it is an unescaped marker
+func markerKind(c char) (spanKind, bool) {
+	if c.escaped {
+		return plainSpan, false
+	}
+	switch c.r {
+	case '*':
+		return boldSpan, true
+	case '`':
+		return codeSpan, true
+	}
+	return plainSpan, false
+}
+
+// closingMarker returns the index of the marker closing the span opened at
+// chars[start], or -1
+func closingMarker(chars []char, start int) int {
+	for i := start + 1; i < len(chars); i++ {
+		if chars[i].r == '\n' {
+			return -1
+		}
+		if chars[i] == chars[start] {
+			if i == start+1 {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// Plain renders text without formatting
+func Plain(text string) string {
+	var b strings.Builder
+	for _, s := range parse(text) {
+		b.WriteString(s.text)
+	}
+	return b.String()
+}
+
+// MarkdownV2 renders text for Telegram's MarkdownV2 parse mode
+func MarkdownV2(text string) string {
+	var b strings.Builder
+	for _, s := range parse(text) {
+		switch s.kind {
+		case boldSpan:
+			b.WriteString("*" + markdownV2Escaper.Replace(s.text) + "*")
+		case codeSpan:
+			b.WriteString("`" + markdownV2CodeEscaper.Replace(s.text) + "`")
+		default:
+			b.WriteString(markdownV2Escaper.Replace(s.text))
+		}
+	}
+	return b.String()
+}
+
+var (
+	markdownV2Escaper = strings.NewReplacer(
+		`\`, `\\`, `_`, `\_`, `*`, `\*`, `[`, `\[`, `]`, `\]`, `(`, `\(`, `)`, `\)`,
+		`~`, `\~`, "`", "\\`", `>`, `\>`, `#`, `\#`, `+`, `\+`, `-`, `\-`, `=`, `\=`,
+		`|`, `\|`, `{`, `\{`, `}`, `\}`, `.`, `\.`, `!`, `\!`,
+	)
+	markdownV2CodeEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+)
+
+// HTML renders text as HTML with <b> and <code> tags. Line breaks are kept
+// as newlines, which Telegram's HTML parse mode expects.
+func HTML(text string) string {
+	var b strings.Builder
+	for _, s := range parse(text) {
+		switch s.kind {
+		case boldSpan:
+			b.WriteString("<b>" + html.EscapeString(s.text) + "</b>")
+		case codeSpan:
+			b.WriteString("<code>" + html.EscapeString(s.text) + "</code>")
+		default:
+			b.WriteString(html.EscapeString(s.text))
+		}
+	}
+	return b.String()
+}
+
+// Split cuts text into parts of at most limit UTF-16 code units, the unit
+// Telegram counts message length in. Parts end at line breaks where possible.
+// Lengths are measured on the source text, which is never shorter than its
+// rendering, so every rendered part fits as well.
+func Split(text string, limit int) []string {
+	if length(text) <= limit {
+		return []string{text}
+	}
+
+	var parts []string
+	var part strings.Builder
+	partLen := 0
+	flush := func() {
+		if part.Len() > 0 {
+			parts = append(parts, strings.TrimRight(part.String(), "\n"))
+			part.Reset()
+			partLen = 0
+		}
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		n := length(line)
+		if partLen+n > limit {
+			flush()
+		}
+		for n > limit {
+			head, tail := cut(line, limit)
+			parts = append(parts, head)
+			line, n = tail, length(tail)
+		}
+		part.WriteString(line)
+		partLen += n
+	}
+	flush()
+	return parts
+}
+
+// cut splits a line after at most limit UTF-16 code units without
+// separating a backslash from the character it escapes
+func cut(line string, limit int) (string, string) {
+	runes := []rune(line)
+	n, i := 0, 0
+	for i < len(runes) {
+		width := utf16.RuneLen(runes[i])
+		if runes[i] == '\\' && i+1 < len(runes) {
+			width += utf16.RuneLen(runes[i+1])
+			if n+width > limit {
+				break
+			}
+			n += width
+			i += 2
+			continue
+		}
+		if n+width > limit {
+			break
+		}
+		n += width
+		i++
+	}
+	if i == 0 {
+		i = 1 // always make progress, even if the limit is tiny
+	}
+	return string(runes[:i]), string(runes[i:])
+}
+
+// length returns the length of s in UTF-16 code units
+func length(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
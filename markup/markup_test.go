@@ -0,0 +1,100 @@
+package markup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		text       string
+		plain      string
+		markdownV2 string
+		html       string
+	}{
+		{
+			"*Offer #1*\n🔹 Price: $500.00",
+			"Offer #1\n🔹 Price: $500.00",
+			"*Offer \\#1*\n🔹 Price: $500\\.00",
+			"<b>Offer #1</b>\n🔹 Price: $500.00",
+		},
+		{
+			"Seller: @" + Escape("al_ice*"),
+			"Seller: @al_ice*",
+			"Seller: @al\\_ice\\*",
+			"Seller: @al_ice*",
+		},
+		{
+			"Token `p2ps_a\\`b` <x>",
+			"Token p2ps_a`b <x>",
+			"Token `p2ps_a\\`b` <x\\>",
+			"Token <code>p2ps_a`b</code> &lt;x&gt;",
+		},
+		{
+			// Unclosed and empty markers are literal
+			"2 * 3 = 6\n** `\nend`",
+			"2 * 3 = 6\n** `\nend`",
+			"2 \\* 3 \\= 6\n\\*\\* \\`\nend\\`",
+			"2 * 3 = 6\n** `\nend`",
+		},
+		{
+			"trailing \\",
+			"trailing \\",
+			"trailing \\\\",
+			"trailing \\",
+		},
+	}
+	for _, tt := range tests {
+		if got := Plain(tt.text); got != tt.plain {
+			t.Errorf("Plain(%q) = %q, want %q", tt.text, got, tt.plain)
+		}
+		if got := MarkdownV2(tt.text); got != tt.markdownV2 {
+			t.Errorf("MarkdownV2(%q) = %q, want %q", tt.text, got, tt.markdownV2)
+		}
+		if got := HTML(tt.text); got != tt.html {
+			t.Errorf("HTML(%q) = %q, want %q", tt.text, got, tt.html)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, s := range []string{"plain", "a*b*c", "`code`", `back\slash`, "*`\\"} {
+		if got := Plain(Escape(s)); got != s {
+			t.Errorf("Plain(Escape(%q)) = %q", s, got)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"line one\nline two\nline three", 18, []string{"line one\nline two", "line three"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"ab\\*cd", 3, []string{"ab", "\\*c", "d"}},
+		{"🔹🔹🔹", 4, []string{"🔹🔹", "🔹"}}, // emoji take two UTF-16 units
+	}
+	for _, tt := range tests {
+		if got := Split(tt.text, tt.limit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Split(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+	}
+
+	long := strings.Repeat("*Offer*\n", 1000)
+	parts := Split(long, 4096)
+	if len(parts) != 2 {
+		t.Fatalf("Split of %d characters = %d parts", len(long), len(parts))
+	}
+	if strings.Join(parts, "\n") != strings.TrimSuffix(long, "\n") {
+		t.Error("parts do not add up to the text")
+	}
+	for _, p := range parts {
+		if length(p) > 4096 || strings.HasPrefix(p, "\n") {
+			t.Errorf("part of length %d starts with %q", length(p), p[:8])
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package matrix implements a shop frontend on top of the Matrix
+// client-server API.
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Client is a minimal Matrix client-server API client
+type Client struct {
+	client        *http.Client
+	homeserverURL string
+	accessToken   string
+	txnID         atomic.Int64
+}
+
+// NewClient initializes a Matrix client authenticated with an access token
+func NewClient(homeserverURL, accessToken string) *Client {
+	return &Client{
+		client:        &http.Client{Timeout: 60 * time.Second},
+		homeserverURL: homeserverURL,
+		accessToken:   accessToken,
+	}
+}
+
+// Event is a room event delivered by /sync
+type Event struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	EventID string `json:"event_id"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	} `json:"content"`
+}
+
+// SyncResponse is the subset of a /sync response used by the frontend
+type SyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []Event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// Sync long-polls the homeserver for events after since
+func (c *Client) Sync(since string, timeout time.Duration) (*SyncResponse, error) {
+	query := url.Values{"timeout": {strconv.FormatInt(timeout.Milliseconds(), 10)}}
+	if since != "" {
+		query.Set("since", since)
+	}
+
+	var resp SyncResponse
+	if err := c.do("GET", "/_matrix/client/v3/sync?"+query.Encode(), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to sync: %v", err)
+	}
+	return &resp, nil
+}
+
+// JoinRoom joins a room the bot has been invited to
+func (c *Client) JoinRoom(roomID string) error {
+	if err := c.do("POST", "/_matrix/client/v3/join/"+url.PathEscape(roomID), map[string]interface{}{}, nil); err != nil {
+		return fmt.Errorf("failed to join room %s: %v", roomID, err)
+	}
+	return nil
+}
+
+// SendMessage sends an m.text message with an HTML formatted body to a room
+func (c *Client) SendMessage(roomID, body, formattedBody string) error {
+	content := map[string]string{
+		"msgtype":        "m.text",
+		"body":           body,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formattedBody,
+	}
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%d-%d",
+		url.PathEscape(roomID), time.Now().UnixNano(), c.txnID.Add(1))
+	if err := c.do("PUT", path, content, nil); err != nil {
+		return fmt.Errorf("failed to send message to %s: %v", roomID, err)
+	}
+	return nil
+}
+
+// do performs an authenticated JSON request
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reqBody *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reqBody = bytes.NewReader(data)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.homeserverURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,1006 @@
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/markup"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// syncTimeout is how long each /sync request long-polls
+const syncTimeout = 30 * time.Second
+
+// Frontend serves the shop to Matrix users through direct messages.
+// Commands start with "!" (or "/"), e.g. "!sell 0.01 500".
+type Frontend struct {
+	client *Client
+	userID string
+	shop   *shop.Service
+	since  string
+	stop   chan struct{}
+}
+
+// NewFrontend creates a Matrix frontend for the bot account userID
+func NewFrontend(client *Client, userID string, svc *shop.Service) *Frontend {
+	return &Frontend{
+		client: client,
+		userID: userID,
+		shop:   svc,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Name implements shop.Frontend
+func (f *Frontend) Name() string {
+	return shop.FrontendMatrix
+}
+
+// Send implements shop.Frontend. Action buttons are rendered as links and
+// commands the user can type.
+func (f *Frontend) Send(roomID string, msg shop.Message) error {
+	body, formatted := render(msg)
+	return f.client.SendMessage(roomID, body, formatted)
+}
+
+// render converts a shop message into plain and HTML bodies
+func render(msg shop.Message) (string, string) {
+	text := msg.Text
+	var lines []string
+	for _, row := range msg.Actions {
+		for _, a := range row {
+			switch {
+			case a.URL != "":
+				lines = append(lines, fmt.Sprintf("%s: %s", markup.Escape(a.Label), markup.Escape(a.URL)))
+			case a.Command != "":
+				lines = append(lines, fmt.Sprintf("%s: `%s`", markup.Escape(a.Label), strings.TrimSpace("!"+a.Command+" "+markup.Escape(a.Data))))
+			}
+		}
+	}
+	if len(lines) > 0 {
+		text = strings.TrimRight(text, "\n") + "\n\n" + strings.Join(lines, "\n")
+	}
+
+	return markup.Plain(text), strings.ReplaceAll(markup.HTML(text), "\n", "<br>")
+}
+
+// Start syncs with the homeserver and handles commands until Stop is called
+func (f *Frontend) Start() {
+	for {
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		if err := f.syncOnce(); err != nil {
+			log.Printf("Matrix sync failed: %v", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// Stop stops the sync loop after the current request
+func (f *Frontend) Stop() {
+	close(f.stop)
+}
+
+// syncOnce performs one /sync round. Messages received before the first
+// sync are skipped so that old commands are not replayed on restart.
+func (f *Frontend) syncOnce() error {
+	resp, err := f.client.Sync(f.since, syncTimeout)
+	if err != nil {
+		return err
+	}
+	initial := f.since == ""
+	f.since = resp.NextBatch
+
+	for roomID := range resp.Rooms.Invite {
+		if err := f.client.JoinRoom(roomID); err != nil {
+			log.Printf("Error joining Matrix room: %v", err)
+		}
+	}
+	if initial {
+		return nil
+	}
+
+	for roomID, room := range resp.Rooms.Join {
+		for _, ev := range room.Timeline.Events {
+			if ev.Type != "m.room.message" || ev.Sender == f.userID || ev.Content.MsgType != "m.text" {
+				continue
+			}
+			if err := f.handleCommand(roomID, ev.Sender, ev.Content.Body); err != nil {
+				log.Printf("Error handling Matrix command from %s: %v", ev.Sender, err)
+			}
+		}
+	}
+	return nil
+}
+
+// identity returns the shop identity of a Matrix user talking in roomID
+func identity(sender, roomID string) models.Identity {
+	return models.Identity{
+		Frontend:   shop.FrontendMatrix,
+		ExternalID: sender,
+		ChatID:     roomID,
+		Username:   strings.TrimPrefix(sender, "@"),
+	}
+}
+
+// reply sends a plain text reply to a room
+func (f *Frontend) reply(roomID, text string) error {
+	return f.Send(roomID, shop.Message{Text: text})
+}
+
+// locale returns the locale to talk to a Matrix user in. Matrix does not
+// report a language, so users keep the default unless they pick one.
+func (f *Frontend) locale(sender string) *i18n.Locale {
+	userID, err := f.shop.UserID(shop.FrontendMatrix, sender)
+	if err != nil {
+		return i18n.Get(i18n.Default)
+	}
+	return f.shop.Locale(userID, "")
+}
+
+// handleCommand dispatches a command sent by a Matrix user. Other text is
+// relayed to the trade counterparty when the user is in a trade chat.
+func (f *Frontend) handleCommand(roomID, sender, body string) error {
+	args := strings.Fields(body)
+	if len(args) == 0 {
+		return nil
+	}
+	l := f.locale(sender)
+
+	// Registered users are throttled like on every frontend
+	userID, err := f.shop.UserID(shop.FrontendMatrix, sender)
+	registered := err == nil
+	if registered {
+		if err := f.shop.Throttle(userID); err != nil {
+			return f.reply(roomID, shop.ThrottledText(l, err))
+		}
+	}
+	if args[0][0] != '!' && args[0][0] != '/' {
+		return f.relay(roomID, sender, body)
+	}
+	command := strings.ToLower(args[0][1:])
+	args = args[1:]
+
+	// Ignore banned users before running any command
+	if registered {
+		if banned, err := f.shop.IsBanned(userID); err != nil {
+			return fmt.Errorf("failed to check ban: %v", err)
+		} else if banned {
+			return f.reply(roomID, l.T("banned"))
+		}
+	}
+
+	switch command {
+	case "start":
+		// "!start ref_CODE" records who invited a new user
+		var code string
+		if len(args) > 0 {
+			code = strings.TrimPrefix(args[0], referralPrefix)
+		}
+		if _, err := f.shop.RegisterReferred(identity(sender, roomID), code); err != nil {
+			f.reply(roomID, l.T("register.failed"))
+			return fmt.Errorf("failed to register user: %v", err)
+		}
+		return f.reply(roomID, l.T("matrix.registered"))
+	case "sell":
+		return f.sell(l, roomID, sender, args)
+	case "list":
+		return f.listOffers(l, roomID, sender)
+	case "marketplace":
+		return f.showMarketplace(l, roomID)
+	case "confirm", shop.ActionConfirmPayment:
+		return f.offerAction(l, roomID, sender, "confirm", args, f.shop.ConfirmPayment, shop.PaymentConfirmedMessage)
+	case "cancel", shop.ActionCancelOffer:
+		return f.offerAction(l, roomID, sender, "cancel", args, f.shop.CancelOffer, shop.OfferCancelledMessage)
+	case "refresh", shop.ActionRefreshInvoice:
+		return f.refresh(l, roomID, sender, args)
+	case "take", shop.ActionTakeOffer:
+		return f.take(l, roomID, sender, args)
+	case "link":
+		return f.link(l, roomID, sender, args)
+	case "language":
+		return f.language(l, roomID, sender, args)
+	case "chat", shop.ActionTradeChat:
+		return f.openChat(l, roomID, sender, args)
+	case shop.ActionContact:
+		return f.openContact(l, roomID, sender, args)
+	case "dispute":
+		return f.dispute(l, roomID, sender, args)
+	case "rate":
+		return f.rate(l, roomID, sender, args)
+	case "exit":
+		return f.exitChat(l, roomID, sender)
+	case "nick":
+		return f.nickname(l, roomID, sender, args)
+	case shop.ActionPayout:
+		return f.payout(l, roomID, sender, args)
+	case shop.ActionRefund:
+		return f.refund(l, roomID, sender, args)
+	case "lnaddress":
+		return f.lightningAddress(l, roomID, sender, args)
+	case "balance":
+		return f.balance(l, roomID, sender)
+	case "limits":
+		return f.limits(l, roomID, sender)
+	case "bond", shop.ActionClaimBond:
+		return f.bond(l, roomID, sender, args)
+	case shop.ActionPostBond:
+		return f.bond(l, roomID, sender, []string{"post"})
+	case shop.ActionReleaseBond:
+		return f.bond(l, roomID, sender, []string{"release"})
+	case "referrals":
+		return f.referrals(l, roomID, sender)
+	case shop.ActionReferralPayout:
+		return f.referralPayout(l, roomID, sender)
+	case "help":
+		return f.reply(roomID, l.T("matrix.help"))
+	default:
+		return f.reply(roomID, l.T("matrix.unknown"))
+	}
+}
+
+// account resolves the shop user behind a Matrix user, asking unregistered
+// users to register
+func (f *Frontend) account(l *i18n.Locale, roomID, sender string) (int64, error) {
+	userID, err := f.shop.UserID(shop.FrontendMatrix, sender)
+	if errors.Is(err, shop.ErrNotRegistered) {
+		f.reply(roomID, l.T("matrix.register_first"))
+	}
+	return userID, err
+}
+
+// offerID parses the offer number given as the only argument of command
+func (f *Frontend) offerID(l *i18n.Locale, roomID, command string, args []string) (int, bool) {
+	if len(args) != 1 {
+		f.reply(roomID, l.T("matrix.offer_usage", command))
+		return 0, false
+	}
+	offerID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		f.reply(roomID, l.T("matrix.invalid_offer"))
+		return 0, false
+	}
+	return offerID, true
+}
+
+func (f *Frontend) sell(l *i18n.Locale, roomID, sender string, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return f.reply(roomID, l.T("matrix.sell_usage"))
+	}
+	amountBTC, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || amountBTC <= 0 {
+		return f.reply(roomID, l.T("sell.invalid_amount"))
+	}
+	priceUSD, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || priceUSD <= 0 {
+		return f.reply(roomID, l.T("sell.invalid_price"))
+	}
+
+	method := models.PaymentLightning
+	if len(args) == 3 {
+		method = models.PaymentMethod(strings.ToLower(args[2]))
+	}
+
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	offer, err := f.shop.CreateOffer(userID, amountBTC, priceUSD, method)
+	switch {
+	case errors.Is(err, shop.ErrPaymentMethod):
+		return f.reply(roomID, l.T("sell.invalid_method"))
+	case errors.Is(err, shop.ErrTooManyOffers):
+		return f.reply(roomID, l.N("sell.too_many", f.shop.Limits().MaxOpenOffers))
+	case errors.Is(err, shop.ErrCooldown):
+		return f.reply(roomID, l.T("sell.cooldown", f.shop.CooldownRemaining(userID).Round(time.Second)))
+	case errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		return f.reply(roomID, f.limitExceeded(l, userID, err))
+	case errors.Is(err, shop.ErrThrottled):
+		return f.reply(roomID, shop.ThrottledText(l, err))
+	case errors.Is(err, shop.ErrInvoice):
+		f.reply(roomID, l.T("sell.invoice_failed"))
+		return err
+	case err != nil:
+		f.reply(roomID, l.T("sell.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.OfferCreatedMessage(l, offer))
+}
+
+func (f *Frontend) listOffers(l *i18n.Locale, roomID, sender string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	offers, err := f.shop.ListOffers(userID)
+	if errors.Is(err, shop.ErrThrottled) {
+		return f.reply(roomID, shop.ThrottledText(l, err))
+	}
+	if err != nil {
+		f.reply(roomID, l.T("list.failed"))
+		return err
+	}
+
+	var active []models.Offer
+	for _, o := range offers {
+		if o.Status == models.StatusPending || o.Status == models.StatusPaid {
+			active = append(active, o)
+		}
+	}
+	if len(active) == 0 {
+		return f.reply(roomID, l.T("matrix.list_empty"))
+	}
+
+	f.reply(roomID, l.T("list.header"))
+	for _, o := range active {
+		f.Send(roomID, shop.OfferCardMessage(l, o))
+	}
+	return nil
+}
+
+func (f *Frontend) showMarketplace(l *i18n.Locale, roomID string) error {
+	sellers, err := f.shop.Marketplace(20)
+	if err != nil {
+		f.reply(roomID, l.T("marketplace.failed"))
+		return err
+	}
+	external := f.shop.ExternalOrders(10)
+	if len(sellers) == 0 && len(external) == 0 {
+		return f.reply(roomID, l.T("marketplace.empty"))
+	}
+
+	if len(sellers) > 0 {
+		f.reply(roomID, l.T("marketplace.header"))
+	}
+	for _, seller := range sellers {
+		f.Send(roomID, shop.SellerOffersMessage(l, seller))
+	}
+	if len(external) > 0 {
+		f.Send(roomID, shop.ExternalOrdersMessage(l, external))
+	}
+	return nil
+}
+
+// offerAction runs a confirm or cancel operation on the offer given in args
+// and replies with done on success
+func (f *Frontend) offerAction(l *i18n.Locale, roomID, sender, command string, args []string, action func(int64, int) (*models.Offer, error), done func(*i18n.Locale, int) shop.Message) error {
+	offerID, ok := f.offerID(l, roomID, command, args)
+	if !ok {
+		return nil
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	_, err = action(userID, offerID)
+	switch {
+	case errors.Is(err, shop.ErrOfferNotFound), errors.Is(err, shop.ErrNotOwner):
+		return f.reply(roomID, l.T("matrix.offer_not_owned", offerID))
+	case errors.Is(err, shop.ErrNotPaid):
+		return f.reply(roomID, l.T("confirm.not_paid"))
+	case errors.Is(err, shop.ErrNotTaken):
+		return f.reply(roomID, l.T("confirm.not_taken"))
+	case errors.Is(err, shop.ErrDisputed):
+		return f.reply(roomID, l.T("offer.disputed"))
+	case errors.Is(err, shop.ErrNotPending):
+		return f.reply(roomID, l.T("cancel.not_pending"))
+	case err != nil:
+		f.reply(roomID, l.T("confirm.failed"))
+		return err
+	}
+	return f.Send(roomID, done(l, offerID))
+}
+
+func (f *Frontend) refresh(l *i18n.Locale, roomID, sender string, args []string) error {
+	offerID, ok := f.offerID(l, roomID, "refresh", args)
+	if !ok {
+		return nil
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	offer, err := f.shop.RefreshInvoice(userID, offerID)
+	switch {
+	case errors.Is(err, shop.ErrOfferNotFound), errors.Is(err, shop.ErrNotOwner):
+		return f.reply(roomID, l.T("matrix.offer_not_owned", offerID))
+	case errors.Is(err, shop.ErrNotRefreshable):
+		return f.reply(roomID, l.T("refresh.not_refreshable"))
+	case errors.Is(err, shop.ErrTooManyInvoices):
+		return f.reply(roomID, l.T("refresh.too_many", offerID, f.shop.Limits().MaxOfferInvoices))
+	case errors.Is(err, shop.ErrTooManyOffers):
+		return f.reply(roomID, l.N("sell.too_many", f.shop.Limits().MaxOpenOffers))
+	case errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		return f.reply(roomID, f.limitExceeded(l, userID, err))
+	case errors.Is(err, shop.ErrThrottled):
+		return f.reply(roomID, shop.ThrottledText(l, err))
+	case err != nil:
+		f.reply(roomID, l.T("refresh.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.InvoiceRefreshedMessage(l, offer))
+}
+
+func (f *Frontend) take(l *i18n.Locale, roomID, sender string, args []string) error {
+	offerID, ok := f.offerID(l, roomID, "take", args)
+	if !ok {
+		return nil
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	trade, err := f.shop.TakeOffer(userID, offerID)
+	switch {
+	case errors.Is(err, shop.ErrOwnOffer):
+		return f.reply(roomID, l.T("take.own"))
+	case errors.Is(err, shop.ErrNotAvailable), errors.Is(err, shop.ErrOfferNotFound):
+		return f.reply(roomID, l.T("take.unavailable"))
+	case errors.Is(err, shop.ErrTradeLimit), errors.Is(err, shop.ErrDailyLimit):
+		return f.reply(roomID, f.limitExceeded(l, userID, err))
+	case err != nil:
+		f.reply(roomID, l.T("take.failed"))
+		return err
+	}
+
+	offer, err := f.shop.Offer(offerID)
+	if err != nil {
+		return err
+	}
+	return f.Send(roomID, shop.TradeStartedMessage(l, trade, offer, f.shop.Seller(*offer)))
+}
+
+func (f *Frontend) link(l *i18n.Locale, roomID, sender string, args []string) error {
+	if len(args) == 0 {
+		userID, err := f.account(l, roomID, sender)
+		if err != nil {
+			return nil
+		}
+		code, err := f.shop.CreateLinkCode(userID)
+		if err != nil {
+			f.reply(roomID, l.T("link.code_failed"))
+			return err
+		}
+		return f.Send(roomID, shop.LinkCodeMessage(l, code))
+	}
+
+	_, err := f.shop.Link(identity(sender, roomID), strings.ToUpper(args[0]))
+	switch {
+	case errors.Is(err, shop.ErrInvalidLinkCode):
+		return f.reply(roomID, l.T("link.invalid"))
+	case errors.Is(err, shop.ErrAlreadyLinked):
+		return f.reply(roomID, l.T("link.already"))
+	case errors.Is(err, shop.ErrFrontendLinked):
+		return f.reply(roomID, l.T("link.frontend_linked", "Matrix"))
+	case err != nil:
+		f.reply(roomID, l.T("link.failed"))
+		return err
+	}
+	return nil
+}
+
+// language lists the available languages, or sets the user's language with
+// "!language <code>". "!language auto" returns to the default language.
+func (f *Frontend) language(l *i18n.Locale, roomID, sender string, args []string) error {
+	languages := strings.Join(i18n.Languages(), ", ")
+	if len(args) != 1 {
+		return f.reply(roomID, l.T("language.prompt", l.T("language.name"))+" "+languages)
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	lang := strings.ToLower(args[0])
+	if lang == "auto" {
+		lang = ""
+	}
+
+	switch err := f.shop.SetLanguage(userID, lang); {
+	case errors.Is(err, shop.ErrUnsupportedLanguage):
+		return f.reply(roomID, l.T("language.unknown", languages))
+	case err != nil:
+		f.reply(roomID, l.T("language.failed"))
+		return err
+	}
+
+	l = f.shop.Locale(userID, "")
+	if lang == "" {
+		return f.reply(roomID, l.T("language.auto_set"))
+	}
+	return f.reply(roomID, l.T("language.set", l.T("language.name")))
+}
+
+// openChat enters the chat of the trade given with "!chat <trade>"
+func (f *Frontend) openChat(l *i18n.Locale, roomID, sender string, args []string) error {
+	if len(args) != 1 {
+		return f.reply(roomID, l.T("chat.usage", "!chat"))
+	}
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return f.reply(roomID, l.T("chat.usage", "!chat"))
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	trade, err := f.shop.OpenTradeChat(userID, tradeID)
+	switch {
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		return f.reply(roomID, l.T("chat.not_found", tradeID))
+	case errors.Is(err, shop.ErrTradeClosed):
+		return f.reply(roomID, l.T("chat.trade_closed"))
+	case err != nil:
+		f.reply(roomID, l.T("chat.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.TradeChatOpenedMessage(l, trade, userID, "!exit"))
+}
+
+// dispute opens a dispute over the trade given with "!dispute <trade>"
+func (f *Frontend) dispute(l *i18n.Locale, roomID, sender string, args []string) error {
+	if len(args) != 1 {
+		return f.reply(roomID, l.T("chat.usage", "!dispute"))
+	}
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return f.reply(roomID, l.T("chat.usage", "!dispute"))
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	trade, err := f.shop.OpenDispute(userID, tradeID)
+	switch {
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		return f.reply(roomID, l.T("chat.not_found", tradeID))
+	case errors.Is(err, shop.ErrTradeClosed):
+		return f.reply(roomID, l.T("dispute.trade_closed", tradeID))
+	case errors.Is(err, shop.ErrDisputed):
+		return f.reply(roomID, l.T("dispute.exists", tradeID))
+	case err != nil:
+		f.reply(roomID, l.T("dispute.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.DisputeOpenedMessage(l, trade, userID))
+}
+
+// rate rates the counterparty of the trade given with
+// "!rate <trade> <score>"
+func (f *Frontend) rate(l *i18n.Locale, roomID, sender string, args []string) error {
+	if len(args) != 2 {
+		return f.reply(roomID, l.T("rate.usage", "!rate"))
+	}
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return f.reply(roomID, l.T("rate.usage", "!rate"))
+	}
+	score, err := strconv.Atoi(args[1])
+	if err != nil {
+		return f.reply(roomID, l.T("rate.usage", "!rate"))
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	_, err = f.shop.RateTrade(userID, tradeID, score)
+	switch {
+	case errors.Is(err, shop.ErrInvalidScore):
+		return f.reply(roomID, l.T("rate.usage", "!rate"))
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		return f.reply(roomID, l.T("chat.not_found", tradeID))
+	case errors.Is(err, shop.ErrNotCompleted):
+		return f.reply(roomID, l.T("rate.not_completed", tradeID))
+	case errors.Is(err, shop.ErrRated):
+		return f.reply(roomID, l.T("rate.exists", tradeID))
+	case err != nil:
+		f.reply(roomID, l.T("rate.failed"))
+		return err
+	}
+	return f.reply(roomID, l.T("rate.done", tradeID))
+}
+
+// openContact enters a direct chat with the user given with
+// "!contact <nickname>"
+func (f *Frontend) openContact(l *i18n.Locale, roomID, sender string, args []string) error {
+	if len(args) != 1 {
+		return f.reply(roomID, l.T("contact.usage", "!contact"))
+	}
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+
+	peer, err := f.shop.OpenContact(userID, args[0])
+	switch {
+	case errors.Is(err, shop.ErrUserNotFound):
+		return f.reply(roomID, l.T("contact.not_found", markup.Escape(args[0])))
+	case errors.Is(err, shop.ErrOwnContact):
+		return f.reply(roomID, l.T("contact.self"))
+	case err != nil:
+		f.reply(roomID, l.T("chat.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.ContactOpenedMessage(l, peer.Nickname, "!exit"))
+}
+
+// exitChat leaves the current chat
+func (f *Frontend) exitChat(l *i18n.Locale, roomID, sender string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	chat, err := f.shop.CloseChat(userID)
+	switch {
+	case errors.Is(err, shop.ErrNotInChat):
+		return f.reply(roomID, l.T("chat.not_in_chat"))
+	case err != nil:
+		f.reply(roomID, l.T("chat.failed"))
+		return err
+	}
+	if chat.Trade != nil {
+		return f.reply(roomID, l.T("chat.closed", chat.Trade.ID))
+	}
+	return f.reply(roomID, l.T("chat.closed_contact", markup.Escape(chat.Peer.Nickname)))
+}
+
+// nickname shows the sender's nickname, or changes it with "!nick <nickname>"
+func (f *Frontend) nickname(l *i18n.Locale, roomID, sender string, args []string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	if len(args) == 0 {
+		current, err := f.shop.Nickname(userID)
+		if err != nil {
+			return err
+		}
+		return f.Send(roomID, shop.NicknameMessage(l, current, "!nick"))
+	}
+
+	nickname := strings.TrimPrefix(args[0], "@")
+	switch err := f.shop.SetNickname(userID, nickname); {
+	case errors.Is(err, shop.ErrInvalidNickname):
+		return f.reply(roomID, l.T("nick.invalid"))
+	case errors.Is(err, shop.ErrNicknameTaken):
+		return f.reply(roomID, l.T("nick.taken", markup.Escape(nickname)))
+	case err != nil:
+		return err
+	}
+	return f.reply(roomID, l.T("nick.set", markup.Escape(nickname)))
+}
+
+// payout lists the sender's payouts, or with "!payout <trade> <destination>"
+// sets where the bitcoin of a trade is sent
+func (f *Frontend) payout(l *i18n.Locale, roomID, sender string, args []string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	if len(args) == 0 {
+		payouts, err := f.shop.Payouts(userID)
+		if err != nil {
+			f.reply(roomID, l.T("payout.failed"))
+			return err
+		}
+		return f.Send(roomID, shop.PayoutsMessage(l, payouts))
+	}
+	tradeID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return f.reply(roomID, l.T("chat.usage", "!payout"))
+	}
+	if len(args) != 2 {
+		return f.reply(roomID, l.T("payout.usage", "!payout", tradeID))
+	}
+
+	payout, err := f.shop.SetPayoutDestination(userID, tradeID, args[1])
+	switch {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		return f.reply(roomID, l.T("payout.invalid"))
+	case errors.Is(err, shop.ErrUnresolvable):
+		return f.reply(roomID, l.T("payout.unresolvable"))
+	case errors.Is(err, shop.ErrPayoutAmount):
+		return f.reply(roomID, l.T("payout.amount_rejected", tradeID))
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		return f.reply(roomID, l.T("payout.wrong_network", f.shop.Network()))
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		return f.reply(roomID, l.T("payout.wrong_amount", tradeID))
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		return f.reply(roomID, l.T("payout.expired"))
+	case errors.Is(err, shop.ErrTradeNotFound), errors.Is(err, shop.ErrNotParticipant):
+		return f.reply(roomID, l.T("chat.not_found", tradeID))
+	case errors.Is(err, shop.ErrNotBuyer):
+		return f.reply(roomID, l.T("payout.not_buyer", tradeID))
+	case errors.Is(err, shop.ErrTradeClosed):
+		return f.reply(roomID, l.T("payout.trade_cancelled", tradeID))
+	case errors.Is(err, shop.ErrPayoutExists):
+		return f.reply(roomID, l.T("payout.exists", tradeID))
+	case err != nil:
+		f.reply(roomID, l.T("payout.failed"))
+		return err
+	}
+	if payout == nil {
+		return f.reply(roomID, l.T("payout.saved", tradeID))
+	}
+	return f.Send(roomID, shop.PayoutMessage(l, payout))
+}
+
+// refund lists the sender's refunds, or with "!refund <offer> <destination>"
+// sets where the refund of a cancelled paid offer is sent
+func (f *Frontend) refund(l *i18n.Locale, roomID, sender string, args []string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	if len(args) == 0 {
+		refunds, err := f.shop.Refunds(userID)
+		if err != nil {
+			f.reply(roomID, l.T("refund.failed"))
+			return err
+		}
+		return f.Send(roomID, shop.RefundsMessage(l, refunds))
+	}
+	offerID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return f.reply(roomID, l.T("refund.offer_usage", "!refund"))
+	}
+	if len(args) != 2 {
+		return f.reply(roomID, l.T("refund.usage", "!refund", offerID))
+	}
+
+	refund, err := f.shop.SetRefundDestination(userID, offerID, args[1])
+	switch {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		return f.reply(roomID, l.T("payout.invalid"))
+	case errors.Is(err, shop.ErrUnresolvable):
+		return f.reply(roomID, l.T("payout.unresolvable"))
+	case errors.Is(err, shop.ErrPayoutAmount):
+		return f.reply(roomID, l.T("refund.amount_rejected", offerID))
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		return f.reply(roomID, l.T("payout.wrong_network", f.shop.Network()))
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		return f.reply(roomID, l.T("refund.wrong_amount", offerID))
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		return f.reply(roomID, l.T("payout.expired"))
+	case errors.Is(err, shop.ErrRefundNotFound), errors.Is(err, shop.ErrNotOwner):
+		return f.reply(roomID, l.T("refund.not_found", offerID))
+	case errors.Is(err, shop.ErrRefundExists):
+		return f.reply(roomID, l.T("refund.exists", offerID))
+	case err != nil:
+		f.reply(roomID, l.T("refund.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.RefundMessage(l, refund))
+}
+
+// lightningAddress shows the sender's Lightning address, or with
+// "!lnaddress <address>" sets it and with "!lnaddress off" removes it
+func (f *Frontend) lightningAddress(l *i18n.Locale, roomID, sender string, args []string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	if len(args) == 0 {
+		current, err := f.shop.LightningAddress(userID)
+		if err != nil {
+			return err
+		}
+		return f.Send(roomID, shop.LightningAddressMessage(l, current, "!lnaddress"))
+	}
+	address := args[0]
+	if strings.EqualFold(address, "off") {
+		address = ""
+	}
+
+	switch err := f.shop.SetLightningAddress(userID, address); {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		return f.reply(roomID, l.T("lnaddress.invalid"))
+	case errors.Is(err, shop.ErrUnresolvable):
+		return f.reply(roomID, l.T("lnaddress.unresolvable"))
+	case err != nil:
+		f.reply(roomID, l.T("lnaddress.failed"))
+		return err
+	}
+	if address == "" {
+		return f.reply(roomID, l.T("lnaddress.removed"))
+	}
+	current, err := f.shop.LightningAddress(userID)
+	if err != nil {
+		return err
+	}
+	return f.reply(roomID, l.T("lnaddress.set", markup.Escape(current)))
+}
+
+// balance shows the sender's ledger balance and latest entries
+func (f *Frontend) balance(l *i18n.Locale, roomID, sender string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	balance, err := f.shop.Balance(userID)
+	if err != nil {
+		return err
+	}
+	return f.Send(roomID, shop.BalanceMessage(l, balance))
+}
+
+// limits shows the sender's tier and trade limits
+func (f *Frontend) limits(l *i18n.Locale, roomID, sender string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	limits, err := f.shop.TradeLimits(userID)
+	if err != nil {
+		f.reply(roomID, l.T("limits.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.LimitsMessage(l, limits))
+}
+
+// limitExceeded explains why err, a trade or daily limit error, rejected an
+// offer or trade of userID
+func (f *Frontend) limitExceeded(l *i18n.Locale, userID int64, err error) string {
+	limits, lerr := f.shop.TradeLimits(userID)
+	if lerr != nil {
+		return l.T("limits.failed")
+	}
+	return shop.LimitExceededText(l, limits, err, "!limits")
+}
+
+// bond shows the sender's seller bond. "!bond post" posts a new bond,
+// "!bond release" releases the active one and "!bond <bond> <destination>"
+// says where to send a bond released to or won by the sender.
+func (f *Frontend) bond(l *i18n.Locale, roomID, sender string, args []string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	if len(args) == 0 {
+		bond, err := f.shop.Bond(userID)
+		if err != nil && !errors.Is(err, shop.ErrNoBond) {
+			f.reply(roomID, l.T("bond.failed"))
+			return err
+		}
+		if f.shop.Bonds().AmountSats <= 0 && bond == nil {
+			return f.reply(roomID, l.T("bond.disabled"))
+		}
+		return f.Send(roomID, shop.BondMessage(l, bond, f.shop.Bonds()))
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "post":
+		bond, err := f.shop.PostBond(userID)
+		switch {
+		case errors.Is(err, shop.ErrBondsDisabled):
+			return f.reply(roomID, l.T("bond.disabled"))
+		case errors.Is(err, shop.ErrBondExists):
+			return f.reply(roomID, l.T("bond.exists"))
+		case err != nil:
+			f.reply(roomID, l.T("bond.failed"))
+			return err
+		}
+		return f.Send(roomID, shop.BondMessage(l, bond, f.shop.Bonds()))
+	case "release":
+		bond, err := f.shop.ReleaseBond(userID)
+		switch {
+		case errors.Is(err, shop.ErrNoBond):
+			return f.reply(roomID, l.T("bond.no_bond"))
+		case errors.Is(err, shop.ErrOpenTrades):
+			return f.reply(roomID, l.T("bond.open_trades"))
+		case err != nil:
+			f.reply(roomID, l.T("bond.failed"))
+			return err
+		}
+		return f.Send(roomID, shop.BondMessage(l, bond, f.shop.Bonds()))
+	}
+
+	bondID, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return f.reply(roomID, l.T("bond.command_usage", "!bond"))
+	}
+	if len(args) != 2 {
+		return f.reply(roomID, l.T("bond.usage", "!bond", bondID))
+	}
+
+	bond, err := f.shop.ClaimBond(userID, bondID, args[1])
+	switch {
+	case errors.Is(err, shop.ErrInvalidDestination):
+		return f.reply(roomID, l.T("payout.invalid"))
+	case errors.Is(err, shop.ErrUnresolvable):
+		return f.reply(roomID, l.T("payout.unresolvable"))
+	case errors.Is(err, shop.ErrPayoutAmount):
+		return f.reply(roomID, l.T("bond.amount_rejected", bondID))
+	case errors.Is(err, shop.ErrInvoiceNetwork):
+		return f.reply(roomID, l.T("payout.wrong_network", f.shop.Network()))
+	case errors.Is(err, shop.ErrInvoiceAmount):
+		return f.reply(roomID, l.T("bond.wrong_amount", bondID))
+	case errors.Is(err, shop.ErrInvoiceExpired):
+		return f.reply(roomID, l.T("payout.expired"))
+	case errors.Is(err, shop.ErrBondNotFound):
+		return f.reply(roomID, l.T("bond.not_found", bondID))
+	case errors.Is(err, shop.ErrBondPayoutExist):
+		return f.reply(roomID, l.T("bond.payout_exists", bondID))
+	case err != nil:
+		f.reply(roomID, l.T("bond.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.BondPayoutMessage(l, bond))
+}
+
+// referralPrefix starts the argument of "!start" naming a referral code
+const referralPrefix = "ref_"
+
+// referrals shows the sender's invite command and referral earnings
+func (f *Frontend) referrals(l *i18n.Locale, roomID, sender string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	summary, err := f.shop.Referrals(userID)
+	if err != nil {
+		return err
+	}
+	return f.Send(roomID, shop.ReferralsMessage(l, summary, "!start "+referralPrefix+summary.Code))
+}
+
+// referralPayout pays the sender's available referral earnings out to their
+// Lightning address
+func (f *Frontend) referralPayout(l *i18n.Locale, roomID, sender string) error {
+	userID, err := f.account(l, roomID, sender)
+	if err != nil {
+		return nil
+	}
+	payout, err := f.shop.RequestReferralPayout(userID)
+	switch {
+	case errors.Is(err, shop.ErrNoReferralEarnings):
+		return f.reply(roomID, l.T("referral.nothing"))
+	case errors.Is(err, shop.ErrNoLightningAddress):
+		return f.reply(roomID, l.T("referral.no_address", "!lnaddress"))
+	case errors.Is(err, shop.ErrReferralPayoutExists):
+		return f.reply(roomID, l.T("referral.exists"))
+	case err != nil:
+		f.reply(roomID, l.T("referral.failed"))
+		return err
+	}
+	return f.Send(roomID, shop.ReferralPayoutMessage(l, payout))
+}
+
+// relay forwards text to the other side of the sender's chat, if any. Text
+// of other users is ignored.
+func (f *Frontend) relay(roomID, sender, body string) error {
+	userID, err := f.shop.UserID(shop.FrontendMatrix, sender)
+	if err != nil {
+		return nil
+	}
+	if banned, err := f.shop.IsBanned(userID); err != nil || banned {
+		return err
+	}
+
+	_, err = f.shop.RelayMessage(userID, shop.FrontendMatrix, body, "")
+	switch {
+	case errors.Is(err, shop.ErrNotInChat):
+		return nil
+	case errors.Is(err, shop.ErrTradeClosed):
+		return f.reply(roomID, f.locale(sender).T("chat.trade_closed"))
+	case err != nil:
+		f.reply(roomID, f.locale(sender).T("chat.failed"))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package matrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay/btcpaytest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/ratelimit"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// homeserver is a fake Matrix homeserver serving scripted sync batches
+type homeserver struct {
+	mu      sync.Mutex
+	batches []map[string]interface{}
+	joined  []string
+	sent    []map[string]string
+}
+
+func (h *homeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/_matrix/client/v3/sync":
+		batch := map[string]interface{}{"next_batch": "end"}
+		if len(h.batches) > 0 {
+			batch, h.batches = h.batches[0], h.batches[1:]
+		}
+		json.NewEncoder(w).Encode(batch)
+	case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/join/"):
+		h.joined = append(h.joined, strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3/join/"))
+		w.Write([]byte(`{}`))
+	case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+		var content map[string]string
+		json.NewDecoder(r.Body).Decode(&content)
+		h.sent = append(h.sent, content)
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// message queues a sync batch with text messages from sender in room
+func (h *homeserver) message(room, sender string, bodies ...string) {
+	var events []map[string]interface{}
+	for _, body := range bodies {
+		events = append(events, map[string]interface{}{
+			"type":    "m.room.message",
+			"sender":  sender,
+			"content": map[string]string{"msgtype": "m.text", "body": body},
+		})
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batches = append(h.batches, map[string]interface{}{
+		"next_batch": "next",
+		"rooms": map[string]interface{}{
+			"join": map[string]interface{}{room: map[string]interface{}{"timeline": map[string]interface{}{"events": events}}},
+		},
+	})
+}
+
+// replies returns and clears the plain bodies of sent messages
+func (h *homeserver) replies() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var bodies []string
+	for _, c := range h.sent {
+		bodies = append(bodies, c["body"])
+	}
+	h.sent = nil
+	return bodies
+}
+
+func newTestFrontend(t *testing.T) (*Frontend, *homeserver, *btcpaytest.Server) {
+	t.Helper()
+	hs := &homeserver{}
+	srv := httptest.NewServer(hs)
+	pay := btcpaytest.NewServer("key", "store")
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		pay.Close()
+		srv.Close()
+	})
+
+	svc := shop.NewService(database, pay.Client())
+	f := NewFrontend(NewClient(srv.URL, "token"), "@shop:example.org", svc)
+	svc.AddFrontend(f)
+	return f, hs, pay
+}
+
+func TestInitialSyncSkipsHistoryAndJoinsInvites(t *testing.T) {
+	f, hs, _ := newTestFrontend(t)
+	hs.message("!dm:example.org", "@alice:example.org", "!start")
+	hs.batches[0]["rooms"].(map[string]interface{})["invite"] = map[string]interface{}{"!new:example.org": map[string]interface{}{}}
+
+	if err := f.syncOnce(); err != nil {
+		t.Fatalf("syncOnce: %v", err)
+	}
+	if replies := hs.replies(); len(replies) != 0 {
+		t.Errorf("replied to history: %q", replies)
+	}
+	if len(hs.joined) != 1 || hs.joined[0] != "!new:example.org" {
+		t.Errorf("joined = %q", hs.joined)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	f, hs, pay := newTestFrontend(t)
+	f.syncOnce() // initial sync
+
+	hs.message("!dm:example.org", "@alice:example.org",
+		"!sell 0.01 500", "!start", "!sell 0.01 500", "!list", "!cancel 1", "hello", "!shop@example.org:")
+	hs.message("!dm:example.org", "@shop:example.org", "!start") // own messages are ignored
+	f.syncOnce()
+	f.syncOnce()
+
+	replies := hs.replies()
+	invoice := pay.Invoices()[0]
+	want := []string{
+		"Please register first with !start",
+		"Successfully registered! Send !help to see what you can do.",
+		"✅ Offer created!\n\n🔹 Amount: 0.01 BTC\n🔹 Price: $500.00\n\n⚡ Lightning invoice to pay from your wallet:\n" + invoice.PaymentRequest + "\n\nView Invoice: " + pay.URL() + "/i/" + invoice.ID,
+		"📋 Your offers:",
+		"", // offer card, checked below
+		"❌ Offer Cancelled\n\nYou have cancelled Offer #1.",
+		"Unknown command. Send !help for the list of commands.",
+	}
+	if len(replies) != len(want) {
+		t.Fatalf("replies = %q", replies)
+	}
+	for i := range want {
+		if want[i] != "" && replies[i] != want[i] {
+			t.Errorf("reply %d = %q, want %q", i, replies[i], want[i])
+		}
+	}
+	if card := replies[4]; !strings.HasPrefix(card, "Offer #1\n") || !strings.HasSuffix(card, "❌ Cancel Offer: !cancel_offer 1\n🔄 Refresh Invoice: !refresh_invoice 1") {
+		t.Errorf("offer card = %q", card)
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	f, hs, _ := newTestFrontend(t)
+	f.syncOnce() // initial sync
+
+	hs.message("!dm:example.org", "@alice:example.org", "!start", "!language de", "!sell 1.5 x", "!language xx", "!language auto")
+	f.syncOnce()
+
+	want := []string{
+		"Successfully registered! Send !help to see what you can do.",
+		"✅ Sprache auf Deutsch umgestellt.",
+		"Ungültiger USD-Preis",
+		"Unbekannte Sprache. Verfügbare Sprachen: de, en, es, pt",
+		"✅ Language set to automatic.",
+	}
+	replies := hs.replies()
+	if len(replies) != len(want) {
+		t.Fatalf("replies = %q", replies)
+	}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Errorf("reply %d = %q, want %q", i, replies[i], want[i])
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	f, hs, pay := newTestFrontend(t)
+	f.shop.SetRateLimits(shop.RateLimits{
+		User:    ratelimit.New(4, time.Hour),
+		Invoice: ratelimit.New(1, time.Hour),
+	})
+	f.syncOnce() // initial sync
+
+	hs.message("!dm:example.org", "@alice:example.org", "!start", "!sell 0.01 500", "!refresh 1", "!help", "!help", "!help")
+	f.syncOnce()
+
+	replies := hs.replies()
+	if len(replies) != 6 {
+		t.Fatalf("replies = %q", replies)
+	}
+	if replies[2] != "⏳ Slow down! You are sending commands too quickly. Please try again in 1h0m0s." {
+		t.Errorf("throttled !refresh = %q", replies[2])
+	}
+	if n := len(pay.Invoices()); n != 1 {
+		t.Errorf("throttled !refresh created an invoice: %d invoices", n)
+	}
+	if !strings.HasPrefix(replies[5], "⏳ Slow down!") {
+		t.Errorf("throttled !help = %q", replies[5])
+	}
+}
+
+func TestRender(t *testing.T) {
+	body, formatted := render(shop.Message{
+		Text:    "*Offer #1* <b>`code`</b>",
+		Actions: [][]shop.Action{{{Label: "Open", URL: "https://example.org"}}},
+	})
+	if body != "Offer #1 <b>code</b>\n\nOpen: https://example.org" {
+		t.Errorf("body = %q", body)
+	}
+	if formatted != "<b>Offer #1</b> &lt;b&gt;<code>code</code>&lt;/b&gt;<br><br>Open: https://example.org" {
+		t.Errorf("formatted = %q", formatted)
+	}
+}
+
+func TestTradeChat(t *testing.T) {
+	f, hs, _ := newTestFrontend(t)
+	f.syncOnce() // initial sync
+
+	hs.message("!alice:example.org", "@alice:example.org", "!start", "!sell 0.01 500")
+	hs.message("!bob:example.org", "@bob:example.org", "!start", "!take 1", "!chat", "!chat 1", "I sent the payment", "!exit", "ignored")
+	f.syncOnce()
+	f.syncOnce()
+
+	replies := hs.replies()
+	want := []string{
+		"Please specify the trade number, e.g. !chat 3",
+		"💬 Trade #1 · Buyer:\n\nI sent the payment\n\n💬 Reply: !trade_chat 1",
+		"You left the chat of Trade #1.",
+	}
+	for _, w := range want {
+		found := false
+		for _, r := range replies {
+			found = found || r == w
+		}
+		if !found {
+			t.Errorf("missing reply %q in %q", w, replies)
+		}
+	}
+	if last := replies[len(replies)-1]; last != "You left the chat of Trade #1." {
+		t.Errorf("text outside the chat got reply %q", last)
+	}
+
+	sellerID, err := f.shop.UserID(shop.FrontendMatrix, "@alice:example.org")
+	if err != nil {
+		t.Fatalf("UserID: %v", err)
+	}
+	messages, err := f.shop.TradeMessages(sellerID, 1)
+	if err != nil || len(messages) != 1 || messages[0].Text != "I sent the payment" || messages[0].Frontend != shop.FrontendMatrix {
+		t.Errorf("trade messages = %+v, %v", messages, err)
+	}
+}
+
+func TestContact(t *testing.T) {
+	f, hs, _ := newTestFrontend(t)
+	f.syncOnce() // initial sync
+
+	hs.message("!alice:example.org", "@alice:example.org", "!start", "!nick alice")
+	f.syncOnce()
+	hs.message("!bob:example.org", "@bob:example.org", "!start", "!contact alice", "Is offer 1 still available?", "!exit")
+	f.syncOnce()
+	f.syncOnce()
+
+	replies := hs.replies()
+	bobID, _ := f.shop.UserID(shop.FrontendMatrix, "@bob:example.org")
+	bob, _ := f.shop.Nickname(bobID)
+	want := []string{
+		"Your nickname is now alice",
+		"💬 " + bob + ":\n\nIs offer 1 still available?\n\n💬 Reply: !contact " + bob,
+		"You left the chat with alice.",
+	}
+	for _, w := range want {
+		found := false
+		for _, r := range replies {
+			found = found || r == w
+		}
+		if !found {
+			t.Errorf("missing reply %q in %q", w, replies)
+		}
+	}
+}
@@ -16,18 +16,460 @@ const (
 	StatusCompleted OfferStatus = "completed"
 	// StatusCancelled indicates an offer that has been cancelled
 	StatusCancelled OfferStatus = "cancelled"
+	// StatusExpired indicates an offer whose invoice expired unpaid
+	StatusExpired OfferStatus = "expired"
 )
 
+// Closed reports whether an offer with this status can no longer change
+func (s OfferStatus) Closed() bool {
+	return s == StatusCompleted || s == StatusCancelled || s == StatusExpired
+}
+
+// PaymentMethod selects how the seller pays the invoice of an offer
+type PaymentMethod string
+
+const (
+	// PaymentLightning pays the invoice over Lightning
+	PaymentLightning PaymentMethod = "lightning"
+	// PaymentOnChain pays the invoice with an on-chain transaction
+	PaymentOnChain PaymentMethod = "onchain"
+	// PaymentBoth lets the seller pay either way
+	PaymentBoth PaymentMethod = "both"
+)
+
+// Valid reports whether m is a known payment method
+func (m PaymentMethod) Valid() bool {
+	return m == PaymentLightning || m == PaymentOnChain || m == PaymentBoth
+}
+
+// Lightning reports whether the invoice can be paid over Lightning
+func (m PaymentMethod) Lightning() bool {
+	return m == PaymentLightning || m == PaymentBoth
+}
+
+// OnChain reports whether the invoice can be paid on-chain
+func (m PaymentMethod) OnChain() bool {
+	return m == PaymentOnChain || m == PaymentBoth
+}
+
 // Offer represents a Bitcoin selling offer
 type Offer struct {
-	ID          int
-	UserID      int64
-	Username    string // Username of the offer creator
-	AmountBTC   float64
-	PriceUSD    float64
+	ID             int
+	UserID         int64
+	Username       string // Username of the offer creator
+	AmountBTC      float64
+	PriceUSD       float64
+	InvoiceID      string
+	InvoiceLink    string
+	PaymentMethod  PaymentMethod
+	PaymentRequest string // BOLT11 invoice of InvoiceID, empty if unknown
+	PaymentAddress string // Bitcoin address of InvoiceID, empty if unknown
+	// Confirmations of the on-chain payment of the invoice, -1 until one is
+	// received, and the number required before the offer is paid
+	Confirmations         int
+	ConfirmationsRequired int
+	MakerFeeSats          int64 // Platform fee paid on top of the amount, included in the invoice
+	Status                OfferStatus
+	Taken                 bool // Whether a buyer has an open trade on the offer
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
+}
+
+// OfferInvoice is a BTCPay invoice created for an offer. Only the latest
+// invoice of an offer is active; the ones it replaced are kept so that late
+// payments to them are still attributed to the offer.
+type OfferInvoice struct {
 	InvoiceID   string
+	OfferID     int
 	InvoiceLink string
-	Status      OfferStatus
+	Active      bool
 	CreatedAt   time.Time
-	UpdatedAt   time.Time
-} 
\ No newline at end of file
+}
+
+// Identity links an account on a messaging frontend to a shop user
+type Identity struct {
+	Frontend   string // Name of the frontend, e.g. "telegram" or "matrix"
+	ExternalID string // User ID on the frontend
+	UserID     int64  // Shop user the identity belongs to
+	ChatID     string // Chat used to reach the user on the frontend
+	Username   string
+	Language   string // Language code reported by the frontend, e.g. "pt-BR"
+}
+
+// User represents a registered shop user
+type User struct {
+	ID               int64
+	Username         string
+	Nickname         string // Public handle shown to other users
+	Language         string // Language chosen by the user, empty to follow the frontend
+	LightningAddress string // Lightning address or LNURL payouts go to by default
+	ReferralCode     string // Code of the user's invite link, empty until first shown
+	ReferrerID       int64  // User who invited the user, 0 if none
+	CreatedAt        time.Time
+}
+
+// Tier is a level of trust users reach with the age of their account, their
+// completed trades, their rating and a seller bond, and the trade limits that
+// come with it
+type Tier struct {
+	Name          string
+	MinAccountAge time.Duration
+	MinTrades     int     // Completed trades, as seller or buyer
+	MinRating     float64 // Average rating received, 0 for no requirement
+	Bonded        bool    // Whether the tier requires an active seller bond
+	MaxTradeSats  int64   // Largest offer or trade, 0 for no cap
+	MaxDailySats  int64   // Volume over the last 24 hours, 0 for no cap
+}
+
+// TradeStatus represents the status of a trade
+type TradeStatus string
+
+const (
+	// TradeOpen indicates a trade waiting for the seller to confirm payment
+	TradeOpen TradeStatus = "open"
+	// TradeCompleted indicates a trade whose payment has been confirmed
+	TradeCompleted TradeStatus = "completed"
+	// TradeCancelled indicates a trade that was cancelled with its offer
+	TradeCancelled TradeStatus = "cancelled"
+	// TradeRefunded indicates a trade cancelled after its offer was paid,
+	// whose payment is returned to the seller
+	TradeRefunded TradeStatus = "refunded"
+)
+
+// Trade represents a buyer taking a seller's offer
+type Trade struct {
+	ID                int
+	OfferID           int
+	SellerID          int64
+	BuyerID           int64
+	Status            TradeStatus
+	PayoutDestination string // Where the buyer receives the bitcoin, empty until given
+	// Platform fee of the trade, paid by the seller with the invoice of the
+	// offer and by the buyer out of the payout
+	MakerFeeSats int64
+	TakerFeeSats int64
+	DisputedBy   int64 // Participant who opened a dispute, 0 if undisputed
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// FeeSats returns the platform fee of the trade
+func (t *Trade) FeeSats() int64 {
+	return t.MakerFeeSats + t.TakerFeeSats
+}
+
+// PayoutStatus represents the status of a payout
+type PayoutStatus string
+
+const (
+	// PayoutAwaitingApproval indicates a payout waiting for the store owner
+	PayoutAwaitingApproval PayoutStatus = "awaiting_approval"
+	// PayoutInProgress indicates an approved payout being paid
+	PayoutInProgress PayoutStatus = "in_progress"
+	// PayoutCompleted indicates a payout that reached its destination
+	PayoutCompleted PayoutStatus = "completed"
+	// PayoutCancelled indicates a payout that failed or was cancelled
+	PayoutCancelled PayoutStatus = "cancelled"
+)
+
+// Closed reports whether a payout with this status can no longer change
+func (s PayoutStatus) Closed() bool {
+	return s == PayoutCompleted || s == PayoutCancelled
+}
+
+// Payout sends the bitcoin of a completed trade to its buyer through a
+// BTCPay pull payment
+type Payout struct {
+	ID            int
+	TradeID       int
+	UserID        int64 // User receiving the payout
+	Destination   string
+	AmountSats    int64
+	PullPaymentID string
+	BTCPayID      string // ID of the payout on BTCPay Server
+	Status        PayoutStatus
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// RefundStatus represents the status of a refund
+type RefundStatus string
+
+const (
+	// RefundAwaitingDestination indicates a refund waiting for the payer to
+	// say where to send it
+	RefundAwaitingDestination RefundStatus = "awaiting_destination"
+	// RefundAwaitingApproval indicates a refund waiting for the store owner
+	RefundAwaitingApproval RefundStatus = "awaiting_approval"
+	// RefundInProgress indicates an approved refund being paid
+	RefundInProgress RefundStatus = "in_progress"
+	// RefundCompleted indicates a refund that reached its destination
+	RefundCompleted RefundStatus = "completed"
+)
+
+// Refund returns the payment of an offer cancelled after its invoice was
+// paid to the payer, through the pull payment BTCPay creates for it
+type Refund struct {
+	ID            int
+	OfferID       int
+	TradeID       int   // Trade cancelled with the offer, 0 if none
+	UserID        int64 // User who paid the invoice and receives the refund
+	InvoiceID     string
+	AmountSats    int64
+	Destination   string // Empty until the payer gives one
+	PullPaymentID string // Empty until BTCPay creates the refund
+	BTCPayID      string // ID of the payout on BTCPay Server, empty until claimed
+	Status        RefundStatus
+	Duplicate     bool // Payment of an invoice of an offer already paid through another one
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// ReferralCredit is the share of the platform fee paid by a referred user on
+// a trade, credited to the user who invited them
+type ReferralCredit struct {
+	ID         int
+	ReferrerID int64
+	ReferredID int64
+	TradeID    int
+	FeeSats    int64 // Platform fee paid by the referred user
+	AmountSats int64 // Share credited to the referrer
+	PayoutID   int   // Referral payout the credit is paid with, 0 until requested
+	CreatedAt  time.Time
+}
+
+// ReferralPayout sends the referral credits of a user to their Lightning
+// address through a BTCPay pull payment
+type ReferralPayout struct {
+	ID            int
+	UserID        int64
+	Destination   string
+	AmountSats    int64
+	PullPaymentID string
+	BTCPayID      string // ID of the payout on BTCPay Server
+	Status        PayoutStatus
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// ReferralEarnings sums the referral credits of a user
+type ReferralEarnings struct {
+	Invites       int   // Users who registered with the user's invite link
+	EarnedSats    int64 // All credits
+	PaidSats      int64 // Credits of completed payouts
+	PendingSats   int64 // Credits of payouts being sent
+	AvailableSats int64 // Credits not paid out yet
+}
+
+// BondStatus represents the status of a seller bond
+type BondStatus string
+
+const (
+	// BondPending indicates a bond whose invoice awaits payment
+	BondPending BondStatus = "pending"
+	// BondActive indicates a paid bond, which lists the offers of its seller
+	BondActive BondStatus = "active"
+	// BondExpired indicates a bond whose invoice expired unpaid
+	BondExpired BondStatus = "expired"
+	// BondReleased indicates a bond returned to its seller
+	BondReleased BondStatus = "released"
+	// BondSlashed indicates a bond paid to the counterparty of a dispute its
+	// seller lost
+	BondSlashed BondStatus = "slashed"
+)
+
+// Bond is a refundable deposit a seller posts with a Lightning invoice. Once
+// released or slashed it is paid out to RecipientID through a BTCPay pull
+// payment.
+type Bond struct {
+	ID             int
+	UserID         int64
+	AmountSats     int64
+	InvoiceID      string
+	InvoiceLink    string
+	PaymentRequest string
+	Status         BondStatus
+	TradeID        int   // Trade whose dispute slashed the bond
+	RecipientID    int64 // User the released or slashed bond is paid to
+	Destination    string
+	PullPaymentID  string
+	BTCPayID       string
+	PayoutStatus   PayoutStatus // Empty while waiting for a destination
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Open reports whether the bond is pending or active, so that its seller
+// cannot post another one
+func (b *Bond) Open() bool {
+	return b.Status == BondPending || b.Status == BondActive
+}
+
+// Claimable reports whether the released or slashed bond waits for its
+// recipient to say where to send it
+func (b *Bond) Claimable() bool {
+	return (b.Status == BondReleased || b.Status == BondSlashed) &&
+		(b.PayoutStatus == "" || b.PayoutStatus == PayoutCancelled)
+}
+
+// LedgerKind is the kind of money movement a ledger entry records
+type LedgerKind string
+
+const (
+	// LedgerInvoiceReceipt records the payment of an offer invoice, credited
+	// to the seller
+	LedgerInvoiceReceipt LedgerKind = "invoice_receipt"
+	// LedgerEscrowHold moves the payment of an offer into the seller's escrow
+	LedgerEscrowHold LedgerKind = "escrow_hold"
+	// LedgerEscrowRelease returns the escrow of a cancelled paid offer to
+	// the seller, to be refunded
+	LedgerEscrowRelease LedgerKind = "escrow_release"
+	// LedgerFee moves the platform fee of a completed trade out of escrow
+	LedgerFee LedgerKind = "fee"
+	// LedgerTradeSettlement moves the rest of the escrow of a completed trade
+	// to the buyer
+	LedgerTradeSettlement LedgerKind = "trade_settlement"
+	// LedgerPayout records the bitcoin of a trade sent to its buyer
+	LedgerPayout LedgerKind = "payout"
+	// LedgerRefund records a refund sent to the payer of an offer
+	LedgerRefund LedgerKind = "refund"
+	// LedgerReferralCredit credits a referrer with a share of a fee
+	LedgerReferralCredit LedgerKind = "referral_credit"
+	// LedgerReferralPayout records referral earnings sent to a referrer
+	LedgerReferralPayout LedgerKind = "referral_payout"
+	// LedgerBondReceipt records the payment of a bond invoice, credited to
+	// the seller
+	LedgerBondReceipt LedgerKind = "bond_receipt"
+	// LedgerBondHold moves the payment of a bond into the seller's bond
+	LedgerBondHold LedgerKind = "bond_hold"
+	// LedgerBondRelease returns a bond to its seller
+	LedgerBondRelease LedgerKind = "bond_release"
+	// LedgerBondSlash gives a bond to the counterparty of a lost dispute
+	LedgerBondSlash LedgerKind = "bond_slash"
+	// LedgerBondPayout records a released or slashed bond sent to its
+	// recipient
+	LedgerBondPayout LedgerKind = "bond_payout"
+)
+
+// Ledger account names. Users have an available, an escrow and a bond
+// account, the platform has the others.
+const (
+	AccountAvailable = "available" // Funds the shop owes a user
+	AccountEscrow    = "escrow"    // Funds of a user held for their offers
+	AccountBond      = "bond"      // Bond posted by a seller
+	AccountFees      = "fees"      // Platform fees not shared with referrers
+	// Funds moving in and out of the BTCPay store: payments received are
+	// debited from it and funds sent credited, so it holds the negated
+	// balance of the store
+	AccountBTCPay = "btcpay"
+)
+
+// LedgerAccount is an account of the ledger, owned by a user or, with a zero
+// UserID, by the platform
+type LedgerAccount struct {
+	UserID int64
+	Name   string
+}
+
+// UserAccount returns an account of a user
+func UserAccount(userID int64, name string) LedgerAccount {
+	return LedgerAccount{UserID: userID, Name: name}
+}
+
+// PlatformAccount returns an account of the platform
+func PlatformAccount(name string) LedgerAccount {
+	return LedgerAccount{Name: name}
+}
+
+// LedgerPosting changes the balance of an account by AmountSats, which is
+// negative for debits
+type LedgerPosting struct {
+	Account    LedgerAccount
+	AmountSats int64
+}
+
+// LedgerEntry is an immutable journal entry of the ledger. Its postings sum
+// to zero, and Reference identifies the money movement so that it is
+// recorded once.
+type LedgerEntry struct {
+	ID        int
+	Reference string
+	Kind      LedgerKind
+	Postings  []LedgerPosting
+	CreatedAt time.Time
+}
+
+// AmountSats returns the sum of the postings of the entry to an account
+func (e *LedgerEntry) AmountSats(account LedgerAccount) int64 {
+	var sum int64
+	for _, p := range e.Postings {
+		if p.Account == account {
+			sum += p.AmountSats
+		}
+	}
+	return sum
+}
+
+// LedgerBalance is the balance of a ledger account
+type LedgerBalance struct {
+	Account     LedgerAccount
+	BalanceSats int64
+}
+
+// Rating is the score, from 1 to 5, a participant of a completed trade gave
+// their counterparty
+type Rating struct {
+	TradeID   int
+	RaterID   int64
+	RatedID   int64
+	Score     int
+	CreatedAt time.Time
+}
+
+// TradeMessage is a message relayed between the counterparties of a trade,
+// kept as evidence for disputes
+type TradeMessage struct {
+	ID        int
+	TradeID   int
+	SenderID  int64
+	Text      string
+	PhotoID   string // File ID of an attached photo on Frontend, if any
+	Frontend  string // Frontend the message was sent from
+	CreatedAt time.Time
+}
+
+// AuditEntry records an action taken by an admin
+type AuditEntry struct {
+	ID        int
+	AdminID   int64
+	Action    string
+	Target    string
+	Details   string
+	CreatedAt time.Time
+}
+
+// MessageKind identifies what a tracked message shows
+type MessageKind string
+
+const (
+	// MessageOfferCard is an offer shown to its owner
+	MessageOfferCard MessageKind = "offer_card"
+	// MessageSellerCard is a seller's offers shown in the marketplace
+	MessageSellerCard MessageKind = "seller_card"
+	// MessageMenu is the main menu
+	MessageMenu MessageKind = "menu"
+	// MessageChannelPost is an offer announced on a public channel
+	MessageChannelPost MessageKind = "channel_post"
+)
+
+// SentMessage is a message sent to a chat that is edited when what it shows
+// changes. A seller card is tracked once per offer it lists.
+type SentMessage struct {
+	Frontend  string
+	ChatID    string
+	MessageID string
+	Kind      MessageKind
+	OfferID   int   // Offer shown, 0 for menus
+	UserID    int64 // User the message was sent to
+	CreatedAt time.Time
+}
@@ -0,0 +1,149 @@
+// Package nostr implements the parts of the Nostr protocol used to publish
+// the shop's offers as NIP-69 order events and to read orders published by
+// other marketplaces.
+package nostr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// Event kinds
+const (
+	KindDeletion = 5     // NIP-09 event deletion request
+	KindOrder    = 38383 // NIP-69 peer-to-peer order
+)
+
+// ErrInvalidEvent is returned for events whose ID or signature do not match
+var ErrInvalidEvent = errors.New("invalid event ID or signature")
+
+// Event is a Nostr event as defined by NIP-01
+type Event struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// Tag returns the first value of the tag named name, or an empty string
+func (e *Event) Tag(name string) string {
+	for _, tag := range e.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// hash returns the SHA-256 of the event serialized as NIP-01 specifies
+func (e *Event) hash() ([32]byte, error) {
+	tags := e.Tags
+	if tags == nil {
+		tags = [][]string{}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode([]interface{}{0, e.PubKey, e.CreatedAt, e.Kind, tags, e.Content}); err != nil {
+		return [32]byte{}, fmt.Errorf("failed to serialize event: %v", err)
+	}
+	return sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// Verify checks the ID and the Schnorr signature of the event
+func (e *Event) Verify() error {
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	if e.ID != hex.EncodeToString(hash[:]) {
+		return ErrInvalidEvent
+	}
+	pub, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return ErrInvalidEvent
+	}
+	key, err := schnorr.ParsePubKey(pub)
+	if err != nil {
+		return ErrInvalidEvent
+	}
+	raw, err := hex.DecodeString(e.Sig)
+	if err != nil {
+		return ErrInvalidEvent
+	}
+	sig, err := schnorr.ParseSignature(raw)
+	if err != nil || !sig.Verify(hash[:], key) {
+		return ErrInvalidEvent
+	}
+	return nil
+}
+
+// Keys is a key pair events are signed with
+type Keys struct {
+	private *btcec.PrivateKey
+	public  string
+}
+
+// ParseKeys loads a key pair from a hex-encoded secret key
+func ParseKeys(secret string) (*Keys, error) {
+	raw, err := hex.DecodeString(secret)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("secret key must be 32 bytes in hex")
+	}
+	private, public := btcec.PrivKeyFromBytes(raw)
+	return &Keys{private: private, public: hex.EncodeToString(schnorr.SerializePubKey(public))}, nil
+}
+
+// PublicKey returns the hex-encoded x-only public key
+func (k *Keys) PublicKey() string {
+	return k.public
+}
+
+// Sign sets the public key, ID and signature of an event
+func (k *Keys) Sign(e *Event) error {
+	e.PubKey = k.public
+	if e.Tags == nil {
+		e.Tags = [][]string{}
+	}
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(k.private, hash[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign event: %v", err)
+	}
+	e.ID = hex.EncodeToString(hash[:])
+	e.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
+
+// Filter selects events in a subscription request
+type Filter struct {
+	Kinds   []int    `json:"kinds,omitempty"`
+	Authors []string `json:"authors,omitempty"`
+	Since   int64    `json:"since,omitempty"`
+	Limit   int      `json:"limit,omitempty"`
+}
+
+// Matches reports whether an event passes the filter
+func (f Filter) Matches(e *Event) bool {
+	if len(f.Kinds) > 0 && !slices.Contains(f.Kinds, e.Kind) {
+		return false
+	}
+	if len(f.Authors) > 0 && !slices.Contains(f.Authors, e.PubKey) {
+		return false
+	}
+	return e.CreatedAt >= f.Since
+}
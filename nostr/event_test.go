@@ -0,0 +1,73 @@
+package nostr_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/nostr"
+)
+
+func TestParseKeys(t *testing.T) {
+	// BIP-340 test vector 0
+	keys, err := nostr.ParseKeys(strings.Repeat("0", 63) + "3")
+	if err != nil {
+		t.Fatalf("ParseKeys: %v", err)
+	}
+	if want := "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"; keys.PublicKey() != want {
+		t.Errorf("PublicKey() = %s, want %s", keys.PublicKey(), want)
+	}
+
+	for _, secret := range []string{"", "abc", strings.Repeat("zz", 32), strings.Repeat("01", 33)} {
+		if _, err := nostr.ParseKeys(secret); err == nil {
+			t.Errorf("ParseKeys(%q) succeeded", secret)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	keys, err := nostr.ParseKeys(strings.Repeat("01", 32))
+	if err != nil {
+		t.Fatalf("ParseKeys: %v", err)
+	}
+	e := &nostr.Event{
+		Kind:      nostr.KindOrder,
+		CreatedAt: 1700000000,
+		Tags:      [][]string{{"d", "1"}, {"name", "<alice & bob>"}},
+		Content:   "line\nbreak \"quoted\"",
+	}
+	if err := keys.Sign(e); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	// The ID hashes the NIP-01 serialization, which does not escape HTML
+	if want := "67cd50e38c674f5e5af59f253bd119b5ac642452ac2e3c977011adf93937bbf5"; e.ID != want {
+		t.Errorf("ID = %s, want %s", e.ID, want)
+	}
+	if e.PubKey != keys.PublicKey() || len(e.Sig) != 128 {
+		t.Fatalf("signed event = %+v", e)
+	}
+	if err := e.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got := e.Tag("name"); got != "<alice & bob>" {
+		t.Errorf(`Tag("name") = %q`, got)
+	}
+
+	tests := map[string]func(e *nostr.Event){
+		"content":   func(e *nostr.Event) { e.Content = "changed" },
+		"tags":      func(e *nostr.Event) { e.Tags[0][1] = "2" },
+		"signature": func(e *nostr.Event) { e.Sig = strings.Repeat("0", 128) },
+		"author": func(e *nostr.Event) {
+			other, _ := nostr.ParseKeys(strings.Repeat("02", 32))
+			e.PubKey = other.PublicKey()
+		},
+	}
+	for name, tamper := range tests {
+		forged := *e
+		forged.Tags = [][]string{{"d", "1"}, {"name", "<alice & bob>"}}
+		tamper(&forged)
+		if err := forged.Verify(); !errors.Is(err, nostr.ErrInvalidEvent) {
+			t.Errorf("tampered %s: Verify() = %v, want ErrInvalidEvent", name, err)
+		}
+	}
+}
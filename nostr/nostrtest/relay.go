@@ -0,0 +1,245 @@
+// Package nostrtest provides an in-process Nostr relay for tests. It stores
+// events, replaces addressable events, applies NIP-09 deletions and serves
+// subscriptions over WebSocket like a real relay.
+package nostrtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/nostr"
+)
+
+// writeTimeout bounds each message written to a client
+const writeTimeout = 5 * time.Second
+
+// Relay is a fake Nostr relay
+type Relay struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	events  []*nostr.Event
+	clients map[*client]bool
+}
+
+// client is a connection with its open subscriptions
+type client struct {
+	conn *websocket.Conn
+	subs map[string][]nostr.Filter
+}
+
+// NewRelay starts a fake relay
+func NewRelay() *Relay {
+	r := &Relay{clients: make(map[*client]bool)}
+	r.srv = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// URL returns the WebSocket URL of the relay
+func (r *Relay) URL() string {
+	return "ws" + strings.TrimPrefix(r.srv.URL, "http")
+}
+
+// Close shuts the relay down, closing client connections
+func (r *Relay) Close() {
+	r.mu.Lock()
+	for c := range r.clients {
+		c.conn.Close(websocket.StatusGoingAway, "")
+	}
+	r.mu.Unlock()
+	r.srv.Close()
+}
+
+// Events returns copies of the stored events matching filter
+func (r *Relay) Events(filter nostr.Filter) []nostr.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []nostr.Event
+	for _, e := range r.events {
+		if filter.Matches(e) {
+			events = append(events, *e)
+		}
+	}
+	return events
+}
+
+func (r *Relay) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, nil)
+	if err != nil {
+		return
+	}
+	c := &client{conn: conn, subs: make(map[string][]nostr.Filter)}
+	r.mu.Lock()
+	r.clients[c] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.clients, c)
+		r.mu.Unlock()
+		conn.CloseNow()
+	}()
+
+	for {
+		var msg []json.RawMessage
+		if err := wsjson.Read(context.Background(), conn, &msg); err != nil {
+			return
+		}
+		if len(msg) < 2 {
+			continue
+		}
+		var label string
+		json.Unmarshal(msg[0], &label)
+		switch label {
+		case "EVENT":
+			var e nostr.Event
+			if err := json.Unmarshal(msg[1], &e); err != nil {
+				continue
+			}
+			accepted, reason := r.add(&e)
+			r.write(c, []interface{}{"OK", e.ID, accepted, reason})
+		case "REQ":
+			r.subscribe(c, msg)
+		case "CLOSE":
+			var id string
+			json.Unmarshal(msg[1], &id)
+			r.mu.Lock()
+			delete(c.subs, id)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// subscribe answers ["REQ", <id>, <filter>...] with the stored events, then
+// keeps the subscription open for new ones
+func (r *Relay) subscribe(c *client, msg []json.RawMessage) {
+	var id string
+	json.Unmarshal(msg[1], &id)
+	var filters []nostr.Filter
+	for _, raw := range msg[2:] {
+		var f nostr.Filter
+		if err := json.Unmarshal(raw, &f); err == nil {
+			filters = append(filters, f)
+		}
+	}
+
+	r.mu.Lock()
+	var stored []*nostr.Event
+	for _, e := range r.events {
+		if matchesAny(filters, e) {
+			stored = append(stored, e)
+		}
+	}
+	c.subs[id] = filters
+	r.mu.Unlock()
+
+	for _, e := range stored {
+		r.write(c, []interface{}{"EVENT", id, e})
+	}
+	r.write(c, []interface{}{"EOSE", id})
+}
+
+// add stores an event and forwards it to matching subscriptions
+func (r *Relay) add(e *nostr.Event) (bool, string) {
+	if err := e.Verify(); err != nil {
+		return false, "invalid: " + err.Error()
+	}
+
+	r.mu.Lock()
+	if e.Kind == nostr.KindDeletion {
+		r.delete(e)
+	}
+	if addressable(e.Kind) {
+		for i, old := range r.events {
+			if old.Kind != e.Kind || old.PubKey != e.PubKey || old.Tag("d") != e.Tag("d") {
+				continue
+			}
+			if old.CreatedAt > e.CreatedAt || (old.CreatedAt == e.CreatedAt && old.ID < e.ID) {
+				r.mu.Unlock()
+				return true, "duplicate: have a newer version"
+			}
+			r.events = append(r.events[:i], r.events[i+1:]...)
+			break
+		}
+	}
+	r.events = append(r.events, e)
+
+	type delivery struct {
+		c  *client
+		id string
+	}
+	var deliveries []delivery
+	for c := range r.clients {
+		for id, filters := range c.subs {
+			if matchesAny(filters, e) {
+				deliveries = append(deliveries, delivery{c, id})
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, d := range deliveries {
+		r.write(d.c, []interface{}{"EVENT", d.id, e})
+	}
+	return true, ""
+}
+
+// delete removes the events a deletion request refers to by ID ("e" tags) or
+// address ("a" tags), if they belong to its author; the caller holds r.mu
+func (r *Relay) delete(deletion *nostr.Event) {
+	kept := r.events[:0]
+	for _, e := range r.events {
+		if e.PubKey != deletion.PubKey || !deletes(deletion, e) {
+			kept = append(kept, e)
+		}
+	}
+	r.events = kept
+}
+
+// deletes reports whether a deletion request refers to e
+func deletes(deletion, e *nostr.Event) bool {
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			if tag[1] == e.ID {
+				return true
+			}
+		case "a":
+			if addressable(e.Kind) && e.CreatedAt <= deletion.CreatedAt &&
+				tag[1] == fmt.Sprintf("%d:%s:%s", e.Kind, e.PubKey, e.Tag("d")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Relay) write(c *client, msg interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	wsjson.Write(ctx, c.conn, msg)
+}
+
+// addressable reports whether events of a kind replace each other per d tag
+func addressable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+func matchesAny(filters []nostr.Filter, e *nostr.Event) bool {
+	for _, f := range filters {
+		if f.Matches(e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package nostr
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// Platform is announced in the y tag of the orders the shop publishes
+const Platform = "p2p-telegram-bitcoin-shop"
+
+// orderLifetime is how long a published order stays valid unless updated,
+// announced with a NIP-40 expiration tag
+const orderLifetime = 24 * time.Hour
+
+// Order statuses defined by NIP-69
+const (
+	OrderPending    = "pending"
+	OrderCanceled   = "canceled"
+	OrderInProgress = "in-progress"
+	OrderSuccess    = "success"
+	OrderExpired    = "expired"
+)
+
+// OrderStatus returns the NIP-69 status of a listed offer. Taken offers are
+// in progress until the seller confirms payment.
+func OrderStatus(listing shop.Listing) string {
+	switch listing.Offer.Status {
+	case models.StatusCompleted:
+		return OrderSuccess
+	case models.StatusCancelled:
+		return OrderCanceled
+	case models.StatusExpired:
+		return OrderExpired
+	case models.StatusPending:
+		if listing.Available {
+			return OrderPending
+		}
+	}
+	return OrderInProgress
+}
+
+// OrderEvent builds the unsigned NIP-69 order event of a listed offer
+func OrderEvent(listing shop.Listing, network string, createdAt time.Time) *Event {
+	o := listing.Offer
+	return &Event{
+		Kind:      KindOrder,
+		CreatedAt: createdAt.Unix(),
+		Tags: [][]string{
+			{"d", strconv.Itoa(o.ID)},
+			{"k", "sell"},
+			{"f", "USD"},
+			{"s", OrderStatus(listing)},
+			{"amt", strconv.FormatInt(int64(o.AmountBTC*100_000_000), 10)},
+			{"fa", strconv.FormatFloat(o.PriceUSD, 'f', 2, 64)},
+			{"pm", "other"},
+			{"premium", "0"},
+			{"network", network},
+			orderLayers(o.PaymentMethod),
+			{"name", listing.Seller.Name},
+			{"expiration", strconv.FormatInt(createdAt.Add(orderLifetime).Unix(), 10)},
+			{"y", Platform},
+			{"z", "order"},
+		},
+	}
+}
+
+// orderLayers returns the NIP-69 layer tag listing how the invoice of an
+// offer can be paid
+func orderLayers(method models.PaymentMethod) []string {
+	tag := []string{"layer"}
+	if method.OnChain() {
+		tag = append(tag, "onchain")
+	}
+	if method.Lightning() || !method.OnChain() {
+		tag = append(tag, "lightning")
+	}
+	return tag
+}
+
+// orderAddress returns the NIP-01 address of an order, shared by all its
+// versions: "<kind>:<pubkey>:<d tag>"
+func orderAddress(e *Event) string {
+	return fmt.Sprintf("%d:%s:%s", e.Kind, e.PubKey, e.Tag("d"))
+}
+
+// ParseOrder reads a NIP-69 order event published by another marketplace
+// and returns it with its status and expiration, zero when it has none
+func ParseOrder(e *Event) (shop.ExternalOrder, string, time.Time, error) {
+	if e.Kind != KindOrder || e.Tag("d") == "" {
+		return shop.ExternalOrder{}, "", time.Time{}, fmt.Errorf("event %s is not an order", e.ID)
+	}
+	order := shop.ExternalOrder{
+		ID:        e.Tag("d"),
+		Type:      e.Tag("k"),
+		Currency:  e.Tag("f"),
+		Platform:  e.Tag("y"),
+		Author:    e.PubKey,
+		CreatedAt: time.Unix(e.CreatedAt, 0),
+	}
+	if order.Type != "sell" && order.Type != "buy" {
+		return shop.ExternalOrder{}, "", time.Time{}, fmt.Errorf("order %s has invalid type %q", order.ID, order.Type)
+	}
+	if order.Platform == "" {
+		order.Platform = "Nostr"
+	}
+	if sats, err := strconv.ParseInt(e.Tag("amt"), 10, 64); err == nil && sats > 0 {
+		order.AmountBTC = float64(sats) / 100_000_000
+	}
+	fiat, err := strconv.ParseFloat(e.Tag("fa"), 64)
+	if err != nil {
+		return shop.ExternalOrder{}, "", time.Time{}, fmt.Errorf("order %s has invalid fiat amount: %v", order.ID, err)
+	}
+	order.FiatAmount = fiat
+
+	var expires time.Time
+	if ts, err := strconv.ParseInt(e.Tag("expiration"), 10, 64); err == nil {
+		expires = time.Unix(ts, 0)
+	}
+	return order, e.Tag("s"), expires, nil
+}
@@ -0,0 +1,310 @@
+package nostr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// trackingName is the frontend name under which the latest event of each
+// published offer is tracked, with the publisher's public key as chat
+const trackingName = "nostr"
+
+// Timeouts and delays of relay connections
+var (
+	publishTimeout = 10 * time.Second
+	retryDelay     = 30 * time.Second
+)
+
+// maxExternalOrders caps the orders of other marketplaces kept in memory.
+// Beyond it, the oldest ones are forgotten.
+const maxExternalOrders = 1000
+
+// externalOrder is an order of another marketplace read from relays. Orders
+// that are no longer pending, or were deleted, are kept without their details
+// for the lifetime of an order, so that older versions still held by other
+// relays do not bring them back.
+type externalOrder struct {
+	order   shop.ExternalOrder
+	pending bool
+	created int64
+	expires time.Time
+}
+
+// stale reports whether an order can be forgotten: pending orders once they
+// expire, and the others, or orders without an expiration, once older than an
+// order lifetime
+func (o externalOrder) stale(now time.Time) bool {
+	if o.pending && !o.expires.IsZero() {
+		return !o.expires.After(now)
+	}
+	return !time.Unix(o.created, 0).Add(orderLifetime).After(now)
+}
+
+// Publisher publishes the shop's offers as NIP-69 orders to Nostr relays
+// and reads the orders other marketplaces publish there
+type Publisher struct {
+	shop    *shop.Service
+	keys    *Keys
+	relays  []string
+	network string
+
+	mu       sync.Mutex
+	lastSent map[int]int64            // created_at of the latest event of each offer
+	orders   map[string]externalOrder // by order address
+	stop     chan struct{}
+}
+
+// NewPublisher creates a publisher signing with keys. network is announced
+// in every order, e.g. "mainnet".
+func NewPublisher(svc *shop.Service, keys *Keys, relays []string, network string) *Publisher {
+	return &Publisher{
+		shop:     svc,
+		keys:     keys,
+		relays:   relays,
+		network:  network,
+		lastSent: make(map[int]int64),
+		orders:   make(map[string]externalOrder),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Publish implements shop.Publisher. Every change replaces the order event
+// of the offer; orders of cancelled or expired offers are then deleted.
+func (p *Publisher) Publish(listing shop.Listing) error {
+	o := listing.Offer
+	published, err := p.shop.ChannelPost(trackingName, p.keys.PublicKey(), o.ID)
+	if err != nil {
+		return err
+	}
+	if published == "" && !listing.Available {
+		return nil
+	}
+
+	order := OrderEvent(listing, p.network, p.timestamp(o.ID))
+	if err := p.keys.Sign(order); err != nil {
+		return err
+	}
+	events := []*Event{order}
+	if o.Status == models.StatusCancelled || o.Status == models.StatusExpired {
+		deletion := &Event{
+			Kind:      KindDeletion,
+			CreatedAt: order.CreatedAt,
+			Tags:      [][]string{{"a", orderAddress(order)}, {"k", strconv.Itoa(KindOrder)}},
+			Content:   "Offer " + string(o.Status),
+		}
+		if err := p.keys.Sign(deletion); err != nil {
+			return err
+		}
+		events = append(events, deletion)
+	}
+	if err := p.broadcast(events); err != nil {
+		return err
+	}
+
+	if published != "" {
+		if err := p.shop.ForgetChannelPost(trackingName, p.keys.PublicKey(), published); err != nil {
+			return err
+		}
+	}
+	if o.Status.Closed() {
+		return nil
+	}
+	return p.shop.TrackChannelPost(trackingName, p.keys.PublicKey(), order.ID, o.ID)
+}
+
+// timestamp returns the creation time of a new event of an offer. Each one is
+// later than the previous so that relays keep the latest version.
+func (p *Publisher) timestamp(offerID int) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ts := time.Now().Unix()
+	if last := p.lastSent[offerID]; ts <= last {
+		ts = last + 1
+	}
+	p.lastSent[offerID] = ts
+	return time.Unix(ts, 0)
+}
+
+// broadcast sends events to every relay. It fails only if no relay accepted
+// them.
+func (p *Publisher) broadcast(events []*Event) error {
+	var lastErr error
+	accepted := 0
+	for _, url := range p.relays {
+		if err := p.send(url, events); err != nil {
+			log.Printf("Failed to publish to relay %s: %v", url, err)
+			lastErr = err
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 && lastErr != nil {
+		return fmt.Errorf("no relay accepted the events: %v", lastErr)
+	}
+	return nil
+}
+
+// send publishes events to a single relay
+func (p *Publisher) send(url string, events []*Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	relay, err := Connect(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	for _, e := range events {
+		if err := relay.Publish(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExternalOrders implements shop.OrderSource with the pending orders read
+// from relays, newest first
+func (p *Publisher) ExternalOrders() []shop.ExternalOrder {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var orders []shop.ExternalOrder
+	for _, o := range p.orders {
+		if o.pending && !o.stale(now) {
+			orders = append(orders, o.order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreatedAt.After(orders[j].CreatedAt) })
+	return orders
+}
+
+// Ingest reads orders from every relay until Stop is called, reconnecting
+// after failures
+func (p *Publisher) Ingest() {
+	var wg sync.WaitGroup
+	for _, url := range p.relays {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			for {
+				if err := p.subscribe(url); err != nil {
+					log.Printf("Lost subscription to relay %s: %v", url, err)
+				}
+				select {
+				case <-p.stop:
+					return
+				case <-time.After(retryDelay):
+				}
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+// Stop stops ingesting orders
+func (p *Publisher) Stop() {
+	close(p.stop)
+}
+
+// subscribe reads the orders of a relay until the connection fails or the
+// publisher stops
+func (p *Publisher) subscribe(url string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay, err := Connect(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+
+	since := time.Now().Add(-orderLifetime).Unix()
+	events, err := relay.Subscribe(ctx, "orders", Filter{Kinds: []int{KindOrder, KindDeletion}, Since: since})
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return relay.Err()
+			}
+			p.addEvent(e)
+		}
+	}
+}
+
+// addEvent records an order of another marketplace, or its deletion
+func (p *Publisher) addEvent(e *Event) {
+	if e.PubKey == p.keys.PublicKey() || e.Verify() != nil {
+		return
+	}
+	switch e.Kind {
+	case KindOrder:
+		p.addOrder(e)
+	case KindDeletion:
+		p.deleteOrders(e)
+	}
+}
+
+// addOrder records the latest version of an order of another marketplace.
+// Orders no longer pending lose their details.
+func (p *Publisher) addOrder(e *Event) {
+	order, status, expires, err := ParseOrder(e)
+	if err != nil {
+		return
+	}
+	known := externalOrder{created: e.CreatedAt, expires: expires}
+	if status == OrderPending {
+		known.order = order
+		known.pending = true
+	}
+	p.setOrder(orderAddress(e), known)
+}
+
+// deleteOrders forgets the details of the orders a NIP-09 deletion request
+// refers to. Only the author of an order can delete it.
+func (p *Publisher) deleteOrders(e *Event) {
+	prefix := fmt.Sprintf("%d:%s:", KindOrder, e.PubKey)
+	for _, tag := range e.Tags {
+		if len(tag) >= 2 && tag[0] == "a" && strings.HasPrefix(tag[1], prefix) {
+			p.setOrder(tag[1], externalOrder{created: e.CreatedAt})
+		}
+	}
+}
+
+// setOrder records the state of the order at address unless a later one is
+// known, then forgets stale orders and the oldest beyond the cap
+func (p *Publisher) setOrder(address string, o externalOrder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if known, ok := p.orders[address]; ok && known.created > o.created {
+		return
+	}
+	p.orders[address] = o
+
+	now := time.Now()
+	for address, o := range p.orders {
+		if o.stale(now) {
+			delete(p.orders, address)
+		}
+	}
+	for len(p.orders) > maxExternalOrders {
+		oldest := ""
+		for address, o := range p.orders {
+			if oldest == "" || o.created < p.orders[oldest].created {
+				oldest = address
+			}
+		}
+		delete(p.orders, oldest)
+	}
+}
@@ -0,0 +1,249 @@
+package nostr_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay/btcpaytest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/nostr"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/nostr/nostrtest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+func newPublisher(t *testing.T) (*shop.Service, *nostr.Publisher, *nostr.Keys, *nostrtest.Relay) {
+	t.Helper()
+	pay := btcpaytest.NewServer("key", "store")
+	relay := nostrtest.NewRelay()
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() {
+		relay.Close()
+		database.Close()
+		pay.Close()
+	})
+
+	keys, err := nostr.ParseKeys(strings.Repeat("01", 32))
+	if err != nil {
+		t.Fatalf("ParseKeys: %v", err)
+	}
+	svc := shop.NewService(database, pay.Client())
+	publisher := nostr.NewPublisher(svc, keys, []string{relay.URL()}, "regtest")
+	svc.AddPublisher(publisher)
+
+	for _, id := range []string{"1001", "1002"} {
+		identity := models.Identity{Frontend: shop.FrontendTelegram, ExternalID: id, Username: "user" + id}
+		userID, err := svc.Register(identity)
+		if err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+		svc.SetNickname(userID, identity.Username)
+	}
+	return svc, publisher, keys, relay
+}
+
+// order returns the order event the relay stores for an offer, if any, once
+// the offer changes so far are published
+func order(svc *shop.Service, relay *nostrtest.Relay, keys *nostr.Keys, d string) *nostr.Event {
+	svc.WaitPublished()
+	for _, e := range relay.Events(nostr.Filter{Kinds: []int{nostr.KindOrder}, Authors: []string{keys.PublicKey()}}) {
+		if e.Tag("d") == d {
+			return &e
+		}
+	}
+	return nil
+}
+
+func TestPublishOrders(t *testing.T) {
+	svc, _, keys, relay := newPublisher(t)
+
+	if _, err := svc.CreateOffer(1001, 0.01, 500, models.PaymentLightning); err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	e := order(svc, relay, keys, "1")
+	if e == nil {
+		t.Fatal("offer 1 was not published")
+	}
+	if err := e.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	want := map[string]string{
+		"k": "sell", "f": "USD", "s": "pending", "amt": "1000000", "fa": "500.00",
+		"network": "regtest", "layer": "lightning", "name": "user1001", "y": nostr.Platform, "z": "order",
+	}
+	for tag, value := range want {
+		if got := e.Tag(tag); got != value {
+			t.Errorf("tag %s = %q, want %q", tag, got, value)
+		}
+	}
+	if e.Tag("expiration") == "" {
+		t.Error("order has no expiration")
+	}
+
+	// Taking the offer replaces the order, then completing it
+	if _, err := svc.TakeOffer(1002, 1); err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if e := order(svc, relay, keys, "1"); e == nil || e.Tag("s") != "in-progress" {
+		t.Errorf("order after take = %+v", e)
+	}
+	if err := svc.Database().UpdateOfferStatus(1, models.StatusPending, models.StatusPaid); err != nil {
+		t.Fatalf("UpdateOfferStatus: %v", err)
+	}
+	if _, err := svc.ConfirmPayment(1001, 1); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	if e := order(svc, relay, keys, "1"); e == nil || e.Tag("s") != "success" {
+		t.Errorf("order after completion = %+v", e)
+	}
+	if n := len(relay.Events(nostr.Filter{Kinds: []int{nostr.KindOrder}})); n != 1 {
+		t.Errorf("relay stores %d versions of the order, want 1", n)
+	}
+
+	// Cancelled offers are deleted
+	if _, err := svc.CreateOffer(1001, 0.02, 900, models.PaymentLightning); err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	if order(svc, relay, keys, "2") == nil {
+		t.Fatal("offer 2 was not published")
+	}
+	if _, err := svc.CancelOffer(1001, 2); err != nil {
+		t.Fatalf("CancelOffer: %v", err)
+	}
+	if e := order(svc, relay, keys, "2"); e != nil {
+		t.Errorf("cancelled order still stored: %+v", e)
+	}
+	if deletions := relay.Events(nostr.Filter{Kinds: []int{nostr.KindDeletion}}); len(deletions) != 1 ||
+		deletions[0].Tag("a") != "38383:"+keys.PublicKey()+":2" {
+		t.Errorf("deletions = %+v", deletions)
+	}
+
+	// The layer tag lists the ways the offer can be paid
+	tests := []struct {
+		method models.PaymentMethod
+		layers []string
+	}{
+		{models.PaymentOnChain, []string{"onchain"}},
+		{models.PaymentBoth, []string{"onchain", "lightning"}},
+	}
+	for _, tt := range tests {
+		offer, err := svc.CreateOffer(1001, 0.01, 500, tt.method)
+		if err != nil {
+			t.Fatalf("CreateOffer(%s): %v", tt.method, err)
+		}
+		e := order(svc, relay, keys, strconv.Itoa(offer.ID))
+		if e == nil {
+			t.Fatalf("%s offer was not published", tt.method)
+		}
+		var layers []string
+		for _, tag := range e.Tags {
+			if tag[0] == "layer" {
+				layers = tag[1:]
+			}
+		}
+		if strings.Join(layers, ",") != strings.Join(tt.layers, ",") {
+			t.Errorf("%s offer: layers = %q, want %q", tt.method, layers, tt.layers)
+		}
+	}
+}
+
+func TestIngestOrders(t *testing.T) {
+	svc, publisher, keys, relay := newPublisher(t)
+	svc.AddOrderSource(publisher)
+	go publisher.Ingest()
+	t.Cleanup(publisher.Stop)
+
+	// The shop's own orders are not ingested
+	if _, err := svc.CreateOffer(1001, 0.01, 500, models.PaymentLightning); err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+
+	other, _ := nostr.ParseKeys(strings.Repeat("02", 32))
+	send := func(e *nostr.Event) {
+		t.Helper()
+		if err := other.Sign(e); err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := nostr.Connect(ctx, relay.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.Publish(ctx, e); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	publish := func(d, status string, createdAt time.Time) {
+		t.Helper()
+		send(&nostr.Event{
+			Kind:      nostr.KindOrder,
+			CreatedAt: createdAt.Unix(),
+			Tags: [][]string{
+				{"d", d}, {"k", "buy"}, {"f", "EUR"}, {"s", status}, {"amt", "0"}, {"fa", "250"},
+				{"y", "otherplace"}, {"z", "order"},
+			},
+		})
+	}
+	waitOrders := func(n int) []shop.ExternalOrder {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			orders := svc.ExternalOrders(10)
+			if len(orders) == n {
+				return orders
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d external orders, want %d", len(orders), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	now := time.Now()
+	publish("a", "pending", now)
+	publish("b", "pending", now.Add(time.Second))
+	orders := waitOrders(2)
+	want := shop.ExternalOrder{
+		ID: "b", Type: "buy", FiatAmount: 250, Currency: "EUR", Platform: "otherplace",
+		Author: other.PublicKey(), CreatedAt: time.Unix(now.Add(time.Second).Unix(), 0),
+	}
+	if orders[0] != want {
+		t.Errorf("newest order = %+v, want %+v", orders[0], want)
+	}
+	for _, o := range orders {
+		if o.Author == keys.PublicKey() {
+			t.Errorf("own order ingested: %+v", o)
+		}
+	}
+
+	// Orders leave the list once taken elsewhere
+	publish("a", "in-progress", now.Add(2*time.Second))
+	if orders := waitOrders(1); orders[0].ID != "b" {
+		t.Errorf("remaining order = %+v", orders[0])
+	}
+
+	// Orders deleted by their author leave it too, even if an older version
+	// arrives later
+	send(&nostr.Event{
+		Kind:      nostr.KindDeletion,
+		CreatedAt: now.Add(3 * time.Second).Unix(),
+		Tags:      [][]string{{"a", fmt.Sprintf("%d:%s:b", nostr.KindOrder, other.PublicKey())}},
+	})
+	waitOrders(0)
+	publish("b", "pending", now.Add(time.Second))
+	publish("c", "pending", now.Add(4*time.Second))
+	if orders := waitOrders(1); orders[0].ID != "c" {
+		t.Errorf("remaining order = %+v", orders[0])
+	}
+}
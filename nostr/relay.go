@@ -0,0 +1,203 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// maxMessageSize caps the relay messages read, which carry a single event
+const maxMessageSize = 1 << 20
+
+// ErrClosed is returned when the relay connection closed before an answer
+var ErrClosed = errors.New("relay connection closed")
+
+// Relay is a WebSocket connection to a Nostr relay
+type Relay struct {
+	URL  string
+	conn *websocket.Conn
+
+	mu   sync.Mutex
+	oks  map[string]chan error
+	subs map[string]chan *Event
+	done chan struct{}
+	err  error
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// Connect opens a connection to the relay at url, e.g. "wss://relay.example.com"
+func Connect(ctx context.Context, url string) (*Relay, error) {
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to relay %s: %v", url, err)
+	}
+	conn.SetReadLimit(maxMessageSize)
+
+	r := &Relay{
+		URL:     url,
+		conn:    conn,
+		oks:     make(map[string]chan error),
+		subs:    make(map[string]chan *Event),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go r.read()
+	return r, nil
+}
+
+// Publish sends an event and waits for the relay to accept it
+func (r *Relay) Publish(ctx context.Context, e *Event) error {
+	ok := make(chan error, 1)
+	r.mu.Lock()
+	r.oks[e.ID] = ok
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.oks, e.ID)
+		r.mu.Unlock()
+	}()
+
+	if err := wsjson.Write(ctx, r.conn, []interface{}{"EVENT", e}); err != nil {
+		return fmt.Errorf("failed to send event: %v", err)
+	}
+	select {
+	case err := <-ok:
+		return err
+	case <-r.done:
+		return r.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe requests the events matching filter, stored ones first and then
+// new ones as they arrive. The channel is closed with the connection.
+func (r *Relay) Subscribe(ctx context.Context, id string, filter Filter) (<-chan *Event, error) {
+	events := make(chan *Event, 64)
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return nil, r.err
+	}
+	r.subs[id] = events
+	r.mu.Unlock()
+
+	if err := wsjson.Write(ctx, r.conn, []interface{}{"REQ", id, filter}); err != nil {
+		return nil, fmt.Errorf("failed to send subscription: %v", err)
+	}
+	return events, nil
+}
+
+// Done is closed when the connection closes
+func (r *Relay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns why the connection closed
+func (r *Relay) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close closes the connection
+func (r *Relay) Close() error {
+	r.closeOnce.Do(func() { close(r.closing) })
+	return r.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// read dispatches relay messages until the connection closes
+func (r *Relay) read() {
+	var err error
+	for {
+		var msg []json.RawMessage
+		if err = wsjson.Read(context.Background(), r.conn, &msg); err != nil {
+			break
+		}
+		if len(msg) < 2 {
+			continue
+		}
+		var label string
+		json.Unmarshal(msg[0], &label)
+		switch label {
+		case "OK":
+			r.handleOK(msg)
+		case "EVENT":
+			r.handleEvent(msg)
+		case "NOTICE":
+			var notice string
+			json.Unmarshal(msg[1], &notice)
+			log.Printf("Notice from relay %s: %s", r.URL, notice)
+		}
+	}
+
+	r.mu.Lock()
+	r.err = fmt.Errorf("%w: %v", ErrClosed, err)
+	for id, events := range r.subs {
+		close(events)
+		delete(r.subs, id)
+	}
+	r.mu.Unlock()
+	close(r.done)
+}
+
+// handleOK answers a pending Publish: ["OK", <id>, <accepted>, <message>]
+func (r *Relay) handleOK(msg []json.RawMessage) {
+	if len(msg) < 3 {
+		return
+	}
+	var id, reason string
+	var accepted bool
+	json.Unmarshal(msg[1], &id)
+	json.Unmarshal(msg[2], &accepted)
+	if len(msg) > 3 {
+		json.Unmarshal(msg[3], &reason)
+	}
+
+	r.mu.Lock()
+	ok, found := r.oks[id]
+	r.mu.Unlock()
+	if !found {
+		return
+	}
+	var err error
+	if !accepted {
+		err = fmt.Errorf("relay %s rejected event: %s", r.URL, reason)
+	}
+	select {
+	case ok <- err:
+	default: // Repeated answer
+	}
+}
+
+// handleEvent delivers a subscribed event: ["EVENT", <subscription>, <event>]
+func (r *Relay) handleEvent(msg []json.RawMessage) {
+	if len(msg) < 3 {
+		return
+	}
+	var id string
+	var e Event
+	json.Unmarshal(msg[1], &id)
+	if err := json.Unmarshal(msg[2], &e); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	events, found := r.subs[id]
+	r.mu.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case events <- &e:
+	case <-r.closing:
+	}
+}
@@ -0,0 +1,81 @@
+// Package ratelimit implements token bucket rate limiters keyed by user.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// pruneThreshold is the number of buckets above which idle buckets are dropped
+const pruneThreshold = 10000
+
+// Limiter keeps one token bucket per key. Each bucket holds up to burst
+// tokens and refills burst tokens every per, so a key may spend burst
+// events at once and then burst events per period.
+type Limiter struct {
+	mu      sync.Mutex
+	burst   float64
+	rate    float64 // tokens per second
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter allowing burst events per period. A limiter with a
+// non-positive burst or period allows everything.
+func New(burst int, per time.Duration) *Limiter {
+	l := &Limiter{
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+	if burst > 0 && per > 0 {
+		l.rate = float64(burst) / per.Seconds()
+	}
+	return l
+}
+
+// Allow spends a token of key. If the bucket is empty it returns false and
+// how long until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= pruneThreshold {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have refilled completely, since they behave
+// like new ones
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
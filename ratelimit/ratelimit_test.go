@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a manually advanced time source
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(burst int, per time.Duration) (*Limiter, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l := New(burst, per)
+	l.now = c.now
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	l, c := newTestLimiter(3, time.Minute)
+
+	tests := []struct {
+		advance time.Duration
+		key     string
+		allowed bool
+		wait    time.Duration
+	}{
+		{0, "alice", true, 0},
+		{0, "alice", true, 0},
+		{0, "alice", true, 0},
+		{0, "alice", false, 20 * time.Second}, // one token every 20s
+		{0, "bob", true, 0},                   // buckets are per key
+		{15 * time.Second, "alice", false, 5 * time.Second},
+		{5 * time.Second, "alice", true, 0},
+		{0, "alice", false, 20 * time.Second},
+		{time.Hour, "alice", true, 0}, // refills up to burst only
+		{0, "alice", true, 0},
+		{0, "alice", true, 0},
+		{0, "alice", false, 20 * time.Second},
+	}
+	for i, tt := range tests {
+		c.advance(tt.advance)
+		allowed, wait := l.Allow(tt.key)
+		if allowed != tt.allowed || wait.Round(time.Millisecond) != tt.wait {
+			t.Errorf("%d: Allow(%s) = %v, %v, want %v, %v", i, tt.key, allowed, wait, tt.allowed, tt.wait)
+		}
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	for _, l := range []*Limiter{New(0, time.Minute), New(5, 0)} {
+		for i := 0; i < 100; i++ {
+			if ok, _ := l.Allow("alice"); !ok {
+				t.Fatalf("disabled limiter throttled after %d events", i)
+			}
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	l, c := newTestLimiter(1, time.Second)
+	l.Allow("idle")
+	c.advance(time.Second)
+	l.prune(c.now())
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket not pruned")
+	}
+
+	l.Allow("busy")
+	l.prune(c.now())
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("empty bucket pruned")
+	}
+}
@@ -0,0 +1,224 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by admin operations
+var (
+	ErrNotAdmin     = errors.New("user is not an admin")
+	ErrBanAdmin     = errors.New("admins cannot be banned")
+	ErrNotBanned    = errors.New("user is not banned")
+	ErrOfferClosed  = errors.New("offer is already completed or cancelled")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// Audit log actions
+const (
+	AuditStats       = "stats"
+	AuditBan         = "ban"
+	AuditUnban       = "unban"
+	AuditForceCancel = "force_cancel"
+	AuditBroadcast   = "broadcast"
+	AuditLookup      = "lookup"
+)
+
+// SetAdmins sets the users allowed to run admin operations
+func (s *Service) SetAdmins(userIDs []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.admins = make(map[int64]bool, len(userIDs))
+	for _, id := range userIDs {
+		s.admins[id] = true
+	}
+}
+
+// IsAdmin reports whether a user is an admin
+func (s *Service) IsAdmin(userID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.admins[userID]
+}
+
+// adminIDs returns the users allowed to run admin operations
+func (s *Service) adminIDs() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]int64, 0, len(s.admins))
+	for id := range s.admins {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// IsBanned reports whether a user is banned
+func (s *Service) IsBanned(userID int64) (bool, error) {
+	return s.database.IsBanned(userID)
+}
+
+// FindUser resolves a user from a numeric ID or a username, with or without @
+func (s *Service) FindUser(ref string) (int64, error) {
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		if exists, err := s.database.UserExists(id); err != nil || !exists {
+			return 0, ErrUserNotFound
+		}
+		return id, nil
+	}
+	if len(ref) > 1 && ref[0] == '@' {
+		ref = ref[1:]
+	}
+	userID, err := s.database.FindUserByUsername(ref)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, ErrUserNotFound
+	}
+	return userID, err
+}
+
+// audit records an admin action, logging failures
+func (s *Service) audit(adminID int64, action, target, details string) {
+	if err := s.database.AddAuditEntry(adminID, action, target, details); err != nil {
+		log.Printf("Failed to audit %s by %d: %v", action, adminID, err)
+	}
+}
+
+// Stats returns the shop statistics
+func (s *Service) Stats(adminID int64) (*db.Stats, error) {
+	if !s.IsAdmin(adminID) {
+		return nil, ErrNotAdmin
+	}
+	stats, err := s.database.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	s.audit(adminID, AuditStats, "", "")
+	return stats, nil
+}
+
+// Ban bans a user from every frontend
+func (s *Service) Ban(adminID, userID int64, reason string) error {
+	if !s.IsAdmin(adminID) {
+		return ErrNotAdmin
+	}
+	if s.IsAdmin(userID) {
+		return ErrBanAdmin
+	}
+	if err := s.database.BanUser(userID, adminID, reason); err != nil {
+		return err
+	}
+	s.audit(adminID, AuditBan, strconv.FormatInt(userID, 10), reason)
+	s.Notify(userID, func(l *i18n.Locale) Message { return BannedMessage(l, reason) })
+	return nil
+}
+
+// Unban lifts the ban of a user
+func (s *Service) Unban(adminID, userID int64) error {
+	if !s.IsAdmin(adminID) {
+		return ErrNotAdmin
+	}
+	banned, err := s.database.UnbanUser(userID)
+	if err != nil {
+		return err
+	}
+	if !banned {
+		return ErrNotBanned
+	}
+	s.audit(adminID, AuditUnban, strconv.FormatInt(userID, 10), "")
+	s.Notify(userID, UnbannedMessage)
+	return nil
+}
+
+// ForceCancel cancels any open offer and notifies its owner. Paid offers are
+// refunded to the owner, who paid their invoice.
+func (s *Service) ForceCancel(adminID int64, offerID int) (*models.Offer, error) {
+	if !s.IsAdmin(adminID) {
+		return nil, ErrNotAdmin
+	}
+	offer, err := s.Offer(offerID)
+	if err != nil {
+		return nil, err
+	}
+	if offer.Status.Closed() {
+		return offer, ErrOfferClosed
+	}
+
+	if err := s.database.UpdateOfferStatus(offerID, offer.Status, models.StatusCancelled); err != nil {
+		return offer, err
+	}
+	s.audit(adminID, AuditForceCancel, strconv.Itoa(offerID), fmt.Sprintf("status was %s", offer.Status))
+	paid := offer.Status == models.StatusPaid
+	offer.Status = models.StatusCancelled
+	tradeStatus := models.TradeCancelled
+	if paid {
+		tradeStatus = models.TradeRefunded
+	}
+	trade := s.closeOpenTrade(offer, tradeStatus)
+	s.offerChanged(offer)
+	s.Notify(offer.UserID, func(l *i18n.Locale) Message { return OfferForceCancelledMessage(l, offerID) })
+	if paid {
+		s.refundPaidOffer(offer, trade, "")
+	}
+	return offer, nil
+}
+
+// Broadcast sends an announcement to every user who is not banned and
+// returns the number of users notified
+func (s *Service) Broadcast(adminID int64, text string) (int, error) {
+	if !s.IsAdmin(adminID) {
+		return 0, ErrNotAdmin
+	}
+	userIDs, err := s.database.GetUserIDs()
+	if err != nil {
+		return 0, err
+	}
+	s.audit(adminID, AuditBroadcast, "", text)
+
+	msg := func(l *i18n.Locale) Message { return BroadcastMessage(l, text) }
+	sent := 0
+	for _, id := range userIDs {
+		if banned, err := s.database.IsBanned(id); err != nil || banned {
+			continue
+		}
+		s.Notify(id, msg)
+		sent++
+	}
+	return sent, nil
+}
+
+// Lookup finds the offer backed by a BTCPay invoice together with the
+// invoice. The invoice is nil if BTCPay cannot be reached.
+func (s *Service) Lookup(adminID int64, invoiceID string) (*models.Offer, *btcpay.Invoice, error) {
+	if !s.IsAdmin(adminID) {
+		return nil, nil, ErrNotAdmin
+	}
+	s.audit(adminID, AuditLookup, invoiceID, "")
+
+	offer, err := s.database.GetOfferByInvoiceID(invoiceID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil, ErrOfferNotFound
+		}
+		return nil, nil, err
+	}
+	invoice, err := s.btcpay.GetInvoice(invoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch invoice %s: %v", invoiceID, err)
+		return offer, nil, nil
+	}
+	return offer, invoice, nil
+}
+
+// AuditLog returns the latest admin actions
+func (s *Service) AuditLog(adminID int64, limit int) ([]models.AuditEntry, error) {
+	if !s.IsAdmin(adminID) {
+		return nil, ErrNotAdmin
+	}
+	return s.database.GetAuditLog(limit)
+}
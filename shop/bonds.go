@@ -0,0 +1,444 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by bond operations
+var (
+	ErrBondsDisabled   = errors.New("bonds are not enabled")
+	ErrBondExists      = errors.New("seller already has an active bond")
+	ErrNoBond          = errors.New("seller has no active bond")
+	ErrBondNotFound    = errors.New("bond not found")
+	ErrOpenTrades      = errors.New("seller has open trades")
+	ErrBondPayoutExist = errors.New("bond is already being sent")
+)
+
+// Bonds is the bond sellers post to deter scam offers. A zero AmountSats
+// disables bonds. When Required, only the offers of sellers with an active
+// bond are listed in the marketplace.
+type Bonds struct {
+	AmountSats int64
+	Required   bool
+}
+
+// SetBonds sets the bond sellers post
+func (s *Service) SetBonds(b Bonds) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bonds = b
+}
+
+// Bonds returns the bond sellers post
+func (s *Service) Bonds() Bonds {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bonds
+}
+
+// bonded reports whether a seller has an active bond
+func (s *Service) bonded(userID int64) bool {
+	b, err := s.database.GetUserBond(userID)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Printf("Failed to fetch bond of user %d: %v", userID, err)
+		}
+		return false
+	}
+	return b.Status == models.BondActive
+}
+
+// listed reports whether the offers of a seller may be listed in the
+// marketplace and taken
+func (s *Service) listed(userID int64) bool {
+	return !s.Bonds().Required || s.Bonds().AmountSats <= 0 || s.bonded(userID)
+}
+
+// PostBond creates the invoice of a new bond of a seller. A bond still
+// waiting for payment is returned instead.
+func (s *Service) PostBond(userID int64) (*models.Bond, error) {
+	amountSats := s.Bonds().AmountSats
+	if amountSats <= 0 {
+		return nil, ErrBondsDisabled
+	}
+	if exists, err := s.database.UserExists(userID); err != nil || !exists {
+		return nil, ErrNotRegistered
+	}
+	if b, err := s.Bond(userID); err == nil && b.Open() {
+		if b.Status == models.BondActive {
+			return b, ErrBondExists
+		}
+		return b, nil
+	} else if err != nil && !errors.Is(err, ErrNoBond) {
+		return nil, err
+	}
+
+	invoiceID, invoiceLink, err := s.btcpay.CreateInvoice(amountSats, fmt.Sprintf("Seller bond of %d", userID), paymentMethods(models.PaymentLightning)...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvoice, err)
+	}
+	paymentRequest, err := s.btcpay.LightningPaymentRequest(invoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch payment request of bond invoice %s: %v", invoiceID, err)
+	}
+	id, err := s.database.CreateBond(models.Bond{
+		UserID:         userID,
+		AmountSats:     amountSats,
+		InvoiceID:      invoiceID,
+		InvoiceLink:    invoiceLink,
+		PaymentRequest: paymentRequest,
+	})
+	if err != nil {
+		if err := s.btcpay.InvalidateInvoice(invoiceID); err != nil {
+			log.Printf("Failed to invalidate bond invoice %s: %v", invoiceID, err)
+		}
+		if errors.Is(err, db.ErrDuplicate) {
+			return nil, ErrBondExists
+		}
+		return nil, err
+	}
+	return s.database.GetBond(id)
+}
+
+// Bond returns the latest bond of a seller, checking whether a pending bond
+// was paid and how the payout of a released or slashed one is going
+func (s *Service) Bond(userID int64) (*models.Bond, error) {
+	b, err := s.database.GetUserBond(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrNoBond
+		}
+		return nil, err
+	}
+	s.refreshBond(b, false)
+	return b, nil
+}
+
+// refreshBond updates a pending bond to the state of its invoice and the
+// payout of a released or slashed bond to its state on BTCPay Server,
+// telling the users concerned about changes when notify is set
+func (s *Service) refreshBond(b *models.Bond, notify bool) {
+	switch {
+	case b.Status == models.BondPending:
+		invoice, err := s.btcpay.GetInvoice(b.InvoiceID)
+		if err != nil {
+			log.Printf("Failed to check invoice of bond %d: %v", b.ID, err)
+			return
+		}
+		if invoice.IsPaid() {
+			s.activateBond(b)
+		} else if invoice.IsPaidLate() {
+			s.lateBond(b)
+		} else if invoice.Status == "Expired" || invoice.Status == "Invalid" {
+			s.expireBond(b)
+		}
+	case b.BTCPayID != "" && !b.PayoutStatus.Closed():
+		if err := s.refreshBondPayout(b, notify); err != nil {
+			log.Printf("Failed to refresh payout of bond %d: %v", b.ID, err)
+		}
+	}
+}
+
+// activateBond marks a pending bond, or an expired one paid late, as paid,
+// which lists the offers of its seller
+func (s *Service) activateBond(b *models.Bond) {
+	if err := s.database.SetBondStatus(b.ID, b.Status, models.BondActive, 0, 0); err != nil {
+		if !errors.Is(err, db.ErrClaimed) {
+			log.Printf("Failed to activate bond %d: %v", b.ID, err)
+		}
+		return
+	}
+	b.Status = models.BondActive
+	s.holdBond(b)
+	bond, bonds := *b, s.Bonds()
+	s.Notify(b.UserID, func(l *i18n.Locale) Message { return BondMessage(l, &bond, bonds) })
+	s.sellerChanged(b.UserID)
+}
+
+// lateBond applies the payment of a bond invoice after it expired, which
+// BTCPay Server reports as PaidLate. The bond is activated, unless its seller
+// posted another bond in the meantime: it is then returned to them.
+func (s *Service) lateBond(b *models.Bond) {
+	log.Printf("Bond %d was paid late", b.ID)
+	if current, err := s.database.GetUserBond(b.UserID); err != nil {
+		log.Printf("Failed to fetch bond of user %d: %v", b.UserID, err)
+		return
+	} else if current.ID == b.ID || !current.Open() {
+		s.activateBond(b)
+		return
+	}
+
+	if err := s.database.SetBondStatus(b.ID, b.Status, models.BondReleased, 0, b.UserID); err != nil {
+		if !errors.Is(err, db.ErrClaimed) {
+			log.Printf("Failed to return bond %d: %v", b.ID, err)
+		}
+		return
+	}
+	b.Status, b.RecipientID = models.BondReleased, b.UserID
+	s.holdBond(b)
+	s.releaseBond(b)
+	s.sendBondToAddress(b)
+}
+
+// expireBond closes a pending bond whose invoice expired unpaid
+func (s *Service) expireBond(b *models.Bond) {
+	if err := s.database.SetBondStatus(b.ID, models.BondPending, models.BondExpired, 0, 0); err != nil {
+		if !errors.Is(err, db.ErrClaimed) {
+			log.Printf("Failed to expire bond %d: %v", b.ID, err)
+		}
+		return
+	}
+	b.Status = models.BondExpired
+}
+
+// handleBondInvoiceEvent applies a BTCPay invoice webhook event to the bond
+// the invoice pays. Invoices of pending or expired bonds paid late activate
+// or return them. Events for unknown invoices are ignored.
+func (s *Service) handleBondInvoiceEvent(event *btcpay.WebhookEvent) error {
+	b, err := s.database.GetBondByInvoiceID(event.InvoiceID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if b.Status != models.BondPending && b.Status != models.BondExpired {
+		return nil
+	}
+	switch {
+	case event.Type == btcpay.EventInvoiceSettled && b.Status == models.BondPending:
+		s.activateBond(b)
+	case s.paidLate(event.InvoiceID):
+		s.lateBond(b)
+	case event.Type == btcpay.EventInvoiceExpired || event.Type == btcpay.EventInvoiceInvalid:
+		if b.Status == models.BondPending {
+			s.expireBond(b)
+		}
+	}
+	return nil
+}
+
+// ReleaseBond returns the active bond of a seller who has no open trades.
+// It is sent to the seller's Lightning address if they registered one, and
+// waits for them to say where to send it otherwise.
+func (s *Service) ReleaseBond(userID int64) (*models.Bond, error) {
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	b, err := s.database.GetUserBond(userID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrNoBond
+	} else if err != nil {
+		return nil, err
+	}
+	if b.Status != models.BondActive {
+		return nil, ErrNoBond
+	}
+	trades, err := s.database.GetUserTrades(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trades {
+		if t.SellerID == userID && t.Status == models.TradeOpen {
+			return nil, ErrOpenTrades
+		}
+	}
+
+	if err := s.database.SetBondStatus(b.ID, models.BondActive, models.BondReleased, 0, userID); err != nil {
+		if errors.Is(err, db.ErrClaimed) {
+			return nil, ErrNoBond
+		}
+		return nil, err
+	}
+	b.Status, b.RecipientID = models.BondReleased, userID
+	s.releaseBond(b)
+	s.sellerChanged(userID)
+	s.sendBondToAddress(b)
+	return b, nil
+}
+
+// slashBond gives the active bond of the seller of a trade, if any, to its
+// buyer after the seller lost a dispute over it
+func (s *Service) slashBond(trade *models.Trade) {
+	b, err := s.database.GetUserBond(trade.SellerID)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Printf("Failed to fetch bond of user %d: %v", trade.SellerID, err)
+		}
+		return
+	}
+	if b.Status != models.BondActive {
+		return
+	}
+	if err := s.database.SetBondStatus(b.ID, models.BondActive, models.BondSlashed, trade.ID, trade.BuyerID); err != nil {
+		log.Printf("Failed to slash bond %d: %v", b.ID, err)
+		return
+	}
+	b.Status, b.TradeID, b.RecipientID = models.BondSlashed, trade.ID, trade.BuyerID
+	s.slashBondEntry(b)
+	bond := *b
+	s.Notify(b.UserID, func(l *i18n.Locale) Message { return BondSlashedMessage(l, &bond) })
+	s.sellerChanged(b.UserID)
+	s.sendBondToAddress(b)
+}
+
+// sendBondToAddress sends a released or slashed bond to the Lightning
+// address of its recipient, or asks them where to send it
+func (s *Service) sendBondToAddress(b *models.Bond) {
+	if address, err := s.LightningAddress(b.RecipientID); err == nil && address != "" {
+		err := s.sendBond(b, address)
+		if err == nil {
+			bond := *b
+			s.Notify(b.RecipientID, func(l *i18n.Locale) Message { return BondPayoutMessage(l, &bond) })
+			return
+		}
+		log.Printf("Failed to send bond %d to %s: %v", b.ID, address, err)
+	}
+	bond := *b
+	s.Notify(b.RecipientID, func(l *i18n.Locale) Message { return BondClaimMessage(l, &bond) })
+}
+
+// ClaimBond sends a released or slashed bond to the destination given by its
+// recipient. Lightning addresses and LNURLs must resolve to an LNURL-pay
+// service; invoices must be signed, unexpired and for exactly the bond
+// amount.
+func (s *Service) ClaimBond(userID int64, bondID int, destination string) (*models.Bond, error) {
+	destination, err := normalizeDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	b, err := s.database.GetBond(bondID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrBondNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if b.RecipientID != userID || (b.Status != models.BondReleased && b.Status != models.BondSlashed) {
+		return nil, ErrBondNotFound
+	}
+	if b.BTCPayID != "" && b.PayoutStatus != models.PayoutCancelled {
+		s.refreshBond(b, false)
+	}
+	if !b.Claimable() {
+		return nil, ErrBondPayoutExist
+	}
+	if !lnurl.IsDestination(destination) {
+		if err := s.checkInvoice(destination, b.AmountSats); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.sendBond(b, destination); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// sendBond claims the pull payment of a released or slashed bond, creating
+// it the first time, to destination
+func (s *Service) sendBond(b *models.Bond, destination string) error {
+	invoice, err := s.invoiceFor(destination, b.AmountSats)
+	if err != nil {
+		return err
+	}
+	if b.PullPaymentID == "" {
+		pullPaymentID, err := s.btcpay.CreatePullPayment(fmt.Sprintf("Bond #%d", b.ID), b.AmountSats, s.autoApprovePayouts)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPayout, err)
+		}
+		if err := s.database.SetBondPayout(b.ID, "", pullPaymentID, "", ""); err != nil {
+			return err
+		}
+		b.PullPaymentID = pullPaymentID
+	}
+
+	claim, err := s.btcpay.CreatePayout(b.PullPaymentID, invoice)
+	if err != nil {
+		var apiErr *btcpay.APIError
+		if errors.As(err, &apiErr) && apiErr.Rejected() {
+			return fmt.Errorf("%w: %v", ErrInvalidDestination, err)
+		}
+		return fmt.Errorf("%w: %v", ErrPayout, err)
+	}
+	status := payoutStatus(claim.State)
+	if err := s.database.SetBondPayout(b.ID, destination, b.PullPaymentID, claim.ID, status); err != nil {
+		return err
+	}
+	b.Destination, b.BTCPayID, b.PayoutStatus = destination, claim.ID, status
+	s.recordBondPayout(b)
+	return nil
+}
+
+// handleBondPayoutEvent applies a BTCPay payout webhook event to the bond it
+// sends. Events for unknown payouts are ignored.
+func (s *Service) handleBondPayoutEvent(event *btcpay.WebhookEvent) error {
+	b, err := s.database.GetBondByBTCPayID(event.PayoutID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if b.PayoutStatus.Closed() {
+		return nil
+	}
+	return s.refreshBondPayout(b, true)
+}
+
+// refreshBondPayout updates the payout of a bond to its state on BTCPay
+// Server, telling the recipient about changes when notify is set. Bonds
+// whose payout was cancelled wait for another destination.
+func (s *Service) refreshBondPayout(b *models.Bond, notify bool) error {
+	claim, err := s.btcpay.GetPayout(b.BTCPayID)
+	if err != nil {
+		return err
+	}
+	status := payoutStatus(claim.State)
+	if status == b.PayoutStatus {
+		return nil
+	}
+	destination, btcpayID := b.Destination, b.BTCPayID
+	if status == models.PayoutCancelled {
+		destination, btcpayID = "", ""
+	}
+	if err := s.database.SetBondPayout(b.ID, destination, b.PullPaymentID, btcpayID, status); err != nil {
+		return err
+	}
+	b.Destination, b.BTCPayID, b.PayoutStatus = destination, btcpayID, status
+	s.recordBondPayout(b)
+	if notify {
+		bond := *b
+		if status == models.PayoutCancelled {
+			s.Notify(b.RecipientID, func(l *i18n.Locale) Message { return BondClaimMessage(l, &bond) })
+		} else {
+			s.Notify(b.RecipientID, func(l *i18n.Locale) Message { return BondPayoutMessage(l, &bond) })
+		}
+	}
+	return nil
+}
+
+// sellerChanged refreshes the listings of the pending offers of a seller,
+// e.g. after their bond changed whether they are listed
+func (s *Service) sellerChanged(userID int64) {
+	offers, err := s.database.GetUserOffers(userID)
+	if err != nil {
+		log.Printf("Failed to fetch offers of user %d: %v", userID, err)
+		return
+	}
+	for i := range offers {
+		if !offers[i].Status.Closed() {
+			s.offerChanged(&offers[i])
+		}
+	}
+}
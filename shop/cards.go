@@ -0,0 +1,184 @@
+package shop
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// TrackOfferCard records a card showing an offer to its owner, so that it is
+// edited whenever the offer changes
+func (s *Service) TrackOfferCard(frontend, chatID, messageID string, userID int64, offerID int) error {
+	return s.database.TrackMessage(models.SentMessage{
+		Frontend:  frontend,
+		ChatID:    chatID,
+		MessageID: messageID,
+		Kind:      models.MessageOfferCard,
+		OfferID:   offerID,
+		UserID:    userID,
+	})
+}
+
+// TrackSellerCard records a marketplace card listing the offers of a seller,
+// so that offers lose their take action once they are no longer available
+func (s *Service) TrackSellerCard(frontend, chatID, messageID string, userID int64, seller SellerOffers) error {
+	for _, o := range seller.Offers {
+		err := s.database.TrackMessage(models.SentMessage{
+			Frontend:  frontend,
+			ChatID:    chatID,
+			MessageID: messageID,
+			Kind:      models.MessageSellerCard,
+			OfferID:   o.ID,
+			UserID:    userID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrackMenu records the main menu sent to a chat and returns the IDs of the
+// menus it replaces, which are no longer tracked
+func (s *Service) TrackMenu(frontend, chatID, messageID string, userID int64) ([]string, error) {
+	menus, err := s.database.GetChatMessages(frontend, chatID, models.MessageMenu)
+	if err != nil {
+		return nil, err
+	}
+	var replaced []string
+	for _, m := range menus {
+		if err := s.database.ForgetMessage(frontend, chatID, m.MessageID); err != nil {
+			return nil, err
+		}
+		replaced = append(replaced, m.MessageID)
+	}
+	err = s.database.TrackMessage(models.SentMessage{
+		Frontend:  frontend,
+		ChatID:    chatID,
+		MessageID: messageID,
+		Kind:      models.MessageMenu,
+		UserID:    userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// offerChanged edits the tracked messages showing an offer to match its
+// current state and republishes it. Cards of closed offers are final and no
+// longer tracked.
+func (s *Service) offerChanged(o *models.Offer) {
+	s.publish(o)
+
+	messages, err := s.database.GetOfferMessages(o.ID)
+	if err != nil {
+		log.Printf("Failed to fetch messages of offer %d: %v", o.ID, err)
+		return
+	}
+
+	for _, m := range messages {
+		l := s.frontendLocale(m.UserID, m.Frontend)
+		switch m.Kind {
+		case models.MessageOfferCard:
+			s.edit(m, OfferCardMessage(l, *o))
+		case models.MessageSellerCard:
+			s.refreshSellerCard(l, m)
+		}
+	}
+
+	if o.Status.Closed() {
+		if err := s.database.ForgetOfferCards(o.ID); err != nil {
+			log.Printf("Failed to forget cards of offer %d: %v", o.ID, err)
+		}
+	}
+}
+
+// refreshSellerCard rebuilds a marketplace card from the offers it lists,
+// keeping the take action of the offers still available. Cards without any
+// available offer are final and no longer tracked.
+func (s *Service) refreshSellerCard(l *i18n.Locale, m models.SentMessage) {
+	entries, err := s.database.GetMessageOffers(m.Frontend, m.ChatID, m.MessageID)
+	if err != nil {
+		log.Printf("Failed to fetch offers of message %s: %v", m.MessageID, err)
+		return
+	}
+
+	var seller SellerOffers
+	available := make(map[string]bool)
+	for _, e := range entries {
+		o, err := s.database.GetOffer(e.OfferID)
+		if err != nil {
+			log.Printf("Failed to fetch offer %d: %v", e.OfferID, err)
+			return
+		}
+		if len(seller.Offers) == 0 {
+			seller = s.Seller(*o)
+		}
+		seller.Offers = append(seller.Offers, *o)
+		if s.takeable(o) {
+			available[strconv.Itoa(o.ID)] = true
+		}
+	}
+
+	s.quoteBuyerFees(&seller)
+	msg := SellerOffersMessage(l, seller)
+	var actions [][]Action
+	for _, row := range msg.Actions {
+		if row[0].Command == ActionTakeOffer && !available[row[0].Data] {
+			continue
+		}
+		actions = append(actions, row)
+	}
+	msg.Actions = actions
+	s.edit(m, msg)
+
+	if len(available) == 0 {
+		if err := s.database.ForgetMessage(m.Frontend, m.ChatID, m.MessageID); err != nil {
+			log.Printf("Failed to forget message %s: %v", m.MessageID, err)
+		}
+	}
+}
+
+// takeable reports whether an offer can still be taken from the marketplace.
+// Offers of sellers without the bond the shop requires cannot.
+func (s *Service) takeable(o *models.Offer) bool {
+	if o.Status != models.StatusPending {
+		return false
+	}
+	if _, err := s.database.GetOpenTrade(o.ID); !errors.Is(err, db.ErrNotFound) {
+		return false
+	}
+	return s.listed(o.UserID)
+}
+
+// edit replaces a tracked message on frontends able to edit messages
+func (s *Service) edit(m models.SentMessage, msg Message) {
+	s.mu.RLock()
+	f, ok := s.frontends[m.Frontend].(Editor)
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err := f.Edit(m.ChatID, m.MessageID, msg); err != nil {
+		log.Printf("Failed to edit message %s on %s: %v", m.MessageID, m.Frontend, err)
+	}
+}
+
+// frontendLocale returns the locale a user is talked to in on a frontend
+func (s *Service) frontendLocale(userID int64, frontend string) *i18n.Locale {
+	identities, err := s.database.GetUserIdentities(userID)
+	if err != nil {
+		log.Printf("Failed to fetch identities of user %d: %v", userID, err)
+	}
+	for _, i := range identities {
+		if i.Frontend == frontend {
+			return s.Locale(userID, i.Language)
+		}
+	}
+	return s.Locale(userID, "")
+}
@@ -0,0 +1,187 @@
+package shop
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by chat operations
+var (
+	ErrNotInChat   = errors.New("user is not in a chat")
+	ErrTradeClosed = errors.New("trade is no longer open")
+	ErrOwnContact  = errors.New("users cannot message themselves")
+)
+
+// Chat is the conversation a user's messages are relayed to: the chat of a
+// trade, or a direct chat with another user, e.g. a seller asked about an
+// offer before taking it
+type Chat struct {
+	Trade *models.Trade // Trade being discussed, nil in direct chats
+	Peer  *models.User  // User receiving the messages
+}
+
+// OpenTradeChat puts a user in the chat of an open trade they take part in.
+// Until they leave it, what they send is relayed to the counterparty.
+func (s *Service) OpenTradeChat(userID int64, tradeID int) (*models.Trade, error) {
+	trade, err := s.Trade(userID, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if trade.Status != models.TradeOpen {
+		return nil, ErrTradeClosed
+	}
+	if err := s.database.SetChatTrade(userID, tradeID); err != nil {
+		return nil, err
+	}
+	return trade, nil
+}
+
+// OpenContact puts a user in a direct chat with the user known by nickname.
+// Neither learns anything about the other's accounts but their nickname.
+func (s *Service) OpenContact(userID int64, nickname string) (*models.User, error) {
+	peer, err := s.database.GetUserByNickname(strings.TrimPrefix(nickname, "@"))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if peer.ID == userID {
+		return nil, ErrOwnContact
+	}
+	if banned, err := s.database.IsBanned(peer.ID); err != nil {
+		return nil, err
+	} else if banned {
+		return nil, ErrUserNotFound
+	}
+	if err := s.database.SetChatPeer(userID, peer.ID); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+// CloseChat takes a user out of their chat and returns the chat they left
+func (s *Service) CloseChat(userID int64) (*Chat, error) {
+	chat, err := s.CurrentChat(userID)
+	if err != nil && !errors.Is(err, ErrTradeClosed) {
+		return nil, err
+	}
+	if err := s.database.SetChatTrade(userID, 0); err != nil {
+		return nil, err
+	}
+	if chat == nil {
+		return nil, ErrNotInChat
+	}
+	return chat, nil
+}
+
+// CurrentChat returns the chat a user is in. Users leave the chat of a trade
+// once it is closed.
+func (s *Service) CurrentChat(userID int64) (*Chat, error) {
+	tradeID, peerID, err := s.database.GetChat(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrNotRegistered
+		}
+		return nil, err
+	}
+
+	if tradeID != 0 {
+		trade, err := s.Trade(userID, tradeID)
+		if err != nil {
+			return nil, err
+		}
+		if trade.Status != models.TradeOpen {
+			if err := s.database.SetChatTrade(userID, 0); err != nil {
+				return nil, err
+			}
+			return nil, ErrTradeClosed
+		}
+		peerID = trade.SellerID
+		if userID == trade.SellerID {
+			peerID = trade.BuyerID
+		}
+		peer, err := s.database.GetUser(peerID)
+		if err != nil {
+			return nil, err
+		}
+		return &Chat{Trade: trade, Peer: peer}, nil
+	}
+
+	if peerID == 0 {
+		return nil, ErrNotInChat
+	}
+	peer, err := s.database.GetUser(peerID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			s.database.SetChatPeer(userID, 0)
+			return nil, ErrNotInChat
+		}
+		return nil, err
+	}
+	return &Chat{Peer: peer}, nil
+}
+
+// RelayMessage forwards a message sent in a user's chat to its other side.
+// In trade chats the sender is only named by their role and messages are
+// stored as evidence for disputes; in direct chats, by their nickname.
+// photoID is the file ID of an attached photo on frontend, which only that
+// frontend can show.
+func (s *Service) RelayMessage(userID int64, frontend, text, photoID string) (*Chat, error) {
+	chat, err := s.CurrentChat(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var build func(l *i18n.Locale, photoMissing bool) Message
+	if trade := chat.Trade; trade != nil {
+		_, err = s.database.AddTradeMessage(models.TradeMessage{
+			TradeID:  trade.ID,
+			SenderID: userID,
+			Text:     text,
+			PhotoID:  photoID,
+			Frontend: frontend,
+		})
+		if err != nil {
+			return nil, err
+		}
+		fromSeller := userID == trade.SellerID
+		build = func(l *i18n.Locale, photoMissing bool) Message {
+			return TradeChatMessage(l, trade, fromSeller, text, photoMissing)
+		}
+	} else {
+		sender, err := s.User(userID)
+		if err != nil {
+			return nil, err
+		}
+		name := s.nickname(sender)
+		build = func(l *i18n.Locale, photoMissing bool) Message {
+			return DirectMessage(l, name, text, photoMissing)
+		}
+	}
+
+	s.deliver(chat.Peer.ID, func(f Frontend, chatID string, l *i18n.Locale) error {
+		if photoID != "" && f.Name() == frontend {
+			if p, ok := f.(PhotoSender); ok {
+				return p.SendPhoto(chatID, photoID, build(l, false))
+			}
+		}
+		return f.Send(chatID, build(l, photoID != ""))
+	})
+	return chat, nil
+}
+
+// TradeMessages returns the chat of a trade, oldest first. Admins may read
+// the chat of any trade to settle disputes.
+func (s *Service) TradeMessages(userID int64, tradeID int) ([]models.TradeMessage, error) {
+	if !s.IsAdmin(userID) {
+		if _, err := s.Trade(userID, tradeID); err != nil {
+			return nil, err
+		}
+	}
+	return s.database.GetTradeMessages(tradeID)
+}
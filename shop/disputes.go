@@ -0,0 +1,137 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// DisputeWinner is the party of a trade an admin settles a dispute for
+type DisputeWinner string
+
+// Dispute winners
+const (
+	DisputeBuyer  DisputeWinner = "buyer"
+	DisputeSeller DisputeWinner = "seller"
+)
+
+// AuditResolve is the audit log action of a settled dispute
+const AuditResolve = "resolve"
+
+// ErrDisputed is returned when a trade is disputed twice, or when its seller
+// confirms or cancels its offer while the dispute is open
+var ErrDisputed = errors.New("trade is disputed")
+
+// OpenDispute has a participant of an open trade dispute it. Until an admin
+// resolves the dispute, the seller can neither confirm nor cancel the offer.
+// The counterparty and the admins are notified.
+func (s *Service) OpenDispute(userID int64, tradeID int) (*models.Trade, error) {
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	trade, err := s.Trade(userID, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if trade.Status != models.TradeOpen {
+		return trade, ErrTradeClosed
+	}
+	if trade.DisputedBy != 0 {
+		return trade, ErrDisputed
+	}
+	if err := s.database.SetTradeDispute(tradeID, userID); errors.Is(err, db.ErrStale) {
+		return trade, ErrDisputed
+	} else if err != nil {
+		return trade, err
+	}
+	trade.DisputedBy = userID
+
+	disputed := *trade
+	counterparty := trade.BuyerID
+	if userID == trade.BuyerID {
+		counterparty = trade.SellerID
+	}
+	s.Notify(counterparty, func(l *i18n.Locale) Message { return DisputeOpenedMessage(l, &disputed, counterparty) })
+	for _, adminID := range s.adminIDs() {
+		s.Notify(adminID, func(l *i18n.Locale) Message { return DisputeAdminMessage(l, &disputed) })
+	}
+	return trade, nil
+}
+
+// checkDispute returns ErrDisputed if the open trade of an offer is disputed
+func (s *Service) checkDispute(offerID int) error {
+	trade, err := s.database.GetOpenTrade(offerID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if trade.DisputedBy != 0 {
+		return ErrDisputed
+	}
+	return nil
+}
+
+// ResolveDispute settles a dispute over an open trade. When the buyer wins,
+// a paid offer is completed and paid out to them, an unpaid one is
+// cancelled, and the seller's bond is slashed to the buyer. When the seller
+// wins, a paid offer is cancelled and refunded to them, and an unpaid one is
+// listed again.
+func (s *Service) ResolveDispute(adminID int64, tradeID int, winner DisputeWinner) (*models.Trade, error) {
+	if !s.IsAdmin(adminID) {
+		return nil, ErrNotAdmin
+	}
+	if winner != DisputeBuyer && winner != DisputeSeller {
+		return nil, fmt.Errorf("unknown dispute winner %q", winner)
+	}
+	trade, err := s.database.GetTrade(tradeID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrTradeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if trade.Status != models.TradeOpen {
+		return trade, ErrTradeClosed
+	}
+	offer, err := s.Offer(trade.OfferID)
+	if err != nil {
+		return trade, err
+	}
+
+	paid := offer.Status == models.StatusPaid
+	offerStatus, tradeStatus := offer.Status, models.TradeCancelled
+	switch {
+	case winner == DisputeBuyer && paid:
+		offerStatus, tradeStatus = models.StatusCompleted, models.TradeCompleted
+	case winner == DisputeBuyer:
+		offerStatus = models.StatusCancelled
+	case paid:
+		offerStatus, tradeStatus = models.StatusCancelled, models.TradeRefunded
+	}
+	if offerStatus != offer.Status {
+		if err := s.database.UpdateOfferStatus(offer.ID, offer.Status, offerStatus); err != nil {
+			return trade, err
+		}
+		offer.Status = offerStatus
+	}
+	s.audit(adminID, AuditResolve, strconv.Itoa(tradeID), string(winner))
+	if closed := s.closeOpenTrade(offer, tradeStatus); closed != nil {
+		trade = closed
+	}
+	s.offerChanged(offer)
+
+	resolved := *trade
+	for _, userID := range []int64{trade.SellerID, trade.BuyerID} {
+		s.Notify(userID, func(l *i18n.Locale) Message { return DisputeResolvedMessage(l, &resolved, winner) })
+	}
+	if winner == DisputeBuyer {
+		s.slashBond(trade)
+	} else if paid {
+		s.refundPaidOffer(offer, trade, "")
+	}
+	return trade, nil
+}
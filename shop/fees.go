@@ -0,0 +1,65 @@
+package shop
+
+import (
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/fees"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// feeCurrency is the currency offers are priced in, which selects the fee
+// rule applied to their trades
+const feeCurrency = "USD"
+
+// SetFees sets the platform fee charged on trades
+func (s *Service) SetFees(schedule fees.Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fees = schedule
+}
+
+// Fees returns the platform fee charged on trades
+func (s *Service) Fees() fees.Schedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fees
+}
+
+// QuoteFee returns the platform fee of a trade of amountBTC opened now
+func (s *Service) QuoteFee(amountBTC float64) fees.Fee {
+	return s.Fees().Compute(btcToSats(amountBTC), feeCurrency, time.Now())
+}
+
+// tradeFee computes the platform fee of a trade taking an offer. The seller
+// pays the share quoted when the offer was created, which its invoice
+// includes; the buyer pays the share computed when the trade opens.
+func (s *Service) tradeFee(offer *models.Offer) fees.Fee {
+	fee := s.QuoteFee(offer.AmountBTC)
+	fee.MakerSats = offer.MakerFeeSats
+	return fee
+}
+
+// quoteBuyerFees fills the fee buyers would pay taking each offer of a
+// seller
+func (s *Service) quoteBuyerFees(seller *SellerOffers) {
+	seller.BuyerFees = make(map[int]int64, len(seller.Offers))
+	for _, o := range seller.Offers {
+		seller.BuyerFees[o.ID] = s.QuoteFee(o.AmountBTC).TakerSats
+	}
+}
+
+// invoiceAmountBTC returns the amount of the invoice funding an offer,
+// including the fee paid by the seller
+func invoiceAmountBTC(o models.Offer) float64 {
+	return satsToBTC(btcToSats(o.AmountBTC) + o.MakerFeeSats)
+}
+
+// btcToSats converts an amount of bitcoin to satoshis
+func btcToSats(amountBTC float64) int64 {
+	return int64(amountBTC * 100_000_000)
+}
+
+// satsToBTC converts an amount of satoshis to bitcoin
+func satsToBTC(sats int64) float64 {
+	return float64(sats) / 100_000_000
+}
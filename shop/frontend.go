@@ -0,0 +1,64 @@
+package shop
+
+// Frontend names
+const (
+	FrontendTelegram = "telegram"
+	FrontendMatrix   = "matrix"
+)
+
+// Action identifiers carried by command actions
+const (
+	ActionConfirmPayment = "confirm_payment"
+	ActionCancelOffer    = "cancel_offer"
+	ActionRefreshInvoice = "refresh_invoice"
+	ActionTakeOffer      = "take_offer"
+	ActionTradeChat      = "trade_chat"
+	ActionContact        = "contact"
+	ActionPayout         = "payout"
+	ActionRefund         = "refund"
+	ActionReferralPayout = "referral_payout"
+	ActionPostBond       = "bond_post"
+	ActionReleaseBond    = "bond_release"
+	ActionClaimBond      = "bond_claim"
+)
+
+// Frontend is a messaging transport through which users reach the shop
+type Frontend interface {
+	// Name returns the frontend name stored with user identities
+	Name() string
+	// Send delivers a message to a chat on the frontend
+	Send(chatID string, msg Message) error
+}
+
+// Editor is implemented by frontends that can edit messages they sent
+type Editor interface {
+	// Edit replaces the text and actions of a message in a chat
+	Edit(chatID, messageID string, msg Message) error
+}
+
+// PhotoSender is implemented by frontends that can send photos uploaded by
+// their users
+type PhotoSender interface {
+	// SendPhoto sends a photo by its file ID on the frontend, captioned with msg
+	SendPhoto(chatID, photoID string, msg Message) error
+}
+
+// Message is a transport-agnostic message with optional action buttons.
+// Text uses the markup of the markup package understood by all frontends.
+// Frontends able to send images show PaymentURI, a lightning: or bitcoin:
+// URI whose invoice or address is already included in Text, as a QR code
+// along the message.
+type Message struct {
+	Text       string
+	Actions    [][]Action
+	PaymentURI string
+}
+
+// Action is a button attached to a message. It either opens URL or triggers
+// Command with Data, e.g. confirming payment for an offer.
+type Action struct {
+	Label   string
+	URL     string
+	Command string
+	Data    string
+}
@@ -0,0 +1,164 @@
+package shop
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// LinkCodeTTL is how long a link code stays valid
+const LinkCodeTTL = 10 * time.Minute
+
+// Errors returned by identity operations
+var (
+	ErrInvalidLinkCode = errors.New("invalid or expired link code")
+	ErrAlreadyLinked   = errors.New("identity is already linked to this account")
+	ErrFrontendLinked  = errors.New("account already has an identity on this frontend")
+)
+
+// AddFrontend registers a frontend used to notify users
+func (s *Service) AddFrontend(f Frontend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frontends[f.Name()] = f
+}
+
+// Register registers a frontend identity, creating its user on first contact,
+// and returns the user ID. Telegram users keep their Telegram ID as user ID.
+// New users get a generated nickname.
+func (s *Service) Register(identity models.Identity) (int64, error) {
+	return s.register(identity, 0)
+}
+
+// register registers a frontend identity, recording referrerID as the user
+// who invited it if it creates a new user
+func (s *Service) register(identity models.Identity, referrerID int64) (int64, error) {
+	var userID int64
+	if identity.Frontend == FrontendTelegram {
+		id, err := strconv.ParseInt(identity.ExternalID, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Telegram user ID %q: %v", identity.ExternalID, err)
+		}
+		userID = id
+	}
+	userID, err := s.database.RegisterIdentity(identity, userID, referrerID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Nickname(userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// UserID resolves the user behind a frontend identity
+func (s *Service) UserID(frontend, externalID string) (int64, error) {
+	identity, err := s.database.GetIdentity(frontend, externalID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return 0, ErrNotRegistered
+		}
+		return 0, err
+	}
+	return identity.UserID, nil
+}
+
+// CreateLinkCode returns a one-time code that links another frontend identity
+// to the user's account
+func (s *Service) CreateLinkCode(userID int64) (string, error) {
+	code, err := randomCode(8)
+	if err != nil {
+		return "", err
+	}
+	if err := s.database.CreateLinkCode(code, userID, time.Now().Add(LinkCodeTTL)); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Link attaches identity to the account that issued code. Offers created by
+// the identity's previous account are merged into the linked account.
+func (s *Service) Link(identity models.Identity, code string) (int64, error) {
+	userID, err := s.database.ConsumeLinkCode(code)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return 0, ErrInvalidLinkCode
+		}
+		return 0, err
+	}
+
+	identities, err := s.database.GetUserIdentities(userID)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range identities {
+		if i.Frontend == identity.Frontend && i.ExternalID == identity.ExternalID {
+			return 0, ErrAlreadyLinked
+		}
+		if i.Frontend == identity.Frontend {
+			return 0, ErrFrontendLinked
+		}
+	}
+
+	if err := s.database.LinkIdentity(identity, userID); err != nil {
+		return 0, err
+	}
+
+	s.Notify(userID, func(l *i18n.Locale) Message { return AccountLinkedMessage(l, identity) })
+	return userID, nil
+}
+
+// Notify sends a message to a user on every frontend they are reachable on.
+// The message is built in the language of each identity.
+func (s *Service) Notify(userID int64, build func(l *i18n.Locale) Message) {
+	s.deliver(userID, func(f Frontend, chatID string, l *i18n.Locale) error {
+		return f.Send(chatID, build(l))
+	})
+}
+
+// deliver calls send for every identity of a user on a registered frontend,
+// with the chat and locale of the identity
+func (s *Service) deliver(userID int64, send func(f Frontend, chatID string, l *i18n.Locale) error) {
+	identities, err := s.database.GetUserIdentities(userID)
+	if err != nil {
+		log.Printf("Failed to fetch identities of user %d: %v", userID, err)
+		return
+	}
+	user, err := s.database.GetUser(userID)
+	if err != nil {
+		log.Printf("Failed to fetch user %d: %v", userID, err)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, i := range identities {
+		f, ok := s.frontends[i.Frontend]
+		if !ok || i.ChatID == "" {
+			continue
+		}
+		if err := send(f, i.ChatID, locale(user, i.Language)); err != nil {
+			log.Printf("Failed to notify user %d on %s: %v", userID, i.Frontend, err)
+		}
+	}
+}
+
+// randomCode returns n random characters that are easy to type
+func randomCode(n int) (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate code: %v", err)
+	}
+	for i := range buf {
+		buf[i] = alphabet[int(buf[i])%len(alphabet)]
+	}
+	return string(buf), nil
+}
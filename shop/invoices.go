@@ -0,0 +1,141 @@
+package shop
+
+import (
+	"errors"
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// ErrTooManyInvoices is returned when an offer already had as many invoices
+// as the limits allow
+var ErrTooManyInvoices = errors.New("offer has too many invoices")
+
+// ErrNotRefreshable is returned when the invoice of an offer cannot be
+// replaced, because the offer is closed or its invoice is being paid
+var ErrNotRefreshable = errors.New("only unpaid pending or expired offers can get a new invoice")
+
+// RefreshInvoice replaces the invoice of a pending or expired offer with a
+// new one for the same amount, fee and payment method, on behalf of its owner.
+// Expired offers are pending again, within the limits of the owner's tier.
+// Refreshes share the invoice rate limit of offer creation, and an offer gets
+// at most MaxOfferInvoices invoices.
+// The replaced invoice is invalidated so that a single invoice of the offer
+// can be paid at a time.
+func (s *Service) RefreshInvoice(userID int64, offerID int) (*models.Offer, error) {
+	offer, err := s.ownedOffer(userID, offerID)
+	if err != nil {
+		return nil, err
+	}
+	// Never replace an invoice that has just been paid
+	if offer.Status == models.StatusPending {
+		s.refreshOfferStatus(offer)
+	}
+	if offer.Status != models.StatusPending && offer.Status != models.StatusExpired {
+		return offer, ErrNotRefreshable
+	}
+	previous, err := s.btcpay.GetInvoice(offer.InvoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch invoice of offer %d: %v", offer.ID, err)
+	} else if previous.IsPaid() || previous.IsProcessing() {
+		return offer, ErrNotRefreshable
+	}
+	if offer.Status == models.StatusExpired {
+		if err := s.checkOpenOffers(userID); err != nil {
+			return offer, err
+		}
+		if err := s.checkTradeLimits(userID, btcToSats(offer.AmountBTC)); err != nil {
+			return offer, err
+		}
+	}
+	if max := s.Limits().MaxOfferInvoices; max > 0 {
+		invoices, err := s.database.GetOfferInvoices(offer.ID)
+		if err != nil {
+			return offer, err
+		}
+		if len(invoices) >= max {
+			return offer, ErrTooManyInvoices
+		}
+	}
+	if err := s.throttle(s.RateLimits().Invoice, userID); err != nil {
+		return offer, err
+	}
+
+	invoiceID, invoiceLink, err := s.createInvoice(userID, btcToSats(offer.AmountBTC)+offer.MakerFeeSats, offer.PaymentMethod)
+	if err != nil {
+		return offer, err
+	}
+	// The new invoice is recorded first, so that events of the replaced
+	// invoice no longer apply to the offer
+	if err := s.database.ReplaceOfferInvoice(offer.ID, offer.Status, invoiceID, invoiceLink); err != nil {
+		if invalidateErr := s.btcpay.InvalidateInvoice(invoiceID); invalidateErr != nil {
+			log.Printf("Failed to invalidate unused invoice %s of offer %d: %v", invoiceID, offer.ID, invalidateErr)
+		}
+		if errors.Is(err, db.ErrStale) {
+			return offer, ErrNotRefreshable
+		}
+		return offer, err
+	}
+	if previous != nil && previous.IsNew() {
+		if err := s.btcpay.InvalidateInvoice(previous.ID); err != nil {
+			log.Printf("Failed to invalidate replaced invoice %s of offer %d: %v", previous.ID, offer.ID, err)
+		}
+	}
+
+	offer, err = s.database.GetOffer(offer.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.fetchPaymentDetails(offer)
+	s.offerChanged(offer)
+	return offer, nil
+}
+
+// OfferInvoices returns the invoices created for an offer, oldest first, on
+// behalf of its owner
+func (s *Service) OfferInvoices(userID int64, offerID int) ([]models.OfferInvoice, error) {
+	if _, err := s.ownedOffer(userID, offerID); err != nil {
+		return nil, err
+	}
+	return s.database.GetOfferInvoices(offerID)
+}
+
+// paidLate reports whether an invoice was paid after it expired
+func (s *Service) paidLate(invoiceID string) bool {
+	invoice, err := s.btcpay.GetInvoice(invoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch invoice %s: %v", invoiceID, err)
+		return false
+	}
+	return invoice.IsPaidLate()
+}
+
+// latePayment marks an offer paid once an invoice it replaced, or the expired
+// invoice of an expired offer, is paid, and invalidates its active invoice so
+// that it is not paid twice. BTCPay Server reports invoices paid after
+// expiring as PaidLate rather than settled.
+func (s *Service) latePayment(o *models.Offer, invoiceID string) error {
+	invoice, err := s.btcpay.GetInvoice(invoiceID)
+	if err != nil {
+		return err
+	}
+	if !invoice.IsPaid() && !invoice.IsPaidLate() {
+		return nil
+	}
+	log.Printf("Offer %d was paid late through invoice %s", o.ID, invoiceID)
+	if err := s.markPaid(o, invoiceID); err != nil {
+		return err
+	}
+	active, err := s.btcpay.GetInvoice(o.InvoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch invoice of offer %d: %v", o.ID, err)
+		return nil
+	}
+	if active.IsNew() {
+		if err := s.btcpay.InvalidateInvoice(active.ID); err != nil {
+			log.Printf("Failed to invalidate invoice %s of offer %d: %v", active.ID, o.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package shop
+
+import (
+	"errors"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// ErrUnsupportedLanguage is returned when a user picks a language without a catalogue
+var ErrUnsupportedLanguage = errors.New("unsupported language")
+
+// Locale returns the locale to talk to a user in: the language they chose,
+// or else the language reported by their frontend
+func (s *Service) Locale(userID int64, detected string) *i18n.Locale {
+	user, err := s.database.GetUser(userID)
+	if err != nil {
+		return i18n.Get(detected)
+	}
+	return locale(user, detected)
+}
+
+// SetLanguage stores the language chosen by a user. An empty language
+// follows the frontend again.
+func (s *Service) SetLanguage(userID int64, lang string) error {
+	if lang != "" && !i18n.Supported(lang) {
+		return ErrUnsupportedLanguage
+	}
+	return s.database.SetUserLanguage(userID, lang)
+}
+
+func locale(user *models.User, detected string) *i18n.Locale {
+	if user.Language != "" {
+		return i18n.Get(user.Language)
+	}
+	return i18n.Get(detected)
+}
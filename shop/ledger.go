@@ -0,0 +1,176 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// statementLength is the number of ledger entries shown with a balance
+const statementLength = 10
+
+// Balance is what the ledger holds for a user: funds the shop owes them,
+// funds of their offers in escrow, their bond and their latest entries
+type Balance struct {
+	UserID        int64
+	AvailableSats int64
+	EscrowSats    int64
+	BondSats      int64
+	Entries       []models.LedgerEntry
+}
+
+// Balance returns the ledger balance of a user
+func (s *Service) Balance(userID int64) (*Balance, error) {
+	if _, err := s.User(userID); err != nil {
+		return nil, err
+	}
+	b := &Balance{UserID: userID}
+	var err error
+	if b.AvailableSats, err = s.database.GetLedgerBalance(models.UserAccount(userID, models.AccountAvailable)); err != nil {
+		return nil, err
+	}
+	if b.EscrowSats, err = s.database.GetLedgerBalance(models.UserAccount(userID, models.AccountEscrow)); err != nil {
+		return nil, err
+	}
+	if b.BondSats, err = s.database.GetLedgerBalance(models.UserAccount(userID, models.AccountBond)); err != nil {
+		return nil, err
+	}
+	if b.Entries, err = s.database.GetUserLedgerEntries(userID, statementLength); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// post records a money movement in the ledger, moving amountSats from one
+// account to another. The movement already happened, so failures cannot
+// undo it: they are reported to the admins, who reconcile the ledger.
+func (s *Service) post(reference string, kind models.LedgerKind, from, to models.LedgerAccount, amountSats int64) {
+	if amountSats <= 0 {
+		return
+	}
+	_, err := s.database.PostLedgerEntry(models.LedgerEntry{
+		Reference: reference,
+		Kind:      kind,
+		Postings: []models.LedgerPosting{
+			{Account: from, AmountSats: -amountSats},
+			{Account: to, AmountSats: amountSats},
+		},
+	})
+	if err == nil {
+		return
+	}
+	if errors.Is(err, db.ErrInsufficientBalance) {
+		log.Printf("Ledger entry %s exceeds the balance it debits: %v", reference, err)
+	} else {
+		log.Printf("Failed to record ledger entry %s: %v", reference, err)
+	}
+	for _, adminID := range s.adminIDs() {
+		s.Notify(adminID, func(l *i18n.Locale) Message { return LedgerAlertMessage(l, reference, amountSats, err) })
+	}
+}
+
+// holdPayment records the payment of an invoice of an offer, credited to the
+// seller and held in their escrow until the offer closes
+func (s *Service) holdPayment(offer *models.Offer, invoiceID string) {
+	amountSats := btcToSats(offer.AmountBTC) + offer.MakerFeeSats
+	available := models.UserAccount(offer.UserID, models.AccountAvailable)
+	s.post("invoice:"+invoiceID, models.LedgerInvoiceReceipt,
+		models.PlatformAccount(models.AccountBTCPay), available, amountSats)
+	s.post("escrow:"+invoiceID, models.LedgerEscrowHold,
+		available, models.UserAccount(offer.UserID, models.AccountEscrow), amountSats)
+}
+
+// settleTrade releases the escrow of a completed trade: the platform keeps
+// the fee and the buyer is owed the rest until it is paid out
+func (s *Service) settleTrade(trade *models.Trade, offer *models.Offer) {
+	escrow := models.UserAccount(trade.SellerID, models.AccountEscrow)
+	s.post(fmt.Sprintf("trade:%d:fee", trade.ID), models.LedgerFee,
+		escrow, models.PlatformAccount(models.AccountFees), trade.FeeSats())
+	s.post(fmt.Sprintf("trade:%d:settlement", trade.ID), models.LedgerTradeSettlement,
+		escrow, models.UserAccount(trade.BuyerID, models.AccountAvailable), btcToSats(offer.AmountBTC)-trade.TakerFeeSats)
+}
+
+// releaseEscrow returns the escrowed payment of a cancelled paid offer to the
+// payer being refunded. Payments that arrived after the offer was cancelled
+// are recorded first.
+func (s *Service) releaseEscrow(offer *models.Offer, r *models.Refund) {
+	s.holdPayment(offer, r.InvoiceID)
+	s.post(fmt.Sprintf("refund:%d:release", r.ID), models.LedgerEscrowRelease,
+		models.UserAccount(r.UserID, models.AccountEscrow), models.UserAccount(r.UserID, models.AccountAvailable), r.AmountSats)
+}
+
+// recordDuplicatePayment records the payment of an invoice of an offer
+// already paid through another one. It is owed back to the payer and never
+// held in escrow.
+func (s *Service) recordDuplicatePayment(r *models.Refund) {
+	s.post("duplicate:"+r.InvoiceID, models.LedgerInvoiceReceipt,
+		models.PlatformAccount(models.AccountBTCPay), models.UserAccount(r.UserID, models.AccountAvailable), r.AmountSats)
+}
+
+// recordPayout records the bitcoin of a trade sent to its buyer
+func (s *Service) recordPayout(p *models.Payout) {
+	if p.Status != models.PayoutCompleted {
+		return
+	}
+	s.post(fmt.Sprintf("payout:%d", p.ID), models.LedgerPayout,
+		models.UserAccount(p.UserID, models.AccountAvailable), models.PlatformAccount(models.AccountBTCPay), p.AmountSats)
+}
+
+// recordRefund records a refund sent to the payer of an offer
+func (s *Service) recordRefund(r *models.Refund) {
+	if r.Status != models.RefundCompleted {
+		return
+	}
+	s.post(fmt.Sprintf("refund:%d", r.ID), models.LedgerRefund,
+		models.UserAccount(r.UserID, models.AccountAvailable), models.PlatformAccount(models.AccountBTCPay), r.AmountSats)
+}
+
+// recordReferralCredit records the share of a fee credited to a referrer
+func (s *Service) recordReferralCredit(c *models.ReferralCredit) {
+	s.post(fmt.Sprintf("referral:%d:%d", c.TradeID, c.ReferredID), models.LedgerReferralCredit,
+		models.PlatformAccount(models.AccountFees), models.UserAccount(c.ReferrerID, models.AccountAvailable), c.AmountSats)
+}
+
+// recordReferralPayout records referral earnings sent to a referrer
+func (s *Service) recordReferralPayout(p *models.ReferralPayout) {
+	if p.Status != models.PayoutCompleted {
+		return
+	}
+	s.post(fmt.Sprintf("referral_payout:%d", p.ID), models.LedgerReferralPayout,
+		models.UserAccount(p.UserID, models.AccountAvailable), models.PlatformAccount(models.AccountBTCPay), p.AmountSats)
+}
+
+// holdBond records the payment of a bond, held in its seller's bond account
+// until it is released or slashed
+func (s *Service) holdBond(b *models.Bond) {
+	available := models.UserAccount(b.UserID, models.AccountAvailable)
+	s.post("invoice:"+b.InvoiceID, models.LedgerBondReceipt,
+		models.PlatformAccount(models.AccountBTCPay), available, b.AmountSats)
+	s.post(fmt.Sprintf("bond:%d:hold", b.ID), models.LedgerBondHold,
+		available, models.UserAccount(b.UserID, models.AccountBond), b.AmountSats)
+}
+
+// releaseBond records a bond returned to its seller
+func (s *Service) releaseBond(b *models.Bond) {
+	s.post(fmt.Sprintf("bond:%d:release", b.ID), models.LedgerBondRelease,
+		models.UserAccount(b.UserID, models.AccountBond), models.UserAccount(b.UserID, models.AccountAvailable), b.AmountSats)
+}
+
+// slashBondEntry records a bond given to the buyer of a disputed trade
+func (s *Service) slashBondEntry(b *models.Bond) {
+	s.post(fmt.Sprintf("bond:%d:slash", b.ID), models.LedgerBondSlash,
+		models.UserAccount(b.UserID, models.AccountBond), models.UserAccount(b.RecipientID, models.AccountAvailable), b.AmountSats)
+}
+
+// recordBondPayout records a released or slashed bond sent to its recipient
+func (s *Service) recordBondPayout(b *models.Bond) {
+	if b.PayoutStatus != models.PayoutCompleted {
+		return
+	}
+	s.post(fmt.Sprintf("bond:%d:payout", b.ID), models.LedgerBondPayout,
+		models.UserAccount(b.RecipientID, models.AccountAvailable), models.PlatformAccount(models.AccountBTCPay), b.AmountSats)
+}
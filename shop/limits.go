@@ -0,0 +1,247 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/ratelimit"
+)
+
+// Errors returned when a user hits a limit
+var (
+	ErrTooManyOffers = errors.New("too many open offers")
+	ErrCooldown      = errors.New("offer creation is cooling down after a cancellation")
+	ErrTradeLimit    = errors.New("amount exceeds the trade limit of the account tier")
+	ErrDailyLimit    = errors.New("amount exceeds the 24-hour volume limit of the account tier")
+	ErrThrottled     = errors.New("too many requests")
+)
+
+// ThrottledError is returned when a user exceeds a rate limit, with how long
+// until they may try again. It wraps ErrThrottled.
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v, retry in %v", ErrThrottled, e.Wait)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrThrottled
+}
+
+// RateLimits throttle how often each user calls the shop, whatever the
+// frontend. Nil limiters allow everything, and admins are never throttled.
+type RateLimits struct {
+	User    *ratelimit.Limiter // Any command or request
+	Invoice *ratelimit.Limiter // Offer creation and invoice refreshes, which create a BTCPay invoice
+	List    *ratelimit.Limiter // Offer listing, which queries BTCPay
+}
+
+// volumeWindow is the rolling period daily volume limits apply to
+const volumeWindow = 24 * time.Hour
+
+// Limits restrict how many offers users keep open, how soon they can create
+// an offer after cancelling one and, through their tier, how much they
+// trade. Zero values disable a limit.
+type Limits struct {
+	MaxOpenOffers    int
+	MaxOfferInvoices int // Invoices created for a single offer, refreshes included
+	CancelCooldown   time.Duration
+	// Tiers from the lowest to the highest. Users are in the highest tier
+	// whose requirements they meet, or in the first one.
+	Tiers []models.Tier
+}
+
+// TradeLimits is the tier a user is in, what got them there and what they
+// traded over the last 24 hours
+type TradeLimits struct {
+	Tier            models.Tier
+	Next            *models.Tier // Tier above the user's, nil at the top
+	AccountAge      time.Duration
+	CompletedTrades int
+	Rating          float64 // Average rating received, 0 without ratings
+	Ratings         int
+	Bonded          bool
+	VolumeSats      int64
+}
+
+// RemainingSats returns how much the user can still trade over the next 24
+// hours, or -1 if their tier has no daily cap
+func (t *TradeLimits) RemainingSats() int64 {
+	if t.Tier.MaxDailySats <= 0 {
+		return -1
+	}
+	return max(t.Tier.MaxDailySats-t.VolumeSats, 0)
+}
+
+// qualifies reports whether the user meets the requirements of a tier
+func (t *TradeLimits) qualifies(tier models.Tier) bool {
+	return t.AccountAge >= tier.MinAccountAge && t.CompletedTrades >= tier.MinTrades &&
+		t.Rating >= tier.MinRating && (!tier.Bonded || t.Bonded)
+}
+
+// SetRateLimits sets the rate limits applied to users
+func (s *Service) SetRateLimits(r RateLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimits = r
+}
+
+// RateLimits returns the rate limits applied to users
+func (s *Service) RateLimits() RateLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rateLimits
+}
+
+// Throttle spends a request of userID from their rate limit. Frontends call
+// it for every command or request before handling it, and reject the request
+// if it returns a ThrottledError.
+func (s *Service) Throttle(userID int64) error {
+	return s.throttle(s.RateLimits().User, userID)
+}
+
+// throttle spends a token of userID from limiter
+func (s *Service) throttle(limiter *ratelimit.Limiter, userID int64) error {
+	if limiter == nil || s.IsAdmin(userID) {
+		return nil
+	}
+	if allowed, wait := limiter.Allow(fmt.Sprint(userID)); !allowed {
+		return &ThrottledError{Wait: wait}
+	}
+	return nil
+}
+
+// SetLimits sets the limits applied to offer creation
+func (s *Service) SetLimits(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+}
+
+// Limits returns the limits applied to offer creation
+func (s *Service) Limits() Limits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limits
+}
+
+// CooldownRemaining returns how long the user must wait before creating an
+// offer after their last cancellation
+func (s *Service) CooldownRemaining(userID int64) time.Duration {
+	cooldown := s.Limits().CancelCooldown
+	if cooldown <= 0 {
+		return 0
+	}
+	last, err := s.database.GetLastCancel(userID)
+	if err != nil {
+		log.Printf("Failed to fetch last cancellation of user %d: %v", userID, err)
+		return 0
+	}
+	remaining := time.Until(last.Add(cooldown))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// checkLimits verifies that userID may create another offer
+func (s *Service) checkLimits(userID int64) error {
+	if err := s.checkOpenOffers(userID); err != nil {
+		return err
+	}
+	if s.CooldownRemaining(userID) > 0 {
+		return ErrCooldown
+	}
+	return nil
+}
+
+// TradeLimits returns the tier of a user and their volume over the last 24
+// hours. Without tiers, users have no trade limits.
+func (s *Service) TradeLimits(userID int64) (*TradeLimits, error) {
+	user, err := s.User(userID)
+	if err != nil {
+		return nil, err
+	}
+	t := &TradeLimits{AccountAge: time.Since(user.CreatedAt)}
+	tiers := s.Limits().Tiers
+	if len(tiers) == 0 {
+		return t, nil
+	}
+	if t.CompletedTrades, err = s.database.CountCompletedTrades(userID); err != nil {
+		return nil, err
+	}
+	if t.Rating, t.Ratings, err = s.database.GetUserRating(userID); err != nil {
+		return nil, err
+	}
+	for _, tier := range tiers {
+		if tier.Bonded {
+			t.Bonded = s.bonded(userID)
+			break
+		}
+	}
+	volume, err := s.database.GetTradedVolume(userID, time.Now().Add(-volumeWindow))
+	if err != nil {
+		return nil, err
+	}
+	t.VolumeSats = btcToSats(volume)
+
+	level := 0
+	for i := len(tiers) - 1; i > 0; i-- {
+		if t.qualifies(tiers[i]) {
+			level = i
+			break
+		}
+	}
+	t.Tier = tiers[level]
+	if level+1 < len(tiers) {
+		next := tiers[level+1]
+		t.Next = &next
+	}
+	return t, nil
+}
+
+// checkTradeLimits verifies that the tier of userID lets them sell or buy
+// amountSats more
+func (s *Service) checkTradeLimits(userID int64, amountSats int64) error {
+	if len(s.Limits().Tiers) == 0 {
+		return nil
+	}
+	t, err := s.TradeLimits(userID)
+	if err != nil {
+		return err
+	}
+	if t.Tier.MaxTradeSats > 0 && amountSats > t.Tier.MaxTradeSats {
+		return ErrTradeLimit
+	}
+	if remaining := t.RemainingSats(); remaining >= 0 && amountSats > remaining {
+		return ErrDailyLimit
+	}
+	return nil
+}
+
+// checkOpenOffers verifies that userID may have another open offer
+func (s *Service) checkOpenOffers(userID int64) error {
+	if max := s.Limits().MaxOpenOffers; max > 0 {
+		open, err := s.database.CountOpenOffers(userID)
+		if err != nil {
+			return err
+		}
+		if open >= max {
+			return ErrTooManyOffers
+		}
+	}
+	return nil
+}
+
+// recordCancel starts the cooldown of a user who cancelled an offer. It is
+// stored so that restarting the shop does not end it.
+func (s *Service) recordCancel(userID int64) {
+	if err := s.database.SetLastCancel(userID, time.Now()); err != nil {
+		log.Printf("Failed to record cancellation of user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,792 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/markup"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// StatusEmoji returns the emoji shown next to an offer status
+func StatusEmoji(status models.OfferStatus) string {
+	switch status {
+	case models.StatusPaid:
+		return "💰"
+	case models.StatusCompleted:
+		return "✅"
+	case models.StatusCancelled:
+		return "❌"
+	case models.StatusExpired:
+		return "⌛"
+	default:
+		return "⏳"
+	}
+}
+
+// StatusName returns the localized name of an offer status
+func StatusName(l *i18n.Locale, status models.OfferStatus) string {
+	return l.T("status." + string(status))
+}
+
+// offerDetails formats the amount, price and date lines shown wherever an
+// offer is listed
+func offerDetails(l *i18n.Locale, o models.Offer) string {
+	return l.T("offer.details", l.BTC(o.AmountBTC), l.USD(o.PriceUSD), l.Date(o.CreatedAt))
+}
+
+// feeLine formats the fee line with key of an amount of satoshis, or returns
+// an empty string when there is no fee
+func feeLine(l *i18n.Locale, key string, sats int64) string {
+	if sats <= 0 {
+		return ""
+	}
+	return l.T(key, l.BTC(satsToBTC(sats)))
+}
+
+// offerStatus formats the status line of an offer
+func offerStatus(l *i18n.Locale, o models.Offer) string {
+	return l.T("offer.status", StatusEmoji(o.Status), StatusName(l, o.Status))
+}
+
+// paymentDetails formats the Lightning invoice and the Bitcoin address of a
+// pending offer as copyable text, with the confirmations of its on-chain
+// payment, or returns an empty string when there is nothing to pay
+func paymentDetails(l *i18n.Locale, o models.Offer) string {
+	if o.Status != models.StatusPending {
+		return ""
+	}
+	var text string
+	if o.PaymentMethod.Lightning() && o.PaymentRequest != "" {
+		text += l.T("offer.payment_request", markup.Escape(o.PaymentRequest))
+	}
+	if o.PaymentMethod.OnChain() && o.PaymentAddress != "" {
+		text += l.T("offer.payment_address", l.BTC(invoiceAmountBTC(o)), markup.Escape(o.PaymentAddress))
+	}
+	if o.PaymentMethod.OnChain() && o.Confirmations >= 0 {
+		text += l.T("offer.confirmations", o.Confirmations, o.ConfirmationsRequired)
+	}
+	return text
+}
+
+// PaymentURI returns the URI wallets pay a pending offer with: a BIP21
+// bitcoin: URI when it can be paid on-chain, carrying the Lightning invoice
+// too when both are allowed, or a lightning: URI. It is empty when there is
+// nothing to pay.
+func PaymentURI(o models.Offer) string {
+	if o.Status != models.StatusPending {
+		return ""
+	}
+	lightning := o.PaymentMethod.Lightning() && o.PaymentRequest != ""
+	switch {
+	case o.PaymentMethod.OnChain() && o.PaymentAddress != "":
+		uri := "bitcoin:" + o.PaymentAddress + "?amount=" + strconv.FormatFloat(invoiceAmountBTC(o), 'f', -1, 64)
+		if lightning {
+			uri += "&lightning=" + o.PaymentRequest
+		}
+		return uri
+	case lightning:
+		return "lightning:" + o.PaymentRequest
+	}
+	return ""
+}
+
+// OfferCreatedMessage confirms a new offer with its payment details and a
+// link to the checkout page
+func OfferCreatedMessage(l *i18n.Locale, o *models.Offer) Message {
+	details := paymentDetails(l, *o)
+	if details == "" {
+		details = l.T("offer.checkout_hint")
+	}
+	return Message{
+		Text: l.T("offer.created", l.BTC(o.AmountBTC), l.USD(o.PriceUSD)) + feeLine(l, "fee.maker", o.MakerFeeSats) + details,
+		Actions: [][]Action{{
+			{Label: l.T("offer.view_invoice"), URL: o.InvoiceLink},
+		}},
+		PaymentURI: PaymentURI(*o),
+	}
+}
+
+// OfferCardMessage shows an offer to its owner with the actions its status
+// and trade allow, the platform fee its invoice includes and the payment details
+// while it is pending
+func OfferCardMessage(l *i18n.Locale, o models.Offer) Message {
+	text := l.T("offer.title", o.ID) + offerDetails(l, o) + feeLine(l, "fee.maker", o.MakerFeeSats) + offerStatus(l, o) + paymentDetails(l, o)
+
+	actions := []Action{{Label: l.T("offer.view_invoice"), URL: o.InvoiceLink}}
+	data := strconv.Itoa(o.ID)
+	if o.Status == models.StatusPaid && o.Taken {
+		actions = append(actions, Action{Label: l.T("offer.confirm_button"), Command: ActionConfirmPayment, Data: data})
+	}
+	if o.Status == models.StatusPending || (o.Status == models.StatusPaid && !o.Taken) {
+		actions = append(actions, Action{Label: l.T("offer.cancel_button"), Command: ActionCancelOffer, Data: data})
+	}
+	if o.Status == models.StatusPending || o.Status == models.StatusExpired {
+		actions = append(actions, Action{Label: l.T("offer.refresh_button"), Command: ActionRefreshInvoice, Data: data})
+	}
+
+	return Message{Text: text, Actions: [][]Action{actions}, PaymentURI: PaymentURI(o)}
+}
+
+// InvoiceRefreshedMessage gives a seller the new invoice of an offer
+func InvoiceRefreshedMessage(l *i18n.Locale, o *models.Offer) Message {
+	details := paymentDetails(l, *o)
+	if details == "" {
+		details = l.T("offer.checkout_hint")
+	}
+	return Message{
+		Text: l.T("offer.invoice_refreshed", o.ID) + details,
+		Actions: [][]Action{{
+			{Label: l.T("offer.view_invoice"), URL: o.InvoiceLink},
+		}},
+		PaymentURI: PaymentURI(*o),
+	}
+}
+
+// SellerOffersMessage shows a seller's marketplace offers, with the fee
+// buyers pay, and a contact action
+func SellerOffersMessage(l *i18n.Locale, seller SellerOffers) Message {
+	var text strings.Builder
+	text.WriteString(sellerHeader(l, seller))
+
+	for _, o := range seller.Offers {
+		text.WriteString(l.T("offer.title", o.ID) + offerDetails(l, o) + feeLine(l, "fee.taker", seller.BuyerFees[o.ID]) + "\n")
+	}
+
+	actions := [][]Action{{
+		{Label: l.T("seller.contact", seller.Name), Command: ActionContact, Data: seller.Name},
+	}}
+	for _, o := range seller.Offers {
+		actions = append(actions, []Action{
+			{Label: l.T("seller.take", o.ID), Command: ActionTakeOffer, Data: strconv.Itoa(o.ID)},
+		})
+	}
+	return Message{Text: text.String(), Actions: actions}
+}
+
+// sellerHeader names a seller, with a badge if they posted a bond
+func sellerHeader(l *i18n.Locale, seller SellerOffers) string {
+	header := l.T("seller.header", markup.Escape(seller.Name))
+	if seller.Bonded {
+		header += l.T("bond.badge")
+	}
+	return header
+}
+
+// ChannelPostMessage announces an offer on a public channel. Available offers
+// link to takeURL, where they can be taken.
+func ChannelPostMessage(l *i18n.Locale, listing Listing, takeURL string) Message {
+	o := listing.Offer
+	text := sellerHeader(l, listing.Seller) + l.T("offer.title", o.ID) + offerDetails(l, o)
+	if !listing.Available {
+		return Message{Text: text + l.T("channel.unavailable")}
+	}
+	return Message{
+		Text: text + feeLine(l, "fee.taker", listing.BuyerFeeSats),
+		Actions: [][]Action{{
+			{Label: l.T("channel.take"), URL: takeURL},
+		}},
+	}
+}
+
+// ExternalOrdersMessage lists read-only orders from other marketplaces
+func ExternalOrdersMessage(l *i18n.Locale, orders []ExternalOrder) Message {
+	var text strings.Builder
+	text.WriteString(l.T("external.header"))
+	for _, o := range orders {
+		amount := l.T("external.any_amount")
+		if o.AmountBTC > 0 {
+			amount = l.BTC(o.AmountBTC)
+		}
+		key := "external.sell"
+		if o.Type == "buy" {
+			key = "external.buy"
+		}
+		text.WriteString(l.T(key, amount, l.Number(o.FiatAmount, 2), markup.Escape(o.Currency), markup.Escape(o.Platform)))
+	}
+	return Message{Text: text.String()}
+}
+
+// PaymentConfirmedMessage tells a seller their confirmation completed the trade
+func PaymentConfirmedMessage(l *i18n.Locale, offerID int) Message {
+	return Message{Text: l.T("offer.payment_confirmed", offerID)}
+}
+
+// OfferCancelledMessage tells a seller their offer was cancelled
+func OfferCancelledMessage(l *i18n.Locale, offerID int) Message {
+	return Message{Text: l.T("offer.cancelled", offerID)}
+}
+
+// LinkCodeMessage explains how to use a link code on another frontend
+func LinkCodeMessage(l *i18n.Locale, code string) Message {
+	return Message{Text: l.N("link.code", int(LinkCodeTTL.Minutes()), code, code)}
+}
+
+// AccountLinkedMessage tells a user that an identity joined their account
+func AccountLinkedMessage(l *i18n.Locale, identity models.Identity) Message {
+	name := identity.ExternalID
+	if identity.Username != "" {
+		name = "@" + identity.Username
+	}
+	return Message{Text: l.T("link.linked", markup.Escape(identity.Frontend), markup.Escape(name))}
+}
+
+// TradeStartedMessage tells a buyer they took an offer, the fee deducted
+// from their payout and how to reach the seller
+func TradeStartedMessage(l *i18n.Locale, t *models.Trade, o *models.Offer, seller SellerOffers) Message {
+	return Message{
+		Text:    l.T("trade.started", t.ID, l.BTC(o.AmountBTC), l.USD(o.PriceUSD), markup.Escape(seller.Name), o.ID) + feeLine(l, "trade.fee", t.TakerFeeSats),
+		Actions: [][]Action{{chatAction(l, t, "chat.button")}},
+	}
+}
+
+// OfferTakenMessage tells a seller that a buyer took their offer
+func OfferTakenMessage(l *i18n.Locale, t *models.Trade, o *models.Offer, buyer string) Message {
+	return Message{
+		Text:    l.T("trade.taken", o.ID, markup.Escape(buyer), l.BTC(o.AmountBTC), l.USD(o.PriceUSD), t.ID),
+		Actions: [][]Action{{chatAction(l, t, "chat.button")}},
+	}
+}
+
+// chatAction opens the chat of a trade
+func chatAction(l *i18n.Locale, t *models.Trade, label string) Action {
+	return Action{Label: l.T(label), Command: ActionTradeChat, Data: strconv.Itoa(t.ID)}
+}
+
+// TradeChatOpenedMessage tells a user they are chatting with the counterparty
+// of a trade and that exitCommand leaves the chat
+func TradeChatOpenedMessage(l *i18n.Locale, t *models.Trade, userID int64, exitCommand string) Message {
+	key := "chat.opened_seller"
+	if userID == t.SellerID {
+		key = "chat.opened_buyer"
+	}
+	return Message{Text: l.T(key, t.ID, exitCommand)}
+}
+
+// TradeChatMessage relays a message of a trade chat, labelled with the
+// sender's role. photoMissing notes a photo that cannot be shown.
+func TradeChatMessage(l *i18n.Locale, t *models.Trade, fromSeller bool, text string, photoMissing bool) Message {
+	key := "chat.from_buyer"
+	if fromSeller {
+		key = "chat.from_seller"
+	}
+	body := l.T(key, t.ID) + markup.Escape(text)
+	if photoMissing {
+		body += l.T("chat.photo_unavailable")
+	}
+	return Message{
+		Text:    body,
+		Actions: [][]Action{{chatAction(l, t, "chat.reply")}},
+	}
+}
+
+// ContactOpenedMessage tells a user they are chatting with another user and
+// that exitCommand leaves the chat
+func ContactOpenedMessage(l *i18n.Locale, nickname, exitCommand string) Message {
+	return Message{Text: l.T("chat.contact_opened", markup.Escape(nickname), markup.Escape(nickname), exitCommand)}
+}
+
+// DirectMessage relays a message of a direct chat, labelled with the sender's
+// nickname. photoMissing notes a photo that cannot be shown.
+func DirectMessage(l *i18n.Locale, nickname, text string, photoMissing bool) Message {
+	body := l.T("chat.from_user", markup.Escape(nickname)) + markup.Escape(text)
+	if photoMissing {
+		body += l.T("chat.photo_unavailable")
+	}
+	return Message{
+		Text: body,
+		Actions: [][]Action{{
+			{Label: l.T("chat.reply"), Command: ActionContact, Data: nickname},
+		}},
+	}
+}
+
+// NicknameMessage shows a user their nickname and how to change it
+func NicknameMessage(l *i18n.Locale, nickname, command string) Message {
+	return Message{Text: l.T("nick.show", markup.Escape(nickname), command)}
+}
+
+// LightningAddressMessage shows the Lightning address payouts of a user go
+// to by default, with the command that changes it
+func LightningAddressMessage(l *i18n.Locale, address, command string) Message {
+	if address == "" {
+		return Message{Text: l.T("lnaddress.none", command, command)}
+	}
+	return Message{Text: l.T("lnaddress.show", markup.Escape(address), command)}
+}
+
+// TradeClosedMessage tells a buyer their trade was completed or cancelled.
+// Buyers who have not said where to receive the bitcoin are asked to.
+func TradeClosedMessage(l *i18n.Locale, t *models.Trade, o *models.Offer) Message {
+	if t.Status != models.TradeCompleted {
+		return Message{Text: l.T("trade.cancelled", t.ID, o.ID)}
+	}
+	if t.PayoutDestination != "" {
+		return Message{Text: l.T("trade.completed", t.ID, o.ID)}
+	}
+	return Message{
+		Text:    l.T("trade.completed", t.ID, o.ID) + l.T("payout.request"),
+		Actions: [][]Action{{payoutAction(l, t.ID)}},
+	}
+}
+
+// payoutAction asks for the destination of the payout of a trade
+func payoutAction(l *i18n.Locale, tradeID int) Action {
+	return Action{Label: l.T("payout.button"), Command: ActionPayout, Data: strconv.Itoa(tradeID)}
+}
+
+// PayoutStatusEmoji returns the emoji shown next to a payout status
+func PayoutStatusEmoji(status models.PayoutStatus) string {
+	switch status {
+	case models.PayoutInProgress:
+		return "⚡"
+	case models.PayoutCompleted:
+		return "✅"
+	case models.PayoutCancelled:
+		return "❌"
+	default:
+		return "⏳"
+	}
+}
+
+// payoutStatusText formats the status of a payout
+func payoutStatusText(l *i18n.Locale, p *models.Payout) string {
+	return PayoutStatusEmoji(p.Status) + " " + l.T("payout.status."+string(p.Status))
+}
+
+// PayoutMessage tells a buyer how the payout of their trade is going.
+// Cancelled payouts can be retried with another destination.
+func PayoutMessage(l *i18n.Locale, p *models.Payout) Message {
+	text := l.T("payout.message", p.TradeID, l.BTC(float64(p.AmountSats)/100_000_000), markup.Escape(p.Destination), payoutStatusText(l, p))
+	if p.Status != models.PayoutCancelled {
+		return Message{Text: text}
+	}
+	return Message{
+		Text:    text + l.T("payout.retry"),
+		Actions: [][]Action{{payoutAction(l, p.TradeID)}},
+	}
+}
+
+// PayoutFailedMessage tells a buyer the payout of their trade could not be
+// sent to the destination they gave
+func PayoutFailedMessage(l *i18n.Locale, t *models.Trade) Message {
+	return Message{
+		Text:    l.T("payout.failed_destination", t.ID),
+		Actions: [][]Action{{payoutAction(l, t.ID)}},
+	}
+}
+
+// PayoutsMessage lists the payouts a user receives
+func PayoutsMessage(l *i18n.Locale, payouts []models.Payout) Message {
+	if len(payouts) == 0 {
+		return Message{Text: l.T("payout.none")}
+	}
+	var text strings.Builder
+	text.WriteString(l.T("payout.header"))
+	for i := range payouts {
+		p := &payouts[i]
+		text.WriteString(l.T("payout.item", p.TradeID, l.BTC(float64(p.AmountSats)/100_000_000), payoutStatusText(l, p)))
+	}
+	return Message{Text: text.String()}
+}
+
+// refundAction asks for the destination of the refund of an offer
+func refundAction(l *i18n.Locale, offerID int) Action {
+	return Action{Label: l.T("refund.button"), Command: ActionRefund, Data: strconv.Itoa(offerID)}
+}
+
+// refundStatusText formats the status of a refund
+func refundStatusText(l *i18n.Locale, r *models.Refund) string {
+	emoji := "⏳"
+	switch r.Status {
+	case models.RefundInProgress:
+		emoji = "⚡"
+	case models.RefundCompleted:
+		emoji = "✅"
+	}
+	return emoji + " " + l.T("refund.status."+string(r.Status))
+}
+
+// RefundRequestMessage asks the payer of an offer cancelled after it was
+// paid, or paid twice, where to send their refund
+func RefundRequestMessage(l *i18n.Locale, r *models.Refund) Message {
+	key := "refund.request"
+	if r.Duplicate {
+		key = "refund.request_duplicate"
+	}
+	return Message{
+		Text:    l.T(key, r.OfferID, l.BTC(float64(r.AmountSats)/100_000_000)),
+		Actions: [][]Action{{refundAction(l, r.OfferID)}},
+	}
+}
+
+// RefundMessage tells a payer how their refund is going
+func RefundMessage(l *i18n.Locale, r *models.Refund) Message {
+	return Message{Text: l.T("refund.message", r.OfferID, l.BTC(float64(r.AmountSats)/100_000_000), markup.Escape(r.Destination), refundStatusText(l, r))}
+}
+
+// RefundFailedMessage tells a payer their refund could not be sent to the
+// destination they gave
+func RefundFailedMessage(l *i18n.Locale, r *models.Refund) Message {
+	return Message{
+		Text:    l.T("refund.failed_destination", r.OfferID),
+		Actions: [][]Action{{refundAction(l, r.OfferID)}},
+	}
+}
+
+// ReferralsMessage shows a user their invite link, how many users they
+// invited and their referral earnings, with an action paying out the
+// available earnings once they reach the minimum payout
+func ReferralsMessage(l *i18n.Locale, r *ReferralSummary, invite string) Message {
+	text := l.T("referral.summary", r.SharePercent, markup.Escape(invite), l.Integer(r.Invites),
+		l.BTC(satsToBTC(r.EarnedSats)), l.BTC(satsToBTC(r.PaidSats)), l.BTC(satsToBTC(r.PendingSats)),
+		l.BTC(satsToBTC(r.AvailableSats)))
+	if !r.CanPayOut() {
+		return Message{Text: text + l.T("referral.minimum", l.BTC(satsToBTC(max(r.MinPayoutSats, 1))))}
+	}
+	return Message{Text: text, Actions: [][]Action{{referralPayoutAction(l)}}}
+}
+
+// referralPayoutAction pays out the available referral earnings of a user
+func referralPayoutAction(l *i18n.Locale) Action {
+	return Action{Label: l.T("referral.payout_button"), Command: ActionReferralPayout}
+}
+
+// ReferralCreditMessage tells a referrer they were credited with a share of
+// the fee paid by a user they invited
+func ReferralCreditMessage(l *i18n.Locale, c *models.ReferralCredit) Message {
+	return Message{Text: l.T("referral.credit", l.BTC(satsToBTC(c.AmountSats)), c.TradeID)}
+}
+
+// ReferralPayoutMessage tells a referrer how the payout of their earnings is
+// going. Cancelled payouts can be requested again.
+func ReferralPayoutMessage(l *i18n.Locale, p *models.ReferralPayout) Message {
+	status := PayoutStatusEmoji(p.Status) + " " + l.T("payout.status."+string(p.Status))
+	text := l.T("referral.payout", l.BTC(satsToBTC(p.AmountSats)), markup.Escape(p.Destination), status)
+	if p.Status != models.PayoutCancelled {
+		return Message{Text: text}
+	}
+	return Message{
+		Text:    text + l.T("referral.payout_retry"),
+		Actions: [][]Action{{referralPayoutAction(l)}},
+	}
+}
+
+// BondMessage shows a seller their bond with the actions its status allows:
+// paying a pending bond, releasing an active one or posting a new one
+func BondMessage(l *i18n.Locale, b *models.Bond, bonds Bonds) Message {
+	post := [][]Action{{{Label: l.T("bond.post_button"), Command: ActionPostBond}}}
+	if b == nil || b.Status == models.BondExpired {
+		text := l.T("bond.none", l.BTC(satsToBTC(bonds.AmountSats)))
+		if bonds.Required {
+			text += l.T("bond.required")
+		}
+		return Message{Text: text, Actions: post}
+	}
+	amount := l.BTC(satsToBTC(b.AmountSats))
+	switch b.Status {
+	case models.BondPending:
+		text := l.T("bond.pending", amount)
+		if b.PaymentRequest != "" {
+			text += l.T("offer.payment_request", markup.Escape(b.PaymentRequest))
+		}
+		msg := Message{
+			Text:    text,
+			Actions: [][]Action{{{Label: l.T("offer.view_invoice"), URL: b.InvoiceLink}}},
+		}
+		if b.PaymentRequest != "" {
+			msg.PaymentURI = "lightning:" + b.PaymentRequest
+		}
+		return msg
+	case models.BondActive:
+		return Message{
+			Text:    l.T("bond.active", amount, l.Date(b.UpdatedAt)),
+			Actions: [][]Action{{{Label: l.T("bond.release_button"), Command: ActionReleaseBond}}},
+		}
+	case models.BondSlashed:
+		return Message{Text: l.T("bond.slashed", amount, b.TradeID), Actions: post}
+	}
+	text := l.T("bond.released", amount)
+	if b.BTCPayID != "" {
+		text += l.T("bond.payout_status", markup.Escape(b.Destination), PayoutStatusEmoji(b.PayoutStatus)+" "+l.T("payout.status."+string(b.PayoutStatus)))
+	}
+	return Message{Text: text, Actions: post}
+}
+
+// BondSlashedMessage tells a seller their bond was given to the buyer of a
+// trade they lost a dispute over
+func BondSlashedMessage(l *i18n.Locale, b *models.Bond) Message {
+	return Message{Text: l.T("bond.slashed", l.BTC(satsToBTC(b.AmountSats)), b.TradeID)}
+}
+
+// BondClaimMessage asks the recipient of a released or slashed bond where to
+// send it
+func BondClaimMessage(l *i18n.Locale, b *models.Bond) Message {
+	text := l.T("bond.claim_released", l.BTC(satsToBTC(b.AmountSats)))
+	if b.Status == models.BondSlashed {
+		text = l.T("bond.claim_slashed", l.BTC(satsToBTC(b.AmountSats)), b.TradeID)
+	}
+	return Message{
+		Text:    text + l.T("bond.claim_hint"),
+		Actions: [][]Action{{{Label: l.T("payout.button"), Command: ActionClaimBond, Data: strconv.Itoa(b.ID)}}},
+	}
+}
+
+// BondPayoutMessage tells the recipient of a bond how its payout is going
+func BondPayoutMessage(l *i18n.Locale, b *models.Bond) Message {
+	status := PayoutStatusEmoji(b.PayoutStatus) + " " + l.T("payout.status."+string(b.PayoutStatus))
+	return Message{Text: l.T("bond.payout", b.ID, l.BTC(satsToBTC(b.AmountSats)), markup.Escape(b.Destination), status)}
+}
+
+// DisputeOpenedMessage tells a participant of a trade, userID, about the
+// dispute opened over it
+func DisputeOpenedMessage(l *i18n.Locale, t *models.Trade, userID int64) Message {
+	switch {
+	case userID == t.DisputedBy:
+		return Message{Text: l.T("dispute.opened", t.ID)}
+	case t.DisputedBy == t.SellerID:
+		return Message{Text: l.T("dispute.opened_by_seller", t.ID)}
+	default:
+		return Message{Text: l.T("dispute.opened_by_buyer", t.ID)}
+	}
+}
+
+// DisputeAdminMessage asks admins to settle the dispute over a trade
+func DisputeAdminMessage(l *i18n.Locale, t *models.Trade) Message {
+	key := "dispute.admin_buyer"
+	if t.DisputedBy == t.SellerID {
+		key = "dispute.admin_seller"
+	}
+	return Message{Text: l.T(key, t.ID, t.OfferID)}
+}
+
+// DisputeResolvedMessage tells the parties of a trade how an admin settled
+// their dispute
+func DisputeResolvedMessage(l *i18n.Locale, t *models.Trade, winner DisputeWinner) Message {
+	return Message{Text: l.T("dispute.resolved_"+string(winner), t.ID)}
+}
+
+// LimitsMessage shows a user their tier, its limits and what they traded
+// over the last 24 hours, with the requirements of the next tier
+func LimitsMessage(l *i18n.Locale, t *TradeLimits) Message {
+	if t.Tier == (models.Tier{}) {
+		return Message{Text: l.T("limits.none")}
+	}
+	remaining := l.T("limits.unlimited")
+	if sats := t.RemainingSats(); sats >= 0 {
+		remaining = l.BTC(satsToBTC(sats))
+	}
+	text := l.T("limits.message", t.Tier.Name, capText(l, t.Tier.MaxTradeSats), capText(l, t.Tier.MaxDailySats),
+		l.BTC(satsToBTC(t.VolumeSats)), remaining)
+	text += l.T("limits.account", l.N("limits.days", int(t.AccountAge/(24*time.Hour))), l.Integer(t.CompletedTrades))
+	text += ratingText(l, t.Rating, t.Ratings)
+	if t.Next == nil {
+		return Message{Text: text + l.T("limits.top")}
+	}
+	next := t.Next
+	text += l.T("limits.next", next.Name, l.N("limits.days", int(next.MinAccountAge/(24*time.Hour))), l.Integer(next.MinTrades))
+	if next.MinRating > 0 {
+		text += l.T("limits.next_rating", l.Number(next.MinRating, 1))
+	}
+	if next.Bonded {
+		text += l.T("limits.next_bond")
+	}
+	text += l.T("limits.next_limits", capText(l, next.MaxTradeSats), capText(l, next.MaxDailySats))
+	return Message{Text: text}
+}
+
+// ratingText formats the average rating of a user, or says they have none
+func ratingText(l *i18n.Locale, average float64, count int) string {
+	if count == 0 {
+		return l.T("limits.unrated")
+	}
+	return l.N("limits.rating", count, l.Number(average, 1))
+}
+
+// RatingReceivedMessage tells a user the score their counterparty gave them
+// for a trade
+func RatingReceivedMessage(l *i18n.Locale, tradeID int, score int) Message {
+	return Message{Text: l.T("rate.received", tradeID, strings.Repeat("⭐", score))}
+}
+
+// capText formats a limit in sats, 0 meaning no limit
+func capText(l *i18n.Locale, sats int64) string {
+	if sats <= 0 {
+		return l.T("limits.unlimited")
+	}
+	return l.BTC(satsToBTC(sats))
+}
+
+// LimitExceededText explains why an offer or trade exceeds the limits of the
+// user's tier and points to command, which shows how to raise them. It is
+// plain text, so that it also fits alerts.
+func LimitExceededText(l *i18n.Locale, t *TradeLimits, err error, command string) string {
+	var text string
+	if errors.Is(err, ErrDailyLimit) {
+		text = l.T("limits.daily_exceeded", t.Tier.Name, l.BTC(satsToBTC(t.Tier.MaxDailySats)), l.BTC(satsToBTC(max(t.RemainingSats(), 0))))
+	} else {
+		text = l.T("limits.trade_exceeded", t.Tier.Name, l.BTC(satsToBTC(t.Tier.MaxTradeSats)))
+	}
+	return text + l.T("limits.see", command)
+}
+
+// ThrottledText tells a user who exceeded a rate limit how long to wait
+// before trying again. It is plain text, so that it also fits alerts.
+func ThrottledText(l *i18n.Locale, err error) string {
+	var wait time.Duration
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		wait = throttled.Wait
+	}
+	return l.T("throttled", FormatWait(wait))
+}
+
+// FormatWait rounds a wait up to whole seconds for display
+func FormatWait(d time.Duration) string {
+	if d < time.Second {
+		d = time.Second
+	}
+	return (d + time.Second - 1).Truncate(time.Second).String()
+}
+
+// RefundsMessage lists the refunds a user receives
+func RefundsMessage(l *i18n.Locale, refunds []models.Refund) Message {
+	if len(refunds) == 0 {
+		return Message{Text: l.T("refund.none")}
+	}
+	var text strings.Builder
+	text.WriteString(l.T("refund.header"))
+	for i := range refunds {
+		r := &refunds[i]
+		text.WriteString(l.T("refund.item", r.OfferID, l.BTC(float64(r.AmountSats)/100_000_000), refundStatusText(l, r)))
+	}
+	return Message{Text: text.String()}
+}
+
+// LedgerAlertMessage tells admins that a money movement could not be recorded
+// in the ledger
+func LedgerAlertMessage(l *i18n.Locale, reference string, amountSats int64, err error) Message {
+	return Message{Text: l.T("ledger.alert", markup.Escape(reference), l.BTC(satsToBTC(amountSats)), markup.Escape(err.Error()))}
+}
+
+// BalanceMessage shows a user the funds the shop owes them, the funds of
+// their offers in escrow and their bond, with their latest ledger entries
+func BalanceMessage(l *i18n.Locale, b *Balance) Message {
+	var text strings.Builder
+	text.WriteString(l.T("balance.message", l.BTC(satsToBTC(b.AvailableSats)), l.BTC(satsToBTC(b.EscrowSats))))
+	if b.BondSats != 0 {
+		text.WriteString(l.T("balance.bond", l.BTC(satsToBTC(b.BondSats))))
+	}
+	if len(b.Entries) == 0 {
+		return Message{Text: text.String()}
+	}
+	text.WriteString(l.T("balance.entries"))
+	available := models.UserAccount(b.UserID, models.AccountAvailable)
+	escrow := models.UserAccount(b.UserID, models.AccountEscrow)
+	bond := models.UserAccount(b.UserID, models.AccountBond)
+	for i := range b.Entries {
+		e := &b.Entries[i]
+		var changes []string
+		if sats := e.AmountSats(available); sats != 0 {
+			changes = append(changes, l.T("balance.available_change", signedBTC(l, sats)))
+		}
+		if sats := e.AmountSats(escrow); sats != 0 {
+			changes = append(changes, l.T("balance.escrow_change", signedBTC(l, sats)))
+		}
+		if sats := e.AmountSats(bond); sats != 0 {
+			changes = append(changes, l.T("balance.bond_change", signedBTC(l, sats)))
+		}
+		text.WriteString(l.T("balance.entry", l.Date(e.CreatedAt), l.T("ledger.kind."+string(e.Kind)), strings.Join(changes, ", ")))
+	}
+	return Message{Text: text.String()}
+}
+
+// signedBTC formats an amount of satoshis as bitcoin with its sign
+func signedBTC(l *i18n.Locale, sats int64) string {
+	if sats < 0 {
+		return "-" + l.BTC(satsToBTC(-sats))
+	}
+	return "+" + l.BTC(satsToBTC(sats))
+}
+
+// APITokenMessage shows a newly issued API token
+func APITokenMessage(l *i18n.Locale, token string) Message {
+	return Message{Text: l.T("apitoken.message", markup.Escape(token))}
+}
+
+// BannedMessage tells a user their account was suspended
+func BannedMessage(l *i18n.Locale, reason string) Message {
+	text := l.T("ban.notice")
+	if reason != "" {
+		text += l.T("ban.reason", markup.Escape(reason))
+	}
+	return Message{Text: text}
+}
+
+// UnbannedMessage tells a user their suspension was lifted
+func UnbannedMessage(l *i18n.Locale) Message {
+	return Message{Text: l.T("unban.notice")}
+}
+
+// OfferForceCancelledMessage tells a seller an admin cancelled their offer
+func OfferForceCancelledMessage(l *i18n.Locale, offerID int) Message {
+	return Message{Text: l.T("offer.force_cancelled", offerID)}
+}
+
+// BroadcastMessage wraps an announcement sent to all users
+func BroadcastMessage(l *i18n.Locale, text string) Message {
+	return Message{Text: l.T("broadcast.header") + markup.Escape(text)}
+}
+
+// StatsMessage summarizes the shop statistics for admins
+func StatsMessage(l *i18n.Locale, stats *db.Stats) Message {
+	total := 0
+	for _, n := range stats.Offers {
+		total += n
+	}
+	return Message{
+		Text: l.T("stats.message",
+			l.Integer(stats.Users), l.Integer(stats.BannedUsers), l.Integer(stats.Trades), l.Integer(total),
+			l.Integer(stats.Offers[models.StatusPending]), l.Integer(stats.Offers[models.StatusPaid]),
+			l.Integer(stats.Offers[models.StatusCompleted]), l.Integer(stats.Offers[models.StatusCancelled]),
+			l.Integer(stats.Offers[models.StatusExpired]),
+			l.BTC(stats.VolumeBTC), l.USD(stats.VolumeUSD)) +
+			l.T("stats.fees", l.BTC(satsToBTC(stats.MakerFeesSats+stats.TakerFeesSats)),
+				l.BTC(satsToBTC(stats.MakerFeesSats)), l.BTC(satsToBTC(stats.TakerFeesSats))),
+	}
+}
+
+// LookupMessage shows an admin the offer behind an invoice
+func LookupMessage(l *i18n.Locale, o *models.Offer, invoice *btcpay.Invoice) Message {
+	text := l.T("lookup.offer", o.ID, markup.Escape(o.Username), o.UserID) + offerDetails(l, *o) + offerStatus(l, *o)
+	if invoice != nil {
+		text += l.T("lookup.invoice", markup.Escape(invoice.Status), markup.Escape(invoice.AdditionalStatus))
+	} else {
+		text += l.T("lookup.invoice_unavailable")
+	}
+	return Message{
+		Text: text,
+		Actions: [][]Action{{
+			{Label: l.T("offer.view_invoice"), URL: o.InvoiceLink},
+		}},
+	}
+}
+
+// AuditLogMessage lists the latest admin actions
+func AuditLogMessage(l *i18n.Locale, entries []models.AuditEntry) Message {
+	if len(entries) == 0 {
+		return Message{Text: l.T("audit.empty")}
+	}
+	var text strings.Builder
+	text.WriteString(l.T("audit.header"))
+	for _, e := range entries {
+		text.WriteString(fmt.Sprintf("%s - %d: `%s` %s\n", l.Date(e.CreatedAt), e.AdminID, markup.Escape(e.Action), markup.Escape(e.Target)))
+	}
+	return Message{Text: text.String()}
+}
@@ -0,0 +1,101 @@
+package shop
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by nickname operations
+var (
+	ErrInvalidNickname = errors.New("invalid nickname")
+	ErrNicknameTaken   = errors.New("nickname is already taken")
+)
+
+// nicknamePattern is what chosen nicknames look like: 3 to 20 letters,
+// digits or underscores, starting with a letter
+var nicknamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{2,19}$`)
+
+// generatedPrefix starts the nicknames given to users who have not chosen one
+const generatedPrefix = "trader_"
+
+// Nickname returns the public handle of a user, the only name other users
+// see. Users get a generated one until they choose their own.
+func (s *Service) Nickname(userID int64) (string, error) {
+	user, err := s.User(userID)
+	if err != nil {
+		return "", err
+	}
+	return s.nickname(user), nil
+}
+
+// SetNickname changes the public handle of a user. Cards listing their offers
+// are updated to show it.
+func (s *Service) SetNickname(userID int64, nickname string) error {
+	if !nicknamePattern.MatchString(nickname) {
+		return ErrInvalidNickname
+	}
+	if err := s.database.SetNickname(userID, nickname); err != nil {
+		if errors.Is(err, db.ErrDuplicate) {
+			return ErrNicknameTaken
+		}
+		return err
+	}
+
+	offers, err := s.database.GetUserOffers(userID)
+	if err != nil {
+		return err
+	}
+	for i := range offers {
+		if !offers[i].Status.Closed() {
+			s.offerChanged(&offers[i])
+		}
+	}
+	return nil
+}
+
+// nickname returns the nickname of a user, generating one if they have none
+func (s *Service) nickname(u *models.User) string {
+	for attempt := 0; u.Nickname == "" && attempt < 5; attempt++ {
+		code, err := randomCode(5)
+		if err != nil {
+			log.Printf("Failed to generate nickname of user %d: %v", u.ID, err)
+			break
+		}
+		nickname := generatedPrefix + strings.ToLower(code)
+		if err := s.database.SetNickname(u.ID, nickname); err != nil {
+			if !errors.Is(err, db.ErrDuplicate) {
+				log.Printf("Failed to store nickname of user %d: %v", u.ID, err)
+				break
+			}
+			continue
+		}
+		u.Nickname = nickname
+	}
+	if u.Nickname == "" {
+		return "trader"
+	}
+	return u.Nickname
+}
+
+// RefreshIdentity updates the chat, username and language of a registered
+// identity when they changed, e.g. after a Telegram user set a username.
+// Unregistered identities are ignored.
+func (s *Service) RefreshIdentity(identity models.Identity) error {
+	known, err := s.database.GetIdentity(identity.Frontend, identity.ExternalID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if known.ChatID == identity.ChatID && known.Username == identity.Username && known.Language == identity.Language {
+		return nil
+	}
+	_, err = s.database.RegisterIdentity(identity, known.UserID, 0)
+	return err
+}
@@ -0,0 +1,101 @@
+package shop
+
+import (
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// SetConfirmations sets the confirmations the on-chain payment of new offers
+// needs before they are paid
+func (s *Service) SetConfirmations(confirmations int) {
+	s.confirmations = confirmations
+}
+
+// Confirmations returns the confirmations the on-chain payment of new offers
+// needs before they are paid
+func (s *Service) Confirmations() int {
+	return s.confirmations
+}
+
+// paymentMethods returns the BTCPay payment methods of an invoice payable
+// with method
+func paymentMethods(method models.PaymentMethod) []string {
+	var methods []string
+	if method.Lightning() {
+		methods = append(methods, btcpay.PaymentMethodLightning)
+	}
+	if method.OnChain() {
+		methods = append(methods, btcpay.PaymentMethodOnChain)
+	}
+	return methods
+}
+
+// missingPaymentDetails reports whether the BOLT11 invoice or the Bitcoin
+// address an offer is paid with is still unknown
+func missingPaymentDetails(o models.Offer) bool {
+	return (o.PaymentMethod.Lightning() && o.PaymentRequest == "") ||
+		(o.PaymentMethod.OnChain() && o.PaymentAddress == "")
+}
+
+// fetchPaymentDetails stores the BOLT11 invoice and the Bitcoin address of an
+// offer's BTCPay invoice so that frontends can show them. Failures are only
+// logged, as the checkout link still lets the seller pay.
+func (s *Service) fetchPaymentDetails(o *models.Offer) {
+	methods, err := s.btcpay.GetPaymentMethods(o.InvoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch payment methods of offer %d: %v", o.ID, err)
+		return
+	}
+	for _, m := range methods {
+		if !m.Activated || m.Destination == "" {
+			continue
+		}
+		switch {
+		case m.PaymentMethod == btcpay.PaymentMethodLightning && o.PaymentMethod.Lightning():
+			if err := s.database.SetOfferPaymentRequest(o.ID, m.Destination); err != nil {
+				log.Printf("Failed to store payment request of offer %d: %v", o.ID, err)
+				continue
+			}
+			o.PaymentRequest = m.Destination
+		case m.PaymentMethod == btcpay.PaymentMethodOnChain && o.PaymentMethod.OnChain():
+			if err := s.database.SetOfferPaymentAddress(o.ID, m.Destination); err != nil {
+				log.Printf("Failed to store payment address of offer %d: %v", o.ID, err)
+				continue
+			}
+			o.PaymentAddress = m.Destination
+		}
+	}
+}
+
+// refreshConfirmations stores the confirmations of the on-chain payment of
+// an offer and reports whether they changed
+func (s *Service) refreshConfirmations(o *models.Offer) bool {
+	methods, err := s.btcpay.GetPaymentMethods(o.InvoiceID)
+	if err != nil {
+		log.Printf("Failed to fetch payments of offer %d: %v", o.ID, err)
+		return false
+	}
+	confirmations := btcpay.OnChainConfirmations(methods)
+	if confirmations == o.Confirmations {
+		return false
+	}
+	if err := s.database.SetOfferConfirmations(o.ID, confirmations); err != nil {
+		log.Printf("Failed to store confirmations of offer %d: %v", o.ID, err)
+		return false
+	}
+	o.Confirmations = confirmations
+	return true
+}
+
+// invoicePaid reports whether the invoice of an offer is paid. Lightning
+// payments count once BTCPay settles the invoice; on-chain payments once
+// they have the confirmations the offer requires, whatever the speed policy
+// of the store.
+func invoicePaid(o *models.Offer, invoice *btcpay.Invoice) bool {
+	if !o.PaymentMethod.OnChain() || o.Confirmations < 0 {
+		return invoice.IsPaid()
+	}
+	return (invoice.IsPaid() || invoice.IsProcessing()) && o.Confirmations >= o.ConfirmationsRequired
+}
@@ -0,0 +1,389 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by payout operations
+var (
+	ErrInvalidDestination = errors.New("not a Lightning address, LNURL or Lightning invoice")
+	ErrUnresolvable       = errors.New("Lightning address could not be resolved")
+	ErrPayoutAmount       = errors.New("amount not accepted by the Lightning address")
+	ErrInvoiceNetwork     = errors.New("invoice is for another Bitcoin network")
+	ErrInvoiceAmount      = errors.New("invoice is not for the trade amount")
+	ErrInvoiceExpired     = errors.New("invoice has expired")
+	ErrNotBuyer           = errors.New("only the buyer of a trade is paid out")
+	ErrPayoutExists       = errors.New("trade is already paid out")
+	ErrPayout             = errors.New("failed to create payout")
+)
+
+// invoicePattern matches BOLT11 invoices. Lightning addresses and LNURLs are
+// resolved to an invoice by the shop before paying out.
+var invoicePattern = regexp.MustCompile(`^ln(bc|tb|bcrt|tbs)[0-9a-z]+$`)
+
+// SetAutoApprovePayouts sets whether payouts are paid without waiting for the
+// store owner to approve them in BTCPay Server
+func (s *Service) SetAutoApprovePayouts(enabled bool) {
+	s.autoApprovePayouts = enabled
+}
+
+// SetNetwork sets the Bitcoin network payout invoices must be for
+func (s *Service) SetNetwork(network bolt11.Network) {
+	s.network = network
+}
+
+// Network returns the Bitcoin network payout invoices must be for
+func (s *Service) Network() bolt11.Network {
+	return s.network
+}
+
+// SetLNURLClient sets the client used to resolve Lightning addresses and
+// LNURLs
+func (s *Service) SetLNURLClient(client *lnurl.Client) {
+	s.lnurl = client
+}
+
+// normalizeDestination strips the URI scheme of a payout destination and
+// lowercases it. It returns ErrInvalidDestination for anything that is not a
+// Lightning address, LNURL or BOLT11 invoice.
+func normalizeDestination(destination string) (string, error) {
+	destination = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(destination), "lightning:"))
+	if !lnurl.IsDestination(destination) && !invoicePattern.MatchString(destination) {
+		return "", ErrInvalidDestination
+	}
+	return destination, nil
+}
+
+// checkInvoice decodes a BOLT11 invoice and verifies that it pays exactly
+// amountSats on the shop's network and has not expired
+func (s *Service) checkInvoice(pr string, amountSats int64) error {
+	invoice, err := bolt11.Decode(pr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDestination, err)
+	}
+	err = invoice.Check(s.network, amountSats*1000, time.Now())
+	switch {
+	case errors.Is(err, bolt11.ErrWrongNetwork):
+		return fmt.Errorf("%w: %v", ErrInvoiceNetwork, err)
+	case errors.Is(err, bolt11.ErrWrongAmount):
+		return fmt.Errorf("%w: %v", ErrInvoiceAmount, err)
+	case errors.Is(err, bolt11.ErrExpired):
+		return fmt.Errorf("%w: %v", ErrInvoiceExpired, err)
+	}
+	return err
+}
+
+// payoutAmountSats returns the amount paid out to the buyer of a trade in
+// satoshis, net of their share of the platform fee
+func (s *Service) payoutAmountSats(trade *models.Trade) (int64, error) {
+	offer, err := s.Offer(trade.OfferID)
+	if err != nil {
+		return 0, err
+	}
+	return btcToSats(offer.AmountBTC) - trade.TakerFeeSats, nil
+}
+
+// LightningAddress returns the Lightning address or LNURL payouts of a user
+// are sent to by default, or an empty string
+func (s *Service) LightningAddress(userID int64) (string, error) {
+	u, err := s.database.GetUser(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return "", ErrNotRegistered
+		}
+		return "", err
+	}
+	return u.LightningAddress, nil
+}
+
+// SetLightningAddress registers the Lightning address or LNURL the user is
+// paid out to when they give no destination for a trade. The address must
+// resolve to an LNURL-pay service. An empty address removes it.
+func (s *Service) SetLightningAddress(userID int64, address string) error {
+	if _, err := s.LightningAddress(userID); err != nil {
+		return err
+	}
+	if address != "" {
+		normalized, err := normalizeDestination(address)
+		if err != nil || !lnurl.IsDestination(normalized) {
+			return ErrInvalidDestination
+		}
+		if _, err := s.lnurl.Resolve(normalized); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnresolvable, err)
+		}
+		address = normalized
+	}
+	return s.database.SetLightningAddress(userID, address)
+}
+
+// SetPayoutDestination sets where the buyer of a trade receives the bitcoin.
+// Completed trades are paid out at once and their payout is returned; open
+// trades are paid out when the seller confirms the payment. Lightning
+// addresses and LNURLs must resolve to an LNURL-pay service; invoices must
+// be signed, unexpired and for exactly the trade amount.
+func (s *Service) SetPayoutDestination(userID int64, tradeID int, destination string) (*models.Payout, error) {
+	destination, err := normalizeDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	trade, err := s.Trade(userID, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if trade.BuyerID != userID {
+		return nil, ErrNotBuyer
+	}
+	switch trade.Status {
+	case models.TradeCancelled, models.TradeRefunded:
+		return nil, ErrTradeClosed
+	case models.TradeCompleted:
+		if p, err := s.database.GetTradePayout(tradeID); err == nil && p.Status != models.PayoutCancelled {
+			return nil, ErrPayoutExists
+		} else if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	if !lnurl.IsDestination(destination) {
+		amountSats, err := s.payoutAmountSats(trade)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkInvoice(destination, amountSats); err != nil {
+			return nil, err
+		}
+	} else if trade.Status != models.TradeCompleted {
+		if _, err := s.lnurl.Resolve(destination); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnresolvable, err)
+		}
+	}
+
+	if err := s.database.SetPayoutDestination(tradeID, destination); err != nil {
+		return nil, err
+	}
+	trade.PayoutDestination = destination
+	if trade.Status != models.TradeCompleted {
+		return nil, nil
+	}
+	return s.payOut(trade)
+}
+
+// invoiceFor returns the BOLT11 invoice paying amountSats to a destination.
+// Lightning addresses and LNURLs are resolved to an invoice for the amount,
+// and invoices are checked again as they may have expired since they were
+// given.
+func (s *Service) invoiceFor(destination string, amountSats int64) (string, error) {
+	if lnurl.IsDestination(destination) {
+		var err error
+		destination, err = s.lnurl.Invoice(destination, amountSats*1000)
+		if errors.Is(err, lnurl.ErrAmountOutOfRange) {
+			return "", fmt.Errorf("%w: %v", ErrPayoutAmount, err)
+		} else if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrUnresolvable, err)
+		}
+	}
+	if err := s.checkInvoice(destination, amountSats); err != nil {
+		return "", err
+	}
+	return destination, nil
+}
+
+// payOut sends the bitcoin of a completed trade to the destination given by
+// its buyer, through a pull payment claimed in full. The payout is stored
+// before anything is claimed on BTCPay, so that trades already paid out or
+// whose offer is being refunded are never paid out.
+func (s *Service) payOut(trade *models.Trade) (*models.Payout, error) {
+	amountSats, err := s.payoutAmountSats(trade)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := s.invoiceFor(trade.PayoutDestination, amountSats)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.database.CreatePayout(models.Payout{
+		TradeID:     trade.ID,
+		UserID:      trade.BuyerID,
+		Destination: trade.PayoutDestination,
+		AmountSats:  amountSats,
+		Status:      models.PayoutInProgress,
+	})
+	if errors.Is(err, db.ErrClaimed) {
+		if p, err := s.database.GetTradePayout(trade.ID); err == nil && p.Status != models.PayoutCancelled {
+			return nil, ErrPayoutExists
+		}
+		return nil, ErrTradeClosed
+	} else if err != nil {
+		return nil, err
+	}
+	pullPaymentID, btcpayID, status, err := s.claimPayout(trade, amountSats, destination)
+	if err != nil {
+		if err := s.database.UpdatePayoutStatus(id, models.PayoutCancelled); err != nil {
+			log.Printf("Failed to cancel payout %d: %v", id, err)
+		}
+		return nil, err
+	}
+	if err := s.database.SetPayoutClaim(id, pullPaymentID, btcpayID, status); err != nil {
+		return nil, err
+	}
+	stored, err := s.database.GetPayout(id)
+	if err != nil {
+		return nil, err
+	}
+	s.recordPayout(stored)
+	return stored, nil
+}
+
+// claimPayout creates the pull payment of a trade payout on BTCPay and
+// claims it to the invoice destination. It returns the pull payment ID, the
+// BTCPay payout ID and the payout status.
+func (s *Service) claimPayout(trade *models.Trade, amountSats int64, destination string) (string, string, models.PayoutStatus, error) {
+	pullPaymentID, err := s.btcpay.CreatePullPayment(fmt.Sprintf("Trade #%d", trade.ID), amountSats, s.autoApprovePayouts)
+	if err != nil {
+		return "", "", "", fmt.Errorf("%w: %v", ErrPayout, err)
+	}
+	claim, err := s.btcpay.CreatePayout(pullPaymentID, destination)
+	if err != nil {
+		if err := s.btcpay.ArchivePullPayment(pullPaymentID); err != nil {
+			log.Printf("Failed to archive pull payment %s: %v", pullPaymentID, err)
+		}
+		var apiErr *btcpay.APIError
+		if errors.As(err, &apiErr) && apiErr.Rejected() {
+			return "", "", "", fmt.Errorf("%w: %v", ErrInvalidDestination, err)
+		}
+		return "", "", "", fmt.Errorf("%w: %v", ErrPayout, err)
+	}
+	return pullPaymentID, claim.ID, payoutStatus(claim.State), nil
+}
+
+// useLightningAddress makes the Lightning address registered by the buyer
+// of a trade its payout destination, unless the buyer gave one for the trade
+func (s *Service) useLightningAddress(trade *models.Trade) {
+	if trade.PayoutDestination != "" {
+		return
+	}
+	address, err := s.LightningAddress(trade.BuyerID)
+	if err != nil || address == "" {
+		return
+	}
+	if err := s.database.SetPayoutDestination(trade.ID, address); err != nil {
+		log.Printf("Failed to set payout destination of trade %d: %v", trade.ID, err)
+		return
+	}
+	trade.PayoutDestination = address
+}
+
+// payOutCompleted pays out a trade that just completed if its buyer already
+// gave a destination
+func (s *Service) payOutCompleted(tradeID int) {
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	trade, err := s.database.GetTrade(tradeID)
+	if err != nil {
+		log.Printf("Failed to fetch trade %d: %v", tradeID, err)
+		return
+	}
+	if trade.PayoutDestination == "" {
+		return
+	}
+	if _, err := s.database.GetTradePayout(tradeID); !errors.Is(err, db.ErrNotFound) {
+		return
+	}
+	payout, err := s.payOut(trade)
+	if err != nil {
+		log.Printf("Failed to pay out trade %d: %v", trade.ID, err)
+		if err := s.database.SetPayoutDestination(trade.ID, ""); err != nil {
+			log.Printf("Failed to clear payout destination of trade %d: %v", trade.ID, err)
+		}
+		s.Notify(trade.BuyerID, func(l *i18n.Locale) Message { return PayoutFailedMessage(l, trade) })
+		return
+	}
+	s.Notify(trade.BuyerID, func(l *i18n.Locale) Message { return PayoutMessage(l, payout) })
+}
+
+// Payouts returns the payouts a user receives, refreshing the status of
+// those still in progress
+func (s *Service) Payouts(userID int64) ([]models.Payout, error) {
+	payouts, err := s.database.GetUserPayouts(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payouts {
+		if payouts[i].BTCPayID != "" && !payouts[i].Status.Closed() {
+			s.refreshPayout(&payouts[i], false)
+		}
+	}
+	return payouts, nil
+}
+
+// HandlePayoutEvent applies a BTCPay webhook event to the payout, refund or
+// referral payout it is about and notifies the recipient of changes. Events
+// for unknown payouts are ignored.
+func (s *Service) HandlePayoutEvent(event *btcpay.WebhookEvent) error {
+	payout, err := s.database.GetPayoutByBTCPayID(event.PayoutID)
+	if errors.Is(err, db.ErrNotFound) {
+		return s.handleRefundEvent(event)
+	} else if err != nil {
+		return err
+	}
+	if payout.Status.Closed() {
+		return nil
+	}
+	return s.refreshPayout(payout, true)
+}
+
+// refreshPayout updates a payout to its state on BTCPay Server, telling the
+// recipient about changes when notify is set
+func (s *Service) refreshPayout(p *models.Payout, notify bool) error {
+	claim, err := s.btcpay.GetPayout(p.BTCPayID)
+	if err != nil {
+		log.Printf("Failed to check payout %d: %v", p.ID, err)
+		return err
+	}
+	status := payoutStatus(claim.State)
+	if status == p.Status {
+		return nil
+	}
+	if err := s.database.UpdatePayoutStatus(p.ID, status); err != nil {
+		return err
+	}
+	p.Status = status
+	s.recordPayout(p)
+	if notify {
+		payout := *p
+		s.Notify(p.UserID, func(l *i18n.Locale) Message { return PayoutMessage(l, &payout) })
+	}
+	return nil
+}
+
+// payoutStatus maps a BTCPay payout state to a payout status
+func payoutStatus(state string) models.PayoutStatus {
+	switch state {
+	case btcpay.PayoutAwaitingApproval:
+		return models.PayoutAwaitingApproval
+	case btcpay.PayoutCompleted:
+		return models.PayoutCompleted
+	case btcpay.PayoutCancelled:
+		return models.PayoutCancelled
+	default:
+		return models.PayoutInProgress
+	}
+}
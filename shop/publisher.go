@@ -0,0 +1,221 @@
+package shop
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Listing is an offer as announced on public channels
+type Listing struct {
+	Offer  models.Offer
+	Seller SellerOffers
+	// Available reports whether the offer can still be taken
+	Available bool
+	// Platform fee a buyer taking the offer pays
+	BuyerFeeSats int64
+}
+
+// Publisher announces offers outside the bot, e.g. on a public channel. It
+// is called when an offer is created and whenever it changes, and keeps its
+// announcement in line with the listing.
+type Publisher interface {
+	Publish(listing Listing) error
+}
+
+// ExternalOrder is a read-only order published by another marketplace
+type ExternalOrder struct {
+	ID         string
+	Type       string  // "sell" or "buy"
+	AmountBTC  float64 // 0 when the amount follows the market price
+	FiatAmount float64
+	Currency   string
+	Platform   string // Marketplace the order was published on
+	Author     string
+	CreatedAt  time.Time
+}
+
+// OrderSource provides orders published outside the shop
+type OrderSource interface {
+	ExternalOrders() []ExternalOrder
+}
+
+// publishQueue holds the listings waiting to be published, only the latest
+// one per offer, so that slow publishers such as unreachable relays delay
+// announcements without holding up offer and trade operations
+type publishQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[int]Listing
+	order   []int // Offer IDs of pending, oldest first
+	busy    bool  // Whether a listing is being published
+	started bool
+}
+
+func newPublishQueue() *publishQueue {
+	q := &publishQueue{pending: make(map[int]Listing)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues a listing, replacing the one of the same offer still waiting
+func (q *publishQueue) push(listing Listing) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[listing.Offer.ID]; !ok {
+		q.order = append(q.order, listing.Offer.ID)
+	}
+	q.pending[listing.Offer.ID] = listing
+	q.cond.Broadcast()
+}
+
+// pop waits for the next listing to publish
+func (q *publishQueue) pop() Listing {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.busy = false
+	for len(q.order) == 0 {
+		q.cond.Broadcast()
+		q.cond.Wait()
+	}
+	id := q.order[0]
+	q.order = q.order[1:]
+	listing := q.pending[id]
+	delete(q.pending, id)
+	q.busy = true
+	return listing
+}
+
+// wait blocks until every queued listing is published
+func (q *publishQueue) wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.order) > 0 || q.busy {
+		q.cond.Wait()
+	}
+}
+
+// AddPublisher registers a publisher notified of every offer change.
+// Listings are published in the background, one at a time.
+func (s *Service) AddPublisher(p Publisher) {
+	s.mu.Lock()
+	s.publishers = append(s.publishers, p)
+	s.mu.Unlock()
+
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+	if !s.queue.started {
+		s.queue.started = true
+		go s.runPublishers()
+	}
+}
+
+// WaitPublished blocks until the listings of every offer change so far have
+// been handed to the publishers
+func (s *Service) WaitPublished() {
+	s.queue.wait()
+}
+
+// runPublishers hands queued listings to every publisher
+func (s *Service) runPublishers() {
+	for {
+		listing := s.queue.pop()
+		s.mu.RLock()
+		publishers := s.publishers
+		s.mu.RUnlock()
+		for _, p := range publishers {
+			if err := p.Publish(listing); err != nil {
+				log.Printf("Failed to publish offer %d: %v", listing.Offer.ID, err)
+			}
+		}
+	}
+}
+
+// AddOrderSource registers a source of external orders shown alongside the
+// marketplace
+func (s *Service) AddOrderSource(src OrderSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = append(s.sources, src)
+}
+
+// ExternalOrders returns the latest limit orders of every source, newest first
+func (s *Service) ExternalOrders(limit int) []ExternalOrder {
+	s.mu.RLock()
+	sources := s.sources
+	s.mu.RUnlock()
+
+	var orders []ExternalOrder
+	for _, src := range sources {
+		orders = append(orders, src.ExternalOrders()...)
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+	if len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders
+}
+
+// TrackChannelPost records the post announcing an offer on a channel
+func (s *Service) TrackChannelPost(frontend, chatID, messageID string, offerID int) error {
+	return s.database.TrackMessage(models.SentMessage{
+		Frontend:  frontend,
+		ChatID:    chatID,
+		MessageID: messageID,
+		Kind:      models.MessageChannelPost,
+		OfferID:   offerID,
+	})
+}
+
+// ChannelPost returns the ID of the post announcing an offer on a channel,
+// or an empty ID if the offer was never posted there
+func (s *Service) ChannelPost(frontend, chatID string, offerID int) (string, error) {
+	messages, err := s.database.GetOfferMessages(offerID)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range messages {
+		if m.Kind == models.MessageChannelPost && m.Frontend == frontend && m.ChatID == chatID {
+			return m.MessageID, nil
+		}
+	}
+	return "", nil
+}
+
+// ForgetChannelPost stops tracking a channel post
+func (s *Service) ForgetChannelPost(frontend, chatID, messageID string) error {
+	return s.database.ForgetMessage(frontend, chatID, messageID)
+}
+
+// publish queues the current listing of an offer for every publisher
+func (s *Service) publish(o *models.Offer) {
+	s.mu.RLock()
+	publishers := s.publishers
+	s.mu.RUnlock()
+	if len(publishers) == 0 {
+		return
+	}
+	s.queue.push(s.listing(o))
+}
+
+// listing builds the public listing of an offer. Offers of banned sellers are
+// not available.
+func (s *Service) listing(o *models.Offer) Listing {
+	listing := Listing{
+		Offer:        *o,
+		Seller:       s.Seller(*o),
+		Available:    s.takeable(o),
+		BuyerFeeSats: s.QuoteFee(o.AmountBTC).TakerSats,
+	}
+	if listing.Available {
+		if banned, err := s.database.IsBanned(o.UserID); err != nil || banned {
+			listing.Available = false
+		}
+	}
+	return listing
+}
@@ -0,0 +1,56 @@
+package shop
+
+import (
+	"errors"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Bounds of the score of a rating
+const (
+	MinScore = 1
+	MaxScore = 5
+)
+
+// Errors returned when rating a trade
+var (
+	ErrInvalidScore = errors.New("score must be between 1 and 5")
+	ErrNotCompleted = errors.New("trade is not completed")
+	ErrRated        = errors.New("trade is already rated")
+)
+
+// RateTrade has a participant of a completed trade rate their counterparty,
+// once per trade. The counterparty is notified of the score.
+func (s *Service) RateTrade(userID int64, tradeID int, score int) (*models.Trade, error) {
+	if score < MinScore || score > MaxScore {
+		return nil, ErrInvalidScore
+	}
+	trade, err := s.Trade(userID, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	if trade.Status != models.TradeCompleted {
+		return trade, ErrNotCompleted
+	}
+	rated := trade.SellerID
+	if userID == trade.SellerID {
+		rated = trade.BuyerID
+	}
+	err = s.database.CreateRating(models.Rating{TradeID: tradeID, RaterID: userID, RatedID: rated, Score: score})
+	if errors.Is(err, db.ErrDuplicate) {
+		return trade, ErrRated
+	} else if err != nil {
+		return trade, err
+	}
+
+	s.Notify(rated, func(l *i18n.Locale) Message { return RatingReceivedMessage(l, tradeID, score) })
+	return trade, nil
+}
+
+// Rating returns the average score a user received and how many ratings it
+// is based on
+func (s *Service) Rating(userID int64) (float64, int, error) {
+	return s.database.GetUserRating(userID)
+}
@@ -0,0 +1,276 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by referral operations
+var (
+	ErrNoReferralEarnings   = errors.New("not enough referral earnings to pay out")
+	ErrNoLightningAddress   = errors.New("user has no Lightning address")
+	ErrReferralPayoutExists = errors.New("referral earnings are already being paid out")
+)
+
+// ReferralProgram rewards users who invite others to the shop: they are
+// credited SharePercent of the platform fees their referred users pay, and
+// can have their credits paid out once they reach MinPayoutSats.
+type ReferralProgram struct {
+	SharePercent  int
+	MinPayoutSats int64
+}
+
+// ReferralSummary shows a user their invite code and referral earnings
+type ReferralSummary struct {
+	Code string
+	models.ReferralEarnings
+	SharePercent  int
+	MinPayoutSats int64
+}
+
+// CanPayOut reports whether the available earnings can be paid out
+func (r *ReferralSummary) CanPayOut() bool {
+	return r.AvailableSats > 0 && r.AvailableSats >= r.MinPayoutSats
+}
+
+// SetReferralProgram sets the rewards of the referral program
+func (s *Service) SetReferralProgram(p ReferralProgram) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.referrals = p
+}
+
+// ReferralProgram returns the rewards of the referral program
+func (s *Service) ReferralProgram() ReferralProgram {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.referrals
+}
+
+// RegisterReferred registers a frontend identity like Register. A new user
+// records the owner of the referral code as the user who invited them;
+// unknown codes are ignored.
+func (s *Service) RegisterReferred(identity models.Identity, code string) (int64, error) {
+	var referrerID int64
+	if code = strings.TrimSpace(code); code != "" {
+		referrer, err := s.database.GetUserByReferralCode(code)
+		if err == nil {
+			referrerID = referrer.ID
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return 0, err
+		}
+	}
+	return s.register(identity, referrerID)
+}
+
+// ReferralCode returns the code of the invite link of a user, generating it
+// the first time
+func (s *Service) ReferralCode(userID int64) (string, error) {
+	u, err := s.User(userID)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; u.ReferralCode == "" && attempt < 5; attempt++ {
+		code, err := randomCode(8)
+		if err != nil {
+			return "", err
+		}
+		if err := s.database.SetReferralCode(userID, code); err != nil {
+			if !errors.Is(err, db.ErrDuplicate) {
+				return "", err
+			}
+			continue
+		}
+		u.ReferralCode = code
+	}
+	if u.ReferralCode == "" {
+		return "", fmt.Errorf("failed to generate referral code of user %d", userID)
+	}
+	return u.ReferralCode, nil
+}
+
+// Referrals returns the invite code and referral earnings of a user,
+// refreshing the payouts being sent
+func (s *Service) Referrals(userID int64) (*ReferralSummary, error) {
+	code, err := s.ReferralCode(userID)
+	if err != nil {
+		return nil, err
+	}
+	payouts, err := s.database.GetUserReferralPayouts(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payouts {
+		if !payouts[i].Status.Closed() {
+			s.refreshReferralPayout(&payouts[i], false)
+		}
+	}
+	earnings, err := s.database.GetReferralEarnings(userID)
+	if err != nil {
+		return nil, err
+	}
+	program := s.ReferralProgram()
+	return &ReferralSummary{
+		Code:             code,
+		ReferralEarnings: *earnings,
+		SharePercent:     program.SharePercent,
+		MinPayoutSats:    program.MinPayoutSats,
+	}, nil
+}
+
+// creditReferrers credits the users who invited the seller and the buyer of
+// a completed trade with their share of the fee each of them paid
+func (s *Service) creditReferrers(trade *models.Trade) {
+	share := s.ReferralProgram().SharePercent
+	if share <= 0 {
+		return
+	}
+	for _, party := range []struct {
+		userID  int64
+		feeSats int64
+	}{{trade.SellerID, trade.MakerFeeSats}, {trade.BuyerID, trade.TakerFeeSats}} {
+		amountSats := party.feeSats * int64(min(share, 100)) / 100
+		if amountSats <= 0 {
+			continue
+		}
+		u, err := s.database.GetUser(party.userID)
+		if err != nil {
+			log.Printf("Failed to fetch user %d: %v", party.userID, err)
+			continue
+		}
+		if u.ReferrerID == 0 {
+			continue
+		}
+		credit := models.ReferralCredit{
+			ReferrerID: u.ReferrerID,
+			ReferredID: u.ID,
+			TradeID:    trade.ID,
+			FeeSats:    party.feeSats,
+			AmountSats: amountSats,
+		}
+		if err := s.database.AddReferralCredit(credit); err != nil {
+			log.Printf("Failed to credit referrer of user %d for trade %d: %v", u.ID, trade.ID, err)
+			continue
+		}
+		s.recordReferralCredit(&credit)
+		s.Notify(u.ReferrerID, func(l *i18n.Locale) Message { return ReferralCreditMessage(l, &credit) })
+	}
+}
+
+// RequestReferralPayout pays the available referral earnings of a user out to
+// their Lightning address, through a pull payment claimed in full
+func (s *Service) RequestReferralPayout(userID int64) (*models.ReferralPayout, error) {
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	earnings, err := s.database.GetReferralEarnings(userID)
+	if err != nil {
+		return nil, err
+	}
+	if earnings.PendingSats > 0 {
+		return nil, ErrReferralPayoutExists
+	}
+	amountSats := earnings.AvailableSats
+	if amountSats <= 0 || amountSats < s.ReferralProgram().MinPayoutSats {
+		return nil, ErrNoReferralEarnings
+	}
+	address, err := s.LightningAddress(userID)
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		return nil, ErrNoLightningAddress
+	}
+	destination, err := s.invoiceFor(address, amountSats)
+	if err != nil {
+		return nil, err
+	}
+
+	pullPaymentID, err := s.btcpay.CreatePullPayment(fmt.Sprintf("Referral earnings of user %d", userID), amountSats, s.autoApprovePayouts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPayout, err)
+	}
+	claim, err := s.btcpay.CreatePayout(pullPaymentID, destination)
+	if err != nil {
+		if err := s.btcpay.ArchivePullPayment(pullPaymentID); err != nil {
+			log.Printf("Failed to archive pull payment %s: %v", pullPaymentID, err)
+		}
+		var apiErr *btcpay.APIError
+		if errors.As(err, &apiErr) && apiErr.Rejected() {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDestination, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrPayout, err)
+	}
+
+	id, err := s.database.CreateReferralPayout(models.ReferralPayout{
+		UserID:        userID,
+		Destination:   address,
+		AmountSats:    amountSats,
+		PullPaymentID: pullPaymentID,
+		BTCPayID:      claim.ID,
+		Status:        payoutStatus(claim.State),
+	})
+	if err != nil {
+		if err := s.btcpay.ArchivePullPayment(pullPaymentID); err != nil {
+			log.Printf("Failed to archive pull payment %s: %v", pullPaymentID, err)
+		}
+		if errors.Is(err, db.ErrClaimed) {
+			return nil, ErrReferralPayoutExists
+		}
+		return nil, err
+	}
+	p, err := s.database.GetReferralPayout(id)
+	if err != nil {
+		return nil, err
+	}
+	s.recordReferralPayout(p)
+	return p, nil
+}
+
+// handleReferralPayoutEvent applies a BTCPay payout webhook event to the
+// referral payout it claims. Other payouts may send seller bonds.
+func (s *Service) handleReferralPayoutEvent(event *btcpay.WebhookEvent) error {
+	p, err := s.database.GetReferralPayoutByBTCPayID(event.PayoutID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return s.handleBondPayoutEvent(event)
+		}
+		return err
+	}
+	if p.Status.Closed() {
+		return nil
+	}
+	return s.refreshReferralPayout(p, true)
+}
+
+// refreshReferralPayout updates a referral payout to its state on BTCPay
+// Server, telling the referrer about changes when notify is set. The credits
+// of a cancelled payout can be paid out again.
+func (s *Service) refreshReferralPayout(p *models.ReferralPayout, notify bool) error {
+	claim, err := s.btcpay.GetPayout(p.BTCPayID)
+	if err != nil {
+		log.Printf("Failed to check referral payout %d: %v", p.ID, err)
+		return err
+	}
+	status := payoutStatus(claim.State)
+	if status == p.Status {
+		return nil
+	}
+	if err := s.database.UpdateReferralPayoutStatus(p.ID, status); err != nil {
+		return err
+	}
+	p.Status = status
+	s.recordReferralPayout(p)
+	if notify {
+		payout := *p
+		s.Notify(p.UserID, func(l *i18n.Locale) Message { return ReferralPayoutMessage(l, &payout) })
+	}
+	return nil
+}
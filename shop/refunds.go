@@ -0,0 +1,308 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by refund operations
+var (
+	ErrRefundNotFound = errors.New("refund not found")
+	ErrRefundExists   = errors.New("refund is already being sent")
+	ErrRefund         = errors.New("failed to create refund")
+)
+
+// refundPaidOffer opens the refund of an offer cancelled after invoiceID was
+// paid, or after any of its invoices was paid if invoiceID is empty. The
+// payer is refunded to their Lightning address if they registered one, and
+// asked where to send the refund otherwise. The platform fee paid with the
+// invoice is refunded too. Offers already paid out or refunded are left
+// alone.
+func (s *Service) refundPaidOffer(offer *models.Offer, trade *models.Trade, invoiceID string) {
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	if invoiceID == "" {
+		invoiceID = s.paidInvoice(offer)
+		if invoiceID == "" {
+			log.Printf("No paid invoice to refund for offer %d", offer.ID)
+			return
+		}
+	}
+	refund := models.Refund{
+		OfferID:    offer.ID,
+		UserID:     offer.UserID,
+		InvoiceID:  invoiceID,
+		AmountSats: btcToSats(offer.AmountBTC) + offer.MakerFeeSats,
+		Status:     models.RefundAwaitingDestination,
+	}
+	if trade != nil {
+		refund.TradeID = trade.ID
+	}
+	s.openRefund(offer, refund)
+}
+
+// refundDuplicatePayment opens the refund of invoiceID, paid after the offer
+// was already paid through another of its invoices
+func (s *Service) refundDuplicatePayment(offer *models.Offer, invoiceID string) {
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	log.Printf("Offer %d was paid again through invoice %s", offer.ID, invoiceID)
+	s.openRefund(offer, models.Refund{
+		OfferID:    offer.ID,
+		UserID:     offer.UserID,
+		InvoiceID:  invoiceID,
+		AmountSats: btcToSats(offer.AmountBTC) + offer.MakerFeeSats,
+		Status:     models.RefundAwaitingDestination,
+		Duplicate:  true,
+	})
+}
+
+// openRefund records a refund, releases the payment it returns from escrow
+// or records the duplicate payment it returns, and sends it to the Lightning
+// address of the payer, or asks them where to send it. The caller holds
+// s.tradeMu.
+func (s *Service) openRefund(offer *models.Offer, refund models.Refund) {
+	id, err := s.database.CreateRefund(refund)
+	if errors.Is(err, db.ErrClaimed) {
+		log.Printf("Not refunding invoice %s of offer %d: %v", refund.InvoiceID, offer.ID, err)
+		return
+	} else if err != nil {
+		log.Printf("Failed to create refund of offer %d: %v", offer.ID, err)
+		return
+	}
+	r, err := s.database.GetRefund(id)
+	if err != nil {
+		log.Printf("Failed to fetch refund %d: %v", id, err)
+		return
+	}
+	if r.Duplicate {
+		s.recordDuplicatePayment(r)
+	} else {
+		s.releaseEscrow(offer, r)
+	}
+
+	if address, err := s.LightningAddress(offer.UserID); err == nil && address != "" {
+		err := s.claimRefund(r, address)
+		if err == nil {
+			refund := *r
+			s.Notify(r.UserID, func(l *i18n.Locale) Message { return RefundMessage(l, &refund) })
+			return
+		}
+		log.Printf("Failed to refund offer %d to %s: %v", offer.ID, address, err)
+	}
+	refund = *r
+	s.Notify(r.UserID, func(l *i18n.Locale) Message { return RefundRequestMessage(l, &refund) })
+}
+
+// paidInvoice returns the ID of the invoice whose payment the ledger holds
+// for an offer, else of a paid invoice of the offer, newest first, or an
+// empty string
+func (s *Service) paidInvoice(offer *models.Offer) string {
+	invoices, err := s.database.GetOfferInvoices(offer.ID)
+	if err != nil {
+		log.Printf("Failed to fetch invoices of offer %d: %v", offer.ID, err)
+		return ""
+	}
+	for i := len(invoices) - 1; i >= 0; i-- {
+		held, err := s.database.HasLedgerEntry("invoice:" + invoices[i].InvoiceID)
+		if err != nil {
+			log.Printf("Failed to check payment of invoice %s: %v", invoices[i].InvoiceID, err)
+		} else if held {
+			return invoices[i].InvoiceID
+		}
+	}
+	for i := len(invoices) - 1; i >= 0; i-- {
+		invoice, err := s.btcpay.GetInvoice(invoices[i].InvoiceID)
+		if err != nil {
+			log.Printf("Failed to fetch invoice %s: %v", invoices[i].InvoiceID, err)
+			continue
+		}
+		if invoice.IsPaid() {
+			return invoice.ID
+		}
+	}
+	return ""
+}
+
+// duplicatePayment reports whether invoiceID of an offer was paid on top of
+// another of its invoices, whose payment the ledger already holds
+func (s *Service) duplicatePayment(offer *models.Offer, invoiceID string) (bool, error) {
+	if held, err := s.database.HasLedgerEntry("invoice:" + invoiceID); err != nil || held {
+		return false, err
+	}
+	invoices, err := s.database.GetOfferInvoices(offer.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, invoice := range invoices {
+		if invoice.InvoiceID == invoiceID {
+			continue
+		}
+		if held, err := s.database.HasLedgerEntry("invoice:" + invoice.InvoiceID); err != nil || held {
+			return held, err
+		}
+	}
+	return false, nil
+}
+
+// Refunds returns the refunds a user receives, refreshing the status of
+// those being paid
+func (s *Service) Refunds(userID int64) ([]models.Refund, error) {
+	refunds, err := s.database.GetUserRefunds(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range refunds {
+		if refunds[i].BTCPayID != "" && refunds[i].Status != models.RefundCompleted {
+			s.refreshRefund(&refunds[i], false)
+		}
+	}
+	return refunds, nil
+}
+
+// SetRefundDestination sends the refund of an offer to a destination given
+// by its payer, starting with a refund awaiting one. Lightning addresses and
+// LNURLs must resolve to an LNURL-pay service; invoices must be signed,
+// unexpired and for exactly the refunded amount.
+func (s *Service) SetRefundDestination(userID int64, offerID int, destination string) (*models.Refund, error) {
+	destination, err := normalizeDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	r, err := s.database.GetClaimableOfferRefund(offerID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrRefundNotFound
+		}
+		return nil, err
+	}
+	if r.UserID != userID {
+		return nil, ErrNotOwner
+	}
+	if r.Status != models.RefundAwaitingDestination {
+		return nil, ErrRefundExists
+	}
+	if !lnurl.IsDestination(destination) {
+		if err := s.checkInvoice(destination, r.AmountSats); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.claimRefund(r, destination); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// claimRefund asks BTCPay to refund the invoice of a refund, unless it
+// already did, and claims the resulting pull payment to destination
+func (s *Service) claimRefund(r *models.Refund, destination string) error {
+	invoice, err := s.invoiceFor(destination, r.AmountSats)
+	if err != nil {
+		return err
+	}
+	if r.PullPaymentID == "" {
+		pullPaymentID, err := s.btcpay.RefundInvoice(r.InvoiceID, fmt.Sprintf("Refund of offer #%d", r.OfferID))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRefund, err)
+		}
+		if err := s.database.SetRefundPullPayment(r.ID, pullPaymentID); err != nil {
+			return err
+		}
+		r.PullPaymentID = pullPaymentID
+	}
+
+	claim, err := s.btcpay.CreatePayout(r.PullPaymentID, invoice)
+	if err != nil {
+		var apiErr *btcpay.APIError
+		if errors.As(err, &apiErr) && apiErr.Rejected() {
+			return fmt.Errorf("%w: %v", ErrInvalidDestination, err)
+		}
+		return fmt.Errorf("%w: %v", ErrRefund, err)
+	}
+	status := refundStatus(claim.State)
+	if err := s.database.SetRefundClaim(r.ID, destination, claim.ID, status); err != nil {
+		return err
+	}
+	r.Destination, r.BTCPayID, r.Status = destination, claim.ID, status
+	s.recordRefund(r)
+	return nil
+}
+
+// handleRefundEvent applies a BTCPay payout webhook event to the refund the
+// payout claims. Events for other payouts go to the referral payouts.
+func (s *Service) handleRefundEvent(event *btcpay.WebhookEvent) error {
+	r, err := s.database.GetRefundByBTCPayID(event.PayoutID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return s.handleReferralPayoutEvent(event)
+		}
+		return err
+	}
+	if r.Status == models.RefundCompleted {
+		return nil
+	}
+	return s.refreshRefund(r, true)
+}
+
+// refreshRefund updates a refund to the state of its payout on BTCPay
+// Server, telling the payer about changes when notify is set. Refunds whose
+// payout was cancelled wait for another destination.
+func (s *Service) refreshRefund(r *models.Refund, notify bool) error {
+	claim, err := s.btcpay.GetPayout(r.BTCPayID)
+	if err != nil {
+		log.Printf("Failed to check refund %d: %v", r.ID, err)
+		return err
+	}
+	status := refundStatus(claim.State)
+	if status == r.Status {
+		return nil
+	}
+	if status == models.RefundAwaitingDestination {
+		err = s.database.SetRefundClaim(r.ID, "", "", status)
+		r.Destination, r.BTCPayID = "", ""
+	} else {
+		err = s.database.UpdateRefundStatus(r.ID, status)
+	}
+	if err != nil {
+		return err
+	}
+	r.Status = status
+	s.recordRefund(r)
+	if notify {
+		refund := *r
+		if status == models.RefundAwaitingDestination {
+			s.Notify(r.UserID, func(l *i18n.Locale) Message { return RefundFailedMessage(l, &refund) })
+		} else {
+			s.Notify(r.UserID, func(l *i18n.Locale) Message { return RefundMessage(l, &refund) })
+		}
+	}
+	return nil
+}
+
+// refundStatus maps the state of the payout claiming a refund to a refund
+// status. Cancelled payouts leave the refund waiting for a destination.
+func refundStatus(state string) models.RefundStatus {
+	switch state {
+	case btcpay.PayoutAwaitingApproval:
+		return models.RefundAwaitingApproval
+	case btcpay.PayoutCompleted:
+		return models.RefundCompleted
+	case btcpay.PayoutCancelled:
+		return models.RefundAwaitingDestination
+	default:
+		return models.RefundInProgress
+	}
+}
@@ -0,0 +1,459 @@
+// Package shop implements the marketplace business logic shared by all
+// messaging frontends.
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/fees"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by Service operations
+var (
+	ErrNotRegistered = errors.New("user is not registered")
+	ErrOfferNotFound = errors.New("offer not found")
+	ErrNotOwner      = errors.New("user does not own the offer")
+	ErrNotPaid       = errors.New("offer is not in the paid status")
+	ErrNotTaken      = errors.New("offer has no open trade")
+	ErrNotPending    = errors.New("offer is not pending")
+	ErrInvoice       = errors.New("failed to create Lightning invoice")
+	ErrPaymentMethod = errors.New("unknown payment method")
+)
+
+// SellerOffers groups the marketplace offers of a single seller
+type SellerOffers struct {
+	UserID int64
+	Name   string // Nickname of the seller
+	Offers []models.Offer
+	Bonded bool // Whether the seller posted a bond
+	// Platform fee buyers pay taking each offer, by offer ID
+	BuyerFees map[int]int64
+}
+
+// Service implements the shop operations on top of the database and BTCPay
+type Service struct {
+	database *db.Database
+	btcpay   *btcpay.Client
+
+	mu         sync.RWMutex
+	frontends  map[string]Frontend
+	publishers []Publisher
+	queue      *publishQueue
+	sources    []OrderSource
+	admins     map[int64]bool
+
+	limits     Limits
+	rateLimits RateLimits
+	fees       fees.Schedule
+	referrals  ReferralProgram
+	bonds      Bonds
+
+	autoApprovePayouts bool
+	lnurl              *lnurl.Client
+	network            bolt11.Network
+	confirmations      int
+
+	tradeMu sync.Mutex
+}
+
+// NewService creates a new Service
+func NewService(database *db.Database, btcpayClient *btcpay.Client) *Service {
+	return &Service{
+		database:  database,
+		btcpay:    btcpayClient,
+		frontends: make(map[string]Frontend),
+		queue:     newPublishQueue(),
+
+		autoApprovePayouts: true,
+		lnurl:              lnurl.NewClient(nil),
+		network:            bolt11.Mainnet,
+		confirmations:      1,
+	}
+}
+
+// Database returns the underlying database
+func (s *Service) Database() *db.Database {
+	return s.database
+}
+
+// CreateOffer creates a Bitcoin selling offer backed by an invoice payable
+// with method. The invoice includes the share of the platform fee paid by
+// the seller. The amount must fit the limits of the seller's tier.
+func (s *Service) CreateOffer(userID int64, amountBTC, priceUSD float64, method models.PaymentMethod) (*models.Offer, error) {
+	if !method.Valid() {
+		return nil, ErrPaymentMethod
+	}
+	// Verify user exists
+	exists, err := s.database.UserExists(userID)
+	if err != nil || !exists {
+		return nil, ErrNotRegistered
+	}
+	if err := s.checkLimits(userID); err != nil {
+		return nil, err
+	}
+	if err := s.checkTradeLimits(userID, btcToSats(amountBTC)); err != nil {
+		return nil, err
+	}
+	if err := s.throttle(s.RateLimits().Invoice, userID); err != nil {
+		return nil, err
+	}
+
+	makerFeeSats := s.QuoteFee(amountBTC).MakerSats
+	invoiceID, invoiceLink, err := s.createInvoice(userID, btcToSats(amountBTC)+makerFeeSats, method)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store offer
+	confirmations := 0
+	if method.OnChain() {
+		confirmations = s.Confirmations()
+	}
+	offerID, err := s.database.CreateOffer(userID, amountBTC, priceUSD, method, confirmations, makerFeeSats, invoiceID, invoiceLink)
+	if err != nil {
+		return nil, err
+	}
+	offer, err := s.database.GetOffer(offerID)
+	if err != nil {
+		return nil, err
+	}
+	s.fetchPaymentDetails(offer)
+	s.publish(offer)
+	return offer, nil
+}
+
+// createInvoice creates the BTCPay Server invoice of amountSats funding an
+// offer
+func (s *Service) createInvoice(userID int64, amountSats int64, method models.PaymentMethod) (string, string, error) {
+	invoiceID, invoiceLink, err := s.btcpay.CreateInvoice(amountSats, fmt.Sprintf("BTC sell offer by %d", userID), paymentMethods(method)...)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrInvoice, err)
+	}
+	return invoiceID, invoiceLink, nil
+}
+
+// ListOffers returns all offers of a user, marking pending offers whose
+// invoice has been settled as paid. As this queries BTCPay, it is rate
+// limited.
+func (s *Service) ListOffers(userID int64) ([]models.Offer, error) {
+	if err := s.throttle(s.RateLimits().List, userID); err != nil {
+		return nil, err
+	}
+
+	offers, err := s.database.GetUserOffers(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range offers {
+		if offers[i].Status == models.StatusPending {
+			s.refreshOfferStatus(&offers[i])
+		}
+		// Retry fetching payment details that could not be fetched at creation
+		if offers[i].Status == models.StatusPending && missingPaymentDetails(offers[i]) {
+			s.fetchPaymentDetails(&offers[i])
+		}
+	}
+	return offers, nil
+}
+
+// refreshOfferStatus marks a pending offer as paid once its invoice is
+// settled, or once its on-chain payment has the confirmations it requires
+func (s *Service) refreshOfferStatus(o *models.Offer) {
+	invoice, err := s.btcpay.GetInvoice(o.InvoiceID)
+	if err != nil {
+		log.Printf("Failed to check invoice status for offer %d: %v", o.ID, err)
+		return
+	}
+	changed := o.PaymentMethod.OnChain() && s.refreshConfirmations(o)
+	if !invoicePaid(o, invoice) {
+		if changed {
+			s.offerChanged(o)
+		}
+		return
+	}
+	if err := s.markPaid(o, o.InvoiceID); err != nil {
+		log.Printf("Failed to update offer status: %v", err)
+	}
+}
+
+// markPaid moves a pending offer paid through invoiceID to the paid status.
+// Offers cancelled in the meantime are refunded instead.
+func (s *Service) markPaid(o *models.Offer, invoiceID string) error {
+	if err := s.database.UpdateOfferStatus(o.ID, o.Status, models.StatusPaid); err != nil {
+		if !errors.Is(err, db.ErrStale) {
+			return err
+		}
+		current, err := s.database.GetOffer(o.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status == models.StatusCancelled {
+			s.refundPaidOffer(current, nil, invoiceID)
+		}
+		return nil
+	}
+	o.Status = models.StatusPaid
+	s.holdPayment(o, invoiceID)
+	s.offerChanged(o)
+	return nil
+}
+
+// expire closes a pending offer whose invoice expired unpaid
+func (s *Service) expire(o *models.Offer) error {
+	if err := s.database.UpdateOfferStatus(o.ID, o.Status, models.StatusExpired); err != nil {
+		if errors.Is(err, db.ErrStale) {
+			return nil
+		}
+		return err
+	}
+	o.Status = models.StatusExpired
+	s.closeOpenTrade(o, models.TradeCancelled)
+	s.offerChanged(o)
+	return nil
+}
+
+// HandleInvoiceEvent applies a BTCPay webhook event to the offer backed by
+// the invoice: settled invoices mark it paid, expired or invalid ones expire
+// it. Payment events of offers payable on-chain refresh their confirmations.
+// Payments to an invoice the offer replaced, or to the invoice of an expired
+// offer, still mark it paid, while the expiry of a replaced invoice is
+// ignored. Invoices of cancelled offers settling or paid late are refunded,
+// and so are invoices paid after the offer was paid through another one.
+// Other invoices may pay seller bonds.
+func (s *Service) HandleInvoiceEvent(event *btcpay.WebhookEvent) error {
+	switch event.Type {
+	case btcpay.EventInvoiceSettled, btcpay.EventInvoiceExpired, btcpay.EventInvoiceInvalid,
+		btcpay.EventInvoiceReceivedPayment, btcpay.EventInvoicePaymentSettled, btcpay.EventInvoiceProcessing:
+	default:
+		return nil
+	}
+	offer, err := s.database.GetOfferByInvoiceID(event.InvoiceID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return s.handleBondInvoiceEvent(event)
+		}
+		return err
+	}
+	active := event.InvoiceID == offer.InvoiceID
+	if event.Type == btcpay.EventInvoiceExpired || event.Type == btcpay.EventInvoiceInvalid {
+		if !active || offer.Status != models.StatusPending {
+			return nil
+		}
+		return s.expire(offer)
+	}
+
+	if offer.Status != models.StatusPending && offer.Status != models.StatusExpired {
+		if event.Type != btcpay.EventInvoiceSettled && !s.paidLate(event.InvoiceID) {
+			return nil
+		}
+		duplicate, err := s.duplicatePayment(offer, event.InvoiceID)
+		if err != nil {
+			return err
+		}
+		if duplicate {
+			s.refundDuplicatePayment(offer, event.InvoiceID)
+		} else if offer.Status == models.StatusCancelled {
+			s.refundPaidOffer(offer, nil, event.InvoiceID)
+		}
+		return nil
+	}
+	switch {
+	case !active || offer.Status == models.StatusExpired:
+		return s.latePayment(offer, event.InvoiceID)
+	case offer.PaymentMethod.OnChain():
+		s.refreshOfferStatus(offer)
+		return nil
+	case event.Type == btcpay.EventInvoiceSettled:
+		return s.markPaid(offer, offer.InvoiceID)
+	}
+	return nil
+}
+
+// ConfirmPayment marks a paid offer that a buyer took as completed on behalf
+// of its owner, unless the trade is disputed
+func (s *Service) ConfirmPayment(userID int64, offerID int) (*models.Offer, error) {
+	offer, err := s.ownedOffer(userID, offerID)
+	if err != nil {
+		return nil, err
+	}
+	if offer.Status != models.StatusPaid {
+		return offer, ErrNotPaid
+	}
+	if !offer.Taken {
+		return offer, ErrNotTaken
+	}
+	if err := s.checkDispute(offerID); err != nil {
+		return offer, err
+	}
+
+	if err := s.database.UpdateOfferStatus(offerID, models.StatusPaid, models.StatusCompleted); err != nil {
+		if errors.Is(err, db.ErrStale) {
+			return offer, ErrNotPaid
+		}
+		return offer, err
+	}
+	offer.Status = models.StatusCompleted
+	s.closeOpenTrade(offer, models.TradeCompleted)
+	s.offerChanged(offer)
+	return offer, nil
+}
+
+// CancelOffer cancels a pending offer, or a paid offer nobody took, on
+// behalf of its owner unless its trade is disputed. Paid offers are refunded
+// to the owner.
+func (s *Service) CancelOffer(userID int64, offerID int) (*models.Offer, error) {
+	offer, err := s.ownedOffer(userID, offerID)
+	if err != nil {
+		return nil, err
+	}
+	paid := offer.Status == models.StatusPaid && !offer.Taken
+	if offer.Status != models.StatusPending && !paid {
+		return offer, ErrNotPending
+	}
+	if err := s.checkDispute(offerID); err != nil {
+		return offer, err
+	}
+
+	if err := s.database.UpdateOfferStatus(offerID, offer.Status, models.StatusCancelled); err != nil {
+		if errors.Is(err, db.ErrStale) {
+			return offer, ErrNotPending
+		}
+		return offer, err
+	}
+	offer.Status = models.StatusCancelled
+	s.recordCancel(userID)
+	s.closeOpenTrade(offer, models.TradeCancelled)
+	s.offerChanged(offer)
+	if paid {
+		s.refundPaidOffer(offer, nil, "")
+	}
+	return offer, nil
+}
+
+// Offer returns an offer by ID
+func (s *Service) Offer(offerID int) (*models.Offer, error) {
+	offer, err := s.database.GetOffer(offerID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrOfferNotFound
+		}
+		return nil, err
+	}
+	return offer, nil
+}
+
+// Offers returns the offers matching filter
+func (s *Service) Offers(filter db.OfferFilter) ([]models.Offer, error) {
+	return s.database.ListOffers(filter)
+}
+
+// User returns a registered user by ID
+func (s *Service) User(userID int64) (*models.User, error) {
+	u, err := s.database.GetUser(userID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrNotRegistered
+	}
+	return u, err
+}
+
+// Invoice returns the BTCPay invoice of an offer on behalf of its owner
+func (s *Service) Invoice(userID int64, offerID int) (*btcpay.Invoice, error) {
+	offer, err := s.ownedOffer(userID, offerID)
+	if err != nil {
+		return nil, err
+	}
+	return s.btcpay.GetInvoice(offer.InvoiceID)
+}
+
+// ownedOffer fetches an offer and checks that userID owns it
+func (s *Service) ownedOffer(userID int64, offerID int) (*models.Offer, error) {
+	offer, err := s.Offer(offerID)
+	if err != nil {
+		return nil, err
+	}
+	if offer.UserID != userID {
+		return offer, ErrNotOwner
+	}
+	return offer, nil
+}
+
+// Marketplace returns the pending offers among the latest limit offers that
+// nobody has taken yet, grouped by seller in order of their most recent
+// offer. Offers of banned sellers, and of sellers without the bond the shop
+// requires, are left out.
+func (s *Service) Marketplace(limit int) ([]SellerOffers, error) {
+	offers, err := s.database.GetAllOffers(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var sellers []SellerOffers
+	index := make(map[int64]int)
+	for _, o := range offers {
+		// Only include pending offers in the marketplace
+		if o.Status != models.StatusPending {
+			continue
+		}
+		if _, err := s.database.GetOpenTrade(o.ID); err == nil {
+			continue
+		}
+		i, ok := index[o.UserID]
+		if !ok {
+			if banned, err := s.database.IsBanned(o.UserID); err != nil || banned {
+				continue
+			}
+			if !s.listed(o.UserID) {
+				continue
+			}
+			i = len(sellers)
+			index[o.UserID] = i
+			sellers = append(sellers, s.Seller(o))
+		}
+		sellers[i].Offers = append(sellers[i].Offers, o)
+	}
+	for i := range sellers {
+		s.quoteBuyerFees(&sellers[i])
+	}
+	return sellers, nil
+}
+
+// MarketplaceOffer returns the marketplace entry of a single offer, e.g. one
+// opened from a link, if it can still be taken
+func (s *Service) MarketplaceOffer(offerID int) (SellerOffers, error) {
+	offer, err := s.Offer(offerID)
+	if err != nil {
+		return SellerOffers{}, err
+	}
+	listing := s.listing(offer)
+	if !listing.Available {
+		return SellerOffers{}, ErrNotAvailable
+	}
+	listing.Seller.Offers = []models.Offer{*offer}
+	s.quoteBuyerFees(&listing.Seller)
+	return listing.Seller, nil
+}
+
+// Seller builds the marketplace entry, without offers, of the user owning o.
+// Sellers are contacted through the shop, by nickname.
+func (s *Service) Seller(o models.Offer) SellerOffers {
+	seller := SellerOffers{UserID: o.UserID, Name: "trader"}
+	if s.Bonds().AmountSats > 0 {
+		seller.Bonded = s.bonded(o.UserID)
+	}
+	user, err := s.database.GetUser(o.UserID)
+	if err != nil {
+		log.Printf("Failed to fetch user %d: %v", o.UserID, err)
+		return seller
+	}
+	seller.Name = s.nickname(user)
+	return seller
+}
@@ -0,0 +1,1633 @@
+package shop_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/bolt11/bolt11test"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/btcpay/btcpaytest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/fees"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/lnurl/lnurltest"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/shop"
+)
+
+// recorder is a frontend that records sent messages per chat
+type recorder struct {
+	name string
+	sent map[string][]shop.Message
+}
+
+func (r *recorder) Name() string { return r.name }
+
+func (r *recorder) Send(chatID string, msg shop.Message) error {
+	r.sent[chatID] = append(r.sent[chatID], msg)
+	return nil
+}
+
+func newService(t *testing.T) (*shop.Service, *btcpaytest.Server) {
+	t.Helper()
+	pay := btcpaytest.NewServer("key", "store")
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		pay.Close()
+	})
+	return shop.NewService(database, pay.Client()), pay
+}
+
+var (
+	telegramAlice = models.Identity{Frontend: shop.FrontendTelegram, ExternalID: "1001", ChatID: "1001", Username: "alice"}
+	matrixAlice   = models.Identity{Frontend: shop.FrontendMatrix, ExternalID: "@alice:example.org", ChatID: "!dm:example.org", Username: "alice:example.org"}
+	matrixBob     = models.Identity{Frontend: shop.FrontendMatrix, ExternalID: "@bob:example.org", ChatID: "!bob:example.org", Username: "bob:example.org"}
+)
+
+func TestRegister(t *testing.T) {
+	svc, _ := newService(t)
+
+	tests := []struct {
+		identity models.Identity
+		want     int64
+	}{
+		{telegramAlice, 1001},
+		{matrixAlice, -1},
+		{matrixBob, -2},
+		{matrixAlice, -1}, // registering again keeps the user
+	}
+	for _, tt := range tests {
+		got, err := svc.Register(tt.identity)
+		if err != nil {
+			t.Fatalf("Register(%s): %v", tt.identity.ExternalID, err)
+		}
+		if got != tt.want {
+			t.Errorf("Register(%s) = %d, want %d", tt.identity.ExternalID, got, tt.want)
+		}
+	}
+
+	if _, err := svc.UserID(shop.FrontendMatrix, "@carol:example.org"); !errors.Is(err, shop.ErrNotRegistered) {
+		t.Errorf("UserID of unknown identity: err = %v, want ErrNotRegistered", err)
+	}
+}
+
+func TestLinkMergesOffers(t *testing.T) {
+	svc, _ := newService(t)
+	telegram := &recorder{name: shop.FrontendTelegram, sent: map[string][]shop.Message{}}
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(telegram)
+	svc.AddFrontend(matrix)
+
+	aliceID, _ := svc.Register(telegramAlice)
+	matrixID, _ := svc.Register(matrixAlice)
+	if _, err := svc.CreateOffer(matrixID, 0.01, 500, models.PaymentLightning); err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+
+	code, err := svc.CreateLinkCode(aliceID)
+	if err != nil {
+		t.Fatalf("CreateLinkCode: %v", err)
+	}
+	if _, err := svc.Link(matrixAlice, "WRONG"); !errors.Is(err, shop.ErrInvalidLinkCode) {
+		t.Errorf("Link with wrong code: err = %v", err)
+	}
+	linked, err := svc.Link(matrixAlice, code)
+	if err != nil || linked != aliceID {
+		t.Fatalf("Link = %d, %v, want %d", linked, err, aliceID)
+	}
+	if _, err := svc.Link(matrixAlice, code); !errors.Is(err, shop.ErrInvalidLinkCode) {
+		t.Errorf("reusing link code: err = %v", err)
+	}
+
+	if id, _ := svc.UserID(shop.FrontendMatrix, matrixAlice.ExternalID); id != aliceID {
+		t.Errorf("Matrix identity resolves to %d, want %d", id, aliceID)
+	}
+	offers, err := svc.ListOffers(aliceID)
+	if err != nil || len(offers) != 1 || offers[0].UserID != aliceID {
+		t.Errorf("offers after link = %+v, %v", offers, err)
+	}
+
+	// Both linked frontends are notified
+	for _, r := range []*recorder{telegram, matrix} {
+		chat := map[string]string{shop.FrontendTelegram: "1001", shop.FrontendMatrix: "!dm:example.org"}[r.name]
+		if msgs := r.sent[chat]; len(msgs) != 1 || !strings.Contains(msgs[0].Text, "Account linked") {
+			t.Errorf("%s notifications = %+v", r.name, msgs)
+		}
+	}
+
+	// A second Matrix identity cannot join the same account
+	code, _ = svc.CreateLinkCode(aliceID)
+	svc.Register(matrixBob)
+	if _, err := svc.Link(matrixBob, code); !errors.Is(err, shop.ErrFrontendLinked) {
+		t.Errorf("linking second Matrix identity: err = %v", err)
+	}
+}
+
+func TestNicknames(t *testing.T) {
+	svc, _ := newService(t)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+
+	// Users are known by a generated nickname until they choose one
+	generated, err := svc.Nickname(aliceID)
+	if err != nil || !strings.HasPrefix(generated, "trader_") {
+		t.Fatalf("Nickname = %q, %v", generated, err)
+	}
+	if again, _ := svc.Nickname(aliceID); again != generated {
+		t.Errorf("Nickname changed from %q to %q", generated, again)
+	}
+
+	tests := []struct {
+		nickname string
+		want     error
+	}{
+		{"al", shop.ErrInvalidNickname},
+		{"1alice", shop.ErrInvalidNickname},
+		{"alice smith", shop.ErrInvalidNickname},
+		{"alice", nil},
+		{"Alice", shop.ErrNicknameTaken}, // nicknames are case insensitive
+	}
+	for _, tt := range tests {
+		id := aliceID
+		if tt.want == shop.ErrNicknameTaken {
+			id = bobID
+		}
+		if err := svc.SetNickname(id, tt.nickname); !errors.Is(err, tt.want) {
+			t.Errorf("SetNickname(%q) = %v, want %v", tt.nickname, err, tt.want)
+		}
+	}
+
+	// The marketplace shows sellers by nickname, never by username
+	svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	svc.CreateOffer(bobID, 0.02, 900, models.PaymentLightning)
+	sellers, err := svc.Marketplace(20)
+	if err != nil || len(sellers) != 2 {
+		t.Fatalf("Marketplace = %+v, %v", sellers, err)
+	}
+	bobNickname, _ := svc.Nickname(bobID)
+	want := map[int64]string{aliceID: "alice", bobID: bobNickname}
+	for _, s := range sellers {
+		if s.Name != want[s.UserID] {
+			t.Errorf("seller %d is named %q, want %q", s.UserID, s.Name, want[s.UserID])
+		}
+	}
+}
+
+func TestContact(t *testing.T) {
+	svc, _ := newService(t)
+	telegram := &recorder{name: shop.FrontendTelegram, sent: map[string][]shop.Message{}}
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(telegram)
+	svc.AddFrontend(matrix)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+	svc.SetNickname(aliceID, "alice")
+	svc.SetNickname(bobID, "bob")
+
+	if _, err := svc.OpenContact(bobID, "carol"); !errors.Is(err, shop.ErrUserNotFound) {
+		t.Errorf("contacting unknown user: err = %v", err)
+	}
+	if _, err := svc.OpenContact(bobID, "bob"); !errors.Is(err, shop.ErrOwnContact) {
+		t.Errorf("contacting self: err = %v", err)
+	}
+	peer, err := svc.OpenContact(bobID, "@Alice")
+	if err != nil || peer.ID != aliceID {
+		t.Fatalf("OpenContact = %+v, %v", peer, err)
+	}
+
+	if _, err := svc.RelayMessage(bobID, shop.FrontendMatrix, "Is offer 1 still available?", ""); err != nil {
+		t.Fatalf("RelayMessage: %v", err)
+	}
+	msgs := telegram.sent["1001"]
+	if len(msgs) != 1 || !strings.Contains(msgs[0].Text, "*bob*") || !strings.Contains(msgs[0].Text, "still available") {
+		t.Fatalf("relayed messages = %+v", msgs)
+	}
+	if reply := msgs[0].Actions[0][0]; reply.Command != shop.ActionContact || reply.Data != "bob" {
+		t.Errorf("reply action = %+v", reply)
+	}
+	if strings.Contains(msgs[0].Text, "example.org") {
+		t.Errorf("relayed message reveals the Matrix ID: %q", msgs[0].Text)
+	}
+
+	chat, err := svc.CloseChat(bobID)
+	if err != nil || chat.Trade != nil || chat.Peer.ID != aliceID {
+		t.Errorf("CloseChat = %+v, %v", chat, err)
+	}
+	if _, err := svc.RelayMessage(bobID, shop.FrontendMatrix, "hello?", ""); !errors.Is(err, shop.ErrNotInChat) {
+		t.Errorf("relaying after leaving: err = %v", err)
+	}
+}
+
+func TestOfferOwnership(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+
+	if _, err := svc.CancelOffer(bobID, offer.ID); !errors.Is(err, shop.ErrNotOwner) {
+		t.Errorf("CancelOffer by other user: err = %v", err)
+	}
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); !errors.Is(err, shop.ErrNotPaid) {
+		t.Errorf("ConfirmPayment on pending offer: err = %v", err)
+	}
+	if _, err := svc.ConfirmPayment(aliceID, 99); !errors.Is(err, shop.ErrOfferNotFound) {
+		t.Errorf("ConfirmPayment on missing offer: err = %v", err)
+	}
+
+	// Paid offers are only confirmed once a buyer took them
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if o, err := svc.ConfirmPayment(aliceID, offer.ID); !errors.Is(err, shop.ErrNotTaken) || o.Status != models.StatusPaid {
+		t.Errorf("ConfirmPayment without a trade = %+v, %v", o, err)
+	}
+	offer, _ = svc.Offer(offer.ID)
+	if msg := shop.OfferCardMessage(i18n.Get(i18n.Default), *offer); len(msg.Actions[0]) != 2 || msg.Actions[0][1].Command != shop.ActionCancelOffer {
+		t.Errorf("card without a trade = %+v", msg.Actions)
+	}
+	if _, err := svc.TakeOffer(bobID, offer.ID); !errors.Is(err, shop.ErrNotAvailable) {
+		t.Errorf("TakeOffer on a paid offer: err = %v", err)
+	}
+
+	// Status changes only apply to offers still in the status they were read in
+	if err := svc.Database().UpdateOfferStatus(offer.ID, models.StatusPending, models.StatusCancelled); !errors.Is(err, db.ErrStale) {
+		t.Errorf("stale status change: err = %v, want ErrStale", err)
+	}
+	if o, _ := svc.Offer(offer.ID); o.Status != models.StatusPaid {
+		t.Errorf("status after stale change = %s, want paid", o.Status)
+	}
+}
+
+func TestOfferPaymentRequest(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(telegramAlice)
+	offer, err := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	inv, _ := pay.Invoice(offer.InvoiceID)
+	if offer.PaymentRequest == "" || offer.PaymentRequest != inv.PaymentRequest {
+		t.Fatalf("payment request = %q, want %q", offer.PaymentRequest, inv.PaymentRequest)
+	}
+	if stored, _ := svc.Offer(offer.ID); stored.PaymentRequest != offer.PaymentRequest {
+		t.Errorf("stored payment request = %q", stored.PaymentRequest)
+	}
+
+	// Only pending offers show their invoice
+	l := svc.Locale(aliceID, "")
+	if msg := shop.OfferCardMessage(l, *offer); msg.PaymentURI != "lightning:"+offer.PaymentRequest || !strings.Contains(msg.Text, "`"+offer.PaymentRequest+"`") {
+		t.Errorf("pending card = %+v", msg)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	offers, _ := svc.ListOffers(aliceID)
+	if msg := shop.OfferCardMessage(l, offers[0]); msg.PaymentURI != "" || strings.Contains(msg.Text, offer.PaymentRequest) {
+		t.Errorf("paid card = %+v", msg)
+	}
+}
+
+func TestOnChainPayment(t *testing.T) {
+	svc, pay := newService(t)
+	svc.SetConfirmations(2)
+	aliceID, _ := svc.Register(telegramAlice)
+
+	if _, err := svc.CreateOffer(aliceID, 0.01, 500, "paypal"); !errors.Is(err, shop.ErrPaymentMethod) {
+		t.Errorf("CreateOffer with unknown method: err = %v, want ErrPaymentMethod", err)
+	}
+	offer, err := svc.CreateOffer(aliceID, 0.5, 20000, models.PaymentOnChain)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	inv, _ := pay.Invoice(offer.InvoiceID)
+	if len(inv.PaymentMethods) != 1 || inv.PaymentMethods[0] != btcpay.PaymentMethodOnChain {
+		t.Errorf("invoice payment methods = %v", inv.PaymentMethods)
+	}
+	if offer.PaymentAddress == "" || offer.PaymentAddress != inv.Address || offer.PaymentRequest != "" {
+		t.Errorf("payment address = %q, request %q", offer.PaymentAddress, offer.PaymentRequest)
+	}
+	if offer.Confirmations != -1 || offer.ConfirmationsRequired != 2 {
+		t.Errorf("confirmations = %d/%d", offer.Confirmations, offer.ConfirmationsRequired)
+	}
+	l := svc.Locale(aliceID, "")
+	if msg := shop.OfferCardMessage(l, *offer); msg.PaymentURI != "bitcoin:"+inv.Address+"?amount=0.5" || !strings.Contains(msg.Text, inv.Address) {
+		t.Errorf("pending card = %+v", msg)
+	}
+
+	// BTCPay settling the invoice is not enough without the confirmations
+	for confirmations, want := range []models.OfferStatus{models.StatusPending, models.StatusPending, models.StatusPaid} {
+		pay.PayOnChain(offer.InvoiceID, confirmations)
+		if confirmations == 1 {
+			pay.MarkSettled(offer.InvoiceID)
+		}
+		offers, _ := svc.ListOffers(aliceID)
+		if offers[0].Status != want || offers[0].Confirmations != confirmations {
+			t.Fatalf("%d confirmations: offer = %s with %d", confirmations, offers[0].Status, offers[0].Confirmations)
+		}
+		if msg := shop.OfferCardMessage(l, offers[0]); want == models.StatusPending && !strings.Contains(msg.Text, fmt.Sprintf("%d/2 confirmations", confirmations)) {
+			t.Errorf("%d confirmations: card = %q", confirmations, msg.Text)
+		}
+	}
+
+	// Offers payable both ways are paid as soon as Lightning settles them
+	both, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentBoth)
+	inv, _ = pay.Invoice(both.InvoiceID)
+	want := "bitcoin:" + inv.Address + "?amount=0.01&lightning=" + inv.PaymentRequest
+	if msg := shop.OfferCreatedMessage(l, both); msg.PaymentURI != want {
+		t.Errorf("payment URI = %q, want %q", msg.PaymentURI, want)
+	}
+	pay.MarkSettled(both.InvoiceID)
+	if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: both.InvoiceID}); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	if o, _ := svc.Offer(both.ID); o.Status != models.StatusPaid {
+		t.Errorf("offer paid over Lightning = %s", o.Status)
+	}
+}
+
+func TestRefreshInvoice(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+	event := func(eventType, invoiceID string) {
+		t.Helper()
+		if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: eventType, InvoiceID: invoiceID}); err != nil {
+			t.Fatalf("HandleInvoiceEvent(%s): %v", eventType, err)
+		}
+	}
+
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	first := offer.InvoiceID
+	if _, err := svc.RefreshInvoice(bobID, offer.ID); !errors.Is(err, shop.ErrNotOwner) {
+		t.Errorf("RefreshInvoice by bob: err = %v, want ErrNotOwner", err)
+	}
+	refreshed, err := svc.RefreshInvoice(aliceID, offer.ID)
+	if err != nil {
+		t.Fatalf("RefreshInvoice: %v", err)
+	}
+	second := refreshed.InvoiceID
+	inv, _ := pay.Invoice(second)
+	if second == first || refreshed.Status != models.StatusPending || refreshed.PaymentRequest != inv.PaymentRequest {
+		t.Errorf("refreshed offer = %+v", refreshed)
+	}
+	if old, _ := pay.Invoice(first); old.Status != btcpaytest.StatusInvalid {
+		t.Errorf("replaced invoice = %s, want Invalid", old.Status)
+	}
+
+	// Events of the replaced invoice no longer expire the offer
+	event(btcpay.EventInvoiceInvalid, first)
+	if o, _ := svc.Offer(offer.ID); o.Status != models.StatusPending {
+		t.Errorf("offer after replaced invoice invalidated = %s", o.Status)
+	}
+
+	// Expired offers are pending again with a new invoice
+	pay.Expire(second)
+	event(btcpay.EventInvoiceExpired, second)
+	if o, _ := svc.Offer(offer.ID); o.Status != models.StatusExpired {
+		t.Fatalf("offer after invoice expired = %s", o.Status)
+	}
+	refreshed, err = svc.RefreshInvoice(aliceID, offer.ID)
+	if err != nil || refreshed.Status != models.StatusPending {
+		t.Fatalf("RefreshInvoice of expired offer = %+v, %v", refreshed, err)
+	}
+	third := refreshed.InvoiceID
+
+	invoices, err := svc.OfferInvoices(aliceID, offer.ID)
+	if err != nil || len(invoices) != 3 {
+		t.Fatalf("OfferInvoices = %+v, %v", invoices, err)
+	}
+	for i, id := range []string{first, second, third} {
+		if invoices[i].InvoiceID != id || invoices[i].Active != (id == third) {
+			t.Errorf("invoice %d = %+v", i, invoices[i])
+		}
+	}
+
+	// A late payment of a replaced invoice still pays the offer, and the
+	// active invoice is invalidated so that it is not paid twice
+	pay.MarkSettled(first)
+	if inv, _ := pay.Invoice(first); inv.Status != btcpaytest.StatusExpired || inv.Additional != btcpaytest.AdditionalStatusPaidLate {
+		t.Errorf("replaced invoice after late payment = %s/%s, want Expired/PaidLate", inv.Status, inv.Additional)
+	}
+	event(btcpay.EventInvoiceReceivedPayment, first)
+	if o, _ := svc.Offer(offer.ID); o.Status != models.StatusPaid {
+		t.Errorf("offer after late payment = %s", o.Status)
+	}
+	if inv, _ := pay.Invoice(third); inv.Status != btcpaytest.StatusInvalid {
+		t.Errorf("active invoice after late payment = %s, want Invalid", inv.Status)
+	}
+	if _, err := svc.RefreshInvoice(aliceID, offer.ID); !errors.Is(err, shop.ErrNotRefreshable) {
+		t.Errorf("RefreshInvoice of paid offer: err = %v, want ErrNotRefreshable", err)
+	}
+
+	// A paid offer never goes back to pending, even if it expired when read
+	if err := svc.Database().ReplaceOfferInvoice(offer.ID, models.StatusExpired, "stale", "https://btcpay.example/i/stale"); !errors.Is(err, db.ErrStale) {
+		t.Errorf("replacing the invoice of a paid offer: err = %v, want ErrStale", err)
+	}
+	if o, _ := svc.Offer(offer.ID); o.Status != models.StatusPaid || o.InvoiceID != third {
+		t.Errorf("offer after stale invoice replacement = %s, %s", o.Status, o.InvoiceID)
+	}
+
+	// Another invoice paid after the offer was paid is refunded on its own,
+	// once, and leaves the offer paid
+	pay.MarkSettled(second)
+	event(btcpay.EventInvoiceReceivedPayment, second)
+	event(btcpay.EventInvoiceReceivedPayment, second)
+	refunds, _ := svc.Refunds(aliceID)
+	if len(refunds) != 1 || refunds[0].InvoiceID != second || !refunds[0].Duplicate || refunds[0].AmountSats != 1_000_000 {
+		t.Fatalf("refunds after duplicate payment = %+v", refunds)
+	}
+	if o, _ := svc.Offer(offer.ID); o.Status != models.StatusPaid {
+		t.Errorf("offer after duplicate payment = %s", o.Status)
+	}
+	// The offer itself can still be cancelled and refunded
+	if _, err := svc.CancelOffer(aliceID, offer.ID); err != nil {
+		t.Fatalf("CancelOffer: %v", err)
+	}
+	if refunds, _ := svc.Refunds(aliceID); len(refunds) != 2 || refunds[0].InvoiceID != first || refunds[0].Duplicate {
+		t.Errorf("refunds after cancel = %+v", refunds)
+	}
+	if b, _ := svc.Balance(aliceID); b.AvailableSats != 2_000_000 || b.EscrowSats != 0 {
+		t.Errorf("balance after refunds = %+v", b)
+	}
+
+	// The expired invoice of an expired offer paid late still pays it
+	expired, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	pay.Expire(expired.InvoiceID)
+	event(btcpay.EventInvoiceExpired, expired.InvoiceID)
+	pay.MarkSettled(expired.InvoiceID)
+	event(btcpay.EventInvoiceReceivedPayment, expired.InvoiceID)
+	if o, _ := svc.Offer(expired.ID); o.Status != models.StatusPaid {
+		t.Errorf("expired offer after late payment = %s, want paid", o.Status)
+	}
+
+	// Offers get a limited number of invoices
+	svc.SetLimits(shop.Limits{MaxOfferInvoices: 2})
+	capped, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if _, err := svc.RefreshInvoice(aliceID, capped.ID); err != nil {
+		t.Fatalf("RefreshInvoice: %v", err)
+	}
+	if _, err := svc.RefreshInvoice(aliceID, capped.ID); !errors.Is(err, shop.ErrTooManyInvoices) {
+		t.Errorf("third invoice: err = %v, want ErrTooManyInvoices", err)
+	}
+}
+
+func TestPayout(t *testing.T) {
+	svc, pay := newService(t)
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(matrix)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+
+	// takeOffer has bob take a new offer from alice
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+	bobAddress := ln.Add("bob", lnurltest.Recipient{})
+
+	takeOffer := func() *models.Trade {
+		t.Helper()
+		offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+		trade, err := svc.TakeOffer(bobID, offer.ID)
+		if err != nil {
+			t.Fatalf("TakeOffer: %v", err)
+		}
+		return trade
+	}
+	confirm := func(trade *models.Trade) {
+		t.Helper()
+		offer, _ := svc.Offer(trade.OfferID)
+		pay.MarkSettled(offer.InvoiceID)
+		svc.ListOffers(aliceID)
+		if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+			t.Fatalf("ConfirmPayment: %v", err)
+		}
+	}
+
+	// A destination given while the trade is open is paid on completion
+	first := takeOffer()
+	if _, err := svc.SetPayoutDestination(bobID, first.ID, "not a destination"); !errors.Is(err, shop.ErrInvalidDestination) {
+		t.Errorf("invalid destination: err = %v", err)
+	}
+	if _, err := svc.SetPayoutDestination(aliceID, first.ID, bobAddress); !errors.Is(err, shop.ErrNotBuyer) {
+		t.Errorf("destination set by seller: err = %v", err)
+	}
+	if _, err := svc.SetPayoutDestination(bobID, first.ID, ln.Address("carol")); !errors.Is(err, shop.ErrUnresolvable) {
+		t.Errorf("unknown Lightning address: err = %v", err)
+	}
+	if p, err := svc.SetPayoutDestination(bobID, first.ID, "lightning:"+bobAddress); err != nil || p != nil {
+		t.Fatalf("SetPayoutDestination on open trade = %+v, %v", p, err)
+	}
+	confirm(first)
+	payouts, _ := svc.Payouts(bobID)
+	if len(payouts) != 1 || payouts[0].Destination != bobAddress || payouts[0].AmountSats != 1_000_000 || payouts[0].Status != models.PayoutInProgress {
+		t.Fatalf("payouts = %+v", payouts)
+	}
+	// BTCPay pays the invoice fetched from the Lightning address
+	if invoices := ln.Invoices(); len(invoices) != 1 || invoices[0].AmountMsat != 1_000_000_000 || pay.Payouts()[0].Destination != invoices[0].PR {
+		t.Errorf("invoices = %+v, BTCPay payouts = %+v", invoices, pay.Payouts())
+	}
+	if _, err := svc.SetPayoutDestination(bobID, first.ID, bobAddress); !errors.Is(err, shop.ErrPayoutExists) {
+		t.Errorf("paying out twice: err = %v", err)
+	}
+
+	// A webhook for the payout updates it and tells the buyer
+	before := len(matrix.sent[matrixBob.ChatID])
+	pay.CompletePayout(pay.Payouts()[0].ID)
+	if err := svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: pay.Payouts()[0].ID}); err != nil {
+		t.Fatalf("HandlePayoutEvent: %v", err)
+	}
+	if payouts, _ := svc.Payouts(bobID); payouts[0].Status != models.PayoutCompleted {
+		t.Errorf("payout after webhook = %+v", payouts[0])
+	}
+	if msgs := matrix.sent[matrixBob.ChatID]; len(msgs) != before+1 {
+		t.Errorf("buyer got %d messages, want %d", len(msgs), before+1)
+	}
+
+	// A completed trade is paid at once and can be retried after a cancellation
+	svc.SetAutoApprovePayouts(false)
+	second := takeOffer()
+	confirm(second)
+	p, err := svc.SetPayoutDestination(bobID, second.ID, bolt11test.NewSigner().Sign(bolt11test.Invoice{AmountMsat: 1_000_000_000}))
+	if err != nil || p.Status != models.PayoutAwaitingApproval {
+		t.Fatalf("SetPayoutDestination on completed trade = %+v, %v", p, err)
+	}
+	pay.CancelPayout(p.BTCPayID)
+	if payouts, _ := svc.Payouts(bobID); payouts[0].Status != models.PayoutCancelled {
+		t.Errorf("payout after cancel = %+v", payouts[0])
+	}
+	if p, err := svc.SetPayoutDestination(bobID, second.ID, bobAddress); err != nil || p.Status != models.PayoutAwaitingApproval {
+		t.Errorf("retry = %+v, %v", p, err)
+	}
+	// The database holds a single live payout per trade
+	if _, err := svc.Database().CreatePayout(models.Payout{TradeID: second.ID, UserID: bobID, Status: models.PayoutInProgress}); !errors.Is(err, db.ErrClaimed) {
+		t.Errorf("second payout of a trade: err = %v, want ErrClaimed", err)
+	}
+
+	// Refunding a replaced invoice paid on top of the offer does not stop
+	// the trade from being paid out
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	refreshed, err := svc.RefreshInvoice(aliceID, offer.ID)
+	if err != nil {
+		t.Fatalf("RefreshInvoice: %v", err)
+	}
+	third, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if _, err := svc.SetPayoutDestination(bobID, third.ID, bobAddress); err != nil {
+		t.Fatalf("SetPayoutDestination: %v", err)
+	}
+	pay.MarkSettled(refreshed.InvoiceID)
+	svc.ListOffers(aliceID)
+	pay.MarkSettled(offer.InvoiceID)
+	if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceReceivedPayment, InvoiceID: offer.InvoiceID}); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	if refunds, _ := svc.Refunds(aliceID); len(refunds) != 1 || !refunds[0].Duplicate {
+		t.Fatalf("refunds after duplicate payment = %+v", refunds)
+	}
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	if payouts, _ := svc.Payouts(bobID); len(payouts) != 4 || payouts[0].TradeID != third.ID || payouts[0].Status != models.PayoutAwaitingApproval {
+		t.Errorf("payouts after duplicate refund = %+v", payouts)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	svc, pay := newService(t)
+	telegram := &recorder{name: shop.FrontendTelegram, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(telegram)
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+	svc.SetAdmins([]int64{42})
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+	bobAddress := ln.Add("bob", lnurltest.Recipient{})
+
+	// A paid offer cancelled by an admin is refunded to the seller who paid it
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	trade, _ := svc.TakeOffer(bobID, offer.ID)
+	if _, err := svc.SetPayoutDestination(bobID, trade.ID, bobAddress); err != nil {
+		t.Fatalf("SetPayoutDestination: %v", err)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ForceCancel(42, offer.ID); err != nil {
+		t.Fatalf("ForceCancel: %v", err)
+	}
+	if trade, _ := svc.Trade(bobID, trade.ID); trade.Status != models.TradeRefunded {
+		t.Errorf("trade status = %s, want refunded", trade.Status)
+	}
+	refunds, _ := svc.Refunds(aliceID)
+	if len(refunds) != 1 || refunds[0].OfferID != offer.ID || refunds[0].TradeID != trade.ID ||
+		refunds[0].AmountSats != 1_000_000 || refunds[0].Status != models.RefundAwaitingDestination {
+		t.Fatalf("refunds = %+v", refunds)
+	}
+	msgs := telegram.sent[telegramAlice.ChatID]
+	if last := msgs[len(msgs)-1]; !strings.HasPrefix(last.Text, "↩️ *Refund of Offer #1*") || last.Actions[0][0].Command != shop.ActionRefund {
+		t.Errorf("refund request = %+v", last)
+	}
+	if _, err := svc.SetPayoutDestination(bobID, trade.ID, bobAddress); !errors.Is(err, shop.ErrTradeClosed) {
+		t.Errorf("payout of refunded trade: err = %v, want ErrTradeClosed", err)
+	}
+
+	signer := bolt11test.NewSigner()
+	if _, err := svc.SetRefundDestination(bobID, offer.ID, bobAddress); !errors.Is(err, shop.ErrNotOwner) {
+		t.Errorf("refund to buyer: err = %v, want ErrNotOwner", err)
+	}
+	if _, err := svc.SetRefundDestination(aliceID, offer.ID, signer.Sign(bolt11test.Invoice{AmountMsat: 1_000})); !errors.Is(err, shop.ErrInvoiceAmount) {
+		t.Errorf("refund to invoice for another amount: err = %v, want ErrInvoiceAmount", err)
+	}
+	r, err := svc.SetRefundDestination(aliceID, offer.ID, signer.Sign(bolt11test.Invoice{AmountMsat: 1_000_000_000}))
+	if err != nil || r.Status != models.RefundAwaitingApproval {
+		t.Fatalf("SetRefundDestination = %+v, %v", r, err)
+	}
+	if pp := pay.PullPayments(); len(pp) != 1 || pp[0].InvoiceID != offer.InvoiceID {
+		t.Errorf("pull payments = %+v", pp)
+	}
+	if _, err := svc.SetRefundDestination(aliceID, offer.ID, bobAddress); !errors.Is(err, shop.ErrRefundExists) {
+		t.Errorf("refunding twice: err = %v, want ErrRefundExists", err)
+	}
+
+	// A cancelled refund payout can be sent elsewhere, on the same pull payment
+	pay.CancelPayout(r.BTCPayID)
+	if err := svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: r.BTCPayID}); err != nil {
+		t.Fatalf("HandlePayoutEvent: %v", err)
+	}
+	if refunds, _ := svc.Refunds(aliceID); refunds[0].Status != models.RefundAwaitingDestination || refunds[0].Destination != "" {
+		t.Errorf("refund after cancelled payout = %+v", refunds[0])
+	}
+	aliceAddress := ln.Add("alice", lnurltest.Recipient{})
+	if r, err = svc.SetRefundDestination(aliceID, offer.ID, aliceAddress); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	pay.CompletePayout(r.BTCPayID)
+	svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: r.BTCPayID})
+	if refunds, _ := svc.Refunds(aliceID); refunds[0].Status != models.RefundCompleted || len(pay.PullPayments()) != 1 {
+		t.Errorf("refund = %+v, pull payments %d", refunds[0], len(pay.PullPayments()))
+	}
+
+	// The invoice settling again does not refund it twice
+	svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: offer.InvoiceID})
+	if refunds, _ := svc.Refunds(aliceID); len(refunds) != 1 {
+		t.Errorf("refunds after repeated event = %d", len(refunds))
+	}
+
+	// An offer paid after it was cancelled is refunded to the seller's
+	// Lightning address at once
+	if err := svc.SetLightningAddress(aliceID, aliceAddress); err != nil {
+		t.Fatal(err)
+	}
+	late, _ := svc.CreateOffer(aliceID, 0.02, 1000, models.PaymentLightning)
+	svc.CancelOffer(aliceID, late.ID)
+	pay.MarkSettled(late.InvoiceID)
+	if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: late.InvoiceID}); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	refunds, _ = svc.Refunds(aliceID)
+	if len(refunds) != 2 || refunds[0].OfferID != late.ID || refunds[0].Destination != aliceAddress || refunds[0].Status != models.RefundAwaitingApproval {
+		t.Errorf("refunds = %+v", refunds)
+	}
+
+	// A paid offer nobody took can be cancelled by its owner, who is refunded
+	untaken, _ := svc.CreateOffer(aliceID, 0.03, 1500, models.PaymentLightning)
+	pay.MarkSettled(untaken.InvoiceID)
+	svc.ListOffers(aliceID)
+	if o, err := svc.CancelOffer(aliceID, untaken.ID); err != nil || o.Status != models.StatusCancelled {
+		t.Fatalf("CancelOffer of a paid offer = %+v, %v", o, err)
+	}
+	refunds, _ = svc.Refunds(aliceID)
+	if len(refunds) != 3 || refunds[0].OfferID != untaken.ID || refunds[0].TradeID != 0 ||
+		refunds[0].AmountSats != 3_000_000 || refunds[0].Destination != aliceAddress {
+		t.Errorf("refunds = %+v", refunds)
+	}
+
+	// So is a cancelled offer whose invoice is paid after it expired
+	expired, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	svc.CancelOffer(aliceID, expired.ID)
+	pay.Expire(expired.InvoiceID)
+	pay.MarkSettled(expired.InvoiceID)
+	if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceReceivedPayment, InvoiceID: expired.InvoiceID}); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	refunds, _ = svc.Refunds(aliceID)
+	if len(refunds) != 4 || refunds[0].OfferID != expired.ID || refunds[0].InvoiceID != expired.InvoiceID {
+		t.Errorf("refunds = %+v", refunds)
+	}
+
+	// Payouts and refunds of the same offer exclude each other
+	paidOut, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	paidTrade, _ := svc.TakeOffer(bobID, paidOut.ID)
+	svc.SetPayoutDestination(bobID, paidTrade.ID, bobAddress)
+	pay.MarkSettled(paidOut.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.CancelOffer(aliceID, paidOut.ID); !errors.Is(err, shop.ErrNotPending) {
+		t.Errorf("CancelOffer of a taken paid offer: err = %v", err)
+	}
+	svc.ConfirmPayment(aliceID, paidOut.ID)
+	if payouts, _ := svc.Payouts(bobID); len(payouts) != 1 {
+		t.Fatalf("payouts = %+v", payouts)
+	}
+	_, err = svc.Database().CreateRefund(models.Refund{OfferID: paidOut.ID, UserID: aliceID, InvoiceID: paidOut.InvoiceID, Status: models.RefundAwaitingDestination})
+	if !errors.Is(err, db.ErrClaimed) {
+		t.Errorf("refund of paid out offer: err = %v, want ErrClaimed", err)
+	}
+	_, err = svc.Database().CreatePayout(models.Payout{TradeID: trade.ID, UserID: bobID, Status: models.PayoutAwaitingApproval})
+	if !errors.Is(err, db.ErrClaimed) {
+		t.Errorf("payout of refunded offer: err = %v, want ErrClaimed", err)
+	}
+}
+
+func TestLightningAddress(t *testing.T) {
+	svc, pay := newService(t)
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(matrix)
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+
+	tests := []struct {
+		address string
+		want    error
+	}{
+		{bolt11test.NewSigner().Sign(bolt11test.Invoice{AmountMsat: 1_000}), shop.ErrInvalidDestination}, // invoices are single use
+		{"bob", shop.ErrInvalidDestination},
+		{ln.Address("bob"), shop.ErrUnresolvable},
+	}
+	for _, tt := range tests {
+		if err := svc.SetLightningAddress(bobID, tt.address); !errors.Is(err, tt.want) {
+			t.Errorf("SetLightningAddress(%q): err = %v, want %v", tt.address, err, tt.want)
+		}
+	}
+	if err := svc.SetLightningAddress(99, "bob@example.com"); !errors.Is(err, shop.ErrNotRegistered) {
+		t.Errorf("SetLightningAddress for unknown user: err = %v", err)
+	}
+
+	// Only 0.001 to 0.005 BTC can be sent to bob
+	address := ln.Add("bob", lnurltest.Recipient{MinSendable: 100_000_000, MaxSendable: 500_000_000})
+	if err := svc.SetLightningAddress(bobID, ln.LNURL("bob")); err != nil {
+		t.Fatalf("SetLightningAddress(LNURL): %v", err)
+	}
+	if err := svc.SetLightningAddress(bobID, strings.ToUpper(address)); err != nil {
+		t.Fatalf("SetLightningAddress: %v", err)
+	}
+	if got, _ := svc.LightningAddress(bobID); got != address {
+		t.Errorf("LightningAddress = %q, want %q", got, address)
+	}
+
+	// buy has bob buy an offer of amount and returns the trade
+	buy := func(amount float64) *models.Trade {
+		t.Helper()
+		offer, _ := svc.CreateOffer(aliceID, amount, 500, models.PaymentLightning)
+		trade, err := svc.TakeOffer(bobID, offer.ID)
+		if err != nil {
+			t.Fatalf("TakeOffer: %v", err)
+		}
+		pay.MarkSettled(offer.InvoiceID)
+		svc.ListOffers(aliceID)
+		if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+			t.Fatalf("ConfirmPayment: %v", err)
+		}
+		trade, _ = svc.Trade(bobID, trade.ID)
+		return trade
+	}
+
+	// Trades without a destination of their own are paid to the address
+	first := buy(0.002)
+	payouts, _ := svc.Payouts(bobID)
+	if len(payouts) != 1 || payouts[0].TradeID != first.ID || payouts[0].Destination != address {
+		t.Fatalf("payouts = %+v", payouts)
+	}
+	msgs := matrix.sent[matrixBob.ChatID]
+	if completed := msgs[len(msgs)-2]; len(completed.Actions) != 0 {
+		t.Errorf("buyer with a Lightning address asked for a destination: %+v", completed)
+	}
+
+	// Amounts the address does not accept are reported to the buyer
+	second := buy(0.01)
+	if second.PayoutDestination != "" {
+		t.Errorf("destination of unpaid trade = %q", second.PayoutDestination)
+	}
+	msgs = matrix.sent[matrixBob.ChatID]
+	if failed := msgs[len(msgs)-1]; !strings.Contains(failed.Text, "could not be sent") {
+		t.Errorf("failure notification = %q", failed.Text)
+	}
+	if _, err := svc.SetPayoutDestination(bobID, second.ID, address); !errors.Is(err, shop.ErrPayoutAmount) {
+		t.Errorf("paying out more than the address accepts: err = %v", err)
+	}
+
+	if err := svc.SetLightningAddress(bobID, ""); err != nil {
+		t.Fatalf("clearing Lightning address: %v", err)
+	}
+	if got, _ := svc.LightningAddress(bobID); got != "" {
+		t.Errorf("LightningAddress after clearing = %q", got)
+	}
+}
+
+func TestPayoutInvoice(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+	address := ln.Add("bob", lnurltest.Recipient{})
+
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	trade, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+
+	signer := bolt11test.NewSigner()
+	corrupted := signer.Sign(bolt11test.Invoice{AmountMsat: 1_000_000_000})
+	corrupted = corrupted[:len(corrupted)-7] + "qqqqqqq"
+	tests := []struct {
+		name    string
+		invoice string
+		want    error
+	}{
+		{"valid", signer.Sign(bolt11test.Invoice{AmountMsat: 1_000_000_000}), nil},
+		{"no amount", signer.Sign(bolt11test.Invoice{}), shop.ErrInvoiceAmount},
+		{"wrong amount", signer.Sign(bolt11test.Invoice{AmountMsat: 999_000_000}), shop.ErrInvoiceAmount},
+		{"wrong network", signer.Sign(bolt11test.Invoice{Network: bolt11.Testnet, AmountMsat: 1_000_000_000}), shop.ErrInvoiceNetwork},
+		{"expired", signer.Sign(bolt11test.Invoice{AmountMsat: 1_000_000_000, Timestamp: time.Now().Add(-2 * time.Hour)}), shop.ErrInvoiceExpired},
+		{"corrupted", corrupted, shop.ErrInvalidDestination},
+	}
+	for _, tt := range tests {
+		if _, err := svc.SetPayoutDestination(bobID, trade.ID, tt.invoice); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Invoices fetched from Lightning addresses are checked too
+	svc.SetNetwork(bolt11.Regtest)
+	if _, err := svc.SetPayoutDestination(bobID, trade.ID, address); err != nil {
+		t.Fatalf("SetPayoutDestination: %v", err)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	if len(pay.Payouts()) != 0 {
+		t.Errorf("paid a mainnet invoice on regtest: %+v", pay.Payouts())
+	}
+	ln.SetNetwork(bolt11.Regtest)
+	if p, err := svc.SetPayoutDestination(bobID, trade.ID, address); err != nil || p == nil {
+		t.Errorf("SetPayoutDestination on regtest = %+v, %v", p, err)
+	}
+}
+
+func TestFees(t *testing.T) {
+	svc, pay := newService(t)
+	svc.SetAdmins([]int64{42})
+	svc.SetFees(fees.Schedule{Default: fees.Rule{Percent: 1, MinSats: 1_000}, MakerPercent: 40})
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.Register(matrixBob)
+	l := i18n.Get(i18n.Default)
+
+	// The seller pays their share of the fee with the invoice
+	offer, err := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	if offer.MakerFeeSats != 4_000 {
+		t.Errorf("maker fee = %d, want 4000", offer.MakerFeeSats)
+	}
+	if inv, _ := pay.Invoice(offer.InvoiceID); inv.Amount != "0.01004" {
+		t.Errorf("invoice amount = %s, want 0.01004", inv.Amount)
+	}
+	if msg := shop.OfferCardMessage(l, *offer); !strings.Contains(msg.Text, "Platform fee: 0.00004 BTC") {
+		t.Errorf("offer card = %q", msg.Text)
+	}
+
+	// Buyers see their share before taking the offer
+	sellers, _ := svc.Marketplace(10)
+	if len(sellers) != 1 || sellers[0].BuyerFees[offer.ID] != 6_000 {
+		t.Fatalf("marketplace = %+v", sellers)
+	}
+	if msg := shop.SellerOffersMessage(l, sellers[0]); !strings.Contains(msg.Text, "Buyer fee: 0.00006 BTC") {
+		t.Errorf("marketplace card = %q", msg.Text)
+	}
+
+	// The fee is stored on the trade and the buyer's share is deducted from
+	// the payout
+	trade, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if trade.MakerFeeSats != 4_000 || trade.TakerFeeSats != 6_000 || trade.FeeSats() != 10_000 {
+		t.Errorf("trade fees = %d + %d", trade.MakerFeeSats, trade.TakerFeeSats)
+	}
+	invoice := bolt11test.NewSigner().Sign(bolt11test.Invoice{AmountMsat: 994_000_000})
+	if _, err := svc.SetPayoutDestination(bobID, trade.ID, invoice); err != nil {
+		t.Fatalf("SetPayoutDestination: %v", err)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	if payouts, _ := svc.Payouts(bobID); len(payouts) != 1 || payouts[0].AmountSats != 994_000 {
+		t.Fatalf("payouts = %+v", payouts)
+	}
+
+	// Trades during a promotion are free
+	svc.SetFees(fees.Schedule{
+		Default:    fees.Rule{Percent: 1, MinSats: 1_000},
+		Promotions: []fees.Promotion{{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}},
+	})
+	free, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if trade, err := svc.TakeOffer(bobID, free.ID); err != nil || trade.FeeSats() != 0 || free.MakerFeeSats != 0 {
+		t.Errorf("trade during promotion = %+v, %v", trade, err)
+	}
+
+	// Admins see the fees of completed trades
+	stats, err := svc.Stats(42)
+	if err != nil || stats.MakerFeesSats != 4_000 || stats.TakerFeesSats != 6_000 {
+		t.Fatalf("Stats = %+v, %v", stats, err)
+	}
+	if msg := shop.StatsMessage(l, stats); !strings.Contains(msg.Text, "0.0001 BTC") {
+		t.Errorf("stats message = %q", msg.Text)
+	}
+}
+
+func TestReferrals(t *testing.T) {
+	svc, pay := newService(t)
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(matrix)
+	svc.SetFees(fees.Schedule{Default: fees.Rule{Percent: 1}, MakerPercent: 40})
+	svc.SetReferralProgram(shop.ReferralProgram{SharePercent: 50, MinPayoutSats: 1_000})
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+
+	// The referrer invites both sides of a trade; unknown codes are ignored
+	carol := models.Identity{Frontend: shop.FrontendMatrix, ExternalID: "@carol:example.org", ChatID: "!carol:example.org", Username: "carol:example.org"}
+	carolID, _ := svc.Register(carol)
+	code, err := svc.ReferralCode(carolID)
+	if err != nil || code == "" {
+		t.Fatalf("ReferralCode = %q, %v", code, err)
+	}
+	if again, _ := svc.ReferralCode(carolID); again != code {
+		t.Errorf("ReferralCode changed from %q to %q", code, again)
+	}
+	aliceID, _ := svc.RegisterReferred(telegramAlice, strings.ToLower(code))
+	bobID, _ := svc.RegisterReferred(matrixBob, code)
+	if _, err := svc.RegisterReferred(matrixAlice, "unknown"); err != nil {
+		t.Errorf("RegisterReferred with unknown code: %v", err)
+	}
+	if u, _ := svc.User(aliceID); u.ReferrerID != carolID {
+		t.Errorf("alice referrer = %d, want %d", u.ReferrerID, carolID)
+	}
+
+	// Completing a trade credits the referrer with half of each fee
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	trade, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if summary, _ := svc.Referrals(carolID); summary.EarnedSats != 0 {
+		t.Errorf("earnings before completion = %+v", summary)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	before := len(matrix.sent[carol.ChatID])
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	if msgs := matrix.sent[carol.ChatID]; len(msgs) != before+2 {
+		t.Errorf("referrer got %d messages, want %d", len(msgs), before+2)
+	}
+	summary, err := svc.Referrals(carolID)
+	if err != nil || summary.Invites != 2 || summary.EarnedSats != 5_000 || summary.AvailableSats != 5_000 || !summary.CanPayOut() {
+		t.Fatalf("Referrals = %+v, %v (trade %+v)", summary, err, trade)
+	}
+
+	// Earnings are paid out to the referrer's Lightning address
+	if _, err := svc.RequestReferralPayout(carolID); !errors.Is(err, shop.ErrNoLightningAddress) {
+		t.Errorf("payout without address: err = %v", err)
+	}
+	if _, err := svc.RequestReferralPayout(aliceID); !errors.Is(err, shop.ErrNoReferralEarnings) {
+		t.Errorf("payout without earnings: err = %v", err)
+	}
+	if err := svc.SetLightningAddress(carolID, ln.Add("carol", lnurltest.Recipient{})); err != nil {
+		t.Fatalf("SetLightningAddress: %v", err)
+	}
+	svc.SetAutoApprovePayouts(false)
+	p, err := svc.RequestReferralPayout(carolID)
+	if err != nil || p.AmountSats != 5_000 || p.Status != models.PayoutAwaitingApproval {
+		t.Fatalf("RequestReferralPayout = %+v, %v", p, err)
+	}
+	if _, err := svc.RequestReferralPayout(carolID); !errors.Is(err, shop.ErrReferralPayoutExists) {
+		t.Errorf("paying out twice: err = %v", err)
+	}
+	if summary, _ := svc.Referrals(carolID); summary.PendingSats != 5_000 || summary.AvailableSats != 0 {
+		t.Errorf("earnings being paid out = %+v", summary)
+	}
+
+	// A cancelled payout releases the credits
+	pay.CancelPayout(p.BTCPayID)
+	if err := svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: p.BTCPayID}); err != nil {
+		t.Fatalf("HandlePayoutEvent: %v", err)
+	}
+	if summary, _ := svc.Referrals(carolID); summary.PendingSats != 0 || summary.AvailableSats != 5_000 {
+		t.Errorf("earnings after cancellation = %+v", summary)
+	}
+	p, err = svc.RequestReferralPayout(carolID)
+	if err != nil {
+		t.Fatalf("RequestReferralPayout after cancellation: %v", err)
+	}
+	pay.CompletePayout(p.BTCPayID)
+	if summary, _ := svc.Referrals(carolID); summary.PaidSats != 5_000 || summary.AvailableSats != 0 || summary.CanPayOut() {
+		t.Errorf("earnings after payout = %+v", summary)
+	}
+}
+
+// checkLedger checks the invariants of the ledger: every entry and the sum of
+// all balances are zero, and no user account is negative
+func checkLedger(t *testing.T, database *db.Database) map[models.LedgerAccount]int64 {
+	t.Helper()
+	entries, err := database.GetLedgerEntries(1_000)
+	if err != nil {
+		t.Fatalf("GetLedgerEntries: %v", err)
+	}
+	for _, e := range entries {
+		var sum int64
+		for _, p := range e.Postings {
+			sum += p.AmountSats
+		}
+		if sum != 0 || len(e.Postings) < 2 {
+			t.Errorf("entry %s is unbalanced: %+v", e.Reference, e.Postings)
+		}
+	}
+	balances, err := database.GetLedgerBalances()
+	if err != nil {
+		t.Fatalf("GetLedgerBalances: %v", err)
+	}
+	var total int64
+	byAccount := make(map[models.LedgerAccount]int64)
+	for _, b := range balances {
+		total += b.BalanceSats
+		byAccount[b.Account] = b.BalanceSats
+		if b.Account.UserID != 0 && b.BalanceSats < 0 {
+			t.Errorf("account %+v is negative: %d", b.Account, b.BalanceSats)
+		}
+	}
+	if total != 0 {
+		t.Errorf("balances sum to %d", total)
+	}
+	return byAccount
+}
+
+func TestLedger(t *testing.T) {
+	svc, pay := newService(t)
+	svc.SetAdmins([]int64{42})
+	svc.SetFees(fees.Schedule{Default: fees.Rule{Percent: 1}, MakerPercent: 40})
+	svc.SetReferralProgram(shop.ReferralProgram{SharePercent: 50, MinPayoutSats: 1_000})
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+	database := svc.Database()
+
+	carolID, _ := svc.Register(models.Identity{Frontend: shop.FrontendMatrix, ExternalID: "@carol:example.org", ChatID: "!carol:example.org"})
+	code, _ := svc.ReferralCode(carolID)
+	aliceID, _ := svc.Register(telegramAlice)
+	bobID, _ := svc.RegisterReferred(matrixBob, code)
+	available := func(userID int64) models.LedgerAccount { return models.UserAccount(userID, models.AccountAvailable) }
+	escrow := func(userID int64) models.LedgerAccount { return models.UserAccount(userID, models.AccountEscrow) }
+	btcpayAccount := models.PlatformAccount(models.AccountBTCPay)
+	feesAccount := models.PlatformAccount(models.AccountFees)
+
+	// The payment of an offer is held in the seller's escrow
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	trade, _ := svc.TakeOffer(bobID, offer.ID)
+	if _, err := svc.SetPayoutDestination(bobID, trade.ID, ln.Add("bob", lnurltest.Recipient{})); err != nil {
+		t.Fatalf("SetPayoutDestination: %v", err)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: offer.InvoiceID})
+	balances := checkLedger(t, database)
+	if balances[escrow(aliceID)] != 1_004_000 || balances[available(aliceID)] != 0 || balances[btcpayAccount] != -1_004_000 {
+		t.Errorf("balances after payment = %+v", balances)
+	}
+
+	// Completing the trade pays the fee, a referral credit and the buyer
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	balances = checkLedger(t, database)
+	if balances[escrow(aliceID)] != 0 || balances[available(bobID)] != 994_000 ||
+		balances[feesAccount] != 7_000 || balances[available(carolID)] != 3_000 {
+		t.Errorf("balances after completion = %+v", balances)
+	}
+	payouts, _ := svc.Payouts(bobID)
+	pay.CompletePayout(payouts[0].BTCPayID)
+	for i := 0; i < 2; i++ {
+		svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: payouts[0].BTCPayID})
+		svc.Payouts(bobID)
+	}
+	balances = checkLedger(t, database)
+	if balances[available(bobID)] != 0 || balances[btcpayAccount] != -10_000 {
+		t.Errorf("balances after payout = %+v", balances)
+	}
+
+	// A cancelled paid offer releases its escrow to be refunded
+	cancelled, _ := svc.CreateOffer(aliceID, 0.02, 1000, models.PaymentLightning)
+	pay.MarkSettled(cancelled.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ForceCancel(42, cancelled.ID); err != nil {
+		t.Fatalf("ForceCancel: %v", err)
+	}
+	balances = checkLedger(t, database)
+	if balances[escrow(aliceID)] != 0 || balances[available(aliceID)] != 2_008_000 {
+		t.Errorf("balances after cancellation = %+v", balances)
+	}
+	r, err := svc.SetRefundDestination(aliceID, cancelled.ID, ln.Add("alice", lnurltest.Recipient{}))
+	if err != nil {
+		t.Fatalf("SetRefundDestination: %v", err)
+	}
+	pay.CompletePayout(r.BTCPayID)
+	svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: r.BTCPayID})
+	balances = checkLedger(t, database)
+	if balances[available(aliceID)] != 0 || balances[btcpayAccount] != -10_000 {
+		t.Errorf("balances after refund = %+v", balances)
+	}
+
+	// Users see their balance and latest entries
+	b, err := svc.Balance(carolID)
+	if err != nil || b.AvailableSats != 3_000 || len(b.Entries) != 1 || b.Entries[0].Kind != models.LedgerReferralCredit {
+		t.Fatalf("Balance = %+v, %v", b, err)
+	}
+	if msg := shop.BalanceMessage(i18n.Get(i18n.Default), b); !strings.Contains(msg.Text, "Referral credit: +0.00003 BTC available") {
+		t.Errorf("balance message = %q", msg.Text)
+	}
+
+	// The ledger rejects unbalanced entries and overdrawn user accounts, and
+	// records each reference once
+	unbalanced := models.LedgerEntry{Reference: "test:unbalanced", Kind: models.LedgerFee, Postings: []models.LedgerPosting{
+		{Account: feesAccount, AmountSats: -5}, {Account: available(carolID), AmountSats: 4},
+	}}
+	if _, err := database.PostLedgerEntry(unbalanced); !errors.Is(err, db.ErrUnbalanced) {
+		t.Errorf("unbalanced entry: err = %v", err)
+	}
+	overdrawn := models.LedgerEntry{Reference: "test:overdrawn", Kind: models.LedgerReferralPayout, Postings: []models.LedgerPosting{
+		{Account: available(carolID), AmountSats: -3_001}, {Account: btcpayAccount, AmountSats: 3_001},
+	}}
+	if _, err := database.PostLedgerEntry(overdrawn); !errors.Is(err, db.ErrInsufficientBalance) {
+		t.Errorf("overdrawn entry: err = %v", err)
+	}
+	overdrawn.Reference, overdrawn.Postings[0].AmountSats, overdrawn.Postings[1].AmountSats = "test:payout", -3_000, 3_000
+	for i, want := range []bool{true, false} {
+		if posted, err := database.PostLedgerEntry(overdrawn); posted != want || err != nil {
+			t.Errorf("posting %d = %v, %v, want %v", i, posted, err, want)
+		}
+	}
+	if balances := checkLedger(t, database); balances[available(carolID)] != 0 {
+		t.Errorf("balance after payout = %d", balances[available(carolID)])
+	}
+}
+
+func TestLedgerAlert(t *testing.T) {
+	svc, pay := newService(t)
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(matrix)
+	aliceID, _ := svc.Register(telegramAlice)
+	adminID, _ := svc.Register(matrixBob)
+	svc.SetAdmins([]int64{adminID})
+	database := svc.Database()
+
+	// An escrow emptied behind the shop's back cannot be released, which
+	// the admins are told about
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	drain := models.LedgerEntry{Reference: "test:drain", Kind: models.LedgerEscrowRelease, Postings: []models.LedgerPosting{
+		{Account: models.UserAccount(aliceID, models.AccountEscrow), AmountSats: -1_000_000},
+		{Account: models.UserAccount(aliceID, models.AccountAvailable), AmountSats: 1_000_000},
+	}}
+	if _, err := database.PostLedgerEntry(drain); err != nil {
+		t.Fatalf("PostLedgerEntry: %v", err)
+	}
+	if _, err := svc.ForceCancel(adminID, offer.ID); err != nil {
+		t.Fatalf("ForceCancel: %v", err)
+	}
+	var alerts []string
+	for _, msg := range matrix.sent[matrixBob.ChatID] {
+		if strings.HasPrefix(msg.Text, "⚠️ *Ledger error*") {
+			alerts = append(alerts, msg.Text)
+		}
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "refund:1:release") || !strings.Contains(alerts[0], "insufficient balance") {
+		t.Errorf("admin alerts = %q", alerts)
+	}
+}
+
+func TestBonds(t *testing.T) {
+	svc, pay := newService(t)
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(matrix)
+	svc.SetAdmins([]int64{42})
+	ln := lnurltest.NewServer()
+	defer ln.Close()
+	svc.SetLNURLClient(ln.Client())
+	database := svc.Database()
+	aliceID, _ := svc.Register(matrixAlice)
+	bobID, _ := svc.Register(matrixBob)
+	bondAccount := models.UserAccount(aliceID, models.AccountBond)
+
+	if _, err := svc.PostBond(aliceID); !errors.Is(err, shop.ErrBondsDisabled) {
+		t.Errorf("PostBond with bonds disabled: err = %v", err)
+	}
+	svc.SetBonds(shop.Bonds{AmountSats: 50_000, Required: true})
+
+	// Offers of sellers without a bond are neither listed nor taken
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if sellers, _ := svc.Marketplace(10); len(sellers) != 0 {
+		t.Errorf("marketplace without bond = %+v", sellers)
+	}
+	if _, err := svc.TakeOffer(bobID, offer.ID); !errors.Is(err, shop.ErrNotAvailable) {
+		t.Errorf("TakeOffer without bond: err = %v", err)
+	}
+
+	// Paying the bond lists the seller with a badge
+	bond, err := svc.PostBond(aliceID)
+	if err != nil || bond.Status != models.BondPending || bond.AmountSats != 50_000 || bond.InvoiceID == "" {
+		t.Fatalf("PostBond = %+v, %v", bond, err)
+	}
+	if again, err := svc.PostBond(aliceID); err != nil || again.ID != bond.ID {
+		t.Errorf("PostBond with a pending bond = %+v, %v", again, err)
+	}
+	pay.MarkSettled(bond.InvoiceID)
+	if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: bond.InvoiceID}); err != nil {
+		t.Fatalf("HandleInvoiceEvent: %v", err)
+	}
+	if _, err := svc.PostBond(aliceID); !errors.Is(err, shop.ErrBondExists) {
+		t.Errorf("PostBond with an active bond: err = %v", err)
+	}
+	sellers, _ := svc.Marketplace(10)
+	if len(sellers) != 1 || !sellers[0].Bonded {
+		t.Fatalf("marketplace with bond = %+v", sellers)
+	}
+	if msg := shop.SellerOffersMessage(i18n.Get(i18n.Default), sellers[0]); !strings.Contains(msg.Text, "Bonded seller") {
+		t.Errorf("seller card = %q", msg.Text)
+	}
+	if balances := checkLedger(t, database); balances[bondAccount] != 50_000 {
+		t.Errorf("bond balance = %d", balances[bondAccount])
+	}
+
+	// Bonds are not released while a trade is open, and a lost dispute
+	// gives the bond to the buyer
+	trade, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if _, err := svc.ReleaseBond(aliceID); !errors.Is(err, shop.ErrOpenTrades) {
+		t.Errorf("ReleaseBond with an open trade: err = %v", err)
+	}
+	if _, err := svc.ResolveDispute(aliceID, trade.ID, shop.DisputeBuyer); !errors.Is(err, shop.ErrNotAdmin) {
+		t.Errorf("ResolveDispute by a user: err = %v", err)
+	}
+	resolved, err := svc.ResolveDispute(42, trade.ID, shop.DisputeBuyer)
+	if err != nil || resolved.Status != models.TradeCancelled {
+		t.Fatalf("ResolveDispute = %+v, %v", resolved, err)
+	}
+	if _, err := svc.ResolveDispute(42, trade.ID, shop.DisputeBuyer); !errors.Is(err, shop.ErrTradeClosed) {
+		t.Errorf("resolving twice: err = %v", err)
+	}
+	slashed, _ := svc.Bond(aliceID)
+	if slashed.Status != models.BondSlashed || slashed.TradeID != trade.ID || slashed.RecipientID != bobID {
+		t.Errorf("slashed bond = %+v", slashed)
+	}
+	msgs := matrix.sent[matrixBob.ChatID]
+	if len(msgs) == 0 || !strings.Contains(msgs[len(msgs)-1].Text, fmt.Sprintf("Trade #%d", trade.ID)) {
+		t.Errorf("buyer messages = %+v", msgs)
+	}
+	balances := checkLedger(t, database)
+	if balances[bondAccount] != 0 || balances[models.UserAccount(bobID, models.AccountAvailable)] != 50_000 {
+		t.Errorf("balances after slashing = %+v", balances)
+	}
+	if sellers, _ := svc.Marketplace(10); len(sellers) != 0 {
+		t.Errorf("marketplace after slashing = %+v", sellers)
+	}
+
+	// Only the buyer receives the slashed bond
+	if _, err := svc.ClaimBond(aliceID, slashed.ID, ln.Add("alice", lnurltest.Recipient{})); !errors.Is(err, shop.ErrBondNotFound) {
+		t.Errorf("ClaimBond by the seller: err = %v", err)
+	}
+	if _, err := svc.ClaimBond(bobID, slashed.ID, "not a destination"); !errors.Is(err, shop.ErrInvalidDestination) {
+		t.Errorf("invalid destination: err = %v", err)
+	}
+	if _, err := svc.ClaimBond(bobID, slashed.ID, bolt11test.NewSigner().Sign(bolt11test.Invoice{AmountMsat: 1_000})); !errors.Is(err, shop.ErrInvoiceAmount) {
+		t.Errorf("invoice for another amount: err = %v", err)
+	}
+	claimed, err := svc.ClaimBond(bobID, slashed.ID, "lightning:"+strings.ToUpper(ln.Add("bob", lnurltest.Recipient{})))
+	if err != nil || claimed.BTCPayID == "" || claimed.Destination != ln.Address("bob") {
+		t.Fatalf("ClaimBond = %+v, %v", claimed, err)
+	}
+	if _, err := svc.ClaimBond(bobID, slashed.ID, ln.Address("bob")); !errors.Is(err, shop.ErrBondPayoutExist) {
+		t.Errorf("claiming twice: err = %v", err)
+	}
+	pay.CompletePayout(claimed.BTCPayID)
+	if err := svc.HandlePayoutEvent(&btcpay.WebhookEvent{Type: btcpay.EventPayoutUpdated, PayoutID: claimed.BTCPayID}); err != nil {
+		t.Fatalf("HandlePayoutEvent: %v", err)
+	}
+	if balances := checkLedger(t, database); balances[models.UserAccount(bobID, models.AccountAvailable)] != 0 {
+		t.Errorf("balances after bond payout = %+v", balances)
+	}
+
+	// Winning a dispute refunds the seller and keeps their bond, which they
+	// can release once no trade is open
+	bond, _ = svc.PostBond(aliceID)
+	pay.MarkSettled(bond.InvoiceID)
+	if bond, _ = svc.Bond(aliceID); bond.Status != models.BondActive {
+		t.Fatalf("bond after payment = %+v", bond)
+	}
+	paid, _ := svc.CreateOffer(aliceID, 0.02, 1000, models.PaymentLightning)
+	trade, _ = svc.TakeOffer(bobID, paid.ID)
+	pay.MarkSettled(paid.InvoiceID)
+	svc.ListOffers(aliceID)
+	if resolved, err := svc.ResolveDispute(42, trade.ID, shop.DisputeSeller); err != nil || resolved.Status != models.TradeRefunded {
+		t.Fatalf("ResolveDispute for the seller = %+v, %v", resolved, err)
+	}
+	if refunds, _ := svc.Refunds(aliceID); len(refunds) != 1 || refunds[0].OfferID != paid.ID {
+		t.Errorf("refunds = %+v", refunds)
+	}
+	if bond, _ := svc.Bond(aliceID); bond.Status != models.BondActive {
+		t.Errorf("bond after winning = %+v", bond)
+	}
+	if err := svc.SetLightningAddress(aliceID, ln.Add("alice2", lnurltest.Recipient{})); err != nil {
+		t.Fatalf("SetLightningAddress: %v", err)
+	}
+	released, err := svc.ReleaseBond(aliceID)
+	if err != nil || released.Status != models.BondReleased || released.RecipientID != aliceID || released.BTCPayID == "" {
+		t.Fatalf("ReleaseBond = %+v, %v", released, err)
+	}
+	if _, err := svc.ReleaseBond(aliceID); !errors.Is(err, shop.ErrNoBond) {
+		t.Errorf("releasing twice: err = %v", err)
+	}
+	if balances := checkLedger(t, database); balances[bondAccount] != 0 {
+		t.Errorf("balances after release = %+v", balances)
+	}
+
+	// A bond paid after its invoice expired is activated
+	event := func(eventType, invoiceID string) {
+		t.Helper()
+		if err := svc.HandleInvoiceEvent(&btcpay.WebhookEvent{Type: eventType, InvoiceID: invoiceID}); err != nil {
+			t.Fatalf("HandleInvoiceEvent(%s): %v", eventType, err)
+		}
+	}
+	late, _ := svc.PostBond(aliceID)
+	pay.Expire(late.InvoiceID)
+	event(btcpay.EventInvoiceExpired, late.InvoiceID)
+	if b, _ := database.GetBond(late.ID); b.Status != models.BondExpired {
+		t.Fatalf("bond after invoice expired = %+v", b)
+	}
+	pay.MarkSettled(late.InvoiceID)
+	event(btcpay.EventInvoiceReceivedPayment, late.InvoiceID)
+	if b, _ := svc.Bond(aliceID); b.ID != late.ID || b.Status != models.BondActive {
+		t.Errorf("bond after late payment = %+v", b)
+	}
+	if balances := checkLedger(t, database); balances[bondAccount] != 50_000 {
+		t.Errorf("bond balance after late payment = %d", balances[bondAccount])
+	}
+
+	// It is returned to the seller if they posted another bond meanwhile
+	if _, err := svc.ReleaseBond(aliceID); err != nil {
+		t.Fatalf("ReleaseBond: %v", err)
+	}
+	late, _ = svc.PostBond(aliceID)
+	pay.Expire(late.InvoiceID)
+	event(btcpay.EventInvoiceExpired, late.InvoiceID)
+	pending, _ := svc.PostBond(aliceID)
+	pay.MarkSettled(late.InvoiceID)
+	event(btcpay.EventInvoiceReceivedPayment, late.InvoiceID)
+	returned, _ := database.GetBond(late.ID)
+	if returned.Status != models.BondReleased || returned.RecipientID != aliceID || returned.BTCPayID == "" {
+		t.Errorf("bond paid late after another was posted = %+v", returned)
+	}
+	if b, _ := svc.Bond(aliceID); b.ID != pending.ID || b.Status != models.BondPending {
+		t.Errorf("pending bond = %+v", b)
+	}
+	if balances := checkLedger(t, database); balances[bondAccount] != 0 {
+		t.Errorf("bond balance after returning a late bond = %d", balances[bondAccount])
+	}
+}
+
+func TestCancelCooldown(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(telegramAlice)
+	svc.SetLimits(shop.Limits{CancelCooldown: time.Hour})
+
+	if d := svc.CooldownRemaining(aliceID); d != 0 {
+		t.Errorf("cooldown before cancelling = %v", d)
+	}
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if _, err := svc.CancelOffer(aliceID, offer.ID); err != nil {
+		t.Fatalf("CancelOffer: %v", err)
+	}
+	if _, err := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning); !errors.Is(err, shop.ErrCooldown) {
+		t.Errorf("offer during cooldown: err = %v, want ErrCooldown", err)
+	}
+
+	// The cooldown outlives a restart of the shop
+	restarted := shop.NewService(svc.Database(), pay.Client())
+	restarted.SetLimits(shop.Limits{CancelCooldown: time.Hour})
+	if d := restarted.CooldownRemaining(aliceID); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("cooldown after restart = %v", d)
+	}
+	restarted.SetLimits(shop.Limits{})
+	if _, err := restarted.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning); err != nil {
+		t.Errorf("offer without cooldown: %v", err)
+	}
+}
+
+func TestTradeLimits(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(matrixAlice)
+	bobID, _ := svc.Register(matrixBob)
+	carolID, _ := svc.Register(models.Identity{Frontend: shop.FrontendTelegram, ExternalID: "1003", ChatID: "1003", Username: "carol"})
+
+	if limits, err := svc.TradeLimits(aliceID); err != nil || limits.RemainingSats() != -1 {
+		t.Errorf("TradeLimits without tiers = %+v, %v", limits, err)
+	}
+	svc.SetLimits(shop.Limits{Tiers: []models.Tier{
+		{Name: "new", MaxTradeSats: 1_000_000, MaxDailySats: 1_500_000},
+		{Name: "regular", MinTrades: 1, MaxTradeSats: 2_000_000},
+		{Name: "veteran", MinAccountAge: 30 * 24 * time.Hour, MinTrades: 1, Bonded: true},
+	}})
+
+	limits, err := svc.TradeLimits(aliceID)
+	if err != nil || limits.Tier.Name != "new" || limits.Next == nil || limits.Next.Name != "regular" || limits.RemainingSats() != 1_500_000 {
+		t.Fatalf("TradeLimits of a new user = %+v, %v", limits, err)
+	}
+
+	// Offers are capped per trade and per 24 hours
+	if _, err := svc.CreateOffer(aliceID, 0.02, 1000, models.PaymentLightning); !errors.Is(err, shop.ErrTradeLimit) {
+		t.Errorf("CreateOffer over the trade limit: err = %v", err)
+	}
+	offer, err := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	if _, err := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning); !errors.Is(err, shop.ErrDailyLimit) {
+		t.Errorf("CreateOffer over the daily limit: err = %v", err)
+	}
+	l := i18n.Get(i18n.Default)
+	limits, _ = svc.TradeLimits(aliceID)
+	if text := shop.LimitExceededText(l, limits, shop.ErrDailyLimit, "/limits"); !strings.Contains(text, "new") || !strings.Contains(text, "/limits") {
+		t.Errorf("daily limit text = %q", text)
+	}
+
+	// Taking offers counts towards the buyer's volume
+	other, _ := svc.CreateOffer(carolID, 0.01, 500, models.PaymentLightning)
+	trade, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if _, err := svc.TakeOffer(bobID, other.ID); !errors.Is(err, shop.ErrDailyLimit) {
+		t.Errorf("TakeOffer over the daily limit: err = %v", err)
+	}
+
+	// A completed trade moves both parties up a tier, while the next one
+	// needs an older account and a bond
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ConfirmPayment(aliceID, trade.OfferID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+	limits, err = svc.TradeLimits(bobID)
+	if err != nil || limits.Tier.Name != "regular" || limits.CompletedTrades != 1 || limits.Next == nil || limits.Next.Name != "veteran" || limits.RemainingSats() != -1 {
+		t.Fatalf("TradeLimits after a trade = %+v, %v", limits, err)
+	}
+	if msg := shop.LimitsMessage(l, limits); !strings.Contains(msg.Text, "regular") || !strings.Contains(msg.Text, "veteran") {
+		t.Errorf("limits message = %q", msg.Text)
+	}
+	if _, err := svc.TakeOffer(bobID, other.ID); err != nil {
+		t.Errorf("TakeOffer after a trade: %v", err)
+	}
+	if _, err := svc.CreateOffer(aliceID, 0.02, 1000, models.PaymentLightning); err != nil {
+		t.Errorf("CreateOffer after a trade: %v", err)
+	}
+	if _, err := svc.CreateOffer(aliceID, 0.03, 1500, models.PaymentLightning); !errors.Is(err, shop.ErrTradeLimit) {
+		t.Errorf("CreateOffer over the regular trade limit: err = %v", err)
+	}
+}
+
+func TestRatings(t *testing.T) {
+	svc, pay := newService(t)
+	aliceID, _ := svc.Register(matrixAlice)
+	bobID, _ := svc.Register(matrixBob)
+	carolID, _ := svc.Register(models.Identity{Frontend: shop.FrontendTelegram, ExternalID: "1003", ChatID: "1003", Username: "carol"})
+	svc.SetLimits(shop.Limits{Tiers: []models.Tier{
+		{Name: "new", MaxTradeSats: 1_000_000},
+		{Name: "rated", MinRating: 4},
+	}})
+
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	trade, err := svc.TakeOffer(bobID, offer.ID)
+	if err != nil {
+		t.Fatalf("TakeOffer: %v", err)
+	}
+	if _, err := svc.RateTrade(bobID, trade.ID, 5); !errors.Is(err, shop.ErrNotCompleted) {
+		t.Errorf("RateTrade of an open trade: err = %v", err)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); err != nil {
+		t.Fatalf("ConfirmPayment: %v", err)
+	}
+
+	if _, err := svc.RateTrade(bobID, trade.ID, 6); !errors.Is(err, shop.ErrInvalidScore) {
+		t.Errorf("RateTrade with score 6: err = %v", err)
+	}
+	if _, err := svc.RateTrade(carolID, trade.ID, 5); !errors.Is(err, shop.ErrNotParticipant) {
+		t.Errorf("RateTrade by an outsider: err = %v", err)
+	}
+	if _, err := svc.RateTrade(bobID, trade.ID, 5); err != nil {
+		t.Fatalf("RateTrade: %v", err)
+	}
+	if _, err := svc.RateTrade(bobID, trade.ID, 1); !errors.Is(err, shop.ErrRated) {
+		t.Errorf("RateTrade twice: err = %v", err)
+	}
+	if _, err := svc.RateTrade(aliceID, trade.ID, 3); err != nil {
+		t.Fatalf("RateTrade by the seller: %v", err)
+	}
+
+	// The rating of each party decides whether they reach the rated tier
+	if average, count, err := svc.Rating(aliceID); err != nil || average != 5 || count != 1 {
+		t.Errorf("Rating of the seller = %v, %d, %v", average, count, err)
+	}
+	limits, err := svc.TradeLimits(aliceID)
+	if err != nil || limits.Tier.Name != "rated" || limits.Rating != 5 || limits.Ratings != 1 {
+		t.Errorf("TradeLimits of the seller = %+v, %v", limits, err)
+	}
+	limits, err = svc.TradeLimits(bobID)
+	if err != nil || limits.Tier.Name != "new" || limits.Rating != 3 {
+		t.Fatalf("TradeLimits of the buyer = %+v, %v", limits, err)
+	}
+	l := i18n.Get(i18n.Default)
+	if msg := shop.LimitsMessage(l, limits); !strings.Contains(msg.Text, "3.0") || !strings.Contains(msg.Text, "4.0") {
+		t.Errorf("limits message = %q", msg.Text)
+	}
+}
+
+func TestDisputes(t *testing.T) {
+	svc, pay := newService(t)
+	matrix := &recorder{name: shop.FrontendMatrix, sent: map[string][]shop.Message{}}
+	svc.AddFrontend(matrix)
+	svc.SetAdmins([]int64{42})
+	aliceID, _ := svc.Register(matrixAlice)
+	bobID, _ := svc.Register(matrixBob)
+	carolID, _ := svc.Register(models.Identity{Frontend: shop.FrontendTelegram, ExternalID: "1003", ChatID: "1003", Username: "carol"})
+
+	offer, _ := svc.CreateOffer(aliceID, 0.01, 500, models.PaymentLightning)
+	trade, _ := svc.TakeOffer(bobID, offer.ID)
+	if _, err := svc.OpenDispute(carolID, trade.ID); !errors.Is(err, shop.ErrNotParticipant) {
+		t.Errorf("OpenDispute by another user: err = %v", err)
+	}
+	disputed, err := svc.OpenDispute(bobID, trade.ID)
+	if err != nil || disputed.DisputedBy != bobID {
+		t.Fatalf("OpenDispute = %+v, %v", disputed, err)
+	}
+	if msgs := matrix.sent[matrixAlice.ChatID]; !strings.Contains(msgs[len(msgs)-1].Text, "The buyer opened a dispute over Trade #1") {
+		t.Errorf("seller messages = %+v", msgs)
+	}
+	if _, err := svc.OpenDispute(aliceID, trade.ID); !errors.Is(err, shop.ErrDisputed) {
+		t.Errorf("disputing twice: err = %v", err)
+	}
+
+	// The seller can neither cancel nor confirm the disputed offer
+	if _, err := svc.CancelOffer(aliceID, offer.ID); !errors.Is(err, shop.ErrDisputed) {
+		t.Errorf("CancelOffer of a disputed offer: err = %v", err)
+	}
+	pay.MarkSettled(offer.InvoiceID)
+	svc.ListOffers(aliceID)
+	if _, err := svc.ConfirmPayment(aliceID, offer.ID); !errors.Is(err, shop.ErrDisputed) {
+		t.Errorf("ConfirmPayment of a disputed offer: err = %v", err)
+	}
+
+	// Settling the dispute for the seller refunds them
+	if resolved, err := svc.ResolveDispute(42, trade.ID, shop.DisputeSeller); err != nil || resolved.Status != models.TradeRefunded {
+		t.Fatalf("ResolveDispute = %+v, %v", resolved, err)
+	}
+	if refunds, _ := svc.Refunds(aliceID); len(refunds) != 1 || refunds[0].TradeID != trade.ID {
+		t.Errorf("refunds = %+v", refunds)
+	}
+	if _, err := svc.OpenDispute(bobID, trade.ID); !errors.Is(err, shop.ErrTradeClosed) {
+		t.Errorf("OpenDispute of a closed trade: err = %v", err)
+	}
+}
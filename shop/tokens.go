@@ -0,0 +1,56 @@
+package shop
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+)
+
+// apiTokenPrefix makes API tokens recognizable, e.g. in leaked logs
+const apiTokenPrefix = "p2ps_"
+
+// ErrInvalidToken is returned for unknown or revoked API tokens
+var ErrInvalidToken = errors.New("invalid API token")
+
+// CreateAPIToken issues a new API token for a user, revoking the previous
+// one. Only a hash of the token is stored, so it can be shown only once.
+func (s *Service) CreateAPIToken(userID int64) (string, error) {
+	exists, err := s.database.UserExists(userID)
+	if err != nil || !exists {
+		return "", ErrNotRegistered
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := apiTokenPrefix + hex.EncodeToString(buf)
+
+	if err := s.database.ReplaceAPIToken(userID, hashToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeAPIToken revokes the API token of a user
+func (s *Service) RevokeAPIToken(userID int64) error {
+	return s.database.RevokeAPITokens(userID)
+}
+
+// Authenticate returns the user owning an API token
+func (s *Service) Authenticate(token string) (int64, error) {
+	userID, err := s.database.GetAPITokenUser(hashToken(token))
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, ErrInvalidToken
+	}
+	return userID, err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,128 @@
+package shop
+
+import (
+	"errors"
+	"log"
+
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/db"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/i18n"
+	"github.com/slashbinslashnoname/p2p-telegram-bitcoin-shop/models"
+)
+
+// Errors returned by trade operations
+var (
+	ErrOwnOffer       = errors.New("users cannot take their own offer")
+	ErrNotAvailable   = errors.New("offer is no longer available")
+	ErrTradeNotFound  = errors.New("trade not found")
+	ErrNotParticipant = errors.New("user is not part of the trade")
+)
+
+// TakeOffer opens a trade in which buyerID buys a pending offer within the
+// limits of their tier. The platform fee of the trade is computed and stored
+// with it.
+func (s *Service) TakeOffer(buyerID int64, offerID int) (*models.Trade, error) {
+	exists, err := s.database.UserExists(buyerID)
+	if err != nil || !exists {
+		return nil, ErrNotRegistered
+	}
+
+	// Serialize takes so that an offer cannot be taken twice
+	s.tradeMu.Lock()
+	defer s.tradeMu.Unlock()
+
+	offer, err := s.Offer(offerID)
+	if err != nil {
+		return nil, err
+	}
+	if offer.UserID == buyerID {
+		return nil, ErrOwnOffer
+	}
+	if offer.Status != models.StatusPending {
+		return nil, ErrNotAvailable
+	}
+	if banned, err := s.database.IsBanned(offer.UserID); err != nil {
+		return nil, err
+	} else if banned {
+		return nil, ErrNotAvailable
+	}
+	if !s.listed(offer.UserID) {
+		return nil, ErrNotAvailable
+	}
+	if err := s.checkTradeLimits(buyerID, btcToSats(offer.AmountBTC)); err != nil {
+		return nil, err
+	}
+	if _, err := s.database.GetOpenTrade(offerID); err == nil {
+		return nil, ErrNotAvailable
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+
+	fee := s.tradeFee(offer)
+	tradeID, err := s.database.CreateTrade(offerID, offer.UserID, buyerID, fee.MakerSats, fee.TakerSats)
+	if err != nil {
+		return nil, err
+	}
+	trade, err := s.database.GetTrade(tradeID)
+	if err != nil {
+		return nil, err
+	}
+
+	buyer, err := s.database.GetUser(buyerID)
+	if err != nil {
+		return nil, err
+	}
+	s.Notify(offer.UserID, func(l *i18n.Locale) Message {
+		return OfferTakenMessage(l, trade, offer, s.nickname(buyer))
+	})
+	offer.Taken = true
+	s.offerChanged(offer)
+	return trade, nil
+}
+
+// Trades returns all trades the user takes part in
+func (s *Service) Trades(userID int64) ([]models.Trade, error) {
+	return s.database.GetUserTrades(userID)
+}
+
+// Trade returns a trade the user takes part in
+func (s *Service) Trade(userID int64, tradeID int) (*models.Trade, error) {
+	trade, err := s.database.GetTrade(tradeID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, ErrTradeNotFound
+		}
+		return nil, err
+	}
+	if trade.SellerID != userID && trade.BuyerID != userID {
+		return nil, ErrNotParticipant
+	}
+	return trade, nil
+}
+
+// closeOpenTrade moves the open trade of an offer, if any, to status,
+// notifies the buyer and returns the trade. Completed trades are paid out.
+func (s *Service) closeOpenTrade(offer *models.Offer, status models.TradeStatus) *models.Trade {
+	trade, err := s.database.GetOpenTrade(offer.ID)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Printf("Failed to fetch open trade of offer %d: %v", offer.ID, err)
+		}
+		return nil
+	}
+	if err := s.database.UpdateTradeStatus(trade.ID, status); err != nil {
+		log.Printf("Failed to update trade %d: %v", trade.ID, err)
+		return nil
+	}
+	trade.Status = status
+	offer.Taken = false
+	if status == models.TradeCompleted {
+		s.settleTrade(trade, offer)
+		s.useLightningAddress(trade)
+	}
+	s.Notify(trade.BuyerID, func(l *i18n.Locale) Message { return TradeClosedMessage(l, trade, offer) })
+	if status == models.TradeCompleted {
+		s.payOutCompleted(trade.ID)
+		s.creditReferrers(trade)
+	}
+	return trade
+}